@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+type configShowOptions struct {
+	ConfigFile string
+	Effective  bool
+}
+
+type configMigrateOptions struct {
+	ConfigFile string
+	DryRun     bool
+}
+
+func newConfigCmd() (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:          "config",
+		Short:        "Inspect and maintain the portier-cli config file",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	showCmd, err := newConfigShowCmd()
+	if err != nil {
+		return nil, err
+	}
+	cmd.AddCommand(showCmd)
+
+	migrateCmd, err := newConfigMigrateCmd()
+	if err != nil {
+		return nil, err
+	}
+	cmd.AddCommand(migrateCmd)
+
+	return cmd, nil
+}
+
+func newConfigShowCmd() (*cobra.Command, error) {
+	home, err := utils.Home()
+	if err != nil {
+		return nil, err
+	}
+	o := &configShowOptions{
+		ConfigFile: filepath.Join(home, "config.yaml"),
+	}
+
+	cmd := &cobra.Command{
+		Use:          "show",
+		Short:        "Print the config. With --effective, print the merged result of flags, env, file and defaults",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.ConfigFile, "config", "c", o.ConfigFile, "config file path")
+	cmd.Flags().BoolVar(&o.Effective, "effective", false, "apply env and flag overrides and print the source of each value")
+
+	return cmd, nil
+}
+
+func (o *configShowOptions) run(cmd *cobra.Command, _ []string) error {
+	if !o.Effective {
+		data, err := os.ReadFile(o.ConfigFile)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(cmd.OutOrStdout(), string(data))
+		return nil
+	}
+
+	effective, err := config.LoadEffectiveConfig(o.ConfigFile, config.FlagValues(cmd.Flags()))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, field := range config.OverrideFields() {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", field.Key, field.Value(effective.Config), effective.Sources[field.Key])
+	}
+	servicesSource := effective.Sources[config.ServicesKey]
+	if len(effective.Config.Services) == 0 {
+		fmt.Fprintf(w, "%s\t[]\t%s\n", config.ServicesKey, servicesSource)
+	}
+	for i, service := range effective.Config.Services {
+		for _, field := range config.ServiceFieldValues(service) {
+			fmt.Fprintf(w, "%s[%d].%s\t%s\t%s\n", config.ServicesKey, i, field.Key, field.Value, servicesSource)
+		}
+	}
+
+	return w.Flush()
+}
+
+func newConfigMigrateCmd() (*cobra.Command, error) {
+	home, err := utils.Home()
+	if err != nil {
+		return nil, err
+	}
+	o := &configMigrateOptions{
+		ConfigFile: filepath.Join(home, "config.yaml"),
+	}
+
+	cmd := &cobra.Command{
+		Use:          "migrate",
+		Short:        "Upgrade the config file to the current schema version, keeping a backup",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.ConfigFile, "config", "c", o.ConfigFile, "config file path")
+	cmd.Flags().BoolVar(&o.DryRun, "dry-run", false, "only print the changes, do not rewrite the config")
+
+	return cmd, nil
+}
+
+func (o *configMigrateOptions) run(cmd *cobra.Command, _ []string) error {
+	result, err := config.MigrateConfigFile(o.ConfigFile, filepath.Dir(o.ConfigFile), o.DryRun)
+	if err != nil {
+		return err
+	}
+
+	if !result.Changed() {
+		fmt.Fprintf(cmd.OutOrStdout(), "Config %s is up to date (version %d)\n", o.ConfigFile, result.FromVersion)
+		return nil
+	}
+
+	for _, applied := range result.Applied {
+		fmt.Fprintf(cmd.OutOrStdout(), "- %s\n", applied)
+	}
+
+	if o.DryRun {
+		diff, err := result.Diff(o.ConfigFile)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(cmd.OutOrStdout(), diff)
+		fmt.Fprintf(cmd.OutOrStdout(), "Dry run: config would be migrated from version %d to %d\n", result.FromVersion, result.ToVersion)
+		return nil
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "Config migrated from version %d to %d, backup written to %s\n", result.FromVersion, result.ToVersion, result.BackupFile)
+	return nil
+}
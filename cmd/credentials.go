@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	api "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+type credentialsMigrateOptions struct {
+	ConfigFile string
+	Store      string
+}
+
+func newCredentialsCmd() (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:          "credentials",
+		Short:        "Manage stored API keys and tokens",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	migrateCmd, err := newCredentialsMigrateCmd()
+	if err != nil {
+		return nil, err
+	}
+	cmd.AddCommand(migrateCmd)
+
+	return cmd, nil
+}
+
+func newCredentialsMigrateCmd() (*cobra.Command, error) {
+	home, err := utils.Home()
+	if err != nil {
+		return nil, err
+	}
+	o := &credentialsMigrateOptions{
+		ConfigFile: filepath.Join(home, "config.yaml"),
+		Store:      secrets.DefaultBackend(),
+	}
+
+	cmd := &cobra.Command{
+		Use:          "migrate",
+		Short:        "Move plaintext credentials into the secret store and restrict file permissions to 0600",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.ConfigFile, "config", "c", o.ConfigFile, "config file path, used to locate the TLS private key")
+	cmd.Flags().StringVar(&o.Store, "store", o.Store, fmt.Sprintf("target secret store, %s or %s (env %s)", secrets.BackendFile, secrets.BackendKeyring, secrets.BackendEnv))
+
+	return cmd, nil
+}
+
+func (o *credentialsMigrateOptions) run(cmd *cobra.Command, _ []string) error {
+	home, err := utils.Home()
+	if err != nil {
+		return err
+	}
+
+	report, err := api.MigrateCredentials(home, o.Store)
+	for _, line := range report {
+		fmt.Fprintln(cmd.OutOrStdout(), line)
+	}
+	if err != nil {
+		return err
+	}
+
+	effectiveConfig, err := config.LoadEffectiveConfig(o.ConfigFile, config.FlagValues(cmd.Flags()))
+	if err != nil {
+		return err
+	}
+	keyFile := effectiveConfig.Config.PTLSConfig.KeyFile
+	if _, err := os.Stat(keyFile); err == nil {
+		if err := os.Chmod(keyFile, 0o600); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%s: permissions set to 0600\n", keyFile)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/api/portiertest"
+	"github.com/spf13/cobra"
+)
+
+type devAPIServerOptions struct {
+	Listen       string
+	FixturesFile string
+	User         string
+	ManualLogin  bool
+}
+
+func newDevCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "dev",
+		Short:        "Tools for developing and testing portier-cli",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	cmd.AddCommand(newDevAPIServerCmd())
+
+	return cmd
+}
+
+func newDevAPIServerCmd() *cobra.Command {
+	o := &devAPIServerOptions{
+		Listen: "127.0.0.1:8080",
+		User:   portiertest.DefaultUser,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "api-server",
+		Short: "Run an in-memory emulator of the portier API, login and relay",
+		Long: `Runs an in-memory emulator of the portier API, the OAuth device flow and the relay.
+
+Point portier-cli at it with the --api-url flag, PORTIER_API_URL or the portierUrl of a
+profile, e.g.
+
+  portier-cli profile create local --portier-url ws://127.0.0.1:8080/spider --use
+
+All state is lost when the server stops. Devices, API keys and fingerprints can be
+preloaded from a YAML fixtures file:
+
+  users:
+    - email: dev@portier.test
+      accessToken: dev-token
+      devices:
+        - name: workplace
+          guid: 00000000-0000-0000-0000-000000000001
+          apiKey: workplace-key
+          sharedWith: [friend@portier.test]`,
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.Listen, "listen", "l", o.Listen, "address to listen on")
+	cmd.Flags().StringVarP(&o.FixturesFile, "fixtures", "f", o.FixturesFile, "YAML file with users and devices to preload")
+	cmd.Flags().StringVarP(&o.User, "user", "u", o.User, "email of the user logged in by 'portier-cli login'")
+	cmd.Flags().BoolVar(&o.ManualLogin, "manual-login", o.ManualLogin, "require opening the verification URL to approve logins")
+
+	return cmd
+}
+
+func (o *devAPIServerOptions) run(cmd *cobra.Command, _ []string) error {
+	options := portiertest.NewDefaultOptions()
+	options.LoginUser = o.User
+	options.AutoApprove = !o.ManualLogin
+	if o.FixturesFile != "" {
+		fixtures, err := portiertest.LoadFixtures(o.FixturesFile)
+		if err != nil {
+			return err
+		}
+		options.Fixtures = fixtures
+	}
+
+	server, err := portiertest.NewServer(options)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", o.Listen)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{
+		Handler:           server,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	address := listener.Addr().String()
+	fmt.Fprintf(cmd.OutOrStdout(), "API:    http://%s/api\n", address)
+	fmt.Fprintf(cmd.OutOrStdout(), "Relay:  ws://%s/spider\n", address)
+	fmt.Fprintf(cmd.OutOrStdout(), "Issuer: http://%s\n", address)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- httpServer.Serve(listener)
+	}()
+
+	// wait until process is killed
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-sigs:
+	case err := <-errs:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+
+	log.Println("Stopping API server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return httpServer.Shutdown(ctx)
+}
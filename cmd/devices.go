@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	portier "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+type devicesOptions struct {
+	HomeFolderPath string
+	ApiURL         string
+	Output         string
+	Force          bool
+}
+
+// deviceView is a device as printed by the devices commands.
+type deviceView struct {
+	Name                string    `json:"name" yaml:"name"`
+	ID                  string    `json:"id" yaml:"id"`
+	Online              bool      `json:"online" yaml:"online"`
+	LastSeen            time.Time `json:"lastSeen" yaml:"lastSeen"`
+	FingerprintUploaded bool      `json:"fingerprintUploaded" yaml:"fingerprintUploaded"`
+	Fingerprint         string    `json:"fingerprint,omitempty" yaml:"fingerprint,omitempty"`
+	Owner               string    `json:"owner" yaml:"owner"`
+	SharedWith          []string  `json:"sharedWith" yaml:"sharedWith"`
+	OutboundBytes       int       `json:"outboundBytes" yaml:"outboundBytes"`
+}
+
+func newDevicesCmd() (*cobra.Command, error) {
+	home, err := utils.Home()
+	if err != nil {
+		return nil, err
+	}
+	o := &devicesOptions{
+		HomeFolderPath: home,
+		Output:         "table",
+	}
+
+	cmd := &cobra.Command{
+		Use:          "devices",
+		Short:        "List and manage the devices of your portier account",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	cmd.PersistentFlags().StringVarP(&o.HomeFolderPath, "home", "H", o.HomeFolderPath, "home folder path")
+	config.AddAPIURLFlag(cmd.PersistentFlags(), &o.ApiURL)
+	cmd.PersistentFlags().StringVarP(&o.Output, "output", "o", o.Output, fmt.Sprintf("output format, one of %v", outputFormats))
+
+	cmd.AddCommand(&cobra.Command{
+		Use:          "list",
+		Short:        "List all devices, including devices shared with you",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE:         o.runList,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:          "show <name|id>",
+		Short:        "Show the details of a device",
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		RunE:         o.runShow,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:          "rename <name|id> <new name>",
+		Short:        "Rename a device",
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(2),
+		RunE:         o.runRename,
+	})
+	deleteCmd := &cobra.Command{
+		Use:          "delete <name|id>",
+		Short:        "Delete a device and revoke its API keys",
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		RunE:         o.runDelete,
+	}
+	deleteCmd.Flags().BoolVarP(&o.Force, "force", "f", false, "do not ask for confirmation")
+	cmd.AddCommand(deleteCmd)
+
+	return cmd, nil
+}
+
+func (o *devicesOptions) client(cmd *cobra.Command) (*portier.Client, error) {
+	apiURL, err := config.ResolveAPIURL(o.ApiURL, filepath.Join(o.HomeFolderPath, "config.yaml"), config.FlagValues(cmd.Flags()))
+	if err != nil {
+		return nil, err
+	}
+	return portier.NewDefaultClient(apiURL, portier.NewBearerAuth(o.HomeFolderPath)), nil
+}
+
+// resolveDevice returns the GUID of the device with the given name or GUID.
+func (o *devicesOptions) resolveDevice(ctx context.Context, client *portier.Client, nameOrID string) (string, error) {
+	if _, err := uuid.Parse(nameOrID); err == nil {
+		return nameOrID, nil
+	}
+	return client.GetDeviceByName(ctx, nameOrID)
+}
+
+func (o *devicesOptions) runList(cmd *cobra.Command, _ []string) error {
+	ctx := cmd.Context()
+	client, err := o.client(cmd)
+	if err != nil {
+		return err
+	}
+
+	devices, err := client.ListDevices(ctx)
+	if err != nil {
+		return err
+	}
+	fingerprints, err := client.GetFingerprints(ctx, []string{})
+	if err != nil {
+		return err
+	}
+
+	views := make([]deviceView, 0, len(devices))
+	for _, device := range devices {
+		views = append(views, newDeviceView(device, fingerprints))
+	}
+
+	return printOutput(cmd.OutOrStdout(), o.Output, views, func(w io.Writer) {
+		fmt.Fprintln(w, "NAME\tID\tONLINE\tFINGERPRINT\tSHARED WITH")
+		for _, view := range views {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", view.Name, view.ID, yesNo(view.Online), yesNo(view.FingerprintUploaded), strings.Join(view.SharedWith, ", "))
+		}
+	})
+}
+
+func (o *devicesOptions) runShow(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	client, err := o.client(cmd)
+	if err != nil {
+		return err
+	}
+
+	guid, err := o.resolveDevice(ctx, client, args[0])
+	if err != nil {
+		return err
+	}
+	device, err := client.GetDevice(ctx, guid)
+	if err != nil {
+		return err
+	}
+	fingerprints, err := client.GetFingerprints(ctx, []string{guid})
+	if err != nil {
+		return err
+	}
+
+	view := newDeviceView(device, fingerprints)
+	return printOutput(cmd.OutOrStdout(), o.Output, view, func(w io.Writer) {
+		lastSeen := "never"
+		if !view.LastSeen.IsZero() {
+			lastSeen = view.LastSeen.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "Name:\t%s\n", view.Name)
+		fmt.Fprintf(w, "ID:\t%s\n", view.ID)
+		fmt.Fprintf(w, "Owner:\t%s\n", view.Owner)
+		fmt.Fprintf(w, "Online:\t%s\n", yesNo(view.Online))
+		fmt.Fprintf(w, "Last seen:\t%s\n", lastSeen)
+		fmt.Fprintf(w, "Fingerprint:\t%s\n", view.Fingerprint)
+		fmt.Fprintf(w, "Shared with:\t%s\n", strings.Join(view.SharedWith, ", "))
+		fmt.Fprintf(w, "Outbound bytes:\t%d\n", view.OutboundBytes)
+	})
+}
+
+func (o *devicesOptions) runRename(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	client, err := o.client(cmd)
+	if err != nil {
+		return err
+	}
+
+	guid, err := o.resolveDevice(ctx, client, args[0])
+	if err != nil {
+		return err
+	}
+	if _, err := client.RenameDevice(ctx, guid, args[1]); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Device %s renamed to %s\n", guid, args[1])
+	return nil
+}
+
+func (o *devicesOptions) runDelete(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	client, err := o.client(cmd)
+	if err != nil {
+		return err
+	}
+
+	guid, err := o.resolveDevice(ctx, client, args[0])
+	if err != nil {
+		return err
+	}
+
+	if !o.Force {
+		fmt.Fprintf(cmd.OutOrStdout(), "Delete device %s (%s)? Its API keys stop working immediately [y/N] ", args[0], guid)
+		answer, _ := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+		answer = strings.TrimSpace(strings.ToLower(answer))
+		if answer != "y" && answer != "yes" {
+			return fmt.Errorf("aborted")
+		}
+	}
+
+	if err := client.DeleteDevice(ctx, guid); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Device %s deleted\n", guid)
+	return nil
+}
+
+func newDeviceView(device portier.Device, fingerprints map[string]string) deviceView {
+	sharedWith := device.SharedWith
+	if sharedWith == nil {
+		sharedWith = []string{}
+	}
+	return deviceView{
+		Name:                device.Name,
+		ID:                  device.GUID,
+		Online:              device.IsOnline(time.Now()),
+		LastSeen:            device.LastSeen,
+		FingerprintUploaded: fingerprints[device.GUID] != "",
+		Fingerprint:         fingerprints[device.GUID],
+		Owner:               device.User,
+		SharedWith:          sharedWith,
+		OutboundBytes:       device.OutboundBytes,
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net/url"
 	"os"
@@ -15,13 +16,15 @@ import (
 	portierapi "github.com/mh-dx/portier-cli/internal/portier/api"
 	"github.com/mh-dx/portier-cli/internal/portier/application"
 	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/compression"
 	"github.com/mh-dx/portier-cli/internal/utils"
 	"github.com/spf13/cobra"
-	"gopkg.in/yaml.v2"
 )
 
 type forwardOptions struct {
 	NoTLS        bool
+	Compression  string
 	NoPersist    bool
 	ConfigFile   string
 	ApiTokenFile string
@@ -36,7 +39,6 @@ func defaultForwardOptions() (*forwardOptions, error) {
 	return &forwardOptions{
 		ConfigFile:   filepath.Join(home, "config.yaml"),
 		ApiTokenFile: filepath.Join(home, "credentials_device.yaml"),
-		ApiURL:       "https://api.portier.dev/api",
 	}, nil
 }
 
@@ -54,8 +56,9 @@ func newForwardCmd() (*cobra.Command, error) {
 		RunE:  o.run,
 	}
 	cmd.Flags().BoolVar(&o.NoTLS, "no-tls", false, "disable TLS encryption")
+	cmd.Flags().StringVar(&o.Compression, "compression", o.Compression, "compress the forwarded data if the remote device supports it: zstd, snappy or none")
 	cmd.Flags().BoolVar(&o.NoPersist, "no-persist", false, "do not store forwarding in config, means this forwarding won't be initialized after restart")
-	cmd.Flags().StringVar(&o.ApiURL, "apiUrl", o.ApiURL, "base URL of the portier API")
+	config.AddAPIURLFlag(cmd.Flags(), &o.ApiURL)
 	cmd.Flags().StringVar(&o.ConfigFile, "config", o.ConfigFile, "config file")
 	cmd.Flags().StringVar(&o.ApiTokenFile, "apiToken", o.ApiTokenFile, "api token file")
 
@@ -95,9 +98,21 @@ func (o *forwardOptions) run(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	if _, err := compression.ParseAlgorithm(o.Compression); err != nil {
+		return err
+	}
+
+	o.ApiURL, err = config.ResolveAPIURL(o.ApiURL, o.ConfigFile, config.FlagValues(cmd.Flags()))
+	if err != nil {
+		return err
+	}
 
 	home := filepath.Dir(o.ApiTokenFile)
-	remoteID, err := portierapi.GetDeviceByName(home, o.ApiURL, remoteName)
+	client, err := portierapi.NewClientForHome(home, o.ApiURL)
+	if err != nil {
+		return err
+	}
+	remoteID, err := client.GetDeviceByName(context.Background(), remoteName)
 	if err != nil {
 		return err
 	}
@@ -105,10 +120,11 @@ func (o *forwardOptions) run(cmd *cobra.Command, args []string) error {
 	// add log statement to show the remote ID
 	fmt.Fprintf(cmd.OutOrStdout(), "Device %s has ID %s\n", remoteName, remoteID)
 
-	cfg, err := config.LoadConfig(o.ConfigFile)
+	effectiveConfig, err := config.LoadEffectiveConfig(o.ConfigFile, config.FlagValues(cmd.Flags()))
 	if err != nil {
 		return err
 	}
+	cfg := effectiveConfig.Config
 	creds, err := config.LoadApiTokenWithBaseURL(o.ApiTokenFile, o.ApiURL)
 	if err != nil {
 		return err
@@ -126,11 +142,13 @@ func (o *forwardOptions) run(cmd *cobra.Command, args []string) error {
 	tlsEnabled := !o.NoTLS
 	if tlsEnabled {
 		khPath := cfg.PTLSConfig.KnownHostsFile
-		kh := make(map[string]string)
-		if data, err := os.ReadFile(khPath); err == nil {
-			yaml.Unmarshal(data, &kh)
+		kh, err := ptls.LoadKnownHosts(khPath)
+		if err != nil {
+			return err
 		}
-		if _, ok := kh[remoteID]; !ok {
+		if !kh.Has(remoteID) && cfg.PTLSConfig.TOFU {
+			fmt.Fprintf(cmd.OutOrStdout(), "Device %s is not trusted yet, its certificate will be trusted on first use\n", remoteName)
+		} else if !kh.Has(remoteID) {
 			fmt.Fprintf(cmd.OutOrStdout(), "Device %s is not trusted for TLS encrypted communication. Please confirm downloading its fingerprint [Y/n] ", remoteName)
 			reader := bufio.NewReader(cmd.InOrStdin())
 			answer, _ := reader.ReadString('\n')
@@ -144,7 +162,7 @@ func (o *forwardOptions) run(cmd *cobra.Command, args []string) error {
 				args := []string{
 					"--home", filepath.Dir(o.ApiTokenFile),
 					"--knownHosts", khPath,
-					"--apiUrl", o.ApiURL,
+					"--api-url", o.ApiURL,
 					"--credentials", filepath.Base(o.ApiTokenFile),
 					"--ids", remoteID,
 				}
@@ -174,15 +192,14 @@ func (o *forwardOptions) run(cmd *cobra.Command, args []string) error {
 			URLRemote:    utils.YAMLURL{URL: remoteURL},
 			PeerDeviceID: peerID,
 			TLSEnabled:   tlsEnabled,
+			Compression:  o.Compression,
 		},
 	}
 
 	cfg.Services = append(cfg.Services, svc)
 	if !o.NoPersist {
-		f, err := os.Create(o.ConfigFile)
-		if err == nil {
-			yaml.NewEncoder(f).Encode(cfg)
-			f.Close()
+		if err := persistService(o.ConfigFile, svc); err != nil {
+			return err
 		}
 	}
 
@@ -202,3 +219,14 @@ func (o *forwardOptions) run(cmd *cobra.Command, args []string) error {
 	app.StopServices()
 	return nil
 }
+
+// persistService appends svc to the services of the config file. The file is loaded without the
+// env and flag overrides, and saved with SaveConfig, which backs up a config of an older version.
+func persistService(configFile string, svc config.Service) error {
+	fileConfig, err := config.LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	fileConfig.Services = append(fileConfig.Services, svc)
+	return config.SaveConfig(configFile, fileConfig)
+}
@@ -2,7 +2,14 @@ package cmd
 
 import (
 	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/stretchr/testify/require"
 )
 
 func TestForwardCommandHelp(t *testing.T) {
@@ -28,3 +35,46 @@ func TestParseSpecDefaultsLocalhost(t *testing.T) {
 		t.Fatalf("unexpected parse result: %s %s %s %s", remote, rport, host, lport)
 	}
 }
+
+func TestPersistServiceBacksUpOutdatedConfig(t *testing.T) {
+	// GIVEN a hand-edited config of version 0
+	home := t.TempDir()
+	configFile := filepath.Join(home, "config.yaml")
+	original := []byte("# relay of the company deployment\ntlsEnabled: true\nservices: []\n")
+	require.NoError(t, os.WriteFile(configFile, original, 0o644))
+
+	// WHEN
+	err := persistService(configFile, forwardTestService(t))
+
+	// THEN the original file is backed up and the service is saved
+	require.NoError(t, err)
+	backups, _ := filepath.Glob(configFile + ".v0-*.bak")
+	require.Len(t, backups, 1)
+	backup, _ := os.ReadFile(backups[0])
+	require.Equal(t, original, backup)
+	saved, err := config.LoadConfig(configFile)
+	require.NoError(t, err)
+	require.Equal(t, config.CurrentConfigVersion, saved.Version)
+	require.Len(t, saved.Services, 1)
+	require.Equal(t, "forward-dev-80", saved.Services[0].Name)
+}
+
+func TestPersistServiceReturnsWriteError(t *testing.T) {
+	err := persistService(filepath.Join(t.TempDir(), "missing", "config.yaml"), forwardTestService(t))
+
+	require.Error(t, err)
+}
+
+func forwardTestService(t *testing.T) config.Service {
+	localURL, err := url.Parse("tcp://localhost:8080")
+	require.NoError(t, err)
+	remoteURL, err := url.Parse("tcp://localhost:80")
+	require.NoError(t, err)
+	return config.Service{
+		Name: "forward-dev-80",
+		Options: config.ServiceOptions{
+			URLLocal:  utils.YAMLURL{URL: localURL},
+			URLRemote: utils.YAMLURL{URL: remoteURL},
+		},
+	}
+}
@@ -1,16 +1,24 @@
 package cmd
 
 import (
+	"path/filepath"
+
 	portier "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/utils"
 	"github.com/spf13/cobra"
 )
 
 type loginOptions struct {
-	// TODO add options
+	ConfigFile string
 }
 
 func defaultLoginOptions() *loginOptions {
-	return &loginOptions{}
+	o := &loginOptions{}
+	if home, err := utils.Home(); err == nil {
+		o.ConfigFile = filepath.Join(home, "config.yaml")
+	}
+	return o
 }
 
 func newLoginCmd() *cobra.Command {
@@ -24,9 +32,15 @@ func newLoginCmd() *cobra.Command {
 		RunE:         o.run,
 	}
 
+	cmd.Flags().StringVarP(&o.ConfigFile, "config", "c", o.ConfigFile, "config file, its endpoints select the identity provider")
+
 	return cmd
 }
 
 func (o *loginOptions) run(cmd *cobra.Command, _ []string) error {
-	return portier.Login()
+	endpoints, err := config.LoadEndpoints(o.ConfigFile, config.FlagValues(cmd.Flags()))
+	if err != nil {
+		return err
+	}
+	return portier.Login(endpoints)
 }
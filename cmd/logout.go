@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	portier "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+type logoutOptions struct {
+	RemoveDevice bool
+}
+
+func defaultLogoutOptions() *logoutOptions {
+	return &logoutOptions{}
+}
+
+func newLogoutCmd() *cobra.Command {
+	o := defaultLogoutOptions()
+
+	cmd := &cobra.Command{
+		Use:          "logout",
+		Short:        "Revoke the login tokens and delete them from this machine",
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(0),
+		RunE:         o.run,
+	}
+
+	cmd.Flags().BoolVar(&o.RemoveDevice, "device", false, "also delete the device credentials (API keys) of this machine")
+
+	return cmd
+}
+
+func (o *logoutOptions) run(cmd *cobra.Command, _ []string) error {
+	home, err := utils.Home()
+	if err != nil {
+		return err
+	}
+	return portier.Logout(home, o.RemoveDevice)
+}
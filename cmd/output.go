@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// outputFormats are the values accepted by --output.
+var outputFormats = []string{"table", "json", "yaml"}
+
+// printOutput writes v as JSON or YAML, or calls table with a tabwriter for the table format.
+func printOutput(w io.Writer, format string, v interface{}, table func(w io.Writer)) error {
+	switch format {
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		table(tw)
+		return tw.Flush()
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(v); err != nil {
+			return err
+		}
+		return encoder.Close()
+	default:
+		return fmt.Errorf("unknown output format %s, use one of %v", format, outputFormats)
+	}
+}
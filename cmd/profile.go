@@ -0,0 +1,254 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	portier "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+// profileEndpointKeys are the config keys that can be set when creating a profile.
+var profileEndpointKeys = []string{"portierUrl", "apiUrl", "auth.issuer", "auth.clientId", "auth.audience"}
+
+type profileCreateOptions struct {
+	Use bool
+}
+
+type profileDeleteOptions struct {
+	Force bool
+}
+
+func newProfileCmd() (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:          "profile",
+		Short:        "Manage profiles, each with its own config, credentials, TLS files and endpoints",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	cmd.AddCommand(newProfileListCmd())
+	cmd.AddCommand(newProfileUseCmd())
+	cmd.AddCommand(newProfileCreateCmd())
+	cmd.AddCommand(newProfileDeleteCmd())
+
+	return cmd, nil
+}
+
+func newProfileListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:          "list",
+		Short:        "List all profiles, the active one is marked with *",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			profiles, err := utils.Profiles()
+			if err != nil {
+				return err
+			}
+			active, err := utils.ActiveProfile()
+			if err != nil {
+				return err
+			}
+			baseHome, err := utils.BaseHome()
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "\tPROFILE\tAPI\tHOME")
+			for _, profile := range profiles {
+				marker := ""
+				if profile == active {
+					marker = "*"
+				}
+				home := utils.ProfileHome(baseHome, profile)
+				// the API of the profile's file, PORTIER_* variables would show the same API for all profiles
+				apiURL := ""
+				if profileConfig, err := config.LoadConfig(filepath.Join(home, "config.yaml")); err == nil {
+					apiURL = profileConfig.Endpoints().APIURL
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", marker, profile, apiURL, home)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newProfileUseCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:          "use <name>",
+		Short:        "Select the profile used when neither --profile nor PORTIER_PROFILE are set",
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			profile := args[0]
+			if err := requireProfile(profile); err != nil {
+				return err
+			}
+			if err := utils.UseProfile(profile); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Using profile %s\n", profile)
+			return nil
+		},
+	}
+}
+
+func newProfileCreateCmd() *cobra.Command {
+	o := &profileCreateOptions{}
+
+	cmd := &cobra.Command{
+		Use:          "create <name>",
+		Short:        "Create a profile with a default config, optionally pointing to another deployment",
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+	}
+
+	// the endpoint flags are the persistent override flags of the root command
+	fields := map[string]config.OverrideField{}
+	for _, field := range config.OverrideFields() {
+		for _, key := range profileEndpointKeys {
+			if field.Key == key {
+				fields[key] = field
+			}
+		}
+	}
+	cmd.Flags().BoolVar(&o.Use, "use", false, "select the new profile, see profile use")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		profile := args[0]
+		if err := utils.ValidateProfileName(profile); err != nil {
+			return err
+		}
+		if profile == utils.DefaultProfile {
+			return fmt.Errorf("the %s profile always exists", utils.DefaultProfile)
+		}
+
+		baseHome, err := utils.BaseHome()
+		if err != nil {
+			return err
+		}
+		home := utils.ProfileHome(baseHome, profile)
+		if _, err := os.Stat(home); err == nil {
+			return fmt.Errorf("profile %s already exists", profile)
+		}
+
+		portierConfig := config.DefaultPortierConfigForHome(home)
+		flagValues := config.FlagValues(cmd.Flags())
+		for _, key := range profileEndpointKeys {
+			field := fields[key]
+			value, ok := flagValues[key]
+			if !ok {
+				continue
+			}
+			if err := field.Set(portierConfig, value); err != nil {
+				return fmt.Errorf("invalid value for --%s: %w", field.Flag, err)
+			}
+		}
+
+		if err := os.MkdirAll(home, 0o700); err != nil {
+			return err
+		}
+		if err := config.SaveConfig(filepath.Join(home, "config.yaml"), portierConfig); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Profile %s created in %s\n", profile, home)
+
+		if o.Use {
+			if err := utils.UseProfile(profile); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Using profile %s\n", profile)
+		} else {
+			fmt.Fprintf(cmd.OutOrStdout(), "Run commands with --profile %s, or select it with: portier-cli profile use %s\n", profile, profile)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+func newProfileDeleteCmd() *cobra.Command {
+	o := &profileDeleteOptions{}
+
+	cmd := &cobra.Command{
+		Use:          "delete <name>",
+		Short:        "Delete a profile together with its config, credentials and TLS files",
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+	}
+	cmd.Flags().BoolVarP(&o.Force, "force", "f", false, "do not ask for confirmation")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		profile := args[0]
+		if profile == utils.DefaultProfile {
+			return fmt.Errorf("the %s profile cannot be deleted", utils.DefaultProfile)
+		}
+		if err := requireProfile(profile); err != nil {
+			return err
+		}
+
+		if !o.Force {
+			fmt.Fprintf(cmd.OutOrStdout(), "Delete profile %s including its credentials and TLS keys? [y/N] ", profile)
+			answer, _ := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+			answer = strings.TrimSpace(strings.ToLower(answer))
+			if answer != "y" && answer != "yes" {
+				return fmt.Errorf("aborted")
+			}
+		}
+
+		baseHome, err := utils.BaseHome()
+		if err != nil {
+			return err
+		}
+		home := utils.ProfileHome(baseHome, profile)
+
+		// secrets in the OS keyring are not removed together with the directory
+		credentialsFiles, err := filepath.Glob(filepath.Join(home, "credentials*.yaml"))
+		if err != nil {
+			return err
+		}
+		for _, file := range credentialsFiles {
+			if err := portier.DeleteCredentials(home, filepath.Base(file)); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(home); err != nil {
+			return err
+		}
+
+		if current, err := utils.CurrentProfile(); err == nil && current == profile {
+			if err := utils.UseProfile(utils.DefaultProfile); err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Profile %s deleted\n", profile)
+		return nil
+	}
+
+	return cmd
+}
+
+// requireProfile returns an error if the profile does not exist.
+func requireProfile(profile string) error {
+	profiles, err := utils.Profiles()
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		if p == profile {
+			return nil
+		}
+	}
+	return fmt.Errorf("profile %s does not exist, create it with: portier-cli profile create %s", profile, profile)
+}
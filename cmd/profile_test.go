@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfileListIgnoresEnvOverrides(t *testing.T) {
+	// GIVEN two profiles with their own API
+	base := t.TempDir()
+	t.Setenv("PORTIER_HOME", base)
+	t.Setenv(utils.ProfileEnv, "")
+	t.Setenv("PORTIER_API_URL", "https://env.example.com/api")
+	work := filepath.Join(base, "profiles", "work")
+	require.NoError(t, os.MkdirAll(work, 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "config.yaml"), []byte("version: 1\napiUrl: https://default.example.com/api\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(work, "config.yaml"), []byte("version: 1\napiUrl: https://work.example.com/api\n"), 0o644))
+	cmd := newRootCmd("")
+	b := bytes.NewBufferString("")
+	cmd.SetOut(b)
+
+	// WHEN
+	cmd.SetArgs([]string{"profile", "list"})
+	err := cmd.Execute()
+
+	// THEN
+	require.NoError(t, err)
+	require.Regexp(t, `\*\s+default\s+https://default.example.com/api`, b.String())
+	require.Regexp(t, `work\s+https://work.example.com/api`, b.String())
+	require.NotContains(t, b.String(), "env.example.com")
+}
@@ -0,0 +1,39 @@
+package ptls_ca_cmd
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+func defaultCADir() string {
+	home, err := utils.Home()
+	if err != nil {
+		log.Fatalf("could not get home directory: %v", err)
+	}
+	return filepath.Join(home, "ca")
+}
+
+func NewCAcmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ca",
+		Short: "Manage a private CA that issues the TLS certificates of devices",
+		Long: `Manage a private CA that issues the TLS certificates of devices.
+
+Devices that have the CA certificate configured as CA file (tlsConfig.caFile) trust every peer
+device with a certificate issued by the CA, instead of trusting fingerprints in known_hosts.
+Each device creates a certificate signing request with 'portier-cli tls csr', the CA signs it
+with 'portier-cli tls ca sign'. Revoked certificates are published in the CRL, which devices
+check during the handshake (tlsConfig.crlFile).`,
+		SilenceUsage: true,
+	}
+
+	cmd.AddCommand(newInitCmd())
+	cmd.AddCommand(newSignCmd())
+	cmd.AddCommand(newRevokeCmd())
+	cmd.AddCommand(newCRLCmd())
+
+	return cmd
+}
@@ -0,0 +1,48 @@
+package ptls_ca_cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/spf13/cobra"
+)
+
+type caCRLOptions struct {
+	Dir         string
+	CRLValidity time.Duration
+}
+
+func newCRLCmd() *cobra.Command {
+	o := &caCRLOptions{
+		Dir:         defaultCADir(),
+		CRLValidity: ptls.DefaultCRLValidity,
+	}
+
+	cmd := &cobra.Command{
+		Use:          "crl",
+		Short:        "Write a new CRL, before the current one is outdated",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.Dir, "dir", "d", o.Dir, "directory of the CA files")
+	cmd.Flags().DurationVar(&o.CRLValidity, "crlValidity", o.CRLValidity, "time until the next CRL update is due")
+
+	return cmd
+}
+
+func (o *caCRLOptions) run(cmd *cobra.Command, args []string) error {
+	ca, err := ptls.LoadCA(o.Dir)
+	if err != nil {
+		return err
+	}
+	if err := ca.WriteCRL(o.CRLValidity); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "CRL written to %s, next update due at %s\n", filepath.Join(o.Dir, ptls.CACRLFile), time.Now().Add(o.CRLValidity).Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,59 @@
+package ptls_ca_cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/spf13/cobra"
+)
+
+const defaultCAValidityDays = 20 * 365
+
+type caInitOptions struct {
+	Dir          string
+	Name         string
+	ValidityDays int
+}
+
+func newInitCmd() *cobra.Command {
+	o := &caInitOptions{
+		Dir:          defaultCADir(),
+		Name:         "portier CA",
+		ValidityDays: defaultCAValidityDays,
+	}
+
+	cmd := &cobra.Command{
+		Use:          "init",
+		Short:        "Create a new CA with an empty CRL",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.Dir, "dir", "d", o.Dir, "directory of the CA files")
+	cmd.Flags().StringVarP(&o.Name, "name", "n", o.Name, "common name of the CA certificate")
+	cmd.Flags().IntVar(&o.ValidityDays, "validityDays", o.ValidityDays, "validity of the CA certificate in days")
+
+	return cmd
+}
+
+func (o *caInitOptions) run(cmd *cobra.Command, args []string) error {
+	if o.ValidityDays <= 0 {
+		return fmt.Errorf("validity must be at least one day")
+	}
+
+	ca, err := ptls.InitCA(o.Dir, o.Name, time.Duration(o.ValidityDays)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "CA %q created, valid until %s\n", ca.Cert.Subject.CommonName, ca.Cert.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(out, "Certificate: \t%s\n", filepath.Join(o.Dir, ptls.CACertFile))
+	fmt.Fprintf(out, "Private key: \t%s\n", filepath.Join(o.Dir, ptls.CAKeyFile))
+	fmt.Fprintf(out, "CRL: \t\t%s\n", filepath.Join(o.Dir, ptls.CACRLFile))
+	fmt.Fprintln(out, "Keep the private key secret, everyone who has it can issue trusted device certificates.")
+	return nil
+}
@@ -0,0 +1,53 @@
+package ptls_ca_cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/spf13/cobra"
+)
+
+type caRevokeOptions struct {
+	Dir         string
+	CRLValidity time.Duration
+}
+
+func newRevokeCmd() *cobra.Command {
+	o := &caRevokeOptions{
+		Dir:         defaultCADir(),
+		CRLValidity: ptls.DefaultCRLValidity,
+	}
+
+	cmd := &cobra.Command{
+		Use:          "revoke <serial|deviceID>",
+		Short:        "Revoke a certificate, or all certificates of a device, and write a new CRL",
+		Long:         "Revoke a certificate by its serial number, or all certificates issued for a device, and write a new CRL. Distribute the CRL to all devices, they reject revoked certificates during the handshake.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.Dir, "dir", "d", o.Dir, "directory of the CA files")
+	cmd.Flags().DurationVar(&o.CRLValidity, "crlValidity", o.CRLValidity, "time until the next CRL update is due")
+
+	return cmd
+}
+
+func (o *caRevokeOptions) run(cmd *cobra.Command, args []string) error {
+	ca, err := ptls.LoadCA(o.Dir)
+	if err != nil {
+		return err
+	}
+	revoked, err := ca.Revoke(args[0], o.CRLValidity)
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return fmt.Errorf("no valid certificate with serial number or device ID %s", args[0])
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "Revoked %d certificates, CRL written to %s\n", revoked, filepath.Join(o.Dir, ptls.CACRLFile))
+	return nil
+}
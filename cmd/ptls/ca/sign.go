@@ -0,0 +1,89 @@
+package ptls_ca_cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/spf13/cobra"
+)
+
+const defaultDeviceValidityDays = 365
+
+type caSignOptions struct {
+	Dir          string
+	CSRPath      string
+	OutPath      string
+	ValidityDays int
+}
+
+func newSignCmd() *cobra.Command {
+	o := &caSignOptions{
+		Dir:          defaultCADir(),
+		ValidityDays: defaultDeviceValidityDays,
+	}
+
+	cmd := &cobra.Command{
+		Use:          "sign <deviceID>",
+		Short:        "Issue a device certificate from a certificate signing request",
+		Long:         "Issue a device certificate from a certificate signing request created with 'portier-cli tls csr' on the device. The request must be for the given device ID.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.Dir, "dir", "d", o.Dir, "directory of the CA files")
+	cmd.Flags().StringVar(&o.CSRPath, "csr", o.CSRPath, "path to the certificate signing request in PEM format")
+	cmd.Flags().StringVarP(&o.OutPath, "out", "o", o.OutPath, "path of the issued certificate, defaults to <deviceID>.pem")
+	cmd.Flags().IntVar(&o.ValidityDays, "validityDays", o.ValidityDays, "validity of the certificate in days")
+	_ = cmd.MarkFlagRequired("csr")
+
+	return cmd
+}
+
+func (o *caSignOptions) run(cmd *cobra.Command, args []string) error {
+	deviceID, err := uuid.Parse(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid device ID %s: %w", args[0], err)
+	}
+	if o.ValidityDays <= 0 {
+		return fmt.Errorf("validity must be at least one day")
+	}
+	if o.OutPath == "" {
+		o.OutPath = deviceID.String() + ".pem"
+	}
+
+	ca, err := ptls.LoadCA(o.Dir)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(o.CSRPath)
+	if err != nil {
+		return err
+	}
+	csr, err := ptls.ParseCertificateRequest(data)
+	if err != nil {
+		return err
+	}
+
+	cert, err := ca.Sign(csr, deviceID.String(), time.Duration(o.ValidityDays)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(o.OutPath, ptls.EncodeCertificate(cert), 0644); err != nil {
+		return err
+	}
+
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "Certificate %s issued for device %s, valid until %s\n", cert.SerialNumber, deviceID, cert.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(out, "Certificate written to \t%s\n", o.OutPath)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Install the files on the device (by default in ~/.portier):")
+	fmt.Fprintf(out, "  %s \t-> cert.pem\n", o.OutPath)
+	fmt.Fprintf(out, "  %s \t-> cacert.pem\n", filepath.Join(o.Dir, ptls.CACertFile))
+	fmt.Fprintf(out, "  %s \t-> ca.crl\n", filepath.Join(o.Dir, ptls.CACRLFile))
+	return nil
+}
@@ -1,12 +1,17 @@
 package ptls_create_cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"time"
 
 	api "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
 	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
 	"github.com/mh-dx/portier-cli/internal/utils"
 	"github.com/spf13/cobra"
 )
@@ -23,6 +28,8 @@ type tlsCreateOptions struct {
 	KnownHostsFilePath  string
 	UploadFingerprint   bool
 	ApiURL              string
+	ValidityDays        int
+	KeyAlgorithm        string
 }
 
 func defaultTLSOptions() *tlsCreateOptions {
@@ -38,7 +45,8 @@ func defaultTLSOptions() *tlsCreateOptions {
 		KeyPath:             fmt.Sprintf("%s/key.pem", home),
 		KnownHostsFilePath:  fmt.Sprintf("%s/known_hosts", home),
 		UploadFingerprint:   true,
-		ApiURL:              "https://api.portier.dev/api",
+		ValidityDays:        int(ptls.DefaultCertificateValidity / (24 * time.Hour)),
+		KeyAlgorithm:        string(ptls.DefaultKeyAlgorithm),
 	}
 }
 
@@ -58,12 +66,27 @@ func NewCreatecmd() *cobra.Command {
 	cmd.Flags().StringVarP(&o.KeyPath, "key", "k", o.KeyPath, "path to the key file in PEM format")
 	cmd.Flags().StringVarP(&o.KnownHostsFilePath, "knownHosts", "f", o.KnownHostsFilePath, "path to the known_hosts file")
 	cmd.Flags().BoolVarP(&o.UploadFingerprint, "uploadFingerprint", "u", o.UploadFingerprint, "if set, will upload the certificate's fingerprint to the server")
-	cmd.Flags().StringVarP(&o.ApiURL, "apiUrl", "a", o.ApiURL, "base URL of the portier API")
+	config.AddAPIURLFlag(cmd.Flags(), &o.ApiURL)
+	cmd.Flags().IntVar(&o.ValidityDays, "validityDays", o.ValidityDays, "validity of the certificate in days")
+	cmd.Flags().StringVar(&o.KeyAlgorithm, "keyAlgorithm", o.KeyAlgorithm, "key algorithm: ed25519, ecdsa-p256, ecdsa-p384, rsa-2048, rsa-3072 or rsa-4096. Noise encryption needs ed25519")
 
 	return cmd
 }
 
 func (o *tlsCreateOptions) run(cmd *cobra.Command, args []string) error {
+	if o.ValidityDays <= 0 {
+		return fmt.Errorf("validity must be at least one day")
+	}
+	keyAlgorithm, err := ptls.ParseKeyAlgorithm(o.KeyAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	apiURL, err := config.ResolveAPIURL(o.ApiURL, filepath.Join(o.HomeFolderPath, "config.yaml"), config.FlagValues(cmd.Flags()))
+	if err != nil {
+		return err
+	}
+	o.ApiURL = apiURL
 
 	// load credentials.yaml file
 	// get the device ID from the credentials.yaml file
@@ -72,7 +95,10 @@ func (o *tlsCreateOptions) run(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	certManager := ptls.NewPTLSCertificateManager()
+	certManager := ptls.NewPTLSCertificateManagerWithOptions(ptls.CertificateManagerOptions{
+		Validity:     time.Duration(o.ValidityDays) * 24 * time.Hour,
+		KeyAlgorithm: keyAlgorithm,
+	})
 	cert, priv, err := certManager.CreateCertificate(credentials.DeviceID)
 	if err != nil {
 		return err
@@ -95,7 +121,7 @@ func (o *tlsCreateOptions) run(cmd *cobra.Command, args []string) error {
 	if err := os.WriteFile(o.CertPath, certPEM, 0644); err != nil {
 		return err
 	}
-	if err := os.WriteFile(o.KeyPath, keyPEM, 0644); err != nil {
+	if err := secrets.WriteFileSecure(o.KeyPath, keyPEM); err != nil {
 		return err
 	}
 	log.Printf("Certificate written to \t%s", o.CertPath)
@@ -119,7 +145,11 @@ func (o *tlsCreateOptions) run(cmd *cobra.Command, args []string) error {
 		log.Println("This way, portier-cli will update the known_hosts file for you")
 		log.Println()
 		log.Println("Uploading fingerprint to the server (it is public)")
-		err = api.UploadFingerprint(o.HomeFolderPath, o.ApiURL, credentials.DeviceID, fp)
+		client, err := api.NewClientForHome(o.HomeFolderPath, o.ApiURL)
+		if err != nil {
+			return err
+		}
+		err = client.UploadFingerprint(context.Background(), credentials.DeviceID, fp)
 		if err != nil {
 			return err
 		}
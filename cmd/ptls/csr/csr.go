@@ -0,0 +1,119 @@
+package ptls_csr_cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	api "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+type tlsCSROptions struct {
+	HomeFolderPath      string
+	CredentialsFileName string
+	DeviceID            string
+	KeyPath             string
+	OutPath             string
+	ApiURL              string
+	KeyAlgorithm        string
+}
+
+func defaultTLSOptions() *tlsCSROptions {
+	home, err := utils.Home()
+	if err != nil {
+		log.Fatalf("could not get home directory: %v", err)
+	}
+
+	return &tlsCSROptions{
+		HomeFolderPath:      home,
+		CredentialsFileName: "credentials_device.yaml",
+		KeyPath:             fmt.Sprintf("%s/key.pem", home),
+		OutPath:             fmt.Sprintf("%s/device.csr", home),
+		KeyAlgorithm:        string(ptls.DefaultKeyAlgorithm),
+	}
+}
+
+func NewCSRcmd() *cobra.Command {
+	o := defaultTLSOptions()
+
+	cmd := &cobra.Command{
+		Use:   "csr",
+		Short: "Create a certificate signing request for the private CA",
+		Long: `Create a certificate signing request for the private CA, see 'portier-cli tls ca'.
+
+The request is signed with the device's private key, a new key is created if there is none.
+The key never leaves the device, only the request is sent to the CA.`,
+		SilenceUsage: true,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.HomeFolderPath, "home", "H", o.HomeFolderPath, "home folder path")
+	cmd.Flags().StringVarP(&o.CredentialsFileName, "credentials", "c", o.CredentialsFileName, "credentials file name in home folder")
+	cmd.Flags().StringVarP(&o.DeviceID, "id", "i", o.DeviceID, "device ID, defaults to the device ID of the credentials")
+	cmd.Flags().StringVarP(&o.KeyPath, "key", "k", o.KeyPath, "path to the key file in PEM format")
+	cmd.Flags().StringVarP(&o.OutPath, "out", "o", o.OutPath, "path of the certificate signing request")
+	config.AddAPIURLFlag(cmd.Flags(), &o.ApiURL)
+	cmd.Flags().StringVar(&o.KeyAlgorithm, "keyAlgorithm", o.KeyAlgorithm, "key algorithm of a new key: ed25519, ecdsa-p256, ecdsa-p384, rsa-2048, rsa-3072 or rsa-4096")
+
+	return cmd
+}
+
+func (o *tlsCSROptions) run(cmd *cobra.Command, args []string) error {
+	deviceID := o.DeviceID
+	if deviceID == "" {
+		apiURL, err := config.ResolveAPIURL(o.ApiURL, filepath.Join(o.HomeFolderPath, "config.yaml"), config.FlagValues(cmd.Flags()))
+		if err != nil {
+			return err
+		}
+		credentials, err := api.LoadDeviceCredentials(o.HomeFolderPath, o.CredentialsFileName, apiURL)
+		if err != nil {
+			return err
+		}
+		deviceID = credentials.DeviceID
+	}
+
+	key, err := ptls.LoadPrivateKey(o.KeyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		keyAlgorithm, err := ptls.ParseKeyAlgorithm(o.KeyAlgorithm)
+		if err != nil {
+			return err
+		}
+		_, key, err = ptls.GenerateKey(keyAlgorithm)
+		if err != nil {
+			return err
+		}
+		keyPEM, err := ptls.EncodePrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := secrets.WriteFileSecure(o.KeyPath, keyPEM); err != nil {
+			return err
+		}
+		log.Printf("Private key written to \t%s", o.KeyPath)
+	} else if err != nil {
+		return err
+	}
+
+	csrPEM, err := ptls.CreateCertificateRequest(deviceID, key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(o.OutPath, csrPEM, 0644); err != nil {
+		return err
+	}
+
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "Certificate signing request for device %s written to %s\n", deviceID, o.OutPath)
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Let the CA sign the request:")
+	fmt.Fprintf(out, "> portier-cli tls ca sign %s --csr device.csr\n", deviceID)
+	fmt.Fprintln(out, "and install the issued certificate as cert.pem, the CA certificate as cacert.pem and the CRL as ca.crl")
+	return nil
+}
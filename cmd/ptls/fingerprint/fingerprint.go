@@ -0,0 +1,22 @@
+package ptls_fingerprint_cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func NewFingerprintcmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "fingerprint",
+		Short: "Show the TLS certificate fingerprint of this device for out-of-band verification",
+		Long: `Show the TLS certificate fingerprint of this device for out-of-band verification.
+
+The fingerprint can be compared over a trusted channel, e.g. a phone call or in person, and
+pinned on the peer device with 'portier-cli tls trust --id <device> --fingerprint <hex>'. This
+way, the portier API does not need to be trusted to hand out the right fingerprints.`,
+		SilenceUsage: true,
+	}
+
+	cmd.AddCommand(newShowCmd())
+
+	return cmd
+}
@@ -0,0 +1,80 @@
+package ptls_fingerprint_cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/mdp/qrterminal/v3"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+type showOptions struct {
+	CertPath string
+	QR       bool
+}
+
+func defaultShowOptions() *showOptions {
+	home, err := utils.Home()
+	if err != nil {
+		log.Fatalf("could not get home directory: %v", err)
+	}
+
+	return &showOptions{
+		CertPath: fmt.Sprintf("%s/cert.pem", home),
+		QR:       true,
+	}
+}
+
+func newShowCmd() *cobra.Command {
+	o := defaultShowOptions()
+
+	cmd := &cobra.Command{
+		Use:          "show",
+		Short:        "Show the fingerprint of the certificate as hex, words and QR code",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.CertPath, "cert", "C", o.CertPath, "path to the certificate file in PEM format")
+	cmd.Flags().BoolVar(&o.QR, "qr", o.QR, "print the fingerprint as QR code")
+
+	return cmd
+}
+
+func (o *showOptions) run(cmd *cobra.Command, args []string) error {
+	chain, err := ptls.LoadCertificateChain(o.CertPath)
+	if err != nil {
+		return err
+	}
+	if len(chain) == 0 {
+		return fmt.Errorf("no certificate found in %s", o.CertPath)
+	}
+	fingerprint, err := ptls.NewPTLSCertificateManager().GetFingerprint(chain[0])
+	if err != nil {
+		return err
+	}
+	words, err := ptls.FingerprintWords(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	// the certificates of devices are issued for the device ID
+	deviceID := chain[0].Subject.CommonName
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "Device:      %s\n", deviceID)
+	fmt.Fprintf(out, "Fingerprint: %s\n", fingerprint)
+	fmt.Fprintf(out, "             %s\n", ptls.FormatFingerprint(fingerprint))
+	fmt.Fprintf(out, "Words:       %s\n", strings.Join(words, " "))
+	if o.QR {
+		fmt.Fprintln(out)
+		qrterminal.GenerateHalfBlock(fingerprint, qrterminal.L, out)
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Compare the words with 'portier-cli tls verify' on the peer device, or pin the fingerprint there with:")
+	fmt.Fprintf(out, "> portier-cli tls trust --id %s --fingerprint %s\n", deviceID, fingerprint)
+	return nil
+}
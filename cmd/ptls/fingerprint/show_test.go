@@ -0,0 +1,39 @@
+package ptls_fingerprint_cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShowPrintsFingerprintAndWords(t *testing.T) {
+	// GIVEN
+	certManager := ptls.NewPTLSCertificateManager()
+	cert, key, err := certManager.CreateCertificate("00000000-0000-0000-0000-000000000001")
+	require.NoError(t, err)
+	certPEM, _, err := certManager.ConvertCertificateToPEM(cert, key)
+	require.NoError(t, err)
+	certPath := filepath.Join(t.TempDir(), "cert.pem")
+	require.NoError(t, os.WriteFile(certPath, certPEM, 0644))
+	fingerprint, err := certManager.GetFingerprint(cert)
+	require.NoError(t, err)
+	words, err := ptls.FingerprintWords(fingerprint)
+	require.NoError(t, err)
+
+	// WHEN
+	out := &bytes.Buffer{}
+	cmd := newShowCmd()
+	cmd.SetOut(out)
+	cmd.SetArgs([]string{"-C", certPath, "--qr=false"})
+	require.NoError(t, cmd.Execute())
+
+	// THEN
+	require.Contains(t, out.String(), fingerprint)
+	require.Contains(t, out.String(), strings.Join(words, " "))
+	require.Contains(t, out.String(), "--id 00000000-0000-0000-0000-000000000001")
+}
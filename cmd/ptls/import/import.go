@@ -0,0 +1,151 @@
+package ptls_import_cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	api "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+type tlsImportOptions struct {
+	HomeFolderPath      string
+	CredentialsFileName string
+	ImportCertPath      string
+	ImportKeyPath       string
+	CertPath            string
+	KeyPath             string
+	UploadFingerprint   bool
+	ApiURL              string
+}
+
+func defaultTLSOptions() *tlsImportOptions {
+	home, err := utils.Home()
+	if err != nil {
+		log.Fatalf("could not get home directory: %v", err)
+	}
+
+	return &tlsImportOptions{
+		HomeFolderPath:      home,
+		CredentialsFileName: "credentials_device.yaml",
+		CertPath:            fmt.Sprintf("%s/cert.pem", home),
+		KeyPath:             fmt.Sprintf("%s/key.pem", home),
+		UploadFingerprint:   true,
+	}
+}
+
+func NewImportcmd() *cobra.Command {
+	o := defaultTLSOptions()
+
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import an existing certificate and key as TLS certificate of this device, upload the fingerprint to the server",
+		Long: `Import an existing certificate and key as TLS certificate of this device, e.g. one issued by a
+corporate PKI. The common name of the certificate must be the device ID. Ed25519, ECDSA (P-256,
+P-384) and RSA keys with at least 2048 bits are supported, Noise encryption needs Ed25519.`,
+		SilenceUsage: true,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVar(&o.ImportCertPath, "cert", o.ImportCertPath, "path of the certificate to import in PEM format, may include the chain")
+	cmd.Flags().StringVar(&o.ImportKeyPath, "key", o.ImportKeyPath, "path of the private key to import in PEM format")
+	cmd.Flags().StringVarP(&o.CertPath, "certOut", "C", o.CertPath, "path to the certificate file of this device")
+	cmd.Flags().StringVarP(&o.KeyPath, "keyOut", "k", o.KeyPath, "path to the key file of this device")
+	cmd.Flags().StringVarP(&o.HomeFolderPath, "home", "H", o.HomeFolderPath, "home folder path")
+	cmd.Flags().StringVarP(&o.CredentialsFileName, "credentials", "c", o.CredentialsFileName, "credentials file name in home folder")
+	cmd.Flags().BoolVarP(&o.UploadFingerprint, "uploadFingerprint", "u", o.UploadFingerprint, "if set, will upload the certificate's fingerprint to the server")
+	config.AddAPIURLFlag(cmd.Flags(), &o.ApiURL)
+	_ = cmd.MarkFlagRequired("cert")
+	_ = cmd.MarkFlagRequired("key")
+
+	return cmd
+}
+
+func (o *tlsImportOptions) run(cmd *cobra.Command, args []string) error {
+	apiURL, err := config.ResolveAPIURL(o.ApiURL, filepath.Join(o.HomeFolderPath, "config.yaml"), config.FlagValues(cmd.Flags()))
+	if err != nil {
+		return err
+	}
+	o.ApiURL = apiURL
+
+	credentials, err := api.LoadDeviceCredentials(o.HomeFolderPath, o.CredentialsFileName, o.ApiURL)
+	if err != nil {
+		return err
+	}
+
+	certPEM, err := os.ReadFile(o.ImportCertPath)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(o.ImportKeyPath)
+	if err != nil {
+		return err
+	}
+	chain, key, err := ptls.ImportCertificate(certPEM, keyPEM, credentials.DeviceID, time.Now())
+	if err != nil {
+		return err
+	}
+	cert := chain[0]
+	keyAlgorithm, err := ptls.KeyAlgorithmOf(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	certManager := ptls.NewPTLSCertificateManager()
+	fingerprint, err := certManager.GetFingerprint(cert)
+	if err != nil {
+		return err
+	}
+	log.Println("Certificate imported:")
+	log.Println()
+	log.Printf("CommonName: \t%s", cert.Subject)
+	log.Printf("Issuer: \t%s", cert.Issuer)
+	log.Printf("NotBefore: \t%s", cert.NotBefore)
+	log.Printf("NotAfter: \t%s", cert.NotAfter)
+	log.Printf("Key: \t\t%s", keyAlgorithm)
+	log.Printf("Fingerprint: \t%s", fingerprint)
+	log.Println()
+	if keyAlgorithm != ptls.KeyAlgorithmEd25519 {
+		log.Println("Noise encryption needs an Ed25519 key, connections of this device use TLS")
+	}
+
+	// the key is stored in PKCS #8 format like the keys of created certificates
+	storedKeyPEM, err := ptls.EncodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(o.CertPath, certPEM, 0644); err != nil {
+		return err
+	}
+	if err := secrets.WriteFileSecure(o.KeyPath, storedKeyPEM); err != nil {
+		return err
+	}
+	log.Printf("Certificate written to \t%s", o.CertPath)
+	log.Printf("Private key written to \t%s", o.KeyPath)
+	log.Println()
+
+	if o.UploadFingerprint {
+		log.Println("Uploading fingerprint to the server (it is public)")
+		client, err := api.NewClientForHome(o.HomeFolderPath, o.ApiURL)
+		if err != nil {
+			return err
+		}
+		if err := client.UploadFingerprint(context.Background(), credentials.DeviceID, fingerprint); err != nil {
+			return err
+		}
+		log.Println("Fingerprint uploaded successfully")
+		log.Println()
+	}
+
+	log.Println("Done")
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package ptls_import_cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/api/portiertest"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/stretchr/testify/require"
+)
+
+const deviceGUID = "00000000-0000-0000-0000-000000000001"
+
+// setupImport returns a home with the credentials of the device and the URL of an API emulator.
+func setupImport(t *testing.T) (home string, url string) {
+	options := portiertest.NewDefaultOptions()
+	options.Fixtures = portiertest.Fixtures{
+		Users: []portiertest.UserFixture{{
+			Email:   portiertest.DefaultUser,
+			Devices: []portiertest.DeviceFixture{{GUID: deviceGUID, Name: "workplace", APIKey: "workplace-key"}},
+		}},
+	}
+	server, err := portiertest.NewServer(options)
+	require.NoError(t, err)
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(func() {
+		server.Close()
+		httpServer.Close()
+	})
+
+	home = t.TempDir()
+	t.Setenv("PORTIER_HOME", home)
+	require.NoError(t, os.WriteFile(filepath.Join(home, "credentials_device.yaml"), []byte("APIKey: workplace-key\n"), 0600))
+	return home, httpServer.URL
+}
+
+// writeCertificate writes a certificate with an ECDSA key in SEC 1 format to the directory.
+func writeCertificate(t *testing.T, dir, commonName string) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	template.Subject.CommonName = commonName
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, "corporate.crt")
+	keyFile = filepath.Join(dir, "corporate.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func runImport(home, url, certFile, keyFile string) error {
+	cmd := NewImportcmd()
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetErr(&bytes.Buffer{})
+	cmd.SetArgs([]string{"-H", home, "-a", url, "--cert", certFile, "--key", keyFile,
+		"-C", filepath.Join(home, "cert.pem"), "-k", filepath.Join(home, "key.pem")})
+	return cmd.Execute()
+}
+
+func TestImportUploadsFingerprint(t *testing.T) {
+	// GIVEN
+	home, url := setupImport(t)
+	certFile, keyFile := writeCertificate(t, t.TempDir(), deviceGUID)
+
+	// WHEN
+	err := runImport(home, url, certFile, keyFile)
+
+	// THEN
+	require.NoError(t, err)
+	chain, err := ptls.LoadCertificateChain(filepath.Join(home, "cert.pem"))
+	require.NoError(t, err)
+	_, err = ptls.LoadPrivateKey(filepath.Join(home, "key.pem"))
+	require.NoError(t, err)
+	fingerprint, err := ptls.NewPTLSCertificateManager().GetFingerprint(chain[0])
+	require.NoError(t, err)
+
+	client, err := api.NewClientForHome(home, url)
+	require.NoError(t, err)
+	fingerprints, err := client.GetFingerprints(context.Background(), []string{deviceGUID})
+	require.NoError(t, err)
+	require.Equal(t, fingerprint, fingerprints[deviceGUID])
+}
+
+func TestImportRejectsCertificateOfOtherDevice(t *testing.T) {
+	// GIVEN
+	home, url := setupImport(t)
+	certFile, keyFile := writeCertificate(t, t.TempDir(), "00000000-0000-0000-0000-000000000002")
+
+	// WHEN
+	err := runImport(home, url, certFile, keyFile)
+
+	// THEN
+	require.ErrorContains(t, err, "is not the device ID")
+	require.NoFileExists(t, filepath.Join(home, "cert.pem"))
+}
@@ -0,0 +1,68 @@
+package ptls_revoke_cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+type tlsRevokeOptions struct {
+	DeviceID           string
+	Fingerprint        string
+	Reason             string
+	KnownHostsFilePath string
+}
+
+func defaultTLSOptions() *tlsRevokeOptions {
+	home, err := utils.Home()
+	if err != nil {
+		log.Fatalf("could not get home directory: %v", err)
+	}
+
+	return &tlsRevokeOptions{
+		KnownHostsFilePath: fmt.Sprintf("%s/known_hosts", home),
+	}
+}
+
+func NewRevokecmd() *cobra.Command {
+	o := defaultTLSOptions()
+
+	cmd := &cobra.Command{
+		Use:          "revoke",
+		Short:        "Revoke the trust in a peer device's certificate fingerprints",
+		Long:         "Revoke the trust in a peer device's certificate fingerprints. Revoked fingerprints are removed from known_hosts and rejected, even if they are downloaded again with the trust command.",
+		SilenceUsage: true,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.DeviceID, "id", "i", o.DeviceID, "device ID of the peer device")
+	cmd.Flags().StringVar(&o.Fingerprint, "fingerprint", o.Fingerprint, "fingerprint to revoke, defaults to all fingerprints of the device")
+	cmd.Flags().StringVarP(&o.Reason, "reason", "r", o.Reason, "reason of the revocation")
+	cmd.Flags().StringVarP(&o.KnownHostsFilePath, "knownHosts", "f", o.KnownHostsFilePath, "path to the known_hosts file")
+	_ = cmd.MarkFlagRequired("id")
+
+	return cmd
+}
+
+func (o *tlsRevokeOptions) run(cmd *cobra.Command, args []string) error {
+	knownHosts, err := ptls.LoadKnownHosts(o.KnownHostsFilePath)
+	if err != nil {
+		return err
+	}
+
+	if o.Fingerprint == "" && !knownHosts.Has(o.DeviceID) {
+		return fmt.Errorf("device %s is not in %s, specify the fingerprint to revoke", o.DeviceID, o.KnownHostsFilePath)
+	}
+
+	revoked := knownHosts.Revoke(o.DeviceID, o.Fingerprint, o.Reason, time.Now())
+	if err := knownHosts.Save(o.KnownHostsFilePath); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "Revoked %d fingerprints of device %s\n", revoked, o.DeviceID)
+	return nil
+}
@@ -0,0 +1,214 @@
+package ptls_rotate_cmd
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	api "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+type tlsRotateOptions struct {
+	HomeFolderPath      string
+	CredentialsFileName string
+	CertPath            string
+	KeyPath             string
+	KnownHostsFilePath  string
+	UploadFingerprint   bool
+	ApiURL              string
+	ValidityDays        int
+	GracePeriod         time.Duration
+	KeyAlgorithm        string
+}
+
+func defaultTLSOptions() *tlsRotateOptions {
+	home, err := utils.Home()
+	if err != nil {
+		log.Fatalf("could not get home directory: %v", err)
+	}
+
+	return &tlsRotateOptions{
+		HomeFolderPath:      home,
+		CredentialsFileName: "credentials_device.yaml",
+		CertPath:            fmt.Sprintf("%s/cert.pem", home),
+		KeyPath:             fmt.Sprintf("%s/key.pem", home),
+		KnownHostsFilePath:  fmt.Sprintf("%s/known_hosts", home),
+		UploadFingerprint:   true,
+		ValidityDays:        int(ptls.DefaultCertificateValidity / (24 * time.Hour)),
+		GracePeriod:         ptls.DefaultGracePeriod,
+	}
+}
+
+func NewRotatecmd() *cobra.Command {
+	o := defaultTLSOptions()
+
+	cmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "Replace the TLS certificate with a new key, keeping the previous one valid during a grace period",
+		Long: `Replace the TLS certificate with a new key, keeping the previous one valid during a grace period.
+
+The new certificate is signed with the previous key and presented together with the previous
+certificate. Peers that still trust the previous fingerprint verify the signature and add the
+new fingerprint to their known_hosts. The previous certificate is retired, once every device
+in this device's known_hosts completed a handshake with the new certificate, or when the grace
+period expires.
+
+The server keeps a single fingerprint per device. During the grace period it keeps the previous
+fingerprint, which verifies the new certificate as well. The new fingerprint is uploaded by the
+running device, once the previous certificate is retired.`,
+		SilenceUsage: true,
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.CertPath, "cert", "C", o.CertPath, "path to the certificate file in PEM format")
+	cmd.Flags().StringVarP(&o.HomeFolderPath, "home", "H", o.HomeFolderPath, "home folder path")
+	cmd.Flags().StringVarP(&o.CredentialsFileName, "credentials", "c", o.CredentialsFileName, "credentials file name in home folder")
+	cmd.Flags().StringVarP(&o.KeyPath, "key", "k", o.KeyPath, "path to the key file in PEM format")
+	cmd.Flags().StringVarP(&o.KnownHostsFilePath, "knownHosts", "f", o.KnownHostsFilePath, "path to the known_hosts file, its devices must confirm the new certificate")
+	cmd.Flags().BoolVarP(&o.UploadFingerprint, "uploadFingerprint", "u", o.UploadFingerprint, "if set, will upload the new certificate's fingerprint to the server")
+	config.AddAPIURLFlag(cmd.Flags(), &o.ApiURL)
+	cmd.Flags().IntVar(&o.ValidityDays, "validityDays", o.ValidityDays, "validity of the new certificate in days")
+	cmd.Flags().StringVar(&o.KeyAlgorithm, "keyAlgorithm", o.KeyAlgorithm, "key algorithm of the new certificate, defaults to the algorithm of the previous one")
+	cmd.Flags().DurationVarP(&o.GracePeriod, "grace", "g", o.GracePeriod, "maximum time the previous certificate stays valid")
+
+	return cmd
+}
+
+func (o *tlsRotateOptions) run(cmd *cobra.Command, args []string) error {
+	if o.ValidityDays <= 0 {
+		return fmt.Errorf("validity must be at least one day")
+	}
+
+	// an interrupted rotation leaves files behind, the certificate and key must match
+	if err := ptls.RecoverKeyPairUpdate(o.CertPath, o.KeyPath); err != nil {
+		return err
+	}
+	rotation, err := ptls.LoadRotation(o.CertPath)
+	if err != nil {
+		return err
+	}
+	if rotation != nil {
+		return fmt.Errorf("a rotation started at %s is in progress until %s, waiting for %d devices to confirm", rotation.Started.Format(time.RFC3339), rotation.Expires.Format(time.RFC3339), len(rotation.Pending))
+	}
+
+	chain, err := ptls.LoadCertificateChain(o.CertPath)
+	if err != nil {
+		return fmt.Errorf("failed to load the certificate, create one with 'portier-cli tls create': %w", err)
+	}
+	previous := chain[0]
+	previousKey, err := ptls.LoadPrivateKey(o.KeyPath)
+	if err != nil {
+		return err
+	}
+
+	var keyAlgorithm ptls.KeyAlgorithm
+	if o.KeyAlgorithm != "" {
+		if keyAlgorithm, err = ptls.ParseKeyAlgorithm(o.KeyAlgorithm); err != nil {
+			return err
+		}
+	}
+
+	certManager := ptls.NewPTLSCertificateManagerWithOptions(ptls.CertificateManagerOptions{
+		Validity:     time.Duration(o.ValidityDays) * 24 * time.Hour,
+		KeyAlgorithm: keyAlgorithm,
+	})
+	cert, priv, err := certManager.RotateCertificate(previous, previousKey)
+	if err != nil {
+		return err
+	}
+	previousFingerprint, err := certManager.GetFingerprint(previous)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := certManager.GetFingerprint(cert)
+	if err != nil {
+		return err
+	}
+	log.Println("Certificate rotated:")
+	log.Println()
+	log.Printf("CommonName: \t%s", cert.Subject)
+	log.Printf("NotBefore: \t%s", cert.NotBefore)
+	log.Printf("NotAfter: \t%s", cert.NotAfter)
+	log.Printf("Previous: \t%s", previousFingerprint)
+	log.Printf("Fingerprint: \t%s", fingerprint)
+	log.Println()
+
+	knownHosts, err := ptls.LoadKnownHosts(o.KnownHostsFilePath)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	rotation = &ptls.Rotation{
+		PreviousFingerprint: previousFingerprint,
+		Fingerprint:         fingerprint,
+		Started:             now,
+		Expires:             now.Add(o.GracePeriod),
+		Pending:             []string{},
+	}
+	for _, deviceID := range knownHosts.DeviceIDs() {
+		if deviceID != previous.Subject.CommonName {
+			rotation.Pending = append(rotation.Pending, deviceID)
+		}
+	}
+
+	certPEM, keyPEM, err := certManager.ConvertCertificateToPEM(cert, priv)
+	if err != nil {
+		return err
+	}
+	previousPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: previous.Raw})
+
+	// present the previous certificate along with the new one, until the peers confirmed
+	inProgress := len(rotation.Pending) > 0 && o.GracePeriod > 0
+	if inProgress {
+		rotation.UploadFingerprint = o.UploadFingerprint
+		certPEM = append(certPEM, previousPEM...)
+		log.Printf("The previous certificate stays valid until %d devices confirmed the new one, at most until %s", len(rotation.Pending), rotation.Expires.Format(time.RFC3339))
+	} else {
+		rotation = nil
+		log.Println("No peer devices to confirm the new certificate, the previous certificate is retired")
+	}
+
+	if err := ptls.WriteKeyPair(o.CertPath, o.KeyPath, certPEM, keyPEM, rotation); err != nil {
+		return err
+	}
+	log.Printf("Certificate written to \t%s", o.CertPath)
+	log.Printf("Private key written to \t%s", o.KeyPath)
+	log.Println()
+
+	if o.UploadFingerprint && inProgress {
+		// the server keeps one fingerprint per device, the previous one still verifies the new
+		// certificate, while the new one alone would not verify the previous certificate
+		log.Println("The new fingerprint is uploaded to the server, once the previous certificate is retired")
+		log.Println()
+	} else if o.UploadFingerprint {
+		apiURL, err := config.ResolveAPIURL(o.ApiURL, filepath.Join(o.HomeFolderPath, "config.yaml"), config.FlagValues(cmd.Flags()))
+		if err != nil {
+			return err
+		}
+		credentials, err := api.LoadDeviceCredentials(o.HomeFolderPath, o.CredentialsFileName, apiURL)
+		if err != nil {
+			return err
+		}
+		log.Println("Uploading new fingerprint to the server (it is public)")
+		client, err := api.NewClientForHome(o.HomeFolderPath, apiURL)
+		if err != nil {
+			return err
+		}
+		if err := client.UploadFingerprint(context.Background(), credentials.DeviceID, fingerprint); err != nil {
+			return err
+		}
+		log.Println("Fingerprint uploaded successfully")
+		log.Println()
+	}
+
+	log.Println("Done")
+
+	return nil
+}
@@ -1,22 +1,33 @@
 package tls_trust_cmd
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"log"
-	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	api "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
 	"github.com/mh-dx/portier-cli/internal/utils"
 	"github.com/spf13/cobra"
-	"gopkg.in/yaml.v3"
 )
 
 type tlsTrustOptions struct {
 	DeviceIDs           *[]string
+	DeviceID            string
+	Fingerprint         string
 	HomeFolderPath      string
 	CredentialsFileName string
 	KnownHostsFilePath  string
 	ApiURL              string
+	GracePeriod         time.Duration
+	Yes                 bool
+	ForgetNoise         bool
 }
 
 func defaultTLSOptions() *tlsTrustOptions {
@@ -29,7 +40,7 @@ func defaultTLSOptions() *tlsTrustOptions {
 		HomeFolderPath:      home,
 		CredentialsFileName: "credentials_device.yaml",
 		KnownHostsFilePath:  fmt.Sprintf("%s/known_hosts", home),
-		ApiURL:              "https://api.portier.dev/api",
+		GracePeriod:         ptls.DefaultGracePeriod,
 	}
 }
 
@@ -37,24 +48,53 @@ func NewTrustcmd() *cobra.Command {
 	o := defaultTLSOptions()
 
 	cmd := &cobra.Command{
-		Use:          "trust",
-		Short:        "Trust a peer device by adding its TLS certificate fingerprint to known_hosts",
+		Use:   "trust",
+		Short: "Trust a peer device by adding its TLS certificate fingerprint to known_hosts",
+		Long: `Trust a peer device by adding its TLS certificate fingerprint to known_hosts.
+
+By default, the fingerprints are downloaded from the portier API. With --fingerprint, the
+fingerprint of the device given by --id is pinned without contacting the API, e.g. after it was
+compared over a trusted channel ('portier-cli tls fingerprint show' on the peer device).
+
+With --forget-noise, the Noise key of the device given by --id is removed from known_hosts, e.g.
+after the device disabled Noise. Connections to it use TLS again, until it accepts Noise.`,
 		SilenceUsage: true,
 		RunE:         o.run,
 	}
 
 	o.DeviceIDs = cmd.Flags().StringSliceP("ids", "i", []string{}, "device ID of the device to trust. If not provided, will trust all devices that have uploaded their fingerprints")
+	cmd.Flags().StringVar(&o.DeviceID, "id", o.DeviceID, "device ID of the device whose fingerprint is pinned with --fingerprint")
+	cmd.Flags().StringVar(&o.Fingerprint, "fingerprint", o.Fingerprint, "SHA-256 fingerprint to pin manually, in hex format")
 	cmd.Flags().StringVarP(&o.HomeFolderPath, "home", "H", o.HomeFolderPath, "home folder path")
 	cmd.Flags().StringVarP(&o.CredentialsFileName, "credentials", "c", o.CredentialsFileName, "credentials file name in home folder")
 	cmd.Flags().StringVarP(&o.KnownHostsFilePath, "knownHosts", "f", o.KnownHostsFilePath, "path to the known_hosts file")
-	cmd.Flags().StringVarP(&o.ApiURL, "apiUrl", "a", o.ApiURL, "base URL of the portier API")
+	config.AddAPIURLFlag(cmd.Flags(), &o.ApiURL)
+	cmd.Flags().BoolVarP(&o.Yes, "yes", "y", false, "trust changed fingerprints without confirmation")
+	cmd.Flags().DurationVarP(&o.GracePeriod, "grace", "g", o.GracePeriod, "time a replaced fingerprint of a rotated certificate stays trusted")
+	cmd.Flags().BoolVar(&o.ForgetNoise, "forget-noise", false, "forget the Noise key of the device given by --id")
 
 	return cmd
 }
 
 func (o *tlsTrustOptions) run(cmd *cobra.Command, args []string) error {
+	if o.ForgetNoise {
+		return o.forgetNoise()
+	}
+	if o.Fingerprint != "" || o.DeviceID != "" {
+		return o.pin(cmd)
+	}
+
+	apiURL, err := config.ResolveAPIURL(o.ApiURL, filepath.Join(o.HomeFolderPath, "config.yaml"), config.FlagValues(cmd.Flags()))
+	if err != nil {
+		return err
+	}
+	o.ApiURL = apiURL
 
-	fingerprints, err := api.GetFingerprint(o.HomeFolderPath, o.ApiURL, *o.DeviceIDs)
+	client, err := api.NewClientForHome(o.HomeFolderPath, o.ApiURL)
+	if err != nil {
+		return err
+	}
+	fingerprints, err := client.GetFingerprints(context.Background(), *o.DeviceIDs)
 	if err != nil {
 		return err
 	}
@@ -68,12 +108,8 @@ func (o *tlsTrustOptions) run(cmd *cobra.Command, args []string) error {
 	for deviceID, fingerprint := range fingerprints {
 		if fingerprint == "" {
 			// If this device was explicitly requested, return an error
-			if len(*o.DeviceIDs) > 0 {
-				for _, requestedID := range *o.DeviceIDs {
-					if requestedID == deviceID {
-						return fmt.Errorf("device %s was explicitly requested but has no fingerprint available. Please ensure the device has uploaded its fingerprint using the create command", deviceID)
-					}
-				}
+			if o.requested(deviceID) {
+				return fmt.Errorf("device %s was explicitly requested but has no fingerprint available. Please ensure the device has uploaded its fingerprint using the create command", deviceID)
 			}
 			log.Printf("DeviceID: %s, Fingerprint: <empty>", deviceID)
 			continue
@@ -84,50 +120,136 @@ func (o *tlsTrustOptions) run(cmd *cobra.Command, args []string) error {
 	log.Println()
 	log.Printf("Adding fingerprints to %s", o.KnownHostsFilePath)
 	log.Println()
-	// load known_hosts file in yaml
-	known_hosts, err := os.Open(o.KnownHostsFilePath)
+	knownHosts, err := ptls.LoadKnownHosts(o.KnownHostsFilePath)
 	if err != nil {
-		// if file does not exist, create it
-		if os.IsNotExist(err) {
-			known_hosts, err = os.Create(o.KnownHostsFilePath)
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
+		return err
 	}
 
-	decoder := yaml.NewDecoder(known_hosts)
-	var knownHostsMap map[string]string
-	err = decoder.Decode(&knownHostsMap)
-	if err != nil {
-		if err.Error() == "EOF" {
-			knownHostsMap = make(map[string]string)
-		} else {
-			return err
+	// device names are informational only, e.g. device credentials may not list devices
+	names := make(map[string]string)
+	if devices, err := client.ListDevices(context.Background()); err == nil {
+		for _, device := range devices {
+			names[device.GUID] = device.Name
 		}
 	}
 
-	// add fingerprints to known_hosts, overwrite if already present
-	for deviceID, fingerprint := range fingerprints {
+	// add fingerprints to known_hosts, a replaced fingerprint stays trusted during the grace period
+	reader := bufio.NewReader(cmd.InOrStdin())
+	now := time.Now()
+	for _, deviceID := range sortedKeys(fingerprints) {
+		fingerprint := fingerprints[deviceID]
 		if fingerprint == "" {
 			continue
 		}
-		knownHostsMap[deviceID] = fingerprint
+		if knownHosts.IsRevoked(fingerprint) {
+			if o.requested(deviceID) {
+				return fmt.Errorf("the fingerprint %s of device %s was revoked", fingerprint, deviceID)
+			}
+			log.Printf("The fingerprint %s of device %s was revoked, skipping", fingerprint, deviceID)
+			continue
+		}
+		if knownHosts.Changed(deviceID, fingerprint) {
+			previous := knownHosts.Devices[deviceID].Fingerprints[0].Fingerprint
+			if !o.Yes && !confirm(cmd, reader, deviceID, previous, fingerprint) {
+				log.Printf("Keeping the previous fingerprint of device %s", deviceID)
+				continue
+			}
+			log.Printf("Fingerprint of device %s changed, the previous one stays trusted until %s", deviceID, now.Add(o.GracePeriod).Format(time.RFC3339))
+		}
+		knownHosts.Add(deviceID, ptls.KnownFingerprint{Fingerprint: fingerprint, Source: ptls.SourceAPI}, o.GracePeriod, now)
+		if name, ok := names[deviceID]; ok {
+			knownHosts.SetName(deviceID, name)
+		}
 	}
 
 	// write the updated known_hosts file
-	known_hosts, err = os.Create(o.KnownHostsFilePath)
+	if err := knownHosts.Save(o.KnownHostsFilePath); err != nil {
+		return err
+	}
+
+	log.Printf("Fingerprints added. Done.")
+	return nil
+}
+
+// pin adds a manually verified fingerprint to known_hosts.
+func (o *tlsTrustOptions) pin(cmd *cobra.Command) error {
+	if o.Fingerprint == "" || o.DeviceID == "" {
+		return fmt.Errorf("--id and --fingerprint must be used together")
+	}
+	fingerprint, err := ptls.NormalizeFingerprint(o.Fingerprint)
 	if err != nil {
 		return err
 	}
-	encoder := yaml.NewEncoder(known_hosts)
-	err = encoder.Encode(knownHostsMap)
+
+	knownHosts, err := ptls.LoadKnownHosts(o.KnownHostsFilePath)
 	if err != nil {
 		return err
 	}
+	if knownHosts.IsRevoked(fingerprint) {
+		return fmt.Errorf("the fingerprint %s of device %s was revoked", fingerprint, o.DeviceID)
+	}
+	if knownHosts.Changed(o.DeviceID, fingerprint) {
+		previous := knownHosts.Devices[o.DeviceID].Fingerprints[0].Fingerprint
+		if !o.Yes && !confirm(cmd, bufio.NewReader(cmd.InOrStdin()), o.DeviceID, previous, fingerprint) {
+			log.Printf("Keeping the previous fingerprint of device %s", o.DeviceID)
+			return nil
+		}
+	}
+	knownHosts.Add(o.DeviceID, ptls.KnownFingerprint{Fingerprint: fingerprint, Source: ptls.SourceManual}, o.GracePeriod, time.Now())
+	if err := knownHosts.Save(o.KnownHostsFilePath); err != nil {
+		return err
+	}
 
-	log.Printf("Fingerprints added. Done.")
+	log.Printf("Pinned fingerprint %s of device %s in %s", fingerprint, o.DeviceID, o.KnownHostsFilePath)
+	return nil
+}
+
+// forgetNoise removes the Noise key of a peer device from known_hosts.
+func (o *tlsTrustOptions) forgetNoise() error {
+	if o.DeviceID == "" || o.Fingerprint != "" {
+		return fmt.Errorf("--forget-noise needs --id and no --fingerprint")
+	}
+	knownHosts, err := ptls.LoadKnownHosts(o.KnownHostsFilePath)
+	if err != nil {
+		return err
+	}
+	if !knownHosts.SetNoisePeer(o.DeviceID, nil) {
+		log.Printf("The Noise key of device %s is not known", o.DeviceID)
+		return nil
+	}
+	if err := knownHosts.Save(o.KnownHostsFilePath); err != nil {
+		return err
+	}
+	log.Printf("Forgot the Noise key of device %s, connections to it use TLS until it accepts Noise again", o.DeviceID)
 	return nil
 }
+
+// confirm asks the user whether a changed fingerprint should be trusted.
+func confirm(cmd *cobra.Command, reader *bufio.Reader, deviceID, previous, fingerprint string) bool {
+	fmt.Fprintf(cmd.OutOrStdout(), "WARNING: the fingerprint of device %s changed\n", deviceID)
+	fmt.Fprintf(cmd.OutOrStdout(), "  known:    %s\n", previous)
+	fmt.Fprintf(cmd.OutOrStdout(), "  received: %s\n", fingerprint)
+	fmt.Fprintln(cmd.OutOrStdout(), "This is expected if the device rotated or re-created its certificate. Otherwise, someone may be impersonating the device.")
+	fmt.Fprint(cmd.OutOrStdout(), "Trust the new fingerprint? [y/N] ")
+	answer, _ := reader.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func (o *tlsTrustOptions) requested(deviceID string) bool {
+	for _, requestedID := range *o.DeviceIDs {
+		if requestedID == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
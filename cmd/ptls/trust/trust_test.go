@@ -2,9 +2,19 @@ package tls_trust_cmd
 
 import (
 	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/api/portiertest"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/stretchr/testify/require"
 )
 
+const workplaceGUID = "00000000-0000-0000-0000-000000000001"
+
 func TestSingleDeviceID(t *testing.T) {
 	// GIVEN
 	cmd := NewTrustcmd()
@@ -14,3 +24,141 @@ func TestSingleDeviceID(t *testing.T) {
 	// WHEN
 	cmd.ExecuteC()
 }
+
+// setupChangedFingerprint returns a home whose known_hosts holds an outdated fingerprint of
+// the workplace device, and the URL of an API emulator serving its new fingerprint.
+func setupChangedFingerprint(t *testing.T) (home string, url string) {
+	options := portiertest.NewDefaultOptions()
+	options.Fixtures = portiertest.Fixtures{
+		Users: []portiertest.UserFixture{{
+			Email: portiertest.DefaultUser,
+			Devices: []portiertest.DeviceFixture{
+				{GUID: workplaceGUID, Name: "workplace", APIKey: "workplace-key", Fingerprint: "new"},
+				{GUID: "00000000-0000-0000-0000-000000000002", Name: "home", APIKey: "home-key"},
+			},
+		}},
+	}
+	server, err := portiertest.NewServer(options)
+	require.NoError(t, err)
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(func() {
+		server.Close()
+		httpServer.Close()
+	})
+
+	home = t.TempDir()
+	t.Setenv("PORTIER_HOME", home)
+	require.NoError(t, os.WriteFile(filepath.Join(home, "credentials_device.yaml"), []byte("APIKey: home-key\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(home, "known_hosts"), []byte(workplaceGUID+": old\n"), 0600))
+	return home, httpServer.URL
+}
+
+func runTrust(t *testing.T, home, url, input string) *ptls.KnownHosts {
+	cmd := NewTrustcmd()
+	cmd.SetIn(bytes.NewBufferString(input))
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetArgs([]string{"-H", home, "-a", url, "-f", filepath.Join(home, "known_hosts"), "-i", workplaceGUID})
+	require.NoError(t, cmd.Execute())
+
+	knownHosts, err := ptls.LoadKnownHosts(filepath.Join(home, "known_hosts"))
+	require.NoError(t, err)
+	return knownHosts
+}
+
+func TestChangedFingerprintIsNotTrustedWithoutConfirmation(t *testing.T) {
+	// GIVEN
+	home, url := setupChangedFingerprint(t)
+
+	// WHEN
+	knownHosts := runTrust(t, home, url, "n\n")
+
+	// THEN
+	require.True(t, knownHosts.Trusts(workplaceGUID, "old", time.Now()))
+	require.False(t, knownHosts.Trusts(workplaceGUID, "new", time.Now()))
+}
+
+func TestChangedFingerprintIsTrustedAfterConfirmation(t *testing.T) {
+	// GIVEN
+	home, url := setupChangedFingerprint(t)
+
+	// WHEN
+	knownHosts := runTrust(t, home, url, "y\n")
+
+	// THEN
+	require.True(t, knownHosts.Trusts(workplaceGUID, "new", time.Now()))
+	require.True(t, knownHosts.Trusts(workplaceGUID, "old", time.Now()))
+	require.False(t, knownHosts.Trusts(workplaceGUID, "old", time.Now().Add(2*ptls.DefaultGracePeriod)))
+	require.Equal(t, ptls.SourceAPI, knownHosts.Devices[workplaceGUID].Fingerprints[0].Source)
+}
+
+func TestRevokedFingerprintIsNotTrusted(t *testing.T) {
+	// GIVEN
+	home, url := setupChangedFingerprint(t)
+	knownHosts, err := ptls.LoadKnownHosts(filepath.Join(home, "known_hosts"))
+	require.NoError(t, err)
+	knownHosts.Revoke(workplaceGUID, "new", "", time.Now())
+	require.NoError(t, knownHosts.Save(filepath.Join(home, "known_hosts")))
+
+	// WHEN
+	cmd := NewTrustcmd()
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetArgs([]string{"-H", home, "-a", url, "-f", filepath.Join(home, "known_hosts"), "-i", workplaceGUID, "-y"})
+	err = cmd.Execute()
+
+	// THEN
+	require.Error(t, err)
+}
+
+func TestManualFingerprintIsPinnedWithoutAPI(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	fingerprint := "00ff10a0b1c2d3e4f5061728394a5b6c7d8e9fa0b1c2d3e4f5061728394a5b6c"
+
+	// WHEN
+	cmd := NewTrustcmd()
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetArgs([]string{"-H", home, "-a", "http://localhost:0", "-f", filepath.Join(home, "known_hosts"), "--id", workplaceGUID, "--fingerprint", ptls.FormatFingerprint(fingerprint)})
+	require.NoError(t, cmd.Execute())
+
+	// THEN
+	knownHosts, err := ptls.LoadKnownHosts(filepath.Join(home, "known_hosts"))
+	require.NoError(t, err)
+	require.True(t, knownHosts.Trusts(workplaceGUID, fingerprint, time.Now()))
+	require.Equal(t, ptls.SourceManual, knownHosts.Devices[workplaceGUID].Fingerprints[0].Source)
+}
+
+func TestManualFingerprintNeedsDeviceID(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+
+	// WHEN
+	cmd := NewTrustcmd()
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetArgs([]string{"-H", home, "-f", filepath.Join(home, "known_hosts"), "--fingerprint", "00ff"})
+	err := cmd.Execute()
+
+	// THEN
+	require.ErrorContains(t, err, "--id and --fingerprint")
+}
+
+func TestForgetNoiseRemovesTheNoiseKey(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	knownHostsFile := filepath.Join(home, "known_hosts")
+	knownHosts := ptls.NewKnownHosts()
+	knownHosts.Add(workplaceGUID, ptls.KnownFingerprint{Fingerprint: "aaaa"}, 0, time.Now())
+	knownHosts.SetNoisePeer(workplaceGUID, []byte("certificate"))
+	require.NoError(t, knownHosts.Save(knownHostsFile))
+
+	// WHEN
+	cmd := NewTrustcmd()
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetArgs([]string{"-H", home, "-f", knownHostsFile, "--id", workplaceGUID, "--forget-noise"})
+	require.NoError(t, cmd.Execute())
+
+	// THEN
+	knownHosts, err := ptls.LoadKnownHosts(knownHostsFile)
+	require.NoError(t, err)
+	require.Nil(t, knownHosts.NoisePeer(workplaceGUID))
+	require.True(t, knownHosts.Trusts(workplaceGUID, "aaaa", time.Now()))
+}
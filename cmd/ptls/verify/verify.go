@@ -0,0 +1,134 @@
+package ptls_verify_cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	api "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+type tlsVerifyOptions struct {
+	HomeFolderPath     string
+	KnownHostsFilePath string
+	ApiURL             string
+}
+
+func defaultTLSOptions() *tlsVerifyOptions {
+	home, err := utils.Home()
+	if err != nil {
+		log.Fatalf("could not get home directory: %v", err)
+	}
+
+	return &tlsVerifyOptions{
+		HomeFolderPath:     home,
+		KnownHostsFilePath: fmt.Sprintf("%s/known_hosts", home),
+	}
+}
+
+func NewVerifycmd() *cobra.Command {
+	o := defaultTLSOptions()
+
+	cmd := &cobra.Command{
+		Use:   "verify <device>...",
+		Short: "Compare the fingerprints of the portier API with the ones pinned in known_hosts",
+		Long: `Compare the fingerprints of the portier API with the ones pinned in known_hosts.
+
+A mismatch means that either the peer device changed its certificate, or the API hands out a
+fingerprint that does not belong to the device. Verify the fingerprint out of band with
+'portier-cli tls fingerprint show' on the peer device before trusting it.`,
+		SilenceUsage: true,
+		Args:         cobra.MinimumNArgs(1),
+		RunE:         o.run,
+	}
+
+	cmd.Flags().StringVarP(&o.HomeFolderPath, "home", "H", o.HomeFolderPath, "home folder path")
+	cmd.Flags().StringVarP(&o.KnownHostsFilePath, "knownHosts", "f", o.KnownHostsFilePath, "path to the known_hosts file")
+	config.AddAPIURLFlag(cmd.Flags(), &o.ApiURL)
+
+	return cmd
+}
+
+func (o *tlsVerifyOptions) run(cmd *cobra.Command, args []string) error {
+	apiURL, err := config.ResolveAPIURL(o.ApiURL, filepath.Join(o.HomeFolderPath, "config.yaml"), config.FlagValues(cmd.Flags()))
+	if err != nil {
+		return err
+	}
+
+	client, err := api.NewClientForHome(o.HomeFolderPath, apiURL)
+	if err != nil {
+		return err
+	}
+	fingerprints, err := client.GetFingerprints(context.Background(), args)
+	if err != nil {
+		return err
+	}
+	knownHosts, err := ptls.LoadKnownHosts(o.KnownHostsFilePath)
+	if err != nil {
+		return err
+	}
+
+	mismatches := 0
+	now := time.Now()
+	for _, deviceID := range args {
+		if !verify(cmd.OutOrStdout(), knownHosts, deviceID, fingerprints[deviceID], now) {
+			mismatches++
+		}
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("the fingerprints of %d devices do not match", mismatches)
+	}
+	return nil
+}
+
+// verify prints the API and the pinned fingerprints of the device. Returns false if they do
+// not match. Devices without a pinned or without an API fingerprint are not a mismatch.
+func verify(out io.Writer, knownHosts *ptls.KnownHosts, deviceID, fingerprint string, now time.Time) bool {
+	fmt.Fprintf(out, "Device %s\n", deviceID)
+	fmt.Fprintf(out, "  API:    %s\n", describe(fingerprint))
+	var pinned []string
+	if device, ok := knownHosts.Devices[deviceID]; ok {
+		for _, known := range device.Fingerprints {
+			if known.Expires.IsZero() || now.Before(known.Expires) {
+				pinned = append(pinned, known.Fingerprint)
+				fmt.Fprintf(out, "  pinned: %s (%s)\n", describe(known.Fingerprint), known.Source)
+			}
+		}
+	}
+
+	switch {
+	case fingerprint == "":
+		fmt.Fprintln(out, "  UNKNOWN: the device did not upload a fingerprint")
+	case knownHosts.IsRevoked(fingerprint):
+		fmt.Fprintln(out, "  MISMATCH: the API fingerprint was revoked")
+		return false
+	case len(pinned) == 0:
+		fmt.Fprintln(out, "  NOT PINNED: verify the fingerprint out of band before trusting it")
+	case knownHosts.Trusts(deviceID, fingerprint, now):
+		fmt.Fprintln(out, "  OK")
+	default:
+		fmt.Fprintln(out, "  MISMATCH: the API fingerprint is not pinned for the device")
+		return false
+	}
+	return true
+}
+
+// describe renders the fingerprint with its short authentication string.
+func describe(fingerprint string) string {
+	if fingerprint == "" {
+		return "<none>"
+	}
+	words, err := ptls.FingerprintWords(fingerprint)
+	if err != nil {
+		return fingerprint
+	}
+	return fmt.Sprintf("%s [%s]", fingerprint, strings.Join(words, " "))
+}
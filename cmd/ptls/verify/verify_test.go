@@ -0,0 +1,79 @@
+package ptls_verify_cmd
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mh-dx/portier-cli/internal/portier/api/portiertest"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	workplaceGUID = "00000000-0000-0000-0000-000000000001"
+	apiValue      = "00ff10a0b1c2d3e4f5061728394a5b6c7d8e9fa0b1c2d3e4f5061728394a5b6c"
+)
+
+// setupVerify returns a home whose known_hosts pins the given fingerprint of the workplace
+// device, and the URL of an API emulator serving apiValue for it.
+func setupVerify(t *testing.T, pinned string) (home string, url string) {
+	options := portiertest.NewDefaultOptions()
+	options.Fixtures = portiertest.Fixtures{
+		Users: []portiertest.UserFixture{{
+			Email: portiertest.DefaultUser,
+			Devices: []portiertest.DeviceFixture{
+				{GUID: workplaceGUID, Name: "workplace", APIKey: "workplace-key", Fingerprint: apiValue},
+				{GUID: "00000000-0000-0000-0000-000000000002", Name: "home", APIKey: "home-key"},
+			},
+		}},
+	}
+	server, err := portiertest.NewServer(options)
+	require.NoError(t, err)
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(func() {
+		server.Close()
+		httpServer.Close()
+	})
+
+	home = t.TempDir()
+	t.Setenv("PORTIER_HOME", home)
+	require.NoError(t, os.WriteFile(filepath.Join(home, "credentials_device.yaml"), []byte("APIKey: home-key\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(home, "known_hosts"), []byte(workplaceGUID+": "+pinned+"\n"), 0600))
+	return home, httpServer.URL
+}
+
+func runVerify(home, url string) (string, error) {
+	out := &bytes.Buffer{}
+	cmd := NewVerifycmd()
+	cmd.SetOut(out)
+	cmd.SetErr(&bytes.Buffer{})
+	cmd.SetArgs([]string{"-H", home, "-a", url, "-f", filepath.Join(home, "known_hosts"), workplaceGUID})
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+func TestVerifyMatchingFingerprint(t *testing.T) {
+	// GIVEN
+	home, url := setupVerify(t, apiValue)
+
+	// WHEN
+	out, err := runVerify(home, url)
+
+	// THEN
+	require.NoError(t, err)
+	require.Contains(t, out, "OK")
+}
+
+func TestVerifyFlagsMismatch(t *testing.T) {
+	// GIVEN
+	home, url := setupVerify(t, "1111111111111111111111111111111111111111111111111111111111111111")
+
+	// WHEN
+	out, err := runVerify(home, url)
+
+	// THEN
+	require.Error(t, err)
+	require.Contains(t, out, "MISMATCH")
+}
@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -30,7 +32,6 @@ func defaultRegisterOptions() *registerOptions {
 	}
 
 	return &registerOptions{
-		ApiURL:              "https://api.portier.dev/api",
 		ApiKey:              "",
 		HomeFolderPath:      home,
 		CredentialsFileName: "credentials_device.yaml",
@@ -53,7 +54,7 @@ func newRegisterCmd() *cobra.Command {
 	cmd.Flags().StringVarP(&o.ApiKey, "apiKey", "k", o.ApiKey, "existing API key to register with")
 	cmd.Flags().StringVarP(&o.HomeFolderPath, "home", "H", o.HomeFolderPath, "home folder path")
 	cmd.Flags().StringVarP(&o.CredentialsFileName, "credentials", "c", o.CredentialsFileName, "credentials file name in home folder")
-	cmd.Flags().StringVarP(&o.ApiURL, "apiUrl", "a", o.ApiURL, "base URL of the API (https://api.portier.dev)")
+	config.AddAPIURLFlag(cmd.Flags(), &o.ApiURL)
 	cmd.Flags().Bool("no-tls", false, "Do not generate or check TLS certificates")
 
 	return cmd
@@ -64,6 +65,10 @@ func (o *registerOptions) run(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	o.ApiURL, err = config.ResolveAPIURL(o.ApiURL, filepath.Join(o.HomeFolderPath, "config.yaml"), config.FlagValues(cmd.Flags()))
+	if err != nil {
+		return err
+	}
 
 	noTLS, _ := cmd.Flags().GetBool("no-tls")
 
@@ -71,7 +76,7 @@ func (o *registerOptions) run(cmd *cobra.Command, args []string) error {
 		if o.Name != "" {
 			return fmt.Errorf("--name must not be provided when --apiKey is used")
 		}
-		guid, err := portier.WhoAmI(strings.TrimSuffix(o.ApiURL, "/api"), o.ApiKey)
+		guid, err := portier.NewDefaultClient(o.ApiURL, portier.DeviceKeyAuth{APIKey: o.ApiKey}).WhoAmI(context.Background())
 		if err != nil {
 			return err
 		}
@@ -81,7 +86,7 @@ func (o *registerOptions) run(cmd *cobra.Command, args []string) error {
 		}
 		fmt.Fprintf(cmd.OutOrStdout(), "Existing API key stored. Device GUID: %s\n", guid)
 		if !noTLS {
-			cert, key, known, err := resolveTLSPaths(o.HomeFolderPath)
+			cert, key, known, err := resolveTLSPaths(o.HomeFolderPath, config.FlagValues(cmd.Flags()))
 			if err != nil {
 				return err
 			}
@@ -118,7 +123,7 @@ func (o *registerOptions) run(cmd *cobra.Command, args []string) error {
 
 	err = portier.Register(o.Name, o.ApiURL, o.HomeFolderPath, o.CredentialsFileName)
 	if err != nil {
-		if strings.Contains(err.Error(), "already exists") {
+		if errors.Is(err, portier.ErrConflict) || strings.Contains(err.Error(), "already exists") {
 			if err := o.takeOverExistingDevice(cmd, noTLS); err != nil {
 				return err
 			}
@@ -142,9 +147,9 @@ func (o *registerOptions) parseArgs(cmd *cobra.Command, _ []string) error {
 		o.ApiKey = apiKey
 	}
 
-	apiUrl, err := cmd.Flags().GetString("apiUrl")
+	apiUrl, err := cmd.Flags().GetString("api-url")
 	if err != nil {
-		log.Fatalf("could not get apiUrl flag: %v", err)
+		log.Fatalf("could not get api-url flag: %v", err)
 		return err
 	}
 	o.ApiURL = apiUrl
@@ -156,7 +161,7 @@ func (o *registerOptions) handleTLS(cmd *cobra.Command, noTLS bool) error {
 	if noTLS {
 		return nil
 	}
-	cert, key, known, err := resolveTLSPaths(o.HomeFolderPath)
+	cert, key, known, err := resolveTLSPaths(o.HomeFolderPath, config.FlagValues(cmd.Flags()))
 	if err != nil {
 		return err
 	}
@@ -189,17 +194,13 @@ func (o *registerOptions) takeOverExistingDevice(cmd *cobra.Command, noTLS bool)
 		return fmt.Errorf("device already exists")
 	}
 
-	guid, err := portier.GetDeviceByName(o.HomeFolderPath, o.ApiURL, o.Name)
-	if err != nil {
-		return err
-	}
-
-	authResponse, err := portier.LoadAccessToken(o.HomeFolderPath)
+	client := portier.NewDefaultClient(o.ApiURL, portier.NewBearerAuth(o.HomeFolderPath))
+	guid, err := client.GetDeviceByName(context.Background(), o.Name)
 	if err != nil {
 		return err
 	}
 
-	apiKey, err := portier.GenerateApiKey(o.ApiURL, guid, "Generated by portier CLI", authResponse.AccessToken, o.HomeFolderPath)
+	apiKey, err := client.GenerateApiKey(context.Background(), guid, "Generated by portier CLI")
 	if err != nil {
 		return err
 	}
@@ -230,6 +231,9 @@ func ensureConfigTLS(home string) error {
 	if portierConfig.PTLSConfig.CAFile == "" {
 		portierConfig.PTLSConfig.CAFile = filepath.Join(home, "cacert.pem")
 	}
+	if portierConfig.PTLSConfig.CRLFile == "" {
+		portierConfig.PTLSConfig.CRLFile = filepath.Join(home, "ca.crl")
+	}
 	if portierConfig.PTLSConfig.KnownHostsFile == "" {
 		portierConfig.PTLSConfig.KnownHostsFile = filepath.Join(home, "known_hosts")
 	}
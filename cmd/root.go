@@ -1,9 +1,21 @@
 package cmd
 
 import (
+	"fmt"
+
 	ptls_cmd "github.com/mh-dx/portier-cli/cmd/ptls"
+	ptls_ca_cmd "github.com/mh-dx/portier-cli/cmd/ptls/ca"
 	ptls_create_cmd "github.com/mh-dx/portier-cli/cmd/ptls/create"
+	ptls_csr_cmd "github.com/mh-dx/portier-cli/cmd/ptls/csr"
+	ptls_fingerprint_cmd "github.com/mh-dx/portier-cli/cmd/ptls/fingerprint"
+	ptls_import_cmd "github.com/mh-dx/portier-cli/cmd/ptls/import"
+	ptls_revoke_cmd "github.com/mh-dx/portier-cli/cmd/ptls/revoke"
+	ptls_rotate_cmd "github.com/mh-dx/portier-cli/cmd/ptls/rotate"
 	ptls_trust_cmd "github.com/mh-dx/portier-cli/cmd/ptls/trust"
+	ptls_verify_cmd "github.com/mh-dx/portier-cli/cmd/ptls/verify"
+	portier "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -16,13 +28,27 @@ func newRootCmd(version string) *cobra.Command {
 		},
 	}
 
+	// evaluated in main before the commands are built, declared here for help and flag parsing
+	cmd.PersistentFlags().String("profile", "", fmt.Sprintf("profile to use, each profile has its own config, credentials and TLS files (env %s)", utils.ProfileEnv))
+	config.AddOverrideFlags(cmd.PersistentFlags())
+
+	cmd.SetGlobalNormalizationFunc(config.NormalizeFlagName)
+
 	cmd.AddCommand(newVersionCmd(version)) // version subcommand
 	cmd.AddCommand(NewManCmd().Cmd)        // man subcommand
 	cmd.AddCommand(newLoginCmd())
+	cmd.AddCommand(newLogoutCmd())
 	cmd.AddCommand(newRegisterCmd())
 	tlsCmd := ptls_cmd.NewTLScmd()
 	tlsCmd.AddCommand(ptls_create_cmd.NewCreatecmd())
+	tlsCmd.AddCommand(ptls_import_cmd.NewImportcmd())
 	tlsCmd.AddCommand(ptls_trust_cmd.NewTrustcmd())
+	tlsCmd.AddCommand(ptls_rotate_cmd.NewRotatecmd())
+	tlsCmd.AddCommand(ptls_revoke_cmd.NewRevokecmd())
+	tlsCmd.AddCommand(ptls_ca_cmd.NewCAcmd())
+	tlsCmd.AddCommand(ptls_csr_cmd.NewCSRcmd())
+	tlsCmd.AddCommand(ptls_fingerprint_cmd.NewFingerprintcmd())
+	tlsCmd.AddCommand(ptls_verify_cmd.NewVerifycmd())
 	cmd.AddCommand(tlsCmd)
 	runCmd, err := newRunCmd()
 	if err != nil {
@@ -40,6 +66,28 @@ func newRootCmd(version string) *cobra.Command {
 		cmd.AddCommand(serviceCmd)
 	}
 
+	devicesCmd, err := newDevicesCmd()
+	if err == nil {
+		cmd.AddCommand(devicesCmd)
+	}
+
+	profileCmd, err := newProfileCmd()
+	if err == nil {
+		cmd.AddCommand(profileCmd)
+	}
+
+	configCmd, err := newConfigCmd()
+	if err == nil {
+		cmd.AddCommand(configCmd)
+	}
+
+	credentialsCmd, err := newCredentialsCmd()
+	if err == nil {
+		cmd.AddCommand(credentialsCmd)
+	}
+
+	cmd.AddCommand(newDevCmd())
+
 	trayCmd := newTrayCmd()
 	cmd.AddCommand(trayCmd)
 
@@ -48,6 +96,8 @@ func newRootCmd(version string) *cobra.Command {
 
 // Execute invokes the command.
 func Execute(version string) error {
+	portier.SetVersion(version)
+
 	if err := newRootCmd(version).Execute(); err != nil {
 		return err
 	}
@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -17,3 +19,43 @@ func TestRootCommandOutput(t *testing.T) {
 	cmdErr := cmd.RunE(cmd, nil)
 	require.NoError(t, cmdErr)
 }
+
+func TestOverrideFlagsApplyToSubcommands(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	t.Setenv("PORTIER_HOME", home)
+	configFile := filepath.Join(home, "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte("version: 1\ndefaultReadTimeout: 5s\nservices:\n- name: web\n  options:\n    compression: zstd\n"), 0o644))
+	cmd := newRootCmd("")
+	b := bytes.NewBufferString("")
+	cmd.SetOut(b)
+
+	// WHEN the flag is given in front of the subcommand
+	cmd.SetArgs([]string{"--default-read-timeout", "9s", "config", "show", "--effective", "-c", configFile})
+	err := cmd.Execute()
+
+	// THEN
+	require.NoError(t, err)
+	require.Regexp(t, `defaultReadTimeout\s+9s\s+flag`, b.String())
+	require.Regexp(t, `services\[0\]\.options\.compression\s+zstd\s+file`, b.String())
+	require.Regexp(t, `services\[0\]\.options\.readBufferSize\s+0\s+file`, b.String())
+}
+
+func TestFormerAPIURLFlagIsTheOverrideFlag(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	t.Setenv("PORTIER_HOME", home)
+	configFile := filepath.Join(home, "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte("version: 1\napiUrl: https://file.example.com/api\n"), 0o644))
+	cmd := newRootCmd("")
+	b := bytes.NewBufferString("")
+	cmd.SetOut(b)
+
+	// WHEN
+	cmd.SetArgs([]string{"--apiUrl", "https://flag.example.com/api", "config", "show", "--effective", "-c", configFile})
+	err := cmd.Execute()
+
+	// THEN
+	require.NoError(t, err)
+	require.Regexp(t, `apiUrl\s+https://flag.example.com/api\s+flag`, b.String())
+}
@@ -72,12 +72,13 @@ func (o *runOptions) run(cmd *cobra.Command, args []string) error {
 
 	application := application.GetPortierApplication()
 
-	portierConfig, err := config.LoadConfig(o.ConfigFile)
+	effectiveConfig, err := config.LoadEffectiveConfig(o.ConfigFile, config.FlagValues(cmd.Flags()))
 	if err != nil {
 		return err
 	}
+	portierConfig := effectiveConfig.Config
 
-	apiBaseURL := config.APIBaseURLFromPortierURL(portierConfig.PortierURL.String())
+	apiBaseURL := portierConfig.Endpoints().APIBaseURL()
 	deviceCreds, err := config.LoadApiTokenWithBaseURL(o.ApiTokenFile, apiBaseURL)
 	if err != nil {
 		return fmt.Errorf("could not load api token file: %w", err)
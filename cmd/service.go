@@ -22,6 +22,9 @@ type serviceOptions struct {
 	ApiTokenFile string
 	LogFile      string
 	Action       string
+
+	// FlagValues are the config override flags of the command line
+	FlagValues map[string]string
 }
 
 type portierService struct {
@@ -61,7 +64,9 @@ Available actions:
   start     - Start the Portier CLI service
   stop      - Stop the Portier CLI service
   restart   - Restart the Portier CLI service
-  status    - Show the status of the Portier CLI service`,
+  status    - Show the status of the Portier CLI service
+
+Config override flags given to install, e.g. --portier-url, are passed on to the installed service.`,
 		Args:         cobra.ExactArgs(1),
 		SilenceUsage: true,
 		RunE:         o.run,
@@ -76,12 +81,14 @@ Available actions:
 
 func (o *serviceOptions) run(cmd *cobra.Command, args []string) error {
 	o.Action = args[0]
+	o.FlagValues = config.FlagValues(cmd.Flags())
 
 	// Create service manager with configuration
 	serviceConfig := &internalService.Config{
 		ConfigFile:   o.ConfigFile,
 		ApiTokenFile: o.ApiTokenFile,
 		LogFile:      o.LogFile,
+		FlagValues:   o.FlagValues,
 	}
 
 	serviceManager, err := internalService.NewServiceManager(serviceConfig)
@@ -208,14 +215,15 @@ func (p *portierService) run() {
 	log.Println("Portier CLI service started")
 
 	// Load configuration
-	portierConfig, err := config.LoadConfig(p.options.ConfigFile)
+	effectiveConfig, err := config.LoadEffectiveConfig(p.options.ConfigFile, p.options.FlagValues)
 	if err != nil {
 		log.Printf("Failed to load config: %v", err)
 		return
 	}
+	portierConfig := effectiveConfig.Config
 
 	// Load API credentials
-	apiBaseURL := config.APIBaseURLFromPortierURL(portierConfig.PortierURL.String())
+	apiBaseURL := portierConfig.Endpoints().APIBaseURL()
 	deviceCreds, err := config.LoadApiTokenWithBaseURL(p.options.ApiTokenFile, apiBaseURL)
 	if err != nil {
 		log.Printf("Failed to load API token: %v", err)
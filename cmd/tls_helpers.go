@@ -2,12 +2,14 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	ptls_create_cmd "github.com/mh-dx/portier-cli/cmd/ptls/create"
 	portier "github.com/mh-dx/portier-cli/internal/portier/api"
@@ -16,13 +18,14 @@ import (
 	"github.com/spf13/cobra"
 )
 
-// resolveTLSPaths retrieves TLS file locations from config.yaml if present.
-// Missing values default to paths inside the provided home directory.
-func resolveTLSPaths(home string) (cert, key, knownHosts string, err error) {
-	cfg, err := config.LoadConfig(filepath.Join(home, "config.yaml"))
+// resolveTLSPaths retrieves TLS file locations from config.yaml if present, with the override
+// flags flagValues. Missing values default to paths inside the provided home directory.
+func resolveTLSPaths(home string, flagValues map[string]string) (cert, key, knownHosts string, err error) {
+	effectiveConfig, err := config.LoadEffectiveConfig(filepath.Join(home, "config.yaml"), flagValues)
 	if err != nil {
 		return "", "", "", err
 	}
+	cfg := effectiveConfig.Config
 
 	cert = cfg.PTLSConfig.CertFile
 	key = cfg.PTLSConfig.KeyFile
@@ -47,6 +50,7 @@ func resolveTLSPaths(home string) (cert, key, knownHosts string, err error) {
 func ensureTLSCertificate(cobraCmd *cobra.Command, home, credentialsFile, apiURL, certPath, keyPath, knownHosts string) error {
 	if _, err := os.Stat(certPath); err == nil {
 		if _, err := os.Stat(keyPath); err == nil {
+			warnCertificateExpiry(cobraCmd, certPath)
 			return nil
 		}
 	}
@@ -68,7 +72,7 @@ func ensureTLSCertificate(cobraCmd *cobra.Command, home, credentialsFile, apiURL
 			"--cert", certPath,
 			"--key", keyPath,
 			"--knownHosts", knownHosts,
-			"--apiUrl", apiURL,
+			"--api-url", apiURL,
 		}
 		createCmd.SetArgs(args)
 		if err := createCmd.Execute(); err != nil {
@@ -81,6 +85,19 @@ func ensureTLSCertificate(cobraCmd *cobra.Command, home, credentialsFile, apiURL
 	return nil
 }
 
+// warnCertificateExpiry prints a warning if the certificate expires soon.
+func warnCertificateExpiry(cobraCmd *cobra.Command, certPath string) {
+	notAfter, expiring, err := ptls.CertificateExpiry(certPath, time.Now())
+	if err != nil || !expiring {
+		return
+	}
+	if notAfter.Before(time.Now()) {
+		fmt.Fprintf(cobraCmd.OutOrStdout(), "Warning: the TLS certificate %s expired on %s. Replace it with 'portier-cli tls rotate'.\n", certPath, notAfter.Format(time.RFC3339))
+		return
+	}
+	fmt.Fprintf(cobraCmd.OutOrStdout(), "Warning: the TLS certificate %s expires on %s. Replace it with 'portier-cli tls rotate'.\n", certPath, notAfter.Format(time.RFC3339))
+}
+
 func ensureFingerprintUpToDate(cobraCmd *cobra.Command, home, apiURL, credentialsFile, certPath string) error {
 	fmt.Fprintln(cobraCmd.OutOrStdout(), "Checking TLS certificate fingerprint registration (upload if needed)")
 	creds, err := portier.LoadDeviceCredentials(home, filepath.Base(credentialsFile), apiURL)
@@ -109,7 +126,18 @@ func ensureFingerprintUpToDate(cobraCmd *cobra.Command, home, apiURL, credential
 		return err
 	}
 
-	fps, err := portier.GetFingerprint(home, apiURL, []string{creds.DeviceID})
+	// during a rotation, the server keeps the previous fingerprint, it verifies both certificates
+	if rotation, err := ptls.LoadRotation(certPath); err != nil {
+		return err
+	} else if rotation != nil {
+		fp = rotation.PreviousFingerprint
+	}
+
+	client, err := portier.NewClientForHome(home, apiURL)
+	if err != nil {
+		return err
+	}
+	fps, err := client.GetFingerprints(context.Background(), []string{creds.DeviceID})
 	if err != nil {
 		return err
 	}
@@ -119,7 +147,7 @@ func ensureFingerprintUpToDate(cobraCmd *cobra.Command, home, apiURL, credential
 		return nil
 	}
 
-	if err := portier.UploadFingerprint(home, apiURL, creds.DeviceID, fp); err != nil {
+	if err := client.UploadFingerprint(context.Background(), creds.DeviceID, fp); err != nil {
 		return err
 	}
 	fmt.Fprintln(cobraCmd.OutOrStdout(), "Fingerprint uploaded")
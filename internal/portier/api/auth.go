@@ -0,0 +1,134 @@
+package portier
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"sync"
+)
+
+// DeviceCredentialsFile is the default name of the device credentials file in the home folder.
+const DeviceCredentialsFile = "credentials_device.yaml"
+
+// AuthKind is the kind of credentials a request is authenticated with.
+type AuthKind int
+
+const (
+	// AuthNone sends requests without credentials
+	AuthNone AuthKind = iota
+
+	// AuthBearer authenticates as the logged in user with an OAuth access token
+	AuthBearer
+
+	// AuthDeviceKey authenticates as a device with its API key
+	AuthDeviceKey
+)
+
+// Authenticator adds credentials to API requests.
+type Authenticator interface {
+	// Kind returns the kind of credentials
+	Kind() AuthKind
+
+	// Authorize sets the credentials on the request
+	Authorize(req *http.Request) error
+
+	// Refresh is called once after a 401 response. It returns true if the credentials were
+	// renewed and the request should be retried.
+	Refresh(ctx context.Context) (bool, error)
+}
+
+// NoAuth sends requests without credentials.
+type NoAuth struct{}
+
+func (NoAuth) Kind() AuthKind                        { return AuthNone }
+func (NoAuth) Authorize(*http.Request) error         { return nil }
+func (NoAuth) Refresh(context.Context) (bool, error) { return false, nil }
+
+// DeviceKeyAuth authenticates as a device with its API key.
+type DeviceKeyAuth struct {
+	APIKey string
+}
+
+func (a DeviceKeyAuth) Kind() AuthKind { return AuthDeviceKey }
+
+func (a DeviceKeyAuth) Authorize(req *http.Request) error {
+	req.Header.Set("Authorization", a.APIKey)
+	return nil
+}
+
+func (a DeviceKeyAuth) Refresh(context.Context) (bool, error) { return false, nil }
+
+// BearerAuth authenticates as the logged in user with the access token stored in home,
+// refreshing it when it expires. The token is loaded once and cached, loading it from an
+// encrypted secret store derives the store key, which takes a while.
+type BearerAuth struct {
+	home string
+
+	mu   sync.Mutex
+	auth *AuthResponse
+}
+
+func NewBearerAuth(home string) *BearerAuth {
+	return &BearerAuth{home: home}
+}
+
+func (a *BearerAuth) Kind() AuthKind { return AuthBearer }
+
+func (a *BearerAuth) Authorize(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.auth == nil || expiresSoon(*a.auth) {
+		auth, err := ValidAccessToken(a.home)
+		if err != nil {
+			return err
+		}
+		a.auth = &auth
+	}
+
+	req.Header.Set("Authorization", "Bearer "+a.auth.AccessToken)
+	return nil
+}
+
+func (a *BearerAuth) Refresh(context.Context) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stale := ""
+	if a.auth != nil {
+		stale = a.auth.AccessToken
+	}
+	auth, err := RefreshAccessToken(a.home, stale)
+	if err != nil {
+		return false, err
+	}
+	a.auth = &auth
+	return auth.AccessToken != stale, nil
+}
+
+// DefaultAuth authenticates as the logged in user if there is a valid access token in home,
+// and with the API key of the device credentials file in home otherwise.
+func DefaultAuth(home string) (Authenticator, error) {
+	auth, tokenErr := ValidAccessToken(home)
+	if tokenErr == nil && auth.AccessToken != "" {
+		return &BearerAuth{home: home, auth: &auth}, nil
+	}
+
+	apiKey, err := ReadDeviceAPIKey(filepath.Join(home, DeviceCredentialsFile))
+	if err != nil {
+		if tokenErr != nil {
+			return nil, tokenErr
+		}
+		return nil, err
+	}
+	return DeviceKeyAuth{APIKey: apiKey}, nil
+}
+
+// NewClientForHome creates a client for apiURL that authenticates with DefaultAuth(home).
+func NewClientForHome(home string, apiURL string) (*Client, error) {
+	auth, err := DefaultAuth(home)
+	if err != nil {
+		return nil, err
+	}
+	return NewDefaultClient(apiURL, auth), nil
+}
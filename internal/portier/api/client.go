@@ -0,0 +1,296 @@
+package portier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUnauthorized is returned for 401 and 403 responses
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrNotFound is returned for 404 responses
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is returned for 409 responses
+	ErrConflict = errors.New("conflict")
+)
+
+// APIError is returned for responses with a non-2xx status. It wraps ErrUnauthorized,
+// ErrNotFound or ErrConflict depending on the status code, use errors.Is to check.
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+	}
+	return fmt.Sprintf("%s %s: %s. Response: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+func (e *APIError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	}
+	return nil
+}
+
+// userAgent is sent with every request, see SetVersion.
+var userAgent = "portier-cli"
+
+// SetVersion sets the portier-cli version reported in the User-Agent header.
+func SetVersion(version string) {
+	userAgent = "portier-cli/" + version
+}
+
+type ClientOptions struct {
+	// BaseURL is the origin of the API, e.g. https://api.portier.dev. A trailing /api is removed.
+	BaseURL string
+
+	// Timeout bounds each attempt of a request
+	Timeout time.Duration
+
+	// MaxRetries is the number of retries after a 5xx or 429 response or a network error. Requests
+	// that are not idempotent are only retried after a 429 response, see Client.Do.
+	MaxRetries int
+
+	// InitialBackoff is the wait before the first retry, doubled for every further retry
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the wait between retries, including waits requested via Retry-After
+	MaxBackoff time.Duration
+
+	// HTTPClient performs the requests
+	HTTPClient *http.Client
+}
+
+func NewDefaultClientOptions(baseURL string) ClientOptions {
+	return ClientOptions{
+		BaseURL:        baseURL,
+		Timeout:        10 * time.Second,
+		MaxRetries:     3,
+		InitialBackoff: 250 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		HTTPClient:     &http.Client{},
+	}
+}
+
+// Client is the portier API client. It authenticates requests with the given Authenticator,
+// retries failed requests with exponential backoff and maps error responses to APIError.
+type Client struct {
+	options ClientOptions
+	auth    Authenticator
+}
+
+// NewClient creates a client with the given options. auth may be nil for unauthenticated requests.
+func NewClient(options ClientOptions, auth Authenticator) *Client {
+	options.BaseURL = strings.TrimSuffix(strings.TrimSuffix(options.BaseURL, "/"), "/api")
+	if options.HTTPClient == nil {
+		options.HTTPClient = &http.Client{}
+	}
+	if auth == nil {
+		auth = NoAuth{}
+	}
+	return &Client{
+		options: options,
+		auth:    auth,
+	}
+}
+
+// NewDefaultClient creates a client with default options for the given API URL.
+func NewDefaultClient(baseURL string, auth Authenticator) *Client {
+	return NewClient(NewDefaultClientOptions(baseURL), auth)
+}
+
+// AuthKind returns the kind of credentials the client authenticates with.
+func (c *Client) AuthKind() AuthKind {
+	return c.auth.Kind()
+}
+
+// route returns userPath for requests authenticated as a user and devicePath for requests
+// authenticated with a device API key. The API serves the latter below /spider.
+func (c *Client) route(userPath string, devicePath string) string {
+	if c.auth.Kind() == AuthDeviceKey {
+		return devicePath
+	}
+	return userPath
+}
+
+// Do sends a request to path, relative to the base URL. in is encoded as JSON request body
+// unless nil, the response body is decoded into out unless nil. GET, HEAD, PUT, DELETE and
+// OPTIONS requests are retried after network errors and 5xx responses. Errors authorizing the
+// request, e.g. an expired refresh token, are returned without retry. Other requests may have
+// been processed by the server before the failure, e.g. a POST creating a device, and are only
+// retried after a 429 response, which rejects the request; use DoIdempotent for POST requests
+// that are safe to repeat.
+func (c *Client) Do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	return c.do(ctx, method, path, in, out, idempotent(method))
+}
+
+// DoIdempotent is like Do, but retries the request after network errors and 5xx responses
+// regardless of its method. Use it for POST requests that only query data.
+func (c *Client) DoIdempotent(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	return c.do(ctx, method, path, in, out, true)
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, in interface{}, out interface{}, idempotent bool) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		payload, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	url := c.options.BaseURL + path
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		status, body, retryAfter, err := c.attempt(ctx, method, url, payload)
+		var requestErr *requestError
+		if errors.As(err, &requestErr) {
+			// the request was not sent, e.g. because the credentials could not be loaded
+			return requestErr.err
+		}
+
+		retry := status == http.StatusTooManyRequests || idempotent && (err != nil || status >= http.StatusInternalServerError)
+		if retry && attempt < c.options.MaxRetries && ctx.Err() == nil {
+			if err := sleep(ctx, c.backoff(attempt, retryAfter)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// an expired or revoked access token is refreshed once
+		if status == http.StatusUnauthorized && !refreshed {
+			refreshed = true
+			ok, err := c.auth.Refresh(ctx)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+		}
+
+		if status < http.StatusOK || status >= http.StatusMultipleChoices {
+			return &APIError{
+				Method:     method,
+				URL:        url,
+				StatusCode: status,
+				Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+				Body:       strings.TrimSpace(string(body)),
+			}
+		}
+
+		if out == nil || len(body) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(body, out); err != nil {
+			return fmt.Errorf("failed to decode response of %s %s: %w", method, url, err)
+		}
+		return nil
+	}
+}
+
+// requestError is returned by attempt if the request could not be built or authorized. It is
+// not retried, unlike the transport errors of a request that was sent.
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string { return e.err.Error() }
+
+// attempt performs a single request and returns status, body and the Retry-After delay.
+func (c *Client) attempt(ctx context.Context, method string, url string, payload []byte) (int, []byte, time.Duration, error) {
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return 0, nil, 0, &requestError{err: err}
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if err := c.auth.Authorize(req); err != nil {
+		return 0, nil, 0, &requestError{err: err}
+	}
+
+	resp, err := c.options.HTTPClient.Do(req)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	return resp.StatusCode, respBody, retryAfter, nil
+}
+
+func (c *Client) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	backoff := c.options.InitialBackoff << attempt
+	if retryAfter > backoff {
+		backoff = retryAfter
+	}
+	if c.options.MaxBackoff > 0 && backoff > c.options.MaxBackoff {
+		backoff = c.options.MaxBackoff
+	}
+	return backoff
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,208 @@
+package portier
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(url string, auth Authenticator) *Client {
+	options := NewDefaultClientOptions(url)
+	options.InitialBackoff = time.Millisecond
+	return NewClient(options, auth)
+}
+
+func TestClientRetriesServerErrors(t *testing.T) {
+	// GIVEN a server that fails twice
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Contains(t, r.Header.Get("User-Agent"), "portier-cli")
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			_, _ = w.Write([]byte(`{"GUID": "00000000-0000-0000-0000-000000000001"}`))
+		}
+	}))
+	defer server.Close()
+
+	// WHEN
+	guid, err := newTestClient(server.URL+"/api", DeviceKeyAuth{APIKey: "key"}).WhoAmI(context.Background())
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, "00000000-0000-0000-0000-000000000001", guid.String())
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestClientDoesNotRetryNonIdempotentRequests(t *testing.T) {
+	// GIVEN a server that fails after it created the device
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	client := newTestClient(server.URL, NoAuth{})
+
+	// WHEN
+	_, err := client.RegisterDevice(context.Background(), "dev")
+
+	// THEN the device is not registered twice
+	require.Error(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// WHEN a POST only queries data
+	_, err = client.GetFingerprints(context.Background(), nil)
+
+	// THEN it is retried
+	require.Error(t, err)
+	require.Equal(t, int32(1+1+client.options.MaxRetries), atomic.LoadInt32(&calls))
+}
+
+func TestClientRetriesRejectedNonIdempotentRequests(t *testing.T) {
+	// GIVEN a server that rejects the first request
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(`{"GUID": "00000000-0000-0000-0000-000000000001"}`))
+	}))
+	defer server.Close()
+
+	// WHEN
+	_, err := newTestClient(server.URL, NoAuth{}).RegisterDevice(context.Background(), "dev")
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestClientTypedErrors(t *testing.T) {
+	statuses := map[int]error{
+		http.StatusUnauthorized: ErrUnauthorized,
+		http.StatusForbidden:    ErrUnauthorized,
+		http.StatusNotFound:     ErrNotFound,
+		http.StatusConflict:     ErrConflict,
+	}
+	for status, expected := range statuses {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+
+		_, err := newTestClient(server.URL, DeviceKeyAuth{APIKey: "key"}).GetDeviceByName(context.Background(), "dev")
+
+		require.ErrorIs(t, err, expected, "status %d", status)
+		server.Close()
+	}
+}
+
+func TestClientRoutesByAuthKind(t *testing.T) {
+	paths := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path+" "+r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(`{"GUID": "00000000-0000-0000-0000-000000000001"}`))
+	}))
+	defer server.Close()
+
+	home := t.TempDir()
+	t.Setenv(secrets.PassphraseEnv, "test")
+	require.NoError(t, StoreAccessToken(home, AuthResponse{AccessToken: "token"}))
+
+	_, err := newTestClient(server.URL, DeviceKeyAuth{APIKey: "key"}).GetDeviceByName(context.Background(), "my dev")
+	require.NoError(t, err)
+	_, err = newTestClient(server.URL, NewBearerAuth(home)).GetDeviceByName(context.Background(), "my dev")
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		"/spider/deviceByName/my dev key",
+		"/api/deviceByName/my dev Bearer token",
+	}, paths)
+}
+
+func TestClientRefreshesTokenOnUnauthorized(t *testing.T) {
+	// GIVEN a stored token the API no longer accepts
+	home := t.TempDir()
+	t.Setenv(secrets.PassphraseEnv, "test")
+	issuer := withAuthServer(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"access_token": "fresh", "expires_in": 3600}`))
+	})
+	require.NoError(t, StoreAccessToken(home, AuthResponse{AccessToken: "revoked", RefreshToken: "refresh", Issuer: issuer}))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"GUID": "00000000-0000-0000-0000-000000000001"}`))
+	}))
+	defer server.Close()
+
+	// WHEN
+	guid, err := newTestClient(server.URL, NewBearerAuth(home)).GetDeviceByName(context.Background(), "dev")
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, "00000000-0000-0000-0000-000000000001", guid)
+}
+
+func TestClientDoesNotRetryAuthorizationErrors(t *testing.T) {
+	// GIVEN an expired access token whose refresh token the identity provider rejects
+	home := t.TempDir()
+	t.Setenv(secrets.PassphraseEnv, "test")
+	var refreshes int32
+	issuer := withAuthServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&refreshes, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": "invalid_grant", "error_description": "refresh token revoked"}`))
+	})
+	require.NoError(t, StoreAccessToken(home, AuthResponse{AccessToken: "expired", RefreshToken: "revoked", ExpiresAt: time.Now().Add(-time.Hour), Issuer: issuer}))
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer server.Close()
+
+	// WHEN
+	_, err := newTestClient(server.URL, NewBearerAuth(home)).GetDeviceByName(context.Background(), "dev")
+
+	// THEN the request is neither sent nor retried
+	require.ErrorContains(t, err, "refresh token revoked")
+	require.Equal(t, int32(0), atomic.LoadInt32(&calls))
+	require.Equal(t, int32(1), atomic.LoadInt32(&refreshes))
+}
+
+func TestBearerAuthCachesAccessToken(t *testing.T) {
+	// GIVEN a valid stored access token
+	home := t.TempDir()
+	t.Setenv(secrets.PassphraseEnv, "test")
+	require.NoError(t, StoreAccessToken(home, AuthResponse{AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour)}))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(`{"GUID": "00000000-0000-0000-0000-000000000001"}`))
+	}))
+	defer server.Close()
+	client := newTestClient(server.URL, NewBearerAuth(home))
+	_, err := client.GetDeviceByName(context.Background(), "dev")
+	require.NoError(t, err)
+
+	// WHEN the stored token is no longer readable
+	require.NoError(t, os.Remove(filepath.Join(home, AccessTokenFile)))
+	_, err = client.GetDeviceByName(context.Background(), "dev")
+
+	// THEN the cached token is used
+	require.NoError(t, err)
+}
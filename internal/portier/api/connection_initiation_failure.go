@@ -1,12 +1,9 @@
 package portier
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
-	"strings"
-	"time"
 )
 
 type ConnectionInitiationFailureRequest struct {
@@ -18,31 +15,11 @@ type ConnectionInitiationFailureRequest struct {
 	RemoteURL            string `json:"remoteURL"`
 }
 
-func ReportConnectionInitiationFailure(baseURL, apiKey string, request ConnectionInitiationFailureRequest) error {
-	baseURL = strings.TrimSuffix(baseURL, "/")
-	url := fmt.Sprintf("%s/spider/connection-initiation-failure", baseURL)
-
-	payload, err := json.Marshal(request)
-	if err != nil {
-		return err
-	}
-
-	httpRequest, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-	if err != nil {
-		return err
-	}
-	httpRequest.Header.Set("Authorization", apiKey)
-	httpRequest.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(httpRequest)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
-		return fmt.Errorf("connection initiation failure report failed: %s", resp.Status)
+// ReportConnectionInitiationFailure reports a failed inbound connection to the API, so that
+// the connecting device can show the reason. The client must authenticate with a device key.
+func (c *Client) ReportConnectionInitiationFailure(ctx context.Context, request ConnectionInitiationFailureRequest) error {
+	if err := c.Do(ctx, http.MethodPost, "/spider/connection-initiation-failure", request, nil); err != nil {
+		return fmt.Errorf("connection initiation failure report failed: %w", err)
 	}
 	return nil
 }
@@ -1,9 +1,11 @@
 package portier
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -17,7 +19,8 @@ func TestReportConnectionInitiationFailure(t *testing.T) {
 	}))
 	defer server.Close()
 
-	err := ReportConnectionInitiationFailure(server.URL, "my-api-key", ConnectionInitiationFailureRequest{
+	client := NewDefaultClient(server.URL, DeviceKeyAuth{APIKey: "my-api-key"})
+	err := client.ReportConnectionInitiationFailure(context.Background(), ConnectionInitiationFailureRequest{
 		ConnectingDeviceGUID: "00000000-0000-0000-0000-000000000000",
 		ConnectionID:         "cid-1",
 		ErrorCode:            "TARGET_INITIATION_ERROR",
@@ -34,7 +37,10 @@ func TestReportConnectionInitiationFailureReturnsErrorOnHTTPFailure(t *testing.T
 	}))
 	defer server.Close()
 
-	err := ReportConnectionInitiationFailure(server.URL, "my-api-key", ConnectionInitiationFailureRequest{
+	options := NewDefaultClientOptions(server.URL)
+	options.InitialBackoff = time.Millisecond
+	client := NewClient(options, DeviceKeyAuth{APIKey: "my-api-key"})
+	err := client.ReportConnectionInitiationFailure(context.Background(), ConnectionInitiationFailureRequest{
 		ConnectingDeviceGUID: "00000000-0000-0000-0000-000000000000",
 		ConnectionID:         "cid-1",
 		ErrorCode:            "TARGET_INITIATION_ERROR",
@@ -0,0 +1,115 @@
+package portier
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
+	"gopkg.in/yaml.v2"
+)
+
+// MigrateCredentials moves the secrets of all credentials*.yaml files in home into the
+// secret store of the given backend. Plaintext secrets are removed from the files and
+// secrets held by another backend are deleted there once copied. It returns one line
+// per credentials file describing what was done.
+func MigrateCredentials(home string, backend string) ([]string, error) {
+	target, err := secrets.Open(home, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(home, "credentials*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	report := []string{}
+	for _, file := range files {
+		var line string
+		if filepath.Base(file) == AccessTokenFile {
+			line, err = migrateAccessToken(home, target)
+		} else {
+			line, err = migrateDeviceCredentials(file, target)
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to migrate %s: %w", file, err)
+		}
+		report = append(report, line)
+	}
+
+	return report, nil
+}
+
+func migrateDeviceCredentials(file string, target secrets.Store) (string, error) {
+	fileContent, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	fc := DeviceCredentials{}
+	if err := yaml.Unmarshal(fileContent, &fc); err != nil {
+		return "", err
+	}
+
+	if fc.APIKey == "" && fc.SecretStore == target.Backend() {
+		return fmt.Sprintf("%s: already in %s secret store", file, target.Backend()), os.Chmod(file, 0o600)
+	}
+
+	apiKey, err := ReadDeviceAPIKey(file)
+	if err != nil {
+		return "", err
+	}
+	if err := storeDeviceCredentials(target, apiKey, filepath.Dir(file), filepath.Base(file)); err != nil {
+		return "", err
+	}
+	if err := deleteFromPreviousStore(filepath.Dir(file), fc.SecretStore, target, filepath.Base(file)); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s: API key moved to %s secret store", file, target.Backend()), nil
+}
+
+func migrateAccessToken(home string, target secrets.Store) (string, error) {
+	file := filepath.Join(home, AccessTokenFile)
+	fileContent, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	credentials := map[string]string{}
+	if err := yaml.Unmarshal(fileContent, &credentials); err != nil {
+		return "", err
+	}
+
+	if credentials["access_token"] == "" && credentials["secret_store"] == target.Backend() {
+		return fmt.Sprintf("%s: already in %s secret store", file, target.Backend()), os.Chmod(file, 0o600)
+	}
+
+	auth, err := LoadAccessToken(home)
+	if err != nil {
+		return "", err
+	}
+	storedAt, err := time.Parse(time.RFC3339, credentials["stored_at"])
+	if err != nil {
+		storedAt = time.Now()
+	}
+	if err := storeAccessToken(target, home, auth, storedAt); err != nil {
+		return "", err
+	}
+	if err := deleteFromPreviousStore(home, credentials["secret_store"], target, AccessTokenFile); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s: tokens moved to %s secret store", file, target.Backend()), nil
+}
+
+func deleteFromPreviousStore(home string, previous string, target secrets.Store, filename string) error {
+	if previous == "" || previous == target.Backend() {
+		return nil
+	}
+	store, err := secrets.Open(home, previous)
+	if err != nil {
+		return err
+	}
+	return store.Delete(secretName(filename))
+}
@@ -0,0 +1,68 @@
+package portier
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreDeviceCredentialsUsesSecretStore(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	t.Setenv(secrets.PassphraseEnv, "test")
+
+	// WHEN
+	require.NoError(t, StoreDeviceCredentials("api-key", home, "credentials_device.yaml"))
+
+	// THEN
+	file := filepath.Join(home, "credentials_device.yaml")
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "api-key")
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	apiKey, err := ReadDeviceAPIKey(file)
+	require.NoError(t, err)
+	require.Equal(t, "api-key", apiKey)
+}
+
+func TestMigrateCredentialsMovesPlaintextSecrets(t *testing.T) {
+	// GIVEN legacy plaintext credentials
+	home := t.TempDir()
+	t.Setenv(secrets.PassphraseEnv, "test")
+	deviceFile := filepath.Join(home, "credentials_device.yaml")
+	tokenFile := filepath.Join(home, AccessTokenFile)
+	require.NoError(t, os.WriteFile(deviceFile, []byte("APIKey: api-key\n"), 0o644))
+	require.NoError(t, os.WriteFile(tokenFile, []byte("access_token: access\nrefresh_token: refresh\nstored_at: \"2024-01-01T00:00:00Z\"\n"), 0o644))
+
+	// WHEN
+	report, err := MigrateCredentials(home, secrets.BackendFile)
+
+	// THEN
+	require.NoError(t, err)
+	require.Len(t, report, 2)
+
+	for _, file := range []string{deviceFile, tokenFile} {
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "api-key")
+		require.NotContains(t, string(data), "access")
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	}
+
+	apiKey, err := ReadDeviceAPIKey(deviceFile)
+	require.NoError(t, err)
+	require.Equal(t, "api-key", apiKey)
+
+	auth, err := LoadAccessToken(home)
+	require.NoError(t, err)
+	require.Equal(t, "access", auth.AccessToken)
+	require.Equal(t, "refresh", auth.RefreshToken)
+}
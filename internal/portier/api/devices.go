@@ -0,0 +1,57 @@
+package portier
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// OnlineThreshold is how recently a device must have been seen by the relay to count as online.
+const OnlineThreshold = 2 * time.Minute
+
+type DeviceUpdateRequest struct {
+	// The new display name of the device
+	Name string
+}
+
+// IsOnline returns true if the device has been seen by the relay within OnlineThreshold.
+func (d Device) IsOnline(now time.Time) bool {
+	return !d.LastSeen.IsZero() && now.Sub(d.LastSeen) < OnlineThreshold
+}
+
+// ListDevices returns all devices of the logged in user, including devices shared with the user.
+func (c *Client) ListDevices(ctx context.Context) ([]Device, error) {
+	devices := []Device{}
+	if err := c.Do(ctx, http.MethodGet, "/api/device", nil, &devices); err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	return devices, nil
+}
+
+// GetDevice returns the device with the given GUID.
+func (c *Client) GetDevice(ctx context.Context, deviceGUID string) (Device, error) {
+	var device Device
+	if err := c.Do(ctx, http.MethodGet, "/api/device/"+url.PathEscape(deviceGUID), nil, &device); err != nil {
+		return Device{}, fmt.Errorf("failed to get device: %w", err)
+	}
+	return device, nil
+}
+
+// RenameDevice changes the display name of a device.
+func (c *Client) RenameDevice(ctx context.Context, deviceGUID string, name string) (Device, error) {
+	var device Device
+	if err := c.Do(ctx, http.MethodPatch, "/api/device/"+url.PathEscape(deviceGUID), DeviceUpdateRequest{Name: name}, &device); err != nil {
+		return Device{}, fmt.Errorf("failed to rename device: %w", err)
+	}
+	return device, nil
+}
+
+// DeleteDevice deletes a device together with its API keys.
+func (c *Client) DeleteDevice(ctx context.Context, deviceGUID string) error {
+	if err := c.Do(ctx, http.MethodDelete, "/api/device/"+url.PathEscape(deviceGUID), nil, nil); err != nil {
+		return fmt.Errorf("failed to delete device: %w", err)
+	}
+	return nil
+}
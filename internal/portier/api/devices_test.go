@@ -0,0 +1,66 @@
+package portier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceManagement(t *testing.T) {
+	// GIVEN a server with one device
+	const guid = "00000000-0000-0000-0000-000000000001"
+	device := Device{GUID: guid, Name: "workplace", SharedWith: []string{"alice@example.com"}}
+	deleted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/device":
+			_ = json.NewEncoder(w).Encode([]Device{device})
+		case r.Method == http.MethodGet && r.URL.Path == "/api/device/"+guid:
+			_ = json.NewEncoder(w).Encode(device)
+		case r.Method == http.MethodPatch && r.URL.Path == "/api/device/"+guid:
+			update := DeviceUpdateRequest{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&update))
+			device.Name = update.Name
+			_ = json.NewEncoder(w).Encode(device)
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/device/"+guid:
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client := newTestClient(server.URL, NoAuth{})
+	ctx := context.Background()
+
+	// WHEN listing, renaming and deleting the device
+	devices, err := client.ListDevices(ctx)
+	require.NoError(t, err)
+	renamed, err := client.RenameDevice(ctx, guid, "office")
+	require.NoError(t, err)
+	fetched, err := client.GetDevice(ctx, guid)
+	require.NoError(t, err)
+	require.NoError(t, client.DeleteDevice(ctx, guid))
+	_, missingErr := client.GetDevice(ctx, "00000000-0000-0000-0000-000000000002")
+
+	// THEN
+	require.Len(t, devices, 1)
+	require.Equal(t, []string{"alice@example.com"}, devices[0].SharedWith)
+	require.Equal(t, "office", renamed.Name)
+	require.Equal(t, "office", fetched.Name)
+	require.True(t, deleted)
+	require.ErrorIs(t, missingErr, ErrNotFound)
+}
+
+func TestDeviceIsOnline(t *testing.T) {
+	now := time.Now()
+
+	require.False(t, Device{}.IsOnline(now))
+	require.True(t, Device{LastSeen: now.Add(-time.Minute)}.IsOnline(now))
+	require.False(t, Device{LastSeen: now.Add(-OnlineThreshold)}.IsOnline(now))
+}
@@ -0,0 +1,108 @@
+package portier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints are the service endpoints of a portier deployment. All commands derive the
+// URLs they talk to from these, so that a self-hosted or staging deployment only needs
+// to be configured once.
+type Endpoints struct {
+	// APIURL is the base URL of the REST API, including the /api suffix
+	APIURL string
+
+	// RelayURL is the websocket URL of the relay
+	RelayURL string
+
+	// AuthIssuer is the OIDC issuer used for login. Its endpoints are found via OIDC discovery.
+	AuthIssuer string
+
+	// AuthClientID is the OAuth client id of portier-cli at the issuer
+	AuthClientID string
+
+	// AuthAudience is the audience requested for API access tokens
+	AuthAudience string
+}
+
+// DefaultEndpoints are the endpoints of portier.dev.
+var DefaultEndpoints = Endpoints{
+	APIURL:       "https://api.portier.dev/api",
+	RelayURL:     "wss://api.portier.dev/spider",
+	AuthIssuer:   "https://auth.portier.dev",
+	AuthClientID: "jE4nxZ6miTLOS4OWGLzoyVlOnkxAiHqb",
+	AuthAudience: "https://api.portier.dev",
+}
+
+// APIBaseURL returns the API URL without the /api suffix, as used by the spider endpoints.
+func (e Endpoints) APIBaseURL() string {
+	return strings.TrimSuffix(strings.TrimSuffix(e.APIURL, "/"), "/api")
+}
+
+// authEndpoints are the OAuth endpoints of an issuer.
+type authEndpoints struct {
+	DeviceAuthorization string `json:"device_authorization_endpoint"`
+	Token               string `json:"token_endpoint"`
+	Revocation          string `json:"revocation_endpoint"`
+}
+
+// discovered caches the discovered endpoints per issuer.
+var discovered sync.Map
+
+// discoverAuthEndpoints reads the issuer's OIDC discovery document. Endpoints that are
+// missing in the document, or all of them if discovery fails, default to the paths used
+// by portier.dev's identity provider.
+func discoverAuthEndpoints(issuer string) authEndpoints {
+	issuer = strings.TrimSuffix(issuer, "/")
+	if cached, ok := discovered.Load(issuer); ok {
+		return cached.(authEndpoints)
+	}
+
+	result, err := fetchDiscoveryDocument(issuer)
+	if err != nil {
+		// not cached, discovery is retried on the next call
+		result = authEndpoints{}
+	}
+	if result.DeviceAuthorization == "" {
+		result.DeviceAuthorization = issuer + "/oauth/device/code"
+	}
+	if result.Token == "" {
+		result.Token = issuer + "/oauth/token"
+	}
+	if result.Revocation == "" {
+		result.Revocation = issuer + "/oauth/revoke"
+	}
+	if err == nil {
+		discovered.Store(issuer, result)
+	}
+	return result
+}
+
+func fetchDiscoveryDocument(issuer string) (authEndpoints, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return authEndpoints{}, err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return authEndpoints{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return authEndpoints{}, fmt.Errorf("OIDC discovery failed: %s", resp.Status)
+	}
+
+	result := authEndpoints{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return authEndpoints{}, err
+	}
+	return result, nil
+}
@@ -9,32 +9,31 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/mdp/qrterminal/v3"
 	"github.com/mh-dx/portier-cli/internal/utils"
-	"gopkg.in/yaml.v3"
 )
 
-// Login uses device flow to log the user in. It uses a file to store the user's jwt token in ~/.portier/credentials.json
+// Login uses device flow to log the user in. The user's tokens are kept in the secret store, referenced by ~/.portier/credentials.yaml
 // Device flow is a way to authenticate users on devices that do not have a browser.
 // See https://tools.ietf.org/html/rfc8628
-func Login() error {
+func Login(endpoints Endpoints) error {
 	home, err := utils.Home()
 	if err != nil {
 		return err
 	}
 
 	// define the endpoint
-	deviceURL := "https://auth.portier.dev/oauth/device/code"
+	authEndpoints := discoverAuthEndpoints(endpoints.AuthIssuer)
+	deviceURL := authEndpoints.DeviceAuthorization
 
 	// define the data
 	data := url.Values{}
-	data.Set("client_id", "jE4nxZ6miTLOS4OWGLzoyVlOnkxAiHqb")
+	data.Set("client_id", endpoints.AuthClientID)
 	data.Set("scope", "openid email profile offline_access")
-	data.Set("audience", "https://api.portier.dev")
+	data.Set("audience", endpoints.AuthAudience)
 
 	// create the request
 	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, deviceURL, strings.NewReader(data.Encode()))
@@ -104,12 +103,12 @@ Alternatively, open ` + verificationURL + ` in your browser and enter the code `
 	// poll the token endpoint until the user has logged in
 	for {
 		// define the endpoint
-		tokenURL := "https://auth.portier.dev/oauth/token"
+		tokenURL := authEndpoints.Token
 
 		// define the data
 		data := url.Values{}
 		data.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
-		data.Set("client_id", "jE4nxZ6miTLOS4OWGLzoyVlOnkxAiHqb")
+		data.Set("client_id", endpoints.AuthClientID)
 		data.Set("device_code", deviceCode)
 
 		// create the request
@@ -155,31 +154,19 @@ Alternatively, open ` + verificationURL + ` in your browser and enter the code `
 		}
 
 		// extract the access token and refresh token
-		log.Printf("Log in successful, storing access token in ~/.portier/credentials.yaml")
-		accessToken, ok := result["access_token"].(string)
-		if !ok {
-			return fmt.Errorf("access_token not found in response")
+		log.Printf("Log in successful, storing access token in the secret store")
+		auth, err := authResponseFromTokenResult(result)
+		if err != nil {
+			return err
 		}
-		refreshToken, ok := result["refresh_token"].(string)
-		if !ok {
+		if auth.RefreshToken == "" {
 			return fmt.Errorf("refresh_token not found in response")
 		}
+		auth.Issuer = endpoints.AuthIssuer
+		auth.ClientID = endpoints.AuthClientID
 
-		// store the access token in the credentials file
-		credentials := map[string]string{
-			"stored_at":     time.Now().Format(time.RFC3339),
-			"access_token":  accessToken,
-			"refresh_token": refreshToken,
-		}
-
-		yamlCredentials, err := yaml.Marshal(credentials)
-		if err != nil {
-			return err
-		}
-		// write the yaml to the file
-		credentialsFile := filepath.Join(home, "credentials.yaml")
-		err = os.WriteFile(credentialsFile, yamlCredentials, 0o644)
-		if err != nil {
+		// store the tokens in the secret store, credentials.yaml only references it
+		if err := StoreAccessToken(home, auth); err != nil {
 			return err
 		}
 
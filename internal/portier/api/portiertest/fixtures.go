@@ -0,0 +1,70 @@
+package portiertest
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Fixtures is the initial state of a Server. They can be loaded from a YAML file, see LoadFixtures.
+type Fixtures struct {
+	// Users are the accounts known to the server
+	Users []UserFixture `yaml:"users"`
+}
+
+// UserFixture is an account together with the devices it owns.
+type UserFixture struct {
+	// Email identifies the user
+	Email string `yaml:"email"`
+
+	// AccessToken, if set, is accepted as bearer token for this user without logging in
+	AccessToken string `yaml:"accessToken,omitempty"`
+
+	// Devices are the devices owned by the user
+	Devices []DeviceFixture `yaml:"devices,omitempty"`
+}
+
+// DeviceFixture is a registered device.
+type DeviceFixture struct {
+	// GUID is the device ID, generated if empty
+	GUID string `yaml:"guid,omitempty"`
+
+	// Name is the display name of the device
+	Name string `yaml:"name"`
+
+	// APIKey, if set, authenticates the device
+	APIKey string `yaml:"apiKey,omitempty"`
+
+	// Fingerprint is the uploaded TLS certificate fingerprint
+	Fingerprint string `yaml:"fingerprint,omitempty"`
+
+	// SharedWith are the emails of the users the device is shared with
+	SharedWith []string `yaml:"sharedWith,omitempty"`
+}
+
+// DefaultUser is the user that is logged in by the OAuth device flow if no user is selected.
+const DefaultUser = "dev@portier.test"
+
+// DefaultFixtures contains a single user without devices.
+func DefaultFixtures() Fixtures {
+	return Fixtures{
+		Users: []UserFixture{{Email: DefaultUser}},
+	}
+}
+
+// LoadFixtures reads fixtures from a YAML file.
+func LoadFixtures(path string) (Fixtures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Fixtures{}, err
+	}
+	fixtures := Fixtures{}
+	if err := yaml.Unmarshal(data, &fixtures); err != nil {
+		return Fixtures{}, fmt.Errorf("failed to parse fixtures %s: %w", path, err)
+	}
+	if len(fixtures.Users) == 0 {
+		return Fixtures{}, fmt.Errorf("fixtures %s contain no users", path)
+	}
+	return fixtures, nil
+}
@@ -0,0 +1,172 @@
+package portiertest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// deviceCodeLifetime is how long a device flow login can be completed.
+const deviceCodeLifetime = 10 * time.Minute
+
+// deviceCode is a pending login of the OAuth device flow.
+type deviceCode struct {
+	userCode  string
+	expiresAt time.Time
+
+	// email is set once the login is approved
+	email string
+}
+
+// origin returns the scheme and host the request was sent to.
+func origin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	base := origin(r)
+	writeJSON(w, map[string]string{
+		"issuer":                        base,
+		"device_authorization_endpoint": base + "/oauth/device/code",
+		"token_endpoint":                base + "/oauth/token",
+		"revocation_endpoint":           base + "/oauth/revoke",
+	})
+}
+
+func (s *Server) handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	code := &deviceCode{
+		userCode:  strings.ToUpper(randomToken(2) + "-" + randomToken(2)),
+		expiresAt: time.Now().Add(deviceCodeLifetime),
+	}
+	if s.options.AutoApprove {
+		code.email = s.options.LoginUser
+	}
+	deviceCodeValue := randomToken(16)
+
+	s.mu.Lock()
+	s.deviceCodes[deviceCodeValue] = code
+	s.mu.Unlock()
+
+	verificationURL := origin(r) + "/activate"
+	writeJSON(w, map[string]interface{}{
+		"device_code":               deviceCodeValue,
+		"user_code":                 code.userCode,
+		"verification_uri":          verificationURL,
+		"verification_uri_complete": verificationURL + "?user_code=" + url.QueryEscape(code.userCode),
+		"expires_in":                int(deviceCodeLifetime.Seconds()),
+		"interval":                  s.options.PollingInterval,
+	})
+}
+
+// handleActivate approves the login with the user_code parameter, as the user would in the browser.
+// The optional email parameter selects the user that logs in.
+func (s *Server) handleActivate(w http.ResponseWriter, r *http.Request) {
+	userCode := r.URL.Query().Get("user_code")
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		email = s.options.LoginUser
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.users[email] {
+		http.Error(w, "unknown user "+email, http.StatusNotFound)
+		return
+	}
+	for _, code := range s.deviceCodes {
+		if code.userCode == userCode && time.Now().Before(code.expiresAt) {
+			code.email = email
+			fmt.Fprintf(w, "Logged in as %s, return to portier-cli.\n", email)
+			return
+		}
+	}
+	http.Error(w, "unknown or expired code", http.StatusNotFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		oauthError(w, "invalid_request", "expected a form POST")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.PostForm.Get("grant_type") {
+	case "urn:ietf:params:oauth:grant-type:device_code":
+		deviceCodeValue := r.PostForm.Get("device_code")
+		code, ok := s.deviceCodes[deviceCodeValue]
+		switch {
+		case !ok:
+			oauthError(w, "invalid_grant", "unknown device code")
+		case time.Now().After(code.expiresAt):
+			delete(s.deviceCodes, deviceCodeValue)
+			oauthError(w, "expired_token", "the device code expired")
+		case code.email == "":
+			oauthError(w, "authorization_pending", "waiting for the user to log in")
+		default:
+			delete(s.deviceCodes, deviceCodeValue)
+			refreshToken := randomToken(24)
+			s.refreshTokens[refreshToken] = code.email
+			s.writeTokens(w, code.email, refreshToken)
+		}
+	case "refresh_token":
+		refreshToken := r.PostForm.Get("refresh_token")
+		email, ok := s.refreshTokens[refreshToken]
+		if !ok {
+			oauthError(w, "invalid_grant", "unknown or revoked refresh token")
+			return
+		}
+		s.writeTokens(w, email, refreshToken)
+	default:
+		oauthError(w, "unsupported_grant_type", "unsupported grant type "+r.PostForm.Get("grant_type"))
+	}
+}
+
+// writeTokens issues an access token for email. s.mu must be held.
+func (s *Server) writeTokens(w http.ResponseWriter, email string, refreshToken string) {
+	token := randomToken(24)
+	s.accessTokens[token] = accessToken{
+		email:     email,
+		expiresAt: time.Now().Add(s.options.AccessTokenLifetime),
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token":  token,
+		"refresh_token": refreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(s.options.AccessTokenLifetime.Seconds()),
+	})
+}
+
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		oauthError(w, "invalid_request", "expected a form POST")
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	s.mu.Lock()
+	delete(s.refreshTokens, token)
+	delete(s.accessTokens, token)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func oauthError(w http.ResponseWriter, code string, description string) {
+	writeJSONStatus(w, http.StatusBadRequest, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
@@ -0,0 +1,155 @@
+package portiertest
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/batch"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+	Subprotocols: []string{batch.Subprotocol},
+}
+
+// relay routes messages between the devices connected to /spider. Messages to devices that
+// are offline, or neither accessible by the sender nor sharing access with it, are dropped.
+type relay struct {
+	server  *Server
+	encoder encoder.EncoderDecoder
+
+	mu    sync.Mutex
+	conns map[string]*relayConn
+}
+
+type relayConn struct {
+	ws *websocket.Conn
+
+	// batching is true if the device negotiated batches, messages are then written as batches of one
+	batching bool
+
+	// writeMu serializes writes, gorilla connections support one concurrent writer
+	writeMu sync.Mutex
+}
+
+func newRelay(server *Server) *relay {
+	return &relay{
+		server:  server,
+		encoder: encoder.NewEncoderDecoder(),
+		conns:   make(map[string]*relayConn),
+	}
+}
+
+func (r *relay) serve(w http.ResponseWriter, req *http.Request) {
+	r.server.mu.Lock()
+	c, ok := r.server.deviceForKey(req.Header.Get("Authorization"))
+	r.server.mu.Unlock()
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	conn := &relayConn{ws: ws, batching: ws.Subprotocol() == batch.Subprotocol}
+
+	// a device reconnecting replaces its previous connection
+	r.mu.Lock()
+	if previous, ok := r.conns[c.deviceGUID]; ok {
+		_ = previous.ws.Close()
+	}
+	r.conns[c.deviceGUID] = conn
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		if r.conns[c.deviceGUID] == conn {
+			delete(r.conns, c.deviceGUID)
+		}
+		r.mu.Unlock()
+		_ = ws.Close()
+	}()
+
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if !conn.batching {
+			r.route(c, messageType, data)
+			continue
+		}
+		payloads, err := batch.Split(data)
+		if err != nil {
+			log.Printf("relay: dropping malformed batch from %s: %v", c.deviceGUID, err)
+		}
+		for _, payload := range payloads {
+			r.route(c, messageType, payload)
+		}
+	}
+}
+
+// route forwards a message from the device c to the recipient in its header.
+func (r *relay) route(c caller, messageType int, data []byte) {
+	msg, err := r.encoder.Decode(data)
+	if err != nil {
+		log.Printf("relay: dropping undecodable message from %s: %v", c.deviceGUID, err)
+		return
+	}
+	if msg.Header.From.String() != c.deviceGUID {
+		log.Printf("relay: dropping message from %s with sender %s", c.deviceGUID, msg.Header.From)
+		return
+	}
+	to := msg.Header.To.String()
+
+	r.server.mu.Lock()
+	sender, senderOk := r.server.devices[c.deviceGUID]
+	recipient, recipientOk := r.server.devices[to]
+	// replies to a device that shares a device with the recipient's owner are allowed, too
+	allowed := senderOk && recipientOk && (accessible(c.email, recipient) || accessible(recipient.User, sender))
+	if senderOk {
+		sender.LastSeen = time.Now()
+	}
+	r.server.mu.Unlock()
+	if !allowed {
+		return
+	}
+
+	r.mu.Lock()
+	target, online := r.conns[to]
+	r.mu.Unlock()
+	if !online {
+		return
+	}
+
+	if target.batching {
+		data = batch.Append(nil, data)
+	}
+	target.writeMu.Lock()
+	defer target.writeMu.Unlock()
+	_ = target.ws.WriteMessage(messageType, data)
+}
+
+func (r *relay) connected(deviceGUID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.conns[deviceGUID]
+	return ok
+}
+
+func (r *relay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for guid, conn := range r.conns {
+		_ = conn.ws.Close()
+		delete(r.conns, guid)
+	}
+}
@@ -0,0 +1,523 @@
+// Package portiertest implements an in-memory emulator of the portier API, the OAuth device
+// flow of its identity provider and the relay. It lets commands and tests run against a local
+// deployment without network access, see Server.
+package portiertest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	portier "github.com/mh-dx/portier-cli/internal/portier/api"
+)
+
+type Options struct {
+	// Fixtures is the initial state of the server
+	Fixtures Fixtures
+
+	// LoginUser is the user logged in by the OAuth device flow, unless the verification
+	// URL is opened with an explicit email parameter
+	LoginUser string
+
+	// AutoApprove approves device flow logins without opening the verification URL
+	AutoApprove bool
+
+	// PollingInterval is the polling interval of the device flow, in seconds
+	PollingInterval int
+
+	// AccessTokenLifetime is the lifetime of issued access tokens
+	AccessTokenLifetime time.Duration
+}
+
+func NewDefaultOptions() Options {
+	return Options{
+		Fixtures:            DefaultFixtures(),
+		LoginUser:           DefaultUser,
+		AutoApprove:         true,
+		PollingInterval:     1,
+		AccessTokenLifetime: time.Hour,
+	}
+}
+
+// Server emulates api.portier.dev in memory. It is an http.Handler serving
+//
+//   - the REST API below /api and /spider, authenticated with access tokens or device API keys,
+//   - the OAuth device flow with OIDC discovery at the server's origin, so that it can be used as issuer,
+//   - the relay websocket at /spider, routing messages between connected devices.
+//
+// Point the API URL at <origin>/api or the portier URL at ws://<host>/spider to use it.
+type Server struct {
+	options Options
+
+	mu            sync.Mutex
+	users         map[string]bool
+	devices       map[string]*portier.Device
+	fingerprints  map[string]string
+	apiKeys       map[string]string
+	accessTokens  map[string]accessToken
+	refreshTokens map[string]string
+	deviceCodes   map[string]*deviceCode
+	failures      []portier.ConnectionInitiationFailureRequest
+
+	relay *relay
+}
+
+type accessToken struct {
+	email     string
+	expiresAt time.Time
+}
+
+// caller is the authenticated identity of a request.
+type caller struct {
+	// email is the user, or the owner of the device for API key authentication
+	email string
+
+	// deviceGUID is set for API key authentication
+	deviceGUID string
+}
+
+// NewServer creates a server with the state of options.Fixtures.
+func NewServer(options Options) (*Server, error) {
+	s := &Server{
+		options:       options,
+		users:         make(map[string]bool),
+		devices:       make(map[string]*portier.Device),
+		fingerprints:  make(map[string]string),
+		apiKeys:       make(map[string]string),
+		accessTokens:  make(map[string]accessToken),
+		refreshTokens: make(map[string]string),
+		deviceCodes:   make(map[string]*deviceCode),
+	}
+	s.relay = newRelay(s)
+
+	for _, user := range options.Fixtures.Users {
+		if user.Email == "" {
+			return nil, fmt.Errorf("fixture user without email")
+		}
+		s.users[user.Email] = true
+		if user.AccessToken != "" {
+			s.accessTokens[user.AccessToken] = accessToken{email: user.Email}
+		}
+		for _, fixture := range user.Devices {
+			guid := fixture.GUID
+			if guid == "" {
+				guid = uuid.NewString()
+			}
+			if _, err := uuid.Parse(guid); err != nil {
+				return nil, fmt.Errorf("fixture device %s: invalid guid %s", fixture.Name, guid)
+			}
+			if _, ok := s.devices[guid]; ok {
+				return nil, fmt.Errorf("duplicate fixture device %s", guid)
+			}
+			s.devices[guid] = &portier.Device{
+				GUID:       guid,
+				Name:       fixture.Name,
+				User:       user.Email,
+				SharedWith: fixture.SharedWith,
+			}
+			if fixture.APIKey != "" {
+				s.apiKeys[fixture.APIKey] = guid
+			}
+			if fixture.Fingerprint != "" {
+				s.fingerprints[guid] = fixture.Fingerprint
+			}
+		}
+	}
+	if options.LoginUser != "" && !s.users[options.LoginUser] {
+		s.users[options.LoginUser] = true
+	}
+	return s, nil
+}
+
+// Close disconnects all devices from the relay.
+func (s *Server) Close() {
+	s.relay.close()
+}
+
+// Devices returns a copy of all registered devices.
+func (s *Server) Devices() []portier.Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devices := make([]portier.Device, 0, len(s.devices))
+	for _, device := range s.devices {
+		devices = append(devices, *device)
+	}
+	return devices
+}
+
+// Connected returns true if the device with the given GUID is connected to the relay.
+func (s *Server) Connected(deviceGUID string) bool {
+	return s.relay.connected(deviceGUID)
+}
+
+// InitiationFailures returns the connection initiation failures reported so far.
+func (s *Server) InitiationFailures() []portier.ConnectionInitiationFailureRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]portier.ConnectionInitiationFailureRequest(nil), s.failures...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case path == "/.well-known/openid-configuration":
+		s.handleDiscovery(w, r)
+	case path == "/oauth/device/code":
+		s.handleDeviceCode(w, r)
+	case path == "/oauth/token":
+		s.handleToken(w, r)
+	case path == "/oauth/revoke":
+		s.handleRevoke(w, r)
+	case path == "/activate":
+		s.handleActivate(w, r)
+	case path == "/spider":
+		s.relay.serve(w, r)
+	default:
+		s.serveAPI(w, r)
+	}
+}
+
+// serveAPI handles the authenticated REST endpoints.
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// device API keys are only accepted below /spider, access tokens only below /api
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/spider/"):
+		if c.deviceGUID == "" {
+			http.Error(w, "requires a device API key", http.StatusForbidden)
+			return
+		}
+		path = strings.TrimPrefix(path, "/spider")
+	case strings.HasPrefix(path, "/api/"):
+		if c.deviceGUID != "" {
+			http.Error(w, "requires an access token", http.StatusForbidden)
+			return
+		}
+		path = strings.TrimPrefix(path, "/api")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "/whoami" && r.Method == http.MethodGet && c.deviceGUID != "":
+		writeJSON(w, portier.DeviceByNameResponse{GUID: c.deviceGUID})
+	case segments[0] == "deviceByName" && len(segments) == 2 && r.Method == http.MethodGet:
+		s.handleDeviceByName(w, c, segments[1])
+	case path == "/fingerprints" && r.Method == http.MethodPost:
+		s.handleFingerprints(w, r, c)
+	case path == "/fingerprintupsert" && r.Method == http.MethodPost:
+		s.handleFingerprintUpsert(w, r, c)
+	case path == "/connection-initiation-failure" && r.Method == http.MethodPost && c.deviceGUID != "":
+		s.handleInitiationFailure(w, r)
+	case path == "/device" && c.deviceGUID == "":
+		switch r.Method {
+		case http.MethodGet:
+			s.handleListDevices(w, c)
+		case http.MethodPost:
+			s.handleRegister(w, r, c)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	case segments[0] == "device" && len(segments) == 2 && c.deviceGUID == "":
+		s.handleDevice(w, r, c, segments[1])
+	case segments[0] == "device" && len(segments) == 3 && segments[2] == "apikey" && r.Method == http.MethodPost && c.deviceGUID == "":
+		s.handleGenerateAPIKey(w, r, c, segments[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authenticate resolves the bearer token or device API key of the request.
+func (s *Server) authenticate(r *http.Request) (caller, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return caller{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strings.HasPrefix(header, "Bearer ") {
+		access, ok := s.accessTokens[strings.TrimPrefix(header, "Bearer ")]
+		if !ok || (!access.expiresAt.IsZero() && time.Now().After(access.expiresAt)) {
+			return caller{}, false
+		}
+		return caller{email: access.email}, true
+	}
+
+	return s.deviceForKey(header)
+}
+
+// deviceForKey returns the caller for a device API key and marks the device as seen. s.mu must be held.
+func (s *Server) deviceForKey(apiKey string) (caller, bool) {
+	guid, ok := s.apiKeys[apiKey]
+	if !ok {
+		return caller{}, false
+	}
+	device, ok := s.devices[guid]
+	if !ok {
+		return caller{}, false
+	}
+	device.LastSeen = time.Now()
+	return caller{email: device.User, deviceGUID: guid}, true
+}
+
+// accessible returns true if the user owns the device or it is shared with the user.
+func accessible(email string, device *portier.Device) bool {
+	if device.User == email {
+		return true
+	}
+	for _, shared := range device.SharedWith {
+		if shared == email {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleDeviceByName(w http.ResponseWriter, c caller, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// prefer the caller's own device if a shared device has the same name
+	var found *portier.Device
+	for _, device := range s.devices {
+		if device.Name != name || !accessible(c.email, device) {
+			continue
+		}
+		if found == nil || device.User == c.email {
+			found = device
+		}
+	}
+	if found == nil {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, portier.DeviceByNameResponse{GUID: found.GUID})
+}
+
+func (s *Server) handleFingerprints(w http.ResponseWriter, r *http.Request, c caller) {
+	request := portier.GetFingerPrintRequest{}
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fingerprints := make(map[string]string)
+	for guid, device := range s.devices {
+		if !accessible(c.email, device) {
+			continue
+		}
+		if len(request.DeviceIDs) > 0 && !contains(request.DeviceIDs, guid) {
+			continue
+		}
+		if fingerprint, ok := s.fingerprints[guid]; ok {
+			fingerprints[guid] = fingerprint
+		}
+	}
+	writeJSON(w, portier.GetFingerPrintResponse{Username: c.email, Fingerprints: fingerprints})
+}
+
+func (s *Server) handleFingerprintUpsert(w http.ResponseWriter, r *http.Request, c caller) {
+	request := portier.FingerPrintUploadRequest{}
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, ok := s.devices[request.DeviceID]
+	if !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	// a device may only upload its own fingerprint, a user those of owned devices
+	if (c.deviceGUID != "" && c.deviceGUID != request.DeviceID) || device.User != c.email {
+		http.Error(w, "not the owner of the device", http.StatusForbidden)
+		return
+	}
+	if request.SHA256Fingerprint == "" {
+		http.Error(w, "missing fingerprint", http.StatusBadRequest)
+		return
+	}
+	s.fingerprints[request.DeviceID] = request.SHA256Fingerprint
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleInitiationFailure(w http.ResponseWriter, r *http.Request) {
+	request := portier.ConnectionInitiationFailureRequest{}
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	s.mu.Lock()
+	s.failures = append(s.failures, request)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListDevices(w http.ResponseWriter, c caller) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devices := []portier.Device{}
+	for _, device := range s.devices {
+		if accessible(c.email, device) {
+			devices = append(devices, *device)
+		}
+	}
+	writeJSON(w, devices)
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request, c caller) {
+	request := portier.RegistrationRequest{}
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if request.Name == "" {
+		http.Error(w, "missing device name", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, device := range s.devices {
+		if device.User == c.email && device.Name == request.Name {
+			http.Error(w, "device already exists", http.StatusConflict)
+			return
+		}
+	}
+	device := &portier.Device{
+		GUID: uuid.NewString(),
+		Name: request.Name,
+		User: c.email,
+	}
+	s.devices[device.GUID] = device
+	writeJSONStatus(w, http.StatusCreated, device)
+}
+
+func (s *Server) handleDevice(w http.ResponseWriter, r *http.Request, c caller, guid string) {
+	update := portier.DeviceUpdateRequest{}
+	if r.Method == http.MethodPatch && !readJSON(w, r, &update) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, ok := s.devices[guid]
+	if !ok || !accessible(c.email, device) {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, device)
+	case http.MethodPatch:
+		if device.User != c.email {
+			http.Error(w, "not the owner of the device", http.StatusForbidden)
+			return
+		}
+		if update.Name != "" {
+			device.Name = update.Name
+		}
+		writeJSON(w, device)
+	case http.MethodDelete:
+		if device.User != c.email {
+			http.Error(w, "not the owner of the device", http.StatusForbidden)
+			return
+		}
+		delete(s.devices, guid)
+		delete(s.fingerprints, guid)
+		for key, keyDevice := range s.apiKeys {
+			if keyDevice == guid {
+				delete(s.apiKeys, key)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleGenerateAPIKey(w http.ResponseWriter, r *http.Request, c caller, guid string) {
+	request := portier.ApiKeyRequest{}
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, ok := s.devices[guid]
+	if !ok || device.User != c.email {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	apiKey := portier.ApiKeyCreation{
+		GUID:        uuid.NewString(),
+		CreatedAt:   time.Now().UTC(),
+		DeviceGUID:  guid,
+		Description: request.Description,
+		ApiKey:      randomToken(24),
+	}
+	s.apiKeys[apiKey.ApiKey] = guid
+	writeJSONStatus(w, http.StatusCreated, apiKey)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// randomToken returns n random bytes, hex encoded.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,150 @@
+package portiertest_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	portier "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/mh-dx/portier-cli/internal/portier/api/portiertest"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	workplaceGUID = "00000000-0000-0000-0000-000000000001"
+	homeGUID      = "00000000-0000-0000-0000-000000000002"
+)
+
+func newTestServer(t *testing.T) (*portiertest.Server, string) {
+	options := portiertest.NewDefaultOptions()
+	options.PollingInterval = 0
+	options.Fixtures = portiertest.Fixtures{
+		Users: []portiertest.UserFixture{{
+			Email: portiertest.DefaultUser,
+			Devices: []portiertest.DeviceFixture{
+				{GUID: workplaceGUID, Name: "workplace", APIKey: "workplace-key", Fingerprint: "AA:BB"},
+				{GUID: homeGUID, Name: "home", APIKey: "home-key"},
+			},
+		}},
+	}
+	server, err := portiertest.NewServer(options)
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(func() {
+		server.Close()
+		httpServer.Close()
+	})
+	return server, httpServer.URL
+}
+
+func TestLoginAndRegister(t *testing.T) {
+	// GIVEN an emulator and an empty portier home
+	_, url := newTestServer(t)
+	home := t.TempDir()
+	t.Setenv("PORTIER_HOME", home)
+	t.Setenv("PORTIER_SECRETS_PASSPHRASE", "test")
+
+	// WHEN logging in with the device flow and registering a device
+	err := portier.Login(portier.Endpoints{APIURL: url + "/api", AuthIssuer: url, AuthClientID: "portier-cli"})
+	require.NoError(t, err)
+	err = portier.Register("laptop", url+"/api", home, "credentials_device.yaml")
+	require.NoError(t, err)
+
+	// THEN the device is registered and authenticates with its API key
+	apiKey, err := portier.ReadDeviceAPIKey(filepath.Join(home, "credentials_device.yaml"))
+	require.NoError(t, err)
+	device := portier.NewDefaultClient(url, portier.DeviceKeyAuth{APIKey: apiKey})
+	guid, err := device.WhoAmI(context.Background())
+	require.NoError(t, err)
+
+	user := portier.NewDefaultClient(url, portier.NewBearerAuth(home))
+	byName, err := user.GetDeviceByName(context.Background(), "laptop")
+	require.NoError(t, err)
+	require.Equal(t, guid.String(), byName)
+
+	// AND registering the same name again conflicts
+	_, err = user.RegisterDevice(context.Background(), "laptop")
+	require.ErrorIs(t, err, portier.ErrConflict)
+}
+
+func TestDeviceEndpoints(t *testing.T) {
+	// GIVEN
+	server, url := newTestServer(t)
+	ctx := context.Background()
+	home := portier.NewDefaultClient(url, portier.DeviceKeyAuth{APIKey: "home-key"})
+
+	// WHEN
+	guid, err := home.GetDeviceByName(ctx, "workplace")
+	require.NoError(t, err)
+	require.NoError(t, home.UploadFingerprint(ctx, homeGUID, "CC:DD"))
+	fingerprints, err := home.GetFingerprints(ctx, []string{})
+	require.NoError(t, err)
+	require.NoError(t, home.ReportConnectionInitiationFailure(ctx, portier.ConnectionInitiationFailureRequest{
+		ConnectingDeviceGUID: workplaceGUID,
+		ErrorCode:            "TLS",
+	}))
+	_, missingErr := home.GetDeviceByName(ctx, "missing")
+	forbiddenErr := home.UploadFingerprint(ctx, workplaceGUID, "EE:FF")
+	_, unauthorizedErr := portier.NewDefaultClient(url, portier.DeviceKeyAuth{APIKey: "wrong"}).WhoAmI(ctx)
+
+	// THEN
+	require.Equal(t, workplaceGUID, guid)
+	require.Equal(t, map[string]string{workplaceGUID: "AA:BB", homeGUID: "CC:DD"}, fingerprints)
+	require.Len(t, server.InitiationFailures(), 1)
+	require.ErrorIs(t, missingErr, portier.ErrNotFound)
+	require.ErrorIs(t, forbiddenErr, portier.ErrUnauthorized)
+	require.ErrorIs(t, unauthorizedErr, portier.ErrUnauthorized)
+}
+
+func TestRelayRoutesMessages(t *testing.T) {
+	// GIVEN two devices connected to the relay
+	server, url := newTestServer(t)
+	relayURL := "ws" + url[len("http"):] + "/spider"
+
+	workplace := uplink.NewWebsocketUplink(uplink.Options{APIToken: "workplace-key", PortierURL: relayURL}, nil)
+	_, err := workplace.Connect()
+	require.NoError(t, err)
+	home := uplink.NewWebsocketUplink(uplink.Options{APIToken: "home-key", PortierURL: relayURL}, nil)
+	received, err := home.Connect()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return server.Connected(workplaceGUID) && server.Connected(homeGUID)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// WHEN
+	msg := messages.Message{
+		Header: messages.MessageHeader{
+			From: uuid.MustParse(workplaceGUID),
+			To:   uuid.MustParse(homeGUID),
+			Type: messages.D,
+		},
+		Message: []byte("hello"),
+	}
+	require.NoError(t, workplace.Send(msg))
+
+	// THEN
+	select {
+	case response := <-received:
+		require.Equal(t, msg.Header, response.Header)
+		require.Equal(t, msg.Message, response.Message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not relayed")
+	}
+}
+
+func TestRelayRejectsUnknownKeys(t *testing.T) {
+	_, url := newTestServer(t)
+
+	resp, err := http.Get(url + "/spider")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -1,13 +1,11 @@
 package portier
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"strings"
+	"net/url"
 	"time"
 )
 
@@ -23,6 +21,7 @@ type Device struct {
 	Networks      []string `validate:"omitempty,uuids"`
 	OutboundBytes int      `validate:"gte=0"`
 	LastSeen      time.Time
+	SharedWith    []string `validate:"omitempty,dive,email"` // emails of the users the device is shared with
 }
 
 type ApiKeyRequest struct {
@@ -41,121 +40,48 @@ type ApiKeyCreation struct {
 	ApiKey      string    `validate:"required,alphanum"`
 }
 
-// Function to register a device
-func RegisterDevice(baseURL, name, accessToken, home string) (Device, error) {
-	baseURL = strings.TrimSuffix(baseURL, "/")
-	regRequest := RegistrationRequest{Name: name}
-
-	// Convert RegistrationRequest to JSON
-	regJSON, err := json.Marshal(regRequest)
-	if err != nil {
-		return Device{}, err
-	}
-
-	// Make POST request to register the device
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/device", baseURL), bytes.NewBuffer(regJSON))
-	if err != nil {
-		return Device{}, err
-	}
-
-	// Set Authorization header if access token available
-	if accessToken != "" {
-		req.Header.Set("Authorization", "Bearer "+accessToken)
-	}
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return Device{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		// parse the response
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return Device{}, err
-		}
-		return Device{}, fmt.Errorf("failed to register device: %s, Response: %s", resp.Status, body)
-	}
-
+// RegisterDevice creates a device of the logged in user.
+func (c *Client) RegisterDevice(ctx context.Context, name string) (Device, error) {
 	var device Device
-	// Parse response body
-	if err := json.NewDecoder(resp.Body).Decode(&device); err != nil {
-		return Device{}, err
+	if err := c.Do(ctx, http.MethodPost, "/api/device", RegistrationRequest{Name: name}, &device); err != nil {
+		return Device{}, fmt.Errorf("failed to register device: %w", err)
 	}
-
 	return device, nil
 }
 
-// Function to generate API key for a device
-func GenerateApiKey(baseURL, deviceGUID, description, accessToken, home string) (ApiKeyCreation, error) {
-	baseURL = strings.TrimSuffix(baseURL, "/")
+// GenerateApiKey creates an API key for a device of the logged in user.
+func (c *Client) GenerateApiKey(ctx context.Context, deviceGUID, description string) (ApiKeyCreation, error) {
 	apiKeyRequest := ApiKeyRequest{
 		DeviceGUID:  deviceGUID,
 		Description: description,
 	}
 
-	// Convert ApiKeyRequest to JSON
-	apiKeyJSON, err := json.Marshal(apiKeyRequest)
-	if err != nil {
-		return ApiKeyCreation{}, err
-	}
-
-	// Make POST request to generate API key
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/device/%s/apikey", baseURL, deviceGUID), bytes.NewBuffer(apiKeyJSON))
-	if err != nil {
-		return ApiKeyCreation{}, err
-	}
-
-	// Set Authorization header if access token available
-	if accessToken != "" {
-		req.Header.Set("Authorization", "Bearer "+accessToken)
-	}
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return ApiKeyCreation{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		// parse the response
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return ApiKeyCreation{}, err
-		}
-		return ApiKeyCreation{}, fmt.Errorf("failed to register device: %s, Response: %s", resp.Status, body)
-	}
-
 	var apiKey ApiKeyCreation
-	// Parse response body
-	if err := json.NewDecoder(resp.Body).Decode(&apiKey); err != nil {
-		return ApiKeyCreation{}, err
+	if err := c.Do(ctx, http.MethodPost, fmt.Sprintf("/api/device/%s/apikey", url.PathEscape(deviceGUID)), apiKeyRequest, &apiKey); err != nil {
+		return ApiKeyCreation{}, fmt.Errorf("failed to generate API key: %w", err)
 	}
-
 	return apiKey, nil
 }
 
 func Register(name string, baseURL string, home string, credentialsFileName string) error {
 	// Attempt to load access token from credentials file
-	authResponse, err := LoadAccessToken(home)
-	if err != nil {
+	if _, err := ValidAccessToken(home); err != nil {
 		log.Println("Failed to load access token:", err)
 		return err
 	}
+	client := NewDefaultClient(baseURL, NewBearerAuth(home))
+	ctx := context.Background()
 
 	// If access token is available and not expired, use it to register device
 	log.Println("Registering Device...")
-	device, err := RegisterDevice(baseURL, name, authResponse.AccessToken, home)
+	device, err := client.RegisterDevice(ctx, name)
 	if err != nil {
 		log.Println("Error registering device:", err)
 		return err
 	}
 
 	log.Println("Generating API key...")
-	apiKey, err := GenerateApiKey(baseURL, device.GUID, "Generated by portier CLI", authResponse.AccessToken, home)
+	apiKey, err := client.GenerateApiKey(ctx, device.GUID, "Generated by portier CLI")
 	if err != nil {
 		log.Println("Error generating API key:", err)
 		return err
@@ -168,6 +94,6 @@ func Register(name string, baseURL string, home string, credentialsFileName stri
 	}
 
 	log.Println("Device registered and credentials stored successfully.")
-	log.Printf("Device ID: \t%s\nAPI Key: \t%s", device.GUID, apiKey.ApiKey)
+	log.Printf("Device ID: \t%s", device.GUID)
 	return nil
 }
@@ -0,0 +1,297 @@
+package portier
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
+	"gopkg.in/yaml.v2"
+)
+
+// expirySkew is how long before its expiry an access token is refreshed.
+const expirySkew = time.Minute
+
+// lockTimeout bounds the wait for a refresh running in another portier-cli process. Lock
+// files older than that are considered stale and removed.
+const lockTimeout = 30 * time.Second
+
+// refreshMu makes sure only one goroutine of this process refreshes the tokens at a time.
+var refreshMu sync.Mutex
+
+// ValidAccessToken loads the OAuth tokens and refreshes them first if the access token
+// is expired or about to expire.
+func ValidAccessToken(home string) (AuthResponse, error) {
+	auth, err := LoadAccessToken(home)
+	if err != nil {
+		return auth, err
+	}
+	if !expiresSoon(auth) {
+		return auth, nil
+	}
+	if auth.RefreshToken == "" {
+		return AuthResponse{}, fmt.Errorf("access token expired at %s. Please login", auth.ExpiresAt.Format(time.RFC3339))
+	}
+	return RefreshAccessToken(home, auth.AccessToken)
+}
+
+// RefreshAccessToken exchanges the refresh token for a new access token and stores the result.
+// stale is the access token the caller found to be expired. If another goroutine or process
+// has replaced it in the meantime, the new tokens are returned without a further refresh.
+func RefreshAccessToken(home string, stale string) (AuthResponse, error) {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	unlock, err := lockCredentials(home)
+	if err != nil {
+		return AuthResponse{}, err
+	}
+	defer unlock()
+
+	auth, err := LoadAccessToken(home)
+	if err != nil {
+		return AuthResponse{}, err
+	}
+	if auth.AccessToken != stale && !expiresSoon(auth) {
+		return auth, nil
+	}
+	if auth.RefreshToken == "" {
+		return AuthResponse{}, fmt.Errorf("no refresh token available. Please login")
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("client_id", auth.ClientID)
+	data.Set("refresh_token", auth.RefreshToken)
+
+	result, err := postAuthForm(discoverAuthEndpoints(auth.Issuer).Token, data)
+	if err != nil {
+		return AuthResponse{}, fmt.Errorf("failed to refresh access token, please login again: %w", err)
+	}
+
+	refreshed, err := authResponseFromTokenResult(result)
+	if err != nil {
+		return AuthResponse{}, err
+	}
+	// refresh tokens are only returned if the identity provider rotates them
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = auth.RefreshToken
+	}
+	refreshed.Issuer = auth.Issuer
+	refreshed.ClientID = auth.ClientID
+
+	if err := StoreAccessToken(home, refreshed); err != nil {
+		return AuthResponse{}, err
+	}
+	return refreshed, nil
+}
+
+// Logout revokes the refresh and the access token at the identity provider and deletes the
+// local OAuth tokens. If removeDevice is set, the device credentials in home are deleted as well.
+func Logout(home string, removeDevice bool) error {
+	auth, err := LoadAccessToken(home)
+	if err == nil {
+		endpoint := discoverAuthEndpoints(auth.Issuer).Revocation
+		if auth.RefreshToken != "" {
+			if err := revokeToken(endpoint, auth.ClientID, auth.RefreshToken, "refresh_token"); err != nil {
+				log.Printf("Warning: failed to revoke refresh token: %v", err)
+			}
+		}
+		if auth.AccessToken != "" {
+			if err := revokeToken(endpoint, auth.ClientID, auth.AccessToken, "access_token"); err != nil {
+				log.Printf("Warning: failed to revoke access token: %v", err)
+			}
+		}
+	}
+
+	files := []string{AccessTokenFile}
+	if removeDevice {
+		deviceFiles, err := filepath.Glob(filepath.Join(home, "credentials_*.yaml"))
+		if err != nil {
+			return err
+		}
+		for _, file := range deviceFiles {
+			files = append(files, filepath.Base(file))
+		}
+	}
+
+	for _, file := range files {
+		if err := DeleteCredentials(home, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteCredentials removes a credentials file from home together with the secret it references.
+func DeleteCredentials(home string, filename string) error {
+	file := filepath.Join(home, filename)
+	fileContent, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	credentials := map[string]string{}
+	if err := yaml.Unmarshal(fileContent, &credentials); err != nil {
+		return err
+	}
+	backend := credentials["secretStore"]
+	if backend == "" {
+		backend = credentials["secret_store"]
+	}
+	if backend != "" {
+		store, err := secrets.Open(home, backend)
+		if err != nil {
+			return err
+		}
+		if err := store.Delete(secretName(filename)); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(file)
+}
+
+func expiresSoon(auth AuthResponse) bool {
+	return !auth.ExpiresAt.IsZero() && time.Now().Add(expirySkew).After(auth.ExpiresAt)
+}
+
+// lockCredentials acquires a lock file next to credentials.yaml, so that concurrent
+// portier-cli processes do not refresh, and thereby rotate, the same refresh token.
+func lockCredentials(home string) (func(), error) {
+	lockFile := filepath.Join(home, AccessTokenFile+".lock")
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		file, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lockFile) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if info, statErr := os.Stat(lockFile); statErr == nil && time.Since(info.ModTime()) > lockTimeout {
+			os.Remove(lockFile)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock %s", lockFile)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// revokeToken revokes a token at the revocation endpoint of the identity provider (RFC 7009).
+// Providers that cannot revoke tokens of the type, typically self-contained access tokens,
+// answer with unsupported_token_type. These tokens stay valid until they expire, which is not
+// reported as an error.
+func revokeToken(endpoint, clientID, token, tokenTypeHint string) error {
+	data := url.Values{}
+	data.Set("client_id", clientID)
+	data.Set("token", token)
+	data.Set("token_type_hint", tokenTypeHint)
+	_, err := postAuthForm(endpoint, data)
+	var authErr *authError
+	if errors.As(err, &authErr) && authErr.code == "unsupported_token_type" {
+		return nil
+	}
+	return err
+}
+
+// authError is an error response of the identity provider.
+type authError struct {
+	status      string
+	code        string
+	description interface{}
+}
+
+func (e *authError) Error() string {
+	return fmt.Sprintf("%s: %v", e.status, e.description)
+}
+
+// postAuthForm posts a form to an endpoint of the identity provider and returns the decoded JSON response.
+func postAuthForm(endpoint string, data url.Values) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, endpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		code, _ := result["error"].(string)
+		return nil, &authError{status: resp.Status, code: code, description: result["error_description"]}
+	}
+	return result, nil
+}
+
+// authResponseFromTokenResult extracts the tokens from a token endpoint response.
+func authResponseFromTokenResult(result map[string]interface{}) (AuthResponse, error) {
+	accessToken, ok := result["access_token"].(string)
+	if !ok {
+		return AuthResponse{}, fmt.Errorf("access_token not found in response")
+	}
+	refreshToken, _ := result["refresh_token"].(string)
+
+	auth := AuthResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}
+	if expiresIn, ok := result["expires_in"].(float64); ok {
+		auth.ExpiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	} else {
+		auth.ExpiresAt = jwtExpiry(accessToken)
+	}
+	return auth, nil
+}
+
+// jwtExpiry returns the exp claim of a JWT without verifying it, or the zero time.
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
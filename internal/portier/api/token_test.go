@@ -0,0 +1,164 @@
+package portier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
+	"github.com/stretchr/testify/require"
+)
+
+// withAuthServer starts an issuer without OIDC discovery and returns its URL.
+func withAuthServer(t *testing.T, handler http.HandlerFunc) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/openid-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestValidAccessTokenRefreshesOnce(t *testing.T) {
+	// GIVEN an expired access token
+	home := t.TempDir()
+	t.Setenv(secrets.PassphraseEnv, "test")
+	var calls int32
+	issuer := withAuthServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		require.Equal(t, "/oauth/token", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "refresh_token", r.Form.Get("grant_type"))
+		require.Equal(t, "refresh", r.Form.Get("refresh_token"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token": "fresh", "refresh_token": "rotated", "expires_in": 3600}`))
+	})
+	require.NoError(t, StoreAccessToken(home, AuthResponse{
+		AccessToken:  "expired",
+		RefreshToken: "refresh",
+		ExpiresAt:    time.Now().Add(-time.Hour),
+		Issuer:       issuer,
+		ClientID:     "test",
+	}))
+
+	// WHEN several goroutines need a token at the same time
+	var wg sync.WaitGroup
+	tokens := make([]string, 5)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			auth, err := ValidAccessToken(home)
+			require.NoError(t, err)
+			tokens[i] = auth.AccessToken
+		}(i)
+	}
+	wg.Wait()
+
+	// THEN the token endpoint is called once and everybody gets the new token
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, token := range tokens {
+		require.Equal(t, "fresh", token)
+	}
+	auth, err := LoadAccessToken(home)
+	require.NoError(t, err)
+	require.Equal(t, "rotated", auth.RefreshToken)
+	require.WithinDuration(t, time.Now().Add(time.Hour), auth.ExpiresAt, time.Minute)
+}
+
+func TestValidAccessTokenWithoutRefreshToken(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv(secrets.PassphraseEnv, "test")
+	require.NoError(t, StoreAccessToken(home, AuthResponse{
+		AccessToken: "expired",
+		ExpiresAt:   time.Now().Add(-time.Hour),
+	}))
+
+	_, err := ValidAccessToken(home)
+
+	require.ErrorContains(t, err, "Please login")
+}
+
+func TestLogoutRevokesAndDeletesCredentials(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	t.Setenv(secrets.PassphraseEnv, "test")
+	var revoked []string
+	issuer := withAuthServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/oauth/revoke", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		revoked = append(revoked, r.Form.Get("token_type_hint")+"="+r.Form.Get("token"))
+	})
+	require.NoError(t, StoreAccessToken(home, AuthResponse{AccessToken: "access", RefreshToken: "refresh", Issuer: issuer}))
+	require.NoError(t, StoreDeviceCredentials("api-key", home, "credentials_device.yaml"))
+
+	// WHEN
+	require.NoError(t, Logout(home, true))
+
+	// THEN
+	require.Equal(t, []string{"refresh_token=refresh", "access_token=access"}, revoked)
+	for _, file := range []string{AccessTokenFile, "credentials_device.yaml"} {
+		_, err := os.Stat(filepath.Join(home, file))
+		require.True(t, os.IsNotExist(err))
+	}
+	store, err := secrets.Open(home, secrets.BackendFile)
+	require.NoError(t, err)
+	_, err = store.Get(secretName(AccessTokenFile))
+	require.ErrorIs(t, err, secrets.ErrNotFound)
+}
+
+func TestRevokeTokenOfUnsupportedType(t *testing.T) {
+	// GIVEN a provider that cannot revoke access tokens
+	issuer := withAuthServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		if r.Form.Get("token_type_hint") == "access_token" {
+			_, _ = w.Write([]byte(`{"error": "unsupported_token_type", "error_description": "access tokens cannot be revoked"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"error": "invalid_request", "error_description": "missing token"}`))
+	})
+
+	// WHEN
+	errAccess := revokeToken(issuer+"/oauth/revoke", "test", "access", "access_token")
+	errRefresh := revokeToken(issuer+"/oauth/revoke", "test", "", "refresh_token")
+
+	// THEN
+	require.NoError(t, errAccess)
+	require.ErrorContains(t, errRefresh, "missing token")
+}
+
+func TestDiscoverAuthEndpoints(t *testing.T) {
+	// GIVEN an issuer that publishes a discovery document
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/.well-known/openid-configuration", r.URL.Path)
+		_, _ = w.Write([]byte(`{"issuer": "` + server.URL + `", "token_endpoint": "` + server.URL + `/token", "device_authorization_endpoint": "` + server.URL + `/device"}`))
+	}))
+	defer server.Close()
+
+	// WHEN
+	endpoints := discoverAuthEndpoints(server.URL)
+
+	// THEN discovered endpoints are used, missing ones default to the portier.dev paths
+	require.Equal(t, server.URL+"/token", endpoints.Token)
+	require.Equal(t, server.URL+"/device", endpoints.DeviceAuthorization)
+	require.Equal(t, server.URL+"/oauth/revoke", endpoints.Revocation)
+}
+
+func TestJWTExpiry(t *testing.T) {
+	// header.{"exp":1700000000}.signature
+	token := "eyJhbGciOiJIUzI1NiJ9.eyJleHAiOjE3MDAwMDAwMDB9.c2ln"
+
+	require.Equal(t, time.Unix(1700000000, 0), jwtExpiry(token))
+	require.True(t, jwtExpiry("opaque").IsZero())
+}
@@ -1,22 +1,35 @@
 package portier
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
 	"gopkg.in/yaml.v2"
 )
 
+// AccessTokenFile is the name of the file in the home folder that references the OAuth tokens.
+const AccessTokenFile = "credentials.yaml"
+
 type AuthResponse struct {
 	AccessToken  string
 	RefreshToken string
+
+	// ExpiresAt is the expiry of the access token. It is zero if unknown.
+	ExpiresAt time.Time
+
+	// Issuer and ClientID identify where the tokens were issued, they are used to refresh and revoke them
+	Issuer   string
+	ClientID string
 }
 
 // Function to load access token from credentials file
 func LoadAccessToken(home string) (AuthResponse, error) {
-	credentialsFile := filepath.Join(home, "credentials.yaml")
+	credentialsFile := filepath.Join(home, AccessTokenFile)
 	if _, err := os.Stat(credentialsFile); os.IsNotExist(err) {
 		return AuthResponse{}, fmt.Errorf("credentials file does not exist. Please login")
 	}
@@ -33,15 +46,100 @@ func LoadAccessToken(home string) (AuthResponse, error) {
 		return AuthResponse{}, err
 	}
 
-	return AuthResponse{
-		AccessToken:  credentials["access_token"],
-		RefreshToken: credentials["refresh_token"],
-	}, nil
+	// credentials files written before the secret store was introduced hold the tokens in plaintext
+	if credentials["access_token"] != "" {
+		return withIssuer(authResponseFromMap(credentials), credentials), nil
+	}
+
+	store, err := secrets.Open(home, credentials["secret_store"])
+	if err != nil {
+		return AuthResponse{}, err
+	}
+	secret, err := store.Get(secretName(AccessTokenFile))
+	if errors.Is(err, secrets.ErrNotFound) {
+		return AuthResponse{}, fmt.Errorf("access token not found in %s secret store. Please login", store.Backend())
+	}
+	if err != nil {
+		return AuthResponse{}, err
+	}
+
+	tokens := map[string]string{}
+	if err := yaml.Unmarshal(secret, &tokens); err != nil {
+		return AuthResponse{}, err
+	}
+
+	return withIssuer(authResponseFromMap(tokens), credentials), nil
+}
+
+// withIssuer sets the issuer stored in credentials.yaml. Files written before issuers
+// were configurable default to portier.dev.
+func withIssuer(auth AuthResponse, credentials map[string]string) AuthResponse {
+	auth.Issuer = credentials["issuer"]
+	auth.ClientID = credentials["client_id"]
+	if auth.Issuer == "" {
+		auth.Issuer = DefaultEndpoints.AuthIssuer
+		auth.ClientID = DefaultEndpoints.AuthClientID
+	}
+	return auth
+}
+
+func authResponseFromMap(tokens map[string]string) AuthResponse {
+	auth := AuthResponse{
+		AccessToken:  tokens["access_token"],
+		RefreshToken: tokens["refresh_token"],
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, tokens["expires_at"]); err == nil {
+		auth.ExpiresAt = expiresAt
+	} else {
+		auth.ExpiresAt = jwtExpiry(auth.AccessToken)
+	}
+	return auth
+}
+
+// StoreAccessToken puts the OAuth tokens into the secret store and writes credentials.yaml,
+// which only references the store.
+func StoreAccessToken(home string, auth AuthResponse) error {
+	store, err := secrets.Open(home, "")
+	if err != nil {
+		return err
+	}
+	return storeAccessToken(store, home, auth, time.Now())
+}
+
+func storeAccessToken(store secrets.Store, home string, auth AuthResponse, storedAt time.Time) error {
+	tokens := map[string]string{
+		"access_token":  auth.AccessToken,
+		"refresh_token": auth.RefreshToken,
+	}
+	if !auth.ExpiresAt.IsZero() {
+		tokens["expires_at"] = auth.ExpiresAt.Format(time.RFC3339)
+	}
+	secret, err := yaml.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	if err := store.Set(secretName(AccessTokenFile), secret); err != nil {
+		return err
+	}
+
+	yamlCredentials, err := yaml.Marshal(map[string]string{
+		"stored_at":    storedAt.Format(time.RFC3339),
+		"secret_store": store.Backend(),
+		"issuer":       auth.Issuer,
+		"client_id":    auth.ClientID,
+	})
+	if err != nil {
+		return err
+	}
+	return secrets.WriteFileSecure(filepath.Join(home, AccessTokenFile), yamlCredentials)
 }
 
 type DeviceCredentials struct {
 	DeviceID string `yaml:"-"`
-	APIKey   string `yaml:"APIKey"`
+	APIKey   string `yaml:"APIKey,omitempty"`
+
+	// SecretStore is the backend holding the API key. It is empty for legacy files with a plaintext APIKey.
+	SecretStore string `yaml:"secretStore,omitempty"`
 }
 
 func LoadDeviceCredentials(home string, filename, apiURL string) (*DeviceCredentials, error) {
@@ -50,44 +148,78 @@ func LoadDeviceCredentials(home string, filename, apiURL string) (*DeviceCredent
 		return nil, fmt.Errorf("file %s does not exist. Please register a device", credentialsFile)
 	}
 
-	// Read the file
-	fileContent, err := os.ReadFile(credentialsFile)
+	apiKey, err := ReadDeviceAPIKey(credentialsFile)
 	if err != nil {
 		return nil, err
 	}
 
-	type fileCreds struct {
-		APIKey string `yaml:"APIKey"`
-	}
-	fc := fileCreds{}
-	if err := yaml.Unmarshal(fileContent, &fc); err != nil {
-		return nil, err
-	}
-
-	guid, err := WhoAmI(strings.TrimSuffix(apiURL, "/api"), fc.APIKey)
+	guid, err := NewDefaultClient(apiURL, DeviceKeyAuth{APIKey: apiKey}).WhoAmI(context.Background())
 	if err != nil {
 		return nil, err
 	}
 
 	credentials := DeviceCredentials{
-		APIKey:   fc.APIKey,
+		APIKey:   apiKey,
 		DeviceID: guid.String(),
 	}
 
 	return &credentials, nil
 }
 
+// ReadDeviceAPIKey returns the API key of a device credentials file, either from the
+// secret store the file references or, for legacy files, from the file itself.
+func ReadDeviceAPIKey(credentialsFile string) (string, error) {
+	fileContent, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return "", err
+	}
+
+	fc := DeviceCredentials{}
+	if err := yaml.Unmarshal(fileContent, &fc); err != nil {
+		return "", err
+	}
+	if fc.APIKey != "" {
+		return fc.APIKey, nil
+	}
+
+	store, err := secrets.Open(filepath.Dir(credentialsFile), fc.SecretStore)
+	if err != nil {
+		return "", err
+	}
+	secret, err := store.Get(secretName(filepath.Base(credentialsFile)))
+	if errors.Is(err, secrets.ErrNotFound) {
+		return "", fmt.Errorf("API key for %s not found in %s secret store. Please register the device again", credentialsFile, store.Backend())
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
 func StoreDeviceCredentials(apiKey, home, filename string) error {
-	// Create YAML file
-	file, err := os.Create(filepath.Join(home, filename))
+	store, err := secrets.Open(home, "")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	return storeDeviceCredentials(store, apiKey, home, filename)
+}
 
-	// Write credentials to file
-	err = yaml.NewEncoder(file).Encode(DeviceCredentials{
-		APIKey: apiKey,
+func storeDeviceCredentials(store secrets.Store, apiKey, home, filename string) error {
+	if err := store.Set(secretName(filename), []byte(apiKey)); err != nil {
+		return err
+	}
+
+	// the credentials file only references the secret store
+	content, err := yaml.Marshal(DeviceCredentials{
+		SecretStore: store.Backend(),
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	return secrets.WriteFileSecure(filepath.Join(home, filename), content)
+}
+
+// secretName is the name under which the secret of a credentials file is kept in the secret store.
+func secretName(filename string) string {
+	return "credentials/" + filename
 }
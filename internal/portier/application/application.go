@@ -1,9 +1,12 @@
 package application
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
@@ -14,6 +17,7 @@ import (
 	"github.com/mh-dx/portier-cli/internal/portier/config"
 	"github.com/mh-dx/portier-cli/internal/portier/ptls"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/adapter"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/compression"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/router"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
@@ -65,11 +69,33 @@ func GetPortierApplication() *PortierApplication {
 
 func (p *PortierApplication) StartServices(portierConfig *config.PortierConfig, creds *config.DeviceCredentials) error {
 
+	if portierConfig.PTLSConfig.RequireNoise && !portierConfig.PTLSConfig.Noise {
+		return fmt.Errorf("tlsConfig.requireNoise needs tlsConfig.noise")
+	}
+
 	log.Println("Creating relay...")
 	p.config = portierConfig
 	p.deviceCredentials = creds
 
-	p.ptls = ptls.NewPTLS(p.config.TLSEnabled, p.config.PTLSConfig.CertFile, p.config.PTLSConfig.KeyFile, p.config.PTLSConfig.CAFile, p.config.PTLSConfig.KnownHostsFile, nil)
+	p.ptls = ptls.NewPTLSWithOptions(ptls.PTLSOptions{
+		Enabled:             p.config.TLSEnabled,
+		CertFile:            p.config.PTLSConfig.CertFile,
+		KeyFile:             p.config.PTLSConfig.KeyFile,
+		CAFile:              p.config.PTLSConfig.CAFile,
+		CRLFile:             p.config.PTLSConfig.CRLFile,
+		KnownHostsFile:      p.config.PTLSConfig.KnownHostsFile,
+		RequireTLS:          p.config.PTLSConfig.RequireTLS,
+		Noise:               p.config.PTLSConfig.Noise,
+		HandshakeTimeout:    p.config.PTLSConfig.HandshakeTimeout,
+		SessionCacheSize:    p.config.PTLSConfig.SessionCacheSize,
+		TOFU:                p.config.PTLSConfig.TOFU,
+		AuditFile:           p.config.PTLSConfig.AuditFile,
+		OnPeerChanged:       p.reportPeerChange,
+		OnRotationCompleted: p.uploadRotatedFingerprint,
+	})
+	if notAfter, expiring, err := ptls.CertificateExpiry(p.config.PTLSConfig.CertFile, time.Now()); err == nil && expiring {
+		log.Printf("Warning: the TLS certificate expires on %s, replace it with 'portier-cli tls rotate'", notAfter.Format(time.RFC3339))
+	}
 
 	router, uplink, err := p.createRelay()
 	if err != nil {
@@ -110,6 +136,8 @@ func (p *PortierApplication) StartServices(portierConfig *config.PortierConfig,
 }
 
 func (p *PortierApplication) handleAccept(context ServiceContext, listener net.Listener) error {
+	// the compression of the service was validated when it was started
+	algorithm, _ := compression.ParseAlgorithm(context.Service.Options.Compression)
 	for {
 		conn, err := context.Listener.Accept()
 		if err != nil {
@@ -122,6 +150,26 @@ func (p *PortierApplication) handleAccept(context ServiceContext, listener net.L
 		// Now we create a new connection adapter for the outbound connection
 		// First, we define the options for the connection adapter
 
+		// If encryption is enabled globally and for this service, the stream is TLS encrypted.
+		// The peer learns about it from the bridge options and refuses if its policy differs.
+		useTLS := p.config.TLSEnabled && context.Service.Options.TLSEnabled
+
+		// A handshake is only started with a key whose certificate was authenticated by a TLS
+		// connection to the peer and is pinned or signed by the CA. Then the messages are
+		// encrypted end-to-end and TLS is not needed. Otherwise TLS stays as requested.
+		handshake, err := p.ptls.NewNoiseHandshake(context.Service.Options.PeerDeviceID, true)
+		switch {
+		case err == nil:
+			useTLS = false
+		case p.config.PTLSConfig.RequireNoise && (!errors.Is(err, ptls.ErrNoiseUnavailable) || !useTLS):
+			// fail closed, the key of an unknown peer is only learned from a TLS connection to it
+			log.Printf("Refusing connection to %s, Noise is required: %v", context.Service.Options.PeerDeviceID, err)
+			_ = conn.Close()
+			continue
+		case !errors.Is(err, ptls.ErrNoiseUnavailable):
+			log.Printf("Not using Noise for connection to %s: %v", context.Service.Options.PeerDeviceID, err)
+		}
+
 		cID := messages.ConnectionID(uuid.New().String())
 		options := adapter.ConnectionAdapterOptions{
 			ConnectionId:  cID,
@@ -130,9 +178,12 @@ func (p *PortierApplication) handleAccept(context ServiceContext, listener net.L
 			BridgeOptions: messages.BridgeOptions{
 				Timestamp: time.Now(),
 				URLRemote: *context.Service.Options.URLRemote.URL,
+				TLS:       useTLS,
 			},
 			ConnectionReadTimeout: context.Service.Options.ConnectionReadTimeout,
 			ReadBufferSize:        context.Service.Options.ReadBufferSize,
+			Noise:                 handshake,
+			Capabilities:          adapter.NewServiceCapabilities(algorithm),
 		}
 		if options.ResponseInterval == 0 {
 			options.ResponseInterval = p.config.DefaultResponseInterval
@@ -149,32 +200,17 @@ func (p *PortierApplication) handleAccept(context ServiceContext, listener net.L
 
 		log.Println(utils.PrettyPrint(options))
 
-		// If encryption is enabled globally and for this service, we need to create a TLS client
-		var tlsHandshaker func() error = nil
-		if p.config.TLSEnabled && context.Service.Options.TLSEnabled {
-			tlsConn, handshaker, err := p.ptls.CreateClientAndBridge(conn, context.Service.Options.PeerDeviceID)
-			if err != nil {
-				log.Printf("Error in TLS handshake: %v", err)
-				return err
+		if useTLS {
+			peerDeviceID := context.Service.Options.PeerDeviceID
+			options.WrapStream = func(stream net.Conn) (net.Conn, error) {
+				return p.ptls.CreateClient(stream, peerDeviceID)
 			}
-			conn = tlsConn
-			tlsHandshaker = handshaker
 		}
 
-		adapter := adapter.NewOutboundConnectionAdapter(options, conn, p.uplink, p.router.EventChannel())
+		adapter := adapter.NewOutboundConnectionAdapter(options, conn, p.uplink, p.router.EventChannel(), p.ptls)
 		p.router.AddConnection(cID, adapter)
 		adapter.Start()
 
-		// If we have a handshaker, we need to call it now
-		if tlsHandshaker != nil {
-			err := tlsHandshaker()
-			if err != nil {
-				log.Printf("Error in TLS handshake: %v", err)
-				adapter.Close()
-				return err
-			}
-		}
-
 		log.Printf("Started connection adapter for service: %s\n", context.Service.Name)
 	}
 }
@@ -189,6 +225,11 @@ func (p *PortierApplication) StopServices() error {
 		}
 	}
 
+	if stats := compression.Totals(); stats.Chunks > 0 {
+		log.Printf("Compressed %d of %d chunks, %d bytes to %d bytes, %d bytes saved in total\n",
+			stats.Compressed, stats.Chunks, stats.BytesIn, stats.BytesOut, stats.Saved())
+	}
+
 	if len(errors) > 0 {
 		return fmt.Errorf("errors while closing listeners: %v", errors)
 	}
@@ -201,6 +242,9 @@ func (p *PortierApplication) startListeners() error {
 		log.Printf("--------------------------------------------------\n")
 		log.Printf("Starting service: %s\n", service.Name)
 		log.Println(utils.PrettyPrint(service))
+		if _, err := compression.ParseAlgorithm(service.Options.Compression); err != nil {
+			return fmt.Errorf("service %s: %w", service.Name, err)
+		}
 		switch service.Options.URLLocal.Scheme {
 		case "tcp", "tcp4", "tcp6", "unix", "unixpacket":
 			listener, err := net.Listen(service.Options.URLLocal.Scheme, service.Options.URLLocal.Host)
@@ -234,6 +278,9 @@ func (p *PortierApplication) AddService(service config.Service) error {
 
 	log.Printf("Starting service: %s\n", service.Name)
 	log.Println(utils.PrettyPrint(service))
+	if _, err := compression.ParseAlgorithm(service.Options.Compression); err != nil {
+		return fmt.Errorf("service %s: %w", service.Name, err)
+	}
 
 	switch service.Options.URLLocal.Scheme {
 	case "tcp", "tcp4", "tcp6", "unix", "unixpacket":
@@ -267,29 +314,71 @@ func (p *PortierApplication) createRelay() (router.Router, uplink.Uplink, error)
 	}
 
 	events := make(chan adapter.AdapterEvent, 100)
-	router := router.NewRouter(uplink, messageChannel, events, p.ptls, p.newInitiationFailureReporter())
+	router := router.NewRouter(uplink, messageChannel, events, p.ptls, p.newInitiationFailureReporter(), p.targetCapabilities)
 
 	return router, uplink, nil
 }
 
+// targetCapabilities returns the capabilities of inbound connections to a target: those of the
+// configured service with the target as remote URL, e.g. its compression, the defaults otherwise.
+func (p *PortierApplication) targetCapabilities(target url.URL) messages.Capabilities {
+	for _, service := range p.config.Services {
+		if service.Options.URLRemote.URL == nil || service.Options.URLRemote.String() != target.String() {
+			continue
+		}
+		algorithm, err := compression.ParseAlgorithm(service.Options.Compression)
+		if err != nil {
+			break
+		}
+		return adapter.NewServiceCapabilities(algorithm)
+	}
+	return adapter.NewDefaultCapabilities()
+}
+
+// reportPeerChange reports a rejected certificate of a known peer device like a failed
+// connection initiation.
+func (p *PortierApplication) reportPeerChange(change ptls.PeerChange) {
+	report := p.newInitiationFailureReporter()
+	if report == nil {
+		return
+	}
+	report(router.InitiationFailureReport{
+		ConnectingDeviceGUID: change.DeviceID.String(),
+		ErrorCode:            "PEER_CERTIFICATE_CHANGED",
+		ErrorMessage:         fmt.Sprintf("peer device %s presented the unknown certificate %s, trusted: %s", change.DeviceID, change.Fingerprint, strings.Join(change.Known, ", ")),
+		RecommendedAction:    "Verify the fingerprint of the peer device out of band with 'portier-cli tls fingerprint show', then pin it with 'portier-cli tls trust --fingerprint' or revoke it.",
+	})
+}
+
+// uploadRotatedFingerprint replaces the fingerprint of this device on the server with the one
+// of the rotated certificate, once the previous certificate is retired.
+func (p *PortierApplication) uploadRotatedFingerprint(rotation ptls.Rotation) {
+	if !rotation.UploadFingerprint || p.deviceCredentials == nil || p.deviceCredentials.ApiToken == "" || p.config == nil {
+		return
+	}
+	client := portierapi.NewDefaultClient(p.config.Endpoints().APIBaseURL(), portierapi.DeviceKeyAuth{APIKey: p.deviceCredentials.ApiToken})
+	deviceID, err := client.WhoAmI(context.Background())
+	if err == nil {
+		err = client.UploadFingerprint(context.Background(), deviceID.String(), rotation.Fingerprint)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to upload the fingerprint %s of the rotated certificate, upload it with 'portier-cli tls import --cert %s --key %s': %v", rotation.Fingerprint, p.config.PTLSConfig.CertFile, p.config.PTLSConfig.KeyFile, err)
+		return
+	}
+	log.Printf("Fingerprint %s of the rotated certificate uploaded", rotation.Fingerprint)
+}
+
 func (p *PortierApplication) newInitiationFailureReporter() router.InitiationFailureReporter {
 	if p.deviceCredentials == nil || p.deviceCredentials.ApiToken == "" || p.config == nil || p.config.PortierURL.URL == nil {
 		return nil
 	}
 
-	baseURL := p.config.PortierURL.URL.String()
-	if p.config.PortierURL.URL.Scheme == "wss" {
-		baseURL = "https://" + p.config.PortierURL.URL.Host
-	} else if p.config.PortierURL.URL.Scheme == "ws" {
-		baseURL = "http://" + p.config.PortierURL.URL.Host
-	} else {
-		baseURL = p.config.PortierURL.URL.Scheme + "://" + p.config.PortierURL.URL.Host
-	}
-	baseURL = strings.TrimSuffix(baseURL, "/")
-	apiKey := p.deviceCredentials.ApiToken
+	options := portierapi.NewDefaultClientOptions(p.config.Endpoints().APIBaseURL())
+	options.Timeout = 5 * time.Second
+	client := portierapi.NewClient(options, portierapi.DeviceKeyAuth{APIKey: p.deviceCredentials.ApiToken})
 
 	return func(report router.InitiationFailureReport) {
-		err := portierapi.ReportConnectionInitiationFailure(baseURL, apiKey, portierapi.ConnectionInitiationFailureRequest{
+		err := client.ReportConnectionInitiationFailure(context.Background(), portierapi.ConnectionInitiationFailureRequest{
 			ConnectingDeviceGUID: report.ConnectingDeviceGUID,
 			ConnectionID:         report.ConnectionID,
 			ErrorCode:            report.ErrorCode,
@@ -0,0 +1,298 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentConfigVersion is the schema version written by this version of portier-cli.
+// Configs without a version field are treated as version 0.
+const CurrentConfigVersion = 1
+
+// Migration upgrades the raw config document from version From to From+1.
+type Migration struct {
+	// From is the version this migration upgrades from
+	From int
+
+	// Description is a short, human readable summary of the migration
+	Description string
+
+	// Apply mutates the root mapping of the yaml document in place, keeping comments and key order.
+	// home is the portier home directory the config belongs to.
+	Apply func(root *yaml.Node, home string) error
+}
+
+// migrations is the ordered list of migrations, one per version step.
+var migrations = []Migration{
+	{
+		From:        0,
+		Description: "add missing tlsConfig defaults and relocate paths from a different home directory",
+		Apply:       migrateV0ToV1,
+	},
+}
+
+// MigrationResult describes the outcome of a migration run.
+type MigrationResult struct {
+	// FromVersion is the version found in the original config
+	FromVersion int
+
+	// ToVersion is the version after migration
+	ToVersion int
+
+	// Applied contains the descriptions of all migrations that were applied
+	Applied []string
+
+	// Original is the unmodified config content
+	Original []byte
+
+	// Migrated is the migrated config content. Equals Original if nothing was applied.
+	Migrated []byte
+
+	// BackupFile is the path of the backup written before rewriting the config, if any
+	BackupFile string
+}
+
+// Changed returns true if at least one migration was applied.
+func (r *MigrationResult) Changed() bool {
+	return len(r.Applied) > 0
+}
+
+// Diff returns a unified diff between the original and the migrated config.
+func (r *MigrationResult) Diff(name string) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(r.Original)),
+		B:        difflib.SplitLines(string(r.Migrated)),
+		FromFile: name,
+		ToFile:   fmt.Sprintf("%s (version %d)", name, r.ToVersion),
+		Context:  3,
+	})
+}
+
+// MigrateConfigData upgrades the given config content step by step to CurrentConfigVersion.
+// The migrations work on the yaml nodes, so comments and the order of keys are preserved.
+func MigrateConfigData(data []byte, home string) (*MigrationResult, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if doc.Kind == 0 {
+		// empty file
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("failed to parse config: expected a mapping at the top level")
+	}
+	root := doc.Content[0]
+
+	version, err := configVersion(root)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MigrationResult{
+		FromVersion: version,
+		ToVersion:   version,
+		Original:    data,
+		Migrated:    data,
+	}
+
+	if version > CurrentConfigVersion {
+		return nil, fmt.Errorf("config version %d is newer than the supported version %d, please upgrade portier-cli", version, CurrentConfigVersion)
+	}
+	if version == CurrentConfigVersion {
+		return result, nil
+	}
+
+	for _, m := range migrations {
+		if m.From != version {
+			continue
+		}
+		if err := m.Apply(root, home); err != nil {
+			return nil, fmt.Errorf("migration from version %d failed: %w", m.From, err)
+		}
+		version++
+		setVersion(root, version)
+		result.Applied = append(result.Applied, m.Description)
+	}
+
+	if version != CurrentConfigVersion {
+		return nil, fmt.Errorf("no migration path from config version %d to %d", version, CurrentConfigVersion)
+	}
+
+	var migrated bytes.Buffer
+	encoder := yaml.NewEncoder(&migrated)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to marshal migrated config: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to marshal migrated config: %w", err)
+	}
+	result.ToVersion = version
+	result.Migrated = migrated.Bytes()
+
+	return result, nil
+}
+
+// MigrateConfigFile migrates the config file at filePath. Unless dryRun is set, a backup of the
+// original file is written next to it before the migrated config replaces it.
+func MigrateConfigFile(filePath string, home string, dryRun bool) (*MigrationResult, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := MigrateConfigData(data, home)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun || !result.Changed() {
+		return result, nil
+	}
+
+	if err := writeMigratedConfig(filePath, data, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// writeMigratedConfig writes a backup of the original config content data and replaces the
+// config file with the migrated config of result.
+func writeMigratedConfig(filePath string, data []byte, result *MigrationResult) error {
+	backupFile, err := backupConfigFile(filePath, data, result.FromVersion)
+	if err != nil {
+		return err
+	}
+	result.BackupFile = backupFile
+
+	if err := os.WriteFile(filePath, result.Migrated, 0o644); err != nil {
+		return fmt.Errorf("failed to write migrated config: %w", err)
+	}
+	log.Printf("Migrated config %s from version %d to %d, backup written to %s", filePath, result.FromVersion, result.ToVersion, backupFile)
+	return nil
+}
+
+// readOnly returns true if err reports that a file or its directory cannot be written.
+func readOnly(err error) bool {
+	return errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EROFS)
+}
+
+// backupConfigFile writes the content of the config file with the given version next to it and
+// returns the path of the backup.
+func backupConfigFile(filePath string, data []byte, version int) (string, error) {
+	backupFile := fmt.Sprintf("%s.v%d-%s.bak", filePath, version, time.Now().Format("20060102150405"))
+	if err := os.WriteFile(backupFile, data, 0o600); err != nil {
+		return "", fmt.Errorf("failed to write config backup: %w", err)
+	}
+	return backupFile, nil
+}
+
+// dataConfigVersion returns the version of the given config content.
+func dataConfigVersion(data []byte) (int, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return 0, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) != 1 || root.Content[0].Kind != yaml.MappingNode {
+		return 0, nil
+	}
+	return configVersion(root.Content[0])
+}
+
+func configVersion(root *yaml.Node) (int, error) {
+	v := mappingValue(root, "version")
+	if v == nil || v.Tag == "!!null" {
+		return 0, nil
+	}
+	var version int
+	if err := v.Decode(&version); err != nil {
+		return 0, fmt.Errorf("invalid config version: %v", v.Value)
+	}
+	return version, nil
+}
+
+// setVersion sets the version field, a missing one is added as the first key.
+func setVersion(root *yaml.Node, version int) {
+	value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(version)}
+	if v := mappingValue(root, "version"); v != nil {
+		*v = *value
+		return
+	}
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "version"}
+	if len(root.Content) > 0 {
+		// keep a comment at the top of the file above the new key
+		key.HeadComment, root.Content[0].HeadComment = root.Content[0].HeadComment, ""
+	}
+	root.Content = append([]*yaml.Node{key, value}, root.Content...)
+}
+
+// mappingValue returns the value node of key in a mapping node, or nil if the key is missing.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue sets key in a mapping node to a string value, appending the key if missing.
+func setMappingValue(mapping *yaml.Node, key string, value string) {
+	node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	if v := mappingValue(mapping, key); v != nil {
+		*v = *node
+		return
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, node)
+}
+
+// migrateV0ToV1 fills in missing tlsConfig entries and rewrites TLS paths that point into a
+// home directory that does not exist on this machine (e.g. a config copied from another host).
+func migrateV0ToV1(root *yaml.Node, home string) error {
+	defaults := defaultPTLSConfig(home)
+	defaultPaths := []struct{ key, path string }{
+		{"certFile", defaults.CertFile},
+		{"keyFile", defaults.KeyFile},
+		{"caFile", defaults.CAFile},
+		{"knownHostsFile", defaults.KnownHostsFile},
+	}
+
+	tlsConfig := mappingValue(root, "tlsConfig")
+	switch {
+	case tlsConfig == nil:
+		tlsConfig = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "tlsConfig"}, tlsConfig)
+	case tlsConfig.Tag == "!!null":
+		*tlsConfig = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+	if tlsConfig.Kind != yaml.MappingNode {
+		return fmt.Errorf("tlsConfig is not a mapping")
+	}
+
+	for _, d := range defaultPaths {
+		current := ""
+		if v := mappingValue(tlsConfig, d.key); v != nil && v.Kind == yaml.ScalarNode && v.Tag != "!!null" {
+			current = v.Value
+		}
+		if current == "" {
+			setMappingValue(tlsConfig, d.key, d.path)
+			continue
+		}
+		if _, err := os.Stat(filepath.Dir(current)); os.IsNotExist(err) {
+			setMappingValue(tlsConfig, d.key, filepath.Join(home, filepath.Base(current)))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMigrateConfigDataFromV0(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	original := []byte(`portierUrl: wss://api.portier.dev/spider
+tlsEnabled: true
+tlsConfig:
+  certFile: /home/someone-else/.portier/cert.pem
+services: []
+`)
+
+	// WHEN
+	result, err := MigrateConfigData(original, home)
+
+	// THEN
+	require.NoError(t, err)
+	require.True(t, result.Changed())
+	require.Equal(t, 0, result.FromVersion)
+	require.Equal(t, CurrentConfigVersion, result.ToVersion)
+
+	migrated := make(map[string]interface{})
+	require.NoError(t, yaml.Unmarshal(result.Migrated, &migrated))
+	require.Equal(t, CurrentConfigVersion, migrated["version"])
+	tlsConfig := migrated["tlsConfig"].(map[string]interface{})
+	require.Equal(t, filepath.Join(home, "cert.pem"), tlsConfig["certFile"])
+	require.Equal(t, filepath.Join(home, "key.pem"), tlsConfig["keyFile"])
+	require.Equal(t, filepath.Join(home, "known_hosts"), tlsConfig["knownHostsFile"])
+
+	diff, err := result.Diff("config.yaml")
+	require.NoError(t, err)
+	require.Contains(t, diff, "+version: 1")
+}
+
+func TestMigrateConfigDataCurrentVersionUnchanged(t *testing.T) {
+	original := []byte("version: 1\ntlsEnabled: false\n")
+
+	result, err := MigrateConfigData(original, t.TempDir())
+
+	require.NoError(t, err)
+	require.False(t, result.Changed())
+	require.Equal(t, original, result.Migrated)
+}
+
+func TestMigrateConfigDataRejectsNewerVersion(t *testing.T) {
+	_, err := MigrateConfigData([]byte("version: 99\n"), t.TempDir())
+
+	require.Error(t, err)
+}
+
+func TestMigrateConfigFileWritesBackup(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	configFile := filepath.Join(home, "config.yaml")
+	original := []byte("tlsEnabled: true\n")
+	require.NoError(t, os.WriteFile(configFile, original, 0o644))
+
+	// WHEN dry run
+	result, err := MigrateConfigFile(configFile, home, true)
+
+	// THEN nothing is written
+	require.NoError(t, err)
+	require.True(t, result.Changed())
+	require.Empty(t, result.BackupFile)
+	content, _ := os.ReadFile(configFile)
+	require.Equal(t, original, content)
+
+	// WHEN
+	result, err = MigrateConfigFile(configFile, home, false)
+
+	// THEN
+	require.NoError(t, err)
+	backup, err := os.ReadFile(result.BackupFile)
+	require.NoError(t, err)
+	require.Equal(t, original, backup)
+	content, _ = os.ReadFile(configFile)
+	require.Equal(t, result.Migrated, content)
+}
+
+func TestMigrateConfigDataKeepsCommentsAndKeyOrder(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	original := []byte(`# relay of the company deployment
+portierUrl: wss://portier.example.com/spider
+tlsEnabled: true # required by the target hosts
+services: []
+`)
+
+	// WHEN
+	result, err := MigrateConfigData(original, home)
+
+	// THEN
+	require.NoError(t, err)
+	migrated := string(result.Migrated)
+	require.Contains(t, migrated, "# relay of the company deployment\n")
+	require.Contains(t, migrated, "tlsEnabled: true # required by the target hosts\n")
+	require.Less(t, strings.Index(migrated, "version:"), strings.Index(migrated, "portierUrl:"))
+	require.Less(t, strings.Index(migrated, "portierUrl:"), strings.Index(migrated, "tlsEnabled:"))
+	require.Less(t, strings.Index(migrated, "services:"), strings.Index(migrated, "tlsConfig:"))
+	require.Contains(t, migrated, "tlsConfig:\n  certFile: "+filepath.Join(home, "cert.pem"))
+}
+
+func TestLoadConfigMigratesOutdatedConfig(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	configFile := filepath.Join(home, "config.yaml")
+	original := []byte("# relay of the company deployment\ntlsEnabled: true\n")
+	require.NoError(t, os.WriteFile(configFile, original, 0o644))
+
+	// WHEN
+	loaded, err := LoadConfig(configFile)
+
+	// THEN the config is migrated relative to the directory of the config file and rewritten
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(home, "cert.pem"), loaded.PTLSConfig.CertFile)
+	content, _ := os.ReadFile(configFile)
+	require.Contains(t, string(content), "version: 1\n")
+	require.Contains(t, string(content), "# relay of the company deployment\n")
+	backups, _ := filepath.Glob(configFile + ".v0-*.bak")
+	require.Len(t, backups, 1)
+	backup, _ := os.ReadFile(backups[0])
+	require.Equal(t, original, backup)
+}
+
+func TestLoadConfigMigratesReadOnlyConfigInMemory(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write read-only files")
+	}
+	// GIVEN a config in a read-only directory
+	home := t.TempDir()
+	configFile := filepath.Join(home, "config.yaml")
+	original := []byte("tlsEnabled: true\n")
+	require.NoError(t, os.WriteFile(configFile, original, 0o444))
+	require.NoError(t, os.Chmod(home, 0o555))
+	t.Cleanup(func() { _ = os.Chmod(home, 0o755) })
+
+	// WHEN
+	loaded, err := LoadConfig(configFile)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, CurrentConfigVersion, loaded.Version)
+	require.Equal(t, filepath.Join(home, "cert.pem"), loaded.PTLSConfig.CertFile)
+	content, _ := os.ReadFile(configFile)
+	require.Equal(t, original, content)
+}
+
+func TestSaveConfigBacksUpOutdatedConfig(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	configFile := filepath.Join(home, "config.yaml")
+	original := []byte("# relay of the company deployment\ntlsEnabled: true\n")
+	require.NoError(t, os.WriteFile(configFile, original, 0o644))
+	loaded, err := LoadConfig(configFile)
+	require.NoError(t, err)
+
+	// WHEN
+	require.NoError(t, SaveConfig(configFile, loaded))
+	require.NoError(t, SaveConfig(configFile, loaded))
+
+	// THEN the original file is kept once
+	backups, _ := filepath.Glob(configFile + ".v0-*.bak")
+	require.Len(t, backups, 1)
+	backup, _ := os.ReadFile(backups[0])
+	require.Equal(t, original, backup)
+	saved, err := LoadConfig(configFile)
+	require.NoError(t, err)
+	require.Equal(t, CurrentConfigVersion, saved.Version)
+}
@@ -0,0 +1,567 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/pflag"
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ValueSource describes where the effective value of a config field comes from.
+type ValueSource string
+
+const (
+	SourceDefault ValueSource = "default"
+	SourceFile    ValueSource = "file"
+	SourceEnv     ValueSource = "env"
+	SourceFlag    ValueSource = "flag"
+)
+
+// ServicesKey is the key of the services list in EffectiveConfig.Sources and in flag values.
+const ServicesKey = "services"
+
+// ServicesEnv holds a JSON (or YAML) list of services, replacing the services of the config file.
+const ServicesEnv = "PORTIER_SERVICES"
+
+// serviceEnvPrefix is the prefix of indexed service variables, e.g. PORTIER_SERVICE_0_NAME.
+const serviceEnvPrefix = "PORTIER_SERVICE_"
+
+// OverrideField describes a PortierConfig field that can be overridden by an environment variable or a flag.
+type OverrideField struct {
+	// Key is the yaml path of the field, e.g. "tlsConfig.certFile"
+	Key string
+
+	// Env is the name of the environment variable
+	Env string
+
+	// Flag is the name of the command line flag
+	Flag string
+
+	// Usage is the flag's help text
+	Usage string
+
+	kind fieldKind
+	set  func(*PortierConfig, string) error
+	get  func(*PortierConfig) string
+}
+
+// fieldKind is the type of an OverrideField, it determines the type of its flag.
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindBool
+	kindInt
+	kindDuration
+)
+
+var overrideFields = []OverrideField{
+	{
+		Key: "portierUrl", Env: "PORTIER_URL", Flag: "portier-url", Usage: "websocket URL of the portier relay",
+		set: func(c *PortierConfig, v string) error { return setURL(&c.PortierURL, v) },
+		get: func(c *PortierConfig) string { return urlString(c.PortierURL) },
+	},
+	{
+		Key: "apiUrl", Env: "PORTIER_API_URL", Flag: "api-url", Usage: "base URL of the portier API, derived from portierUrl if not set",
+		set: func(c *PortierConfig, v string) error { c.APIURL = v; return nil },
+		get: func(c *PortierConfig) string { return c.APIURL },
+	},
+	{
+		Key: "auth.issuer", Env: "PORTIER_AUTH_ISSUER", Flag: "auth-issuer", Usage: "OIDC issuer used for login, derived from apiUrl if not set",
+		set: func(c *PortierConfig, v string) error { c.Auth.Issuer = v; return nil },
+		get: func(c *PortierConfig) string { return c.Auth.Issuer },
+	},
+	{
+		Key: "auth.clientId", Env: "PORTIER_AUTH_CLIENT_ID", Flag: "auth-client-id", Usage: "OAuth client id used for login",
+		set: func(c *PortierConfig, v string) error { c.Auth.ClientID = v; return nil },
+		get: func(c *PortierConfig) string { return c.Auth.ClientID },
+	},
+	{
+		Key: "auth.audience", Env: "PORTIER_AUTH_AUDIENCE", Flag: "auth-audience", Usage: "audience of API access tokens",
+		set: func(c *PortierConfig, v string) error { c.Auth.Audience = v; return nil },
+		get: func(c *PortierConfig) string { return c.Auth.Audience },
+	},
+	{
+		Key: "tlsEnabled", Env: "PORTIER_TLS_ENABLED", Flag: "tls-enabled", Usage: "enable end-to-end TLS",
+		kind: kindBool,
+		set:  func(c *PortierConfig, v string) error { return setBool(&c.TLSEnabled, v) },
+		get:  func(c *PortierConfig) string { return strconv.FormatBool(c.TLSEnabled) },
+	},
+	{
+		Key: "tlsConfig.certFile", Env: "PORTIER_TLS_CERT_FILE", Flag: "tls-cert-file", Usage: "TLS certificate file",
+		set: func(c *PortierConfig, v string) error { c.PTLSConfig.CertFile = v; return nil },
+		get: func(c *PortierConfig) string { return c.PTLSConfig.CertFile },
+	},
+	{
+		Key: "tlsConfig.keyFile", Env: "PORTIER_TLS_KEY_FILE", Flag: "tls-key-file", Usage: "TLS private key file",
+		set: func(c *PortierConfig, v string) error { c.PTLSConfig.KeyFile = v; return nil },
+		get: func(c *PortierConfig) string { return c.PTLSConfig.KeyFile },
+	},
+	{
+		Key: "tlsConfig.caFile", Env: "PORTIER_TLS_CA_FILE", Flag: "tls-ca-file", Usage: "TLS CA certificate file",
+		set: func(c *PortierConfig, v string) error { c.PTLSConfig.CAFile = v; return nil },
+		get: func(c *PortierConfig) string { return c.PTLSConfig.CAFile },
+	},
+	{
+		Key: "tlsConfig.crlFile", Env: "PORTIER_TLS_CRL_FILE", Flag: "tls-crl-file", Usage: "TLS certificate revocation list of the CA",
+		set: func(c *PortierConfig, v string) error { c.PTLSConfig.CRLFile = v; return nil },
+		get: func(c *PortierConfig) string { return c.PTLSConfig.CRLFile },
+	},
+	{
+		Key: "tlsConfig.knownHostsFile", Env: "PORTIER_TLS_KNOWN_HOSTS_FILE", Flag: "tls-known-hosts-file", Usage: "known_hosts file",
+		set: func(c *PortierConfig, v string) error { c.PTLSConfig.KnownHostsFile = v; return nil },
+		get: func(c *PortierConfig) string { return c.PTLSConfig.KnownHostsFile },
+	},
+	{
+		Key: "tlsConfig.requireTls", Env: "PORTIER_TLS_REQUIRE_TLS", Flag: "tls-require-tls", Usage: "comma-separated targets that only accept TLS encrypted connections, e.g. 22,db.local:5432",
+		set: func(c *PortierConfig, v string) error { c.PTLSConfig.RequireTLS = splitList(v); return nil },
+		get: func(c *PortierConfig) string { return strings.Join(c.PTLSConfig.RequireTLS, ",") },
+	},
+	{
+		Key: "tlsConfig.noise", Env: "PORTIER_TLS_NOISE", Flag: "tls-noise", Usage: "encrypt the messages of connections with Noise, if the peer accepts it",
+		kind: kindBool,
+		set:  func(c *PortierConfig, v string) error { return setBool(&c.PTLSConfig.Noise, v) },
+		get:  func(c *PortierConfig) string { return strconv.FormatBool(c.PTLSConfig.Noise) },
+	},
+	{
+		Key: "tlsConfig.requireNoise", Env: "PORTIER_TLS_REQUIRE_NOISE", Flag: "tls-require-noise", Usage: "refuse connections to peers that are neither Noise nor TLS encrypted, never fall back from Noise",
+		kind: kindBool,
+		set:  func(c *PortierConfig, v string) error { return setBool(&c.PTLSConfig.RequireNoise, v) },
+		get:  func(c *PortierConfig) string { return strconv.FormatBool(c.PTLSConfig.RequireNoise) },
+	},
+	{
+		Key: "tlsConfig.handshakeTimeout", Env: "PORTIER_TLS_HANDSHAKE_TIMEOUT", Flag: "tls-handshake-timeout", Usage: "time a TLS handshake with a peer may take, e.g. 15s",
+		kind: kindDuration,
+		set:  func(c *PortierConfig, v string) error { return setDuration(&c.PTLSConfig.HandshakeTimeout, v) },
+		get:  func(c *PortierConfig) string { return c.PTLSConfig.HandshakeTimeout.String() },
+	},
+	{
+		Key: "tlsConfig.sessionCacheSize", Env: "PORTIER_TLS_SESSION_CACHE_SIZE", Flag: "tls-session-cache-size", Usage: "TLS sessions cached per peer for resumption, -1 disables resumption",
+		kind: kindInt,
+		set:  func(c *PortierConfig, v string) error { return setInt(&c.PTLSConfig.SessionCacheSize, v) },
+		get:  func(c *PortierConfig) string { return strconv.Itoa(c.PTLSConfig.SessionCacheSize) },
+	},
+	{
+		Key: "tlsConfig.tofu", Env: "PORTIER_TLS_TOFU", Flag: "tls-tofu", Usage: "trust peer devices that are not in known_hosts on first use",
+		kind: kindBool,
+		set:  func(c *PortierConfig, v string) error { return setBool(&c.PTLSConfig.TOFU, v) },
+		get:  func(c *PortierConfig) string { return strconv.FormatBool(c.PTLSConfig.TOFU) },
+	},
+	{
+		Key: "tlsConfig.auditFile", Env: "PORTIER_TLS_AUDIT_FILE", Flag: "tls-audit-file", Usage: "path to the audit log of pinned and changed peer certificates",
+		set: func(c *PortierConfig, v string) error { c.PTLSConfig.AuditFile = v; return nil },
+		get: func(c *PortierConfig) string { return c.PTLSConfig.AuditFile },
+	},
+	{
+		Key: "defaultResponseInterval", Env: "PORTIER_DEFAULT_RESPONSE_INTERVAL", Flag: "default-response-interval", Usage: "default connection response interval, e.g. 1s",
+		kind: kindDuration,
+		set:  func(c *PortierConfig, v string) error { return setDuration(&c.DefaultResponseInterval, v) },
+		get:  func(c *PortierConfig) string { return c.DefaultResponseInterval.String() },
+	},
+	{
+		Key: "defaultReadTimeout", Env: "PORTIER_DEFAULT_READ_TIMEOUT", Flag: "default-read-timeout", Usage: "default connection read timeout, e.g. 1s",
+		kind: kindDuration,
+		set:  func(c *PortierConfig, v string) error { return setDuration(&c.DefaultReadTimeout, v) },
+		get:  func(c *PortierConfig) string { return c.DefaultReadTimeout.String() },
+	},
+	{
+		Key: "defaultThroughputLimit", Env: "PORTIER_DEFAULT_THROUGHPUT_LIMIT", Flag: "default-throughput-limit", Usage: "default throughput limit in bytes per second",
+		kind: kindInt,
+		set:  func(c *PortierConfig, v string) error { return setInt(&c.DefaultThroughputLimit, v) },
+		get:  func(c *PortierConfig) string { return strconv.Itoa(c.DefaultThroughputLimit) },
+	},
+	{
+		Key: "defaultReadBufferSize", Env: "PORTIER_DEFAULT_READ_BUFFER_SIZE", Flag: "default-read-buffer-size", Usage: "default read buffer size in bytes",
+		kind: kindInt,
+		set:  func(c *PortierConfig, v string) error { return setInt(&c.DefaultReadBufferSize, v) },
+		get:  func(c *PortierConfig) string { return strconv.Itoa(c.DefaultReadBufferSize) },
+	},
+	{
+		Key: "defaultDatagramConnectionId", Env: "PORTIER_DEFAULT_DATAGRAM_CONNECTION_ID", Flag: "default-datagram-connection-id", Usage: "default datagram connection id",
+		set: func(c *PortierConfig, v string) error {
+			c.DefaultDatagramConnectionID = messages.ConnectionID(v)
+			return nil
+		},
+		get: func(c *PortierConfig) string { return string(c.DefaultDatagramConnectionID) },
+	},
+}
+
+// OverrideFields returns all config fields that can be overridden by environment variables and flags.
+func OverrideFields() []OverrideField {
+	return overrideFields
+}
+
+// Value returns the field's current value in the given config, formatted as a string.
+func (f OverrideField) Value(c *PortierConfig) string {
+	return f.get(c)
+}
+
+// Set parses v and assigns it to the field in the given config.
+func (f OverrideField) Set(c *PortierConfig, v string) error {
+	return f.set(c, v)
+}
+
+// EffectiveConfig is the config resolved from defaults, file, environment and flags,
+// together with the source of each value.
+type EffectiveConfig struct {
+	Config *PortierConfig
+
+	// Sources maps each OverrideField.Key, and ServicesKey, to the source of its value
+	Sources map[string]ValueSource
+}
+
+// AddOverrideFlags registers one flag per overridable config field, and one for the services.
+func AddOverrideFlags(flags *pflag.FlagSet) {
+	for _, field := range overrideFields {
+		usage := fmt.Sprintf("%s (env %s)", field.Usage, field.Env)
+		switch field.kind {
+		case kindBool:
+			flags.Bool(field.Flag, false, usage)
+		case kindInt:
+			flags.Int(field.Flag, 0, usage)
+		case kindDuration:
+			flags.Duration(field.Flag, 0, usage)
+		default:
+			flags.String(field.Flag, "", usage)
+		}
+	}
+	flags.String(ServicesKey, "", fmt.Sprintf("JSON list of services, replaces the services of the config file (env %s)", ServicesEnv))
+}
+
+// apiURLFlagAlias is the former name of the --api-url flag, which is still accepted.
+const apiURLFlagAlias = "apiUrl"
+
+// NormalizeFlagName accepts --apiUrl, the former name of the API URL flag, as --api-url. It is
+// the global normalization function of the root command, AddAPIURLFlag sets it as well.
+func NormalizeFlagName(_ *pflag.FlagSet, name string) pflag.NormalizedName {
+	if name == apiURLFlagAlias {
+		return pflag.NormalizedName(apiURLField().Flag)
+	}
+	return pflag.NormalizedName(name)
+}
+
+// AddAPIURLFlag registers the --api-url override flag, short -a, bound to target. It is meant
+// for commands that are also run on their own, without the flags of the root command. Below the
+// root command it replaces the inherited flag, so there is a single API URL flag either way.
+func AddAPIURLFlag(flags *pflag.FlagSet, target *string) {
+	field := apiURLField()
+	flags.SetNormalizeFunc(NormalizeFlagName)
+	flags.StringVarP(target, field.Flag, "a", "", fmt.Sprintf("%s (env %s)", field.Usage, field.Env))
+}
+
+func apiURLField() OverrideField {
+	for _, field := range overrideFields {
+		if field.Key == "apiUrl" {
+			return field
+		}
+	}
+	panic("apiUrl is not an override field")
+}
+
+// FlagValues returns the values of the override flags that were set explicitly in flags, keyed
+// by OverrideField.Key (or ServicesKey), as expected by LoadEffectiveConfig.
+func FlagValues(flags *pflag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	for _, field := range overrideFields {
+		if flags.Changed(field.Flag) {
+			values[field.Key] = flags.Lookup(field.Flag).Value.String()
+		}
+	}
+	if flags.Changed(ServicesKey) {
+		values[ServicesKey], _ = flags.GetString(ServicesKey)
+	}
+	return values
+}
+
+// FlagArgs returns the command line arguments that set the override flags in flagValues, the
+// inverse of FlagValues. It is used to pass the overrides on to another portier-cli process.
+func FlagArgs(flagValues map[string]string) []string {
+	var args []string
+	for _, field := range overrideFields {
+		if v, ok := flagValues[field.Key]; ok {
+			args = append(args, fmt.Sprintf("--%s=%s", field.Flag, v))
+		}
+	}
+	if v, ok := flagValues[ServicesKey]; ok {
+		args = append(args, fmt.Sprintf("--%s=%s", ServicesKey, v))
+	}
+	return args
+}
+
+// LoadEffectiveConfig loads the config file and applies overrides with the precedence
+// flags > env > file > defaults. flagValues maps OverrideField.Key (or ServicesKey) to the
+// raw flag value and only contains flags that were set explicitly, see FlagValues.
+func LoadEffectiveConfig(filePath string, flagValues map[string]string) (*EffectiveConfig, error) {
+	config, err := LoadConfig(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fileKeys, err := presentFileKeys(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EffectiveConfig{
+		Config:  config,
+		Sources: make(map[string]ValueSource),
+	}
+
+	for _, field := range overrideFields {
+		result.Sources[field.Key] = SourceDefault
+		if fileKeys[field.Key] {
+			result.Sources[field.Key] = SourceFile
+		}
+		if v, ok := os.LookupEnv(field.Env); ok {
+			if err := field.set(config, v); err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %w", field.Env, err)
+			}
+			result.Sources[field.Key] = SourceEnv
+		}
+		if v, ok := flagValues[field.Key]; ok {
+			if err := field.set(config, v); err != nil {
+				return nil, fmt.Errorf("invalid value for --%s: %w", field.Flag, err)
+			}
+			result.Sources[field.Key] = SourceFlag
+		}
+	}
+
+	result.Sources[ServicesKey] = SourceDefault
+	if fileKeys[ServicesKey] {
+		result.Sources[ServicesKey] = SourceFile
+	}
+	services, ok, err := servicesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		config.Services = services
+		result.Sources[ServicesKey] = SourceEnv
+	}
+	if v, ok := flagValues[ServicesKey]; ok {
+		services, err := parseServices(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for --services: %w", err)
+		}
+		config.Services = services
+		result.Sources[ServicesKey] = SourceFlag
+	}
+
+	return result, nil
+}
+
+// presentFileKeys returns the override keys that are set in the config file.
+func presentFileKeys(filePath string) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return keys, nil
+		}
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	for _, field := range overrideFields {
+		var current interface{} = raw
+		for _, part := range strings.Split(field.Key, ".") {
+			m, ok := current.(map[string]interface{})
+			if !ok {
+				current = nil
+				break
+			}
+			current = m[part]
+		}
+		keys[field.Key] = current != nil
+	}
+	_, keys[ServicesKey] = raw[ServicesKey]
+
+	return keys, nil
+}
+
+// servicesFromEnv reads services from PORTIER_SERVICES and from indexed variables
+// PORTIER_SERVICE_<n>_<FIELD>, n starting at 0. Indexed services are appended to the list.
+func servicesFromEnv() ([]Service, bool, error) {
+	services := []Service{}
+	found := false
+
+	if v, ok := os.LookupEnv(ServicesEnv); ok {
+		parsed, err := parseServices(v)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid value for %s: %w", ServicesEnv, err)
+		}
+		services = append(services, parsed...)
+		found = true
+	}
+
+	for i := 0; ; i++ {
+		prefix := fmt.Sprintf("%s%d_", serviceEnvPrefix, i)
+		service := Service{}
+		indexedFound := false
+		for _, field := range serviceFields {
+			v, ok := os.LookupEnv(prefix + field.suffix)
+			if !ok {
+				continue
+			}
+			if err := field.set(&service, v); err != nil {
+				return nil, false, fmt.Errorf("invalid value for %s%s: %w", prefix, field.suffix, err)
+			}
+			indexedFound = true
+		}
+		if !indexedFound {
+			break
+		}
+		services = append(services, service)
+		found = true
+	}
+
+	return services, found, nil
+}
+
+// parseServices parses a JSON or YAML list of services.
+func parseServices(v string) ([]Service, error) {
+	services := []Service{}
+	if err := yamlv2.Unmarshal([]byte(v), &services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+type serviceField struct {
+	suffix string
+	key    string
+	set    func(*Service, string) error
+	get    func(*Service) string
+}
+
+var serviceFields = []serviceField{
+	{
+		suffix: "NAME", key: "name",
+		set: func(s *Service, v string) error { s.Name = v; return nil },
+		get: func(s *Service) string { return s.Name },
+	},
+	{
+		suffix: "URL_LOCAL", key: "options.urlLocal",
+		set: func(s *Service, v string) error { return setURL(&s.Options.URLLocal, v) },
+		get: func(s *Service) string { return urlString(s.Options.URLLocal) },
+	},
+	{
+		suffix: "URL_REMOTE", key: "options.urlRemote",
+		set: func(s *Service, v string) error { return setURL(&s.Options.URLRemote, v) },
+		get: func(s *Service) string { return urlString(s.Options.URLRemote) },
+	},
+	{
+		suffix: "PEER_DEVICE_ID", key: "options.peerDeviceID",
+		set: func(s *Service, v string) error {
+			id, err := uuid.Parse(v)
+			s.Options.PeerDeviceID = id
+			return err
+		},
+		get: func(s *Service) string { return s.Options.PeerDeviceID.String() },
+	},
+	{
+		suffix: "TLS_ENABLED", key: "options.tlsEnabled",
+		set: func(s *Service, v string) error { return setBool(&s.Options.TLSEnabled, v) },
+		get: func(s *Service) string { return strconv.FormatBool(s.Options.TLSEnabled) },
+	},
+	{
+		suffix: "CONNECTION_READ_TIMEOUT", key: "options.connectionReadTimeout",
+		set: func(s *Service, v string) error { return setDuration(&s.Options.ConnectionReadTimeout, v) },
+		get: func(s *Service) string { return s.Options.ConnectionReadTimeout.String() },
+	},
+	{
+		suffix: "READ_BUFFER_SIZE", key: "options.readBufferSize",
+		set: func(s *Service, v string) error { return setInt(&s.Options.ReadBufferSize, v) },
+		get: func(s *Service) string { return strconv.Itoa(s.Options.ReadBufferSize) },
+	},
+	{
+		suffix: "COMPRESSION", key: "options.compression",
+		set: func(s *Service, v string) error { s.Options.Compression = v; return nil },
+		get: func(s *Service) string { return s.Options.Compression },
+	},
+}
+
+// ServiceFieldValue is the value of a field of a service, formatted as a string.
+type ServiceFieldValue struct {
+	// Key is the path of the field within a service of the config file, e.g. options.urlLocal
+	Key string
+
+	Value string
+}
+
+// ServiceFieldValues returns the values of all fields of the service that can be overridden by
+// environment variables and flags.
+func ServiceFieldValues(s Service) []ServiceFieldValue {
+	values := make([]ServiceFieldValue, 0, len(serviceFields))
+	for _, field := range serviceFields {
+		values = append(values, ServiceFieldValue{Key: field.key, Value: field.get(&s)})
+	}
+	return values
+}
+
+func setURL(target *utils.YAMLURL, v string) error {
+	parsed, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	target.URL = parsed
+	return nil
+}
+
+func urlString(u utils.YAMLURL) string {
+	if u.URL == nil {
+		return ""
+	}
+	return u.String()
+}
+
+func setBool(target *bool, v string) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	*target = b
+	return nil
+}
+
+func setInt(target *int, v string) error {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*target = i
+	return nil
+}
+
+func setDuration(target *time.Duration, v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*target = d
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
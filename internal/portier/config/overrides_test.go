@@ -0,0 +1,136 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadEffectiveConfigPrecedence(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	t.Setenv("PORTIER_HOME", home)
+	configFile := filepath.Join(home, "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(`version: 1
+tlsEnabled: true
+defaultReadTimeout: 5s
+defaultReadBufferSize: 1024
+`), 0o644))
+	t.Setenv("PORTIER_DEFAULT_READ_TIMEOUT", "7s")
+	t.Setenv("PORTIER_DEFAULT_READ_BUFFER_SIZE", "2048")
+
+	// WHEN
+	effective, err := LoadEffectiveConfig(configFile, map[string]string{
+		"defaultReadBufferSize": "8192",
+	})
+
+	// THEN
+	require.NoError(t, err)
+	require.True(t, effective.Config.TLSEnabled)
+	require.Equal(t, SourceFile, effective.Sources["tlsEnabled"])
+	require.Equal(t, 7*time.Second, effective.Config.DefaultReadTimeout)
+	require.Equal(t, SourceEnv, effective.Sources["defaultReadTimeout"])
+	require.Equal(t, 8192, effective.Config.DefaultReadBufferSize)
+	require.Equal(t, SourceFlag, effective.Sources["defaultReadBufferSize"])
+	require.Equal(t, SourceDefault, effective.Sources["defaultThroughputLimit"])
+}
+
+func TestLoadEffectiveConfigServicesFromEnv(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	t.Setenv("PORTIER_HOME", home)
+	t.Setenv(ServicesEnv, `[{"name": "ssh", "options": {"urlLocal": "tcp://localhost:2222", "urlRemote": "tcp://localhost:22", "peerDeviceID": "00000000-0000-0000-0000-000000000002", "tlsEnabled": true}}]`)
+	t.Setenv("PORTIER_SERVICE_0_NAME", "web")
+	t.Setenv("PORTIER_SERVICE_0_URL_LOCAL", "tcp://localhost:8080")
+	t.Setenv("PORTIER_SERVICE_0_URL_REMOTE", "tcp://localhost:80")
+	t.Setenv("PORTIER_SERVICE_0_PEER_DEVICE_ID", "00000000-0000-0000-0000-000000000003")
+	t.Setenv("PORTIER_SERVICE_0_COMPRESSION", "zstd")
+
+	// WHEN
+	effective, err := LoadEffectiveConfig(filepath.Join(home, "config.yaml"), nil)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, SourceEnv, effective.Sources[ServicesKey])
+	require.Len(t, effective.Config.Services, 2)
+	require.Equal(t, "ssh", effective.Config.Services[0].Name)
+	require.Equal(t, "localhost:2222", effective.Config.Services[0].Options.URLLocal.Host)
+	require.True(t, effective.Config.Services[0].Options.TLSEnabled)
+	require.Equal(t, "web", effective.Config.Services[1].Name)
+	require.Equal(t, "00000000-0000-0000-0000-000000000003", effective.Config.Services[1].Options.PeerDeviceID.String())
+	require.Equal(t, "zstd", effective.Config.Services[1].Options.Compression)
+}
+
+func TestLoadEffectiveConfigRejectsInvalidEnv(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("PORTIER_HOME", home)
+	t.Setenv("PORTIER_TLS_ENABLED", "maybe")
+
+	_, err := LoadEffectiveConfig(filepath.Join(home, "config.yaml"), nil)
+
+	require.Error(t, err)
+}
+
+func TestOverrideFlagsAreTyped(t *testing.T) {
+	// GIVEN
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	AddOverrideFlags(flags)
+
+	// WHEN a bool flag is given without value
+	err := flags.Parse([]string{"--tls-enabled", "--tls-tofu=false", "--tls-session-cache-size", "5", "--tls-handshake-timeout", "3s", "--api-url", "https://api.example.com"})
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, "bool", flags.Lookup("tls-enabled").Value.Type())
+	require.Equal(t, "int", flags.Lookup("tls-session-cache-size").Value.Type())
+	require.Equal(t, "duration", flags.Lookup("tls-handshake-timeout").Value.Type())
+	require.Equal(t, map[string]string{
+		"tlsEnabled":                 "true",
+		"tlsConfig.tofu":             "false",
+		"tlsConfig.sessionCacheSize": "5",
+		"tlsConfig.handshakeTimeout": "3s",
+		"apiUrl":                     "https://api.example.com",
+	}, FlagValues(flags))
+	require.Error(t, flags.Parse([]string{"--tls-session-cache-size", "many"}))
+}
+
+func TestFlagArgsRoundTrip(t *testing.T) {
+	// GIVEN
+	values := map[string]string{
+		"portierUrl":            "wss://portier.example.com/spider",
+		"tlsConfig.requireTls":  "22,db.local:5432",
+		"tlsEnabled":            "false",
+		"defaultReadBufferSize": "8192",
+		ServicesKey:             `[{"name": "web"}]`,
+	}
+
+	// WHEN
+	args := FlagArgs(values)
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	AddOverrideFlags(flags)
+	err := flags.Parse(args)
+
+	// THEN
+	require.NoError(t, err)
+	require.Contains(t, args, "--tls-enabled=false")
+	require.Equal(t, values, FlagValues(flags))
+}
+
+func TestAPIURLFlagAcceptsFormerName(t *testing.T) {
+	// GIVEN
+	var apiURL string
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	AddAPIURLFlag(flags, &apiURL)
+
+	// WHEN
+	err := flags.Parse([]string{"--apiUrl", "https://api.example.com"})
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, "https://api.example.com", apiURL)
+	require.Equal(t, map[string]string{"apiUrl": "https://api.example.com"}, FlagValues(flags))
+}
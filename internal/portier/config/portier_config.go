@@ -1,6 +1,7 @@
 package config
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/url"
@@ -17,7 +18,10 @@ import (
 )
 
 type PortierConfig struct {
+	Version                     int                   `yaml:"version"`
 	PortierURL                  utils.YAMLURL         `yaml:"portierUrl"`
+	APIURL                      string                `yaml:"apiUrl,omitempty"`
+	Auth                        AuthConfig            `yaml:"auth,omitempty"`
 	TLSEnabled                  bool                  `yaml:"tlsEnabled"`
 	PTLSConfig                  PTLSConfig            `yaml:"tlsConfig"`
 	Services                    []Service             `yaml:"services"`
@@ -28,6 +32,22 @@ type PortierConfig struct {
 	DefaultDatagramConnectionID messages.ConnectionID `yaml:"defaultDatagramConnectionId"`
 }
 
+// AuthConfig configures the identity provider used by login. Unset values are derived
+// from the API URL, see PortierConfig.Endpoints.
+type AuthConfig struct {
+	// OIDC issuer URL, its endpoints are found via OIDC discovery
+	// default: https://auth.portier.dev for portier.dev, the API origin otherwise
+	Issuer string `yaml:"issuer,omitempty"`
+
+	// OAuth client id of portier-cli
+	// default: portier.dev's client id for portier.dev, "portier-cli" otherwise
+	ClientID string `yaml:"clientId,omitempty"`
+
+	// audience of the API access tokens
+	// default: the API origin
+	Audience string `yaml:"audience,omitempty"`
+}
+
 type DeviceCredentials struct {
 	// DeviceID is filled at runtime using the whoami endpoint and is not persisted
 	DeviceID uuid.UUID `yaml:"-"`
@@ -53,6 +73,13 @@ type ServiceOptions struct {
 
 	// The TCP read buffer size
 	ReadBufferSize int `yaml:"readBufferSize"`
+
+	// Compression compresses the data of the service's connections if the peer supports it:
+	// "zstd", "snappy" or "none" (default). On TLS and Noise encrypted connections the data is
+	// compressed before it is encrypted, the size of the encrypted data can reveal secrets that
+	// are sent together with data an attacker controls (CRIME/BREACH). Leave it off for such
+	// services, e.g. HTTP with cookies or tokens and reflected input.
+	Compression string `yaml:"compression,omitempty"`
 }
 
 // Service is a service that is exposed by the portier server as a TCP or UDP service. Each Service
@@ -85,10 +112,54 @@ type PTLSConfig struct {
 	// default: not set
 	CAFile string `yaml:"caFile"`
 
+	// CRL file path, containing the certificate revocation list of the CA
+	// If it exists, peer certificates revoked by the CA are rejected. Only used if CAFile is set.
+	// default: "{home}/ca.crl"
+	CRLFile string `yaml:"crlFile"`
+
 	// KnownHosts is a local file containing a map of known certificate fingerprints to deviceID, for
 	// verifying the peer's certificate. Only used if CAFile is not set.
 	// default: {home}/known_hosts
 	KnownHostsFile string `yaml:"knownHostsFile"`
+
+	// RequireTLS lists the targets of this device that only accept TLS encrypted connections from
+	// peers: "*" for all, a port ("22"), a host ("db.local") or a host and port ("db.local:5432").
+	// Peers opening an unencrypted connection to such a target are refused.
+	// default: empty
+	RequireTLS []string `yaml:"requireTls,omitempty"`
+
+	// Noise enables Noise encryption of the messages of connections, including the connection
+	// requests with the target URL. Used for peers that enabled it as well, which this device
+	// learns about from their connection accept messages. Requires Ed25519 device keys.
+	// default: false
+	Noise bool `yaml:"noise,omitempty"`
+
+	// RequireNoise refuses outbound connections that would not be Noise encrypted: a peer whose
+	// key no longer verifies is not connected to without Noise. Connections to peers whose key
+	// is not known yet must be TLS encrypted, they learn the key. Requires Noise.
+	// default: false
+	RequireNoise bool `yaml:"requireNoise,omitempty"`
+
+	// HandshakeTimeout is the time a TLS handshake with a peer may take. A connection whose
+	// handshake does not complete in time is closed.
+	// default: 15s
+	HandshakeTimeout time.Duration `yaml:"handshakeTimeout,omitempty"`
+
+	// SessionCacheSize is the number of TLS sessions cached per peer device. Repeated connections
+	// to a peer resume a cached session instead of a full handshake. -1 disables resumption.
+	// default: 16
+	SessionCacheSize int `yaml:"sessionCacheSize,omitempty"`
+
+	// TOFU trusts peer devices that are not in the known hosts file on first use, for devices that
+	// cannot ask for confirmation. The first verified certificate of a peer is pinned, a later
+	// change is rejected, reported and recorded in the audit log. Only used if CAFile does not exist.
+	// default: false
+	TOFU bool `yaml:"tofu,omitempty"`
+
+	// AuditFile is a local file recording the certificates pinned on first use and rejected
+	// certificate changes of peers, one JSON object per line
+	// default: {home}/tls_audit.log
+	AuditFile string `yaml:"auditFile,omitempty"`
 }
 
 func defaultPTLSConfig(home string) *PTLSConfig {
@@ -96,13 +167,17 @@ func defaultPTLSConfig(home string) *PTLSConfig {
 		CertFile:       filepath.Join(home, "cert.pem"),
 		KeyFile:        filepath.Join(home, "key.pem"),
 		CAFile:         filepath.Join(home, "cacert.pem"),
+		CRLFile:        filepath.Join(home, "ca.crl"),
 		KnownHostsFile: filepath.Join(home, "known_hosts"),
+		AuditFile:      filepath.Join(home, "tls_audit.log"),
 	}
 
 	return &result
 }
 
-// LoadConfig loads the config from the given file path.
+// LoadConfig loads the config from the given file path. Configs with an older schema version
+// are migrated and rewritten, keeping their comments and a backup of the original file. A config
+// that cannot be written, e.g. on a read-only file system, is migrated in memory only.
 func LoadConfig(filePath string) (*PortierConfig, error) {
 	config, err := DefaultPortierConfig()
 	if err != nil {
@@ -110,27 +185,27 @@ func LoadConfig(filePath string) (*PortierConfig, error) {
 		return nil, err
 	}
 
-	stat, err := os.Stat(filePath)
+	data, err := os.ReadFile(filePath)
 	if err != nil {
-		log.Printf("Error getting file info: %v. Using default config only.", err)
+		log.Printf("Error reading config file: %v. Using default config only.", err)
 		return config, nil
 	}
 
-	file, err := os.Open(filePath)
+	migration, err := MigrateConfigData(data, filepath.Dir(filePath))
 	if err != nil {
-		log.Printf("Error opening file: %v", err)
+		log.Printf("Error migrating config: %v", err)
 		return nil, err
 	}
-	defer file.Close()
-
-	fileContent := make([]byte, stat.Size())
-	_, err = file.Read(fileContent)
-	if err != nil {
-		log.Printf("Error reading file: %v", err)
-		return nil, err
+	if migration.Changed() {
+		if err := writeMigratedConfig(filePath, data, migration); err != nil {
+			if !readOnly(err) {
+				return nil, err
+			}
+			log.Printf("Config %s of version %d is read-only, migrated it to version %d in memory only: %v", filePath, migration.FromVersion, migration.ToVersion, err)
+		}
 	}
 
-	err = yaml.Unmarshal(fileContent, config)
+	err = yaml.Unmarshal(migration.Migrated, config)
 	if err != nil {
 		log.Printf("Error unmarshalling yaml: %v", err)
 		return nil, err
@@ -142,7 +217,7 @@ func LoadConfig(filePath string) (*PortierConfig, error) {
 func APIBaseURLFromPortierURL(portierURL string) string {
 	parsedURL, err := url.Parse(strings.TrimSpace(portierURL))
 	if err != nil || parsedURL.Host == "" {
-		return "https://api.portier.dev"
+		return api.DefaultEndpoints.APIBaseURL()
 	}
 
 	scheme := parsedURL.Scheme
@@ -165,67 +240,68 @@ func normalizeAPIBaseURL(baseURL string) string {
 	return result
 }
 
-func LoadApiTokenWithBaseURL(filePath string, baseURL string) (*DeviceCredentials, error) {
-	stat, err := os.Stat(filePath)
-	if err != nil {
-		log.Printf("Error getting file info: %v. Exiting", err)
-		return nil, err
-	}
+// APIKeyEnv overrides the API key stored in the device credentials file.
+const APIKeyEnv = "PORTIER_API_KEY"
 
-	file, err := os.Open(filePath)
-	if err != nil {
-		log.Printf("Error opening file: %v. Exiting", err)
-		return nil, err
+func LoadApiTokenWithBaseURL(filePath string, baseURL string) (*DeviceCredentials, error) {
+	if apiKey, ok := os.LookupEnv(APIKeyEnv); ok && apiKey != "" {
+		return deviceCredentialsForAPIKey(apiKey, baseURL)
 	}
-	defer file.Close()
 
-	fileContent := make([]byte, stat.Size())
-	_, err = file.Read(fileContent)
+	apiKey, err := api.ReadDeviceAPIKey(filePath)
 	if err != nil {
-		log.Printf("Error reading file: %v. Exiting", err)
+		log.Printf("Error reading API key: %v. Exiting", err)
 		return nil, err
 	}
 
-	type fileCreds struct {
-		ApiToken string `yaml:"APIKey"`
-	}
-
-	fc := fileCreds{}
-	err = yaml.Unmarshal(fileContent, &fc)
-	if err != nil {
-		log.Printf("Error unmarshalling yaml: %v. Exiting", err)
-		return nil, err
-	}
+	return deviceCredentialsForAPIKey(apiKey, baseURL)
+}
 
+func deviceCredentialsForAPIKey(apiKey string, baseURL string) (*DeviceCredentials, error) {
 	baseURL = normalizeAPIBaseURL(baseURL)
 	if baseURL == "" {
-		baseURL = "https://api.portier.dev"
+		baseURL = api.DefaultEndpoints.APIBaseURL()
 	}
 
-	guid, err := api.WhoAmI(baseURL, fc.ApiToken)
+	guid, err := api.NewDefaultClient(baseURL, api.DeviceKeyAuth{APIKey: apiKey}).WhoAmI(context.Background())
 	if err != nil {
 		return nil, fmt.Errorf("could not get device ID: %w", err)
 	}
 
 	credentials := DeviceCredentials{
 		DeviceID: guid,
-		ApiToken: fc.ApiToken,
+		ApiToken: apiKey,
 	}
 
 	return &credentials, nil
 }
 
 func LoadApiToken(filePath string) (*DeviceCredentials, error) {
-	return LoadApiTokenWithBaseURL(filePath, "https://api.portier.dev")
+	return LoadApiTokenWithBaseURL(filePath, api.DefaultEndpoints.APIBaseURL())
 }
 
-// SaveConfig saves the config to the given file path.
+// SaveConfig saves the config to the given file path. A file of an older schema version is kept
+// in a backup next to it, like `config migrate` does, since the comments of the file are lost.
 func SaveConfig(filePath string, config *PortierConfig) error {
+	if config.Version == 0 {
+		config.Version = CurrentConfigVersion
+	}
+
 	data, err := yaml.Marshal(config)
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
 
+	if original, err := os.ReadFile(filePath); err == nil {
+		if version, err := dataConfigVersion(original); err == nil && version < CurrentConfigVersion {
+			backupFile, err := backupConfigFile(filePath, original, version)
+			if err != nil {
+				return err
+			}
+			log.Printf("Saving config %s of version %d as version %d, backup written to %s", filePath, version, CurrentConfigVersion, backupFile)
+		}
+	}
+
 	err = os.WriteFile(filePath, data, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
@@ -234,13 +310,72 @@ func SaveConfig(filePath string, config *PortierConfig) error {
 	return nil
 }
 
+// selfHostedClientID is the default OAuth client id for deployments other than portier.dev.
+const selfHostedClientID = "portier-cli"
+
+// Endpoints returns the service endpoints of the deployment this config points to. Only the
+// relay URL (portierUrl) needs to be set for a self-hosted deployment, the API URL is derived
+// from its host and the auth settings from the API URL.
+func (c *PortierConfig) Endpoints() api.Endpoints {
+	endpoints := api.Endpoints{
+		RelayURL: api.DefaultEndpoints.RelayURL,
+		APIURL:   strings.TrimSuffix(c.APIURL, "/"),
+	}
+	if c.PortierURL.URL != nil && c.PortierURL.Host != "" {
+		endpoints.RelayURL = c.PortierURL.String()
+	}
+	if endpoints.APIURL == "" {
+		endpoints.APIURL = APIBaseURLFromPortierURL(endpoints.RelayURL) + "/api"
+	}
+
+	origin := endpoints.APIBaseURL()
+	isDefault := origin == api.DefaultEndpoints.APIBaseURL()
+
+	endpoints.AuthIssuer = c.Auth.Issuer
+	if endpoints.AuthIssuer == "" {
+		endpoints.AuthIssuer = origin
+		if isDefault {
+			endpoints.AuthIssuer = api.DefaultEndpoints.AuthIssuer
+		}
+	}
+	endpoints.AuthClientID = c.Auth.ClientID
+	if endpoints.AuthClientID == "" {
+		endpoints.AuthClientID = selfHostedClientID
+		if endpoints.AuthIssuer == api.DefaultEndpoints.AuthIssuer {
+			endpoints.AuthClientID = api.DefaultEndpoints.AuthClientID
+		}
+	}
+	endpoints.AuthAudience = c.Auth.Audience
+	if endpoints.AuthAudience == "" {
+		endpoints.AuthAudience = origin
+	}
+
+	return endpoints
+}
+
+// LoadEndpoints loads the config file, applying env and flag overrides, and returns its endpoints.
+func LoadEndpoints(filePath string, flagValues map[string]string) (api.Endpoints, error) {
+	effective, err := LoadEffectiveConfig(filePath, flagValues)
+	if err != nil {
+		return api.Endpoints{}, err
+	}
+	return effective.Config.Endpoints(), nil
+}
+
 func DefaultPortierConfig() (*PortierConfig, error) {
 	home, err := utils.Home()
 	if err != nil {
 		return nil, err
 	}
 
+	return DefaultPortierConfigForHome(home), nil
+}
+
+// DefaultPortierConfigForHome returns the default config with TLS files in the given home
+// directory, e.g. the home of a profile other than the active one.
+func DefaultPortierConfigForHome(home string) *PortierConfig {
 	return &PortierConfig{
+		Version: CurrentConfigVersion,
 		PortierURL: utils.YAMLURL{
 			URL: &url.URL{
 				Scheme: "wss",
@@ -256,5 +391,18 @@ func DefaultPortierConfig() (*PortierConfig, error) {
 		DefaultThroughputLimit:      0,
 		DefaultReadBufferSize:       4096,
 		DefaultDatagramConnectionID: messages.ConnectionID("00000000-1111-0000-0000-000000000000"),
-	}, nil
+	}
+}
+
+// ResolveAPIURL returns apiURL if set, e.g. by a command line flag, and the API URL
+// of the config file with the override flags flagValues otherwise.
+func ResolveAPIURL(apiURL string, configFile string, flagValues map[string]string) (string, error) {
+	if apiURL != "" {
+		return apiURL, nil
+	}
+	endpoints, err := LoadEndpoints(configFile, flagValues)
+	if err != nil {
+		return "", err
+	}
+	return endpoints.APIURL, nil
 }
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+
+	api "github.com/mh-dx/portier-cli/internal/portier/api"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointsDefaultToPortierDev(t *testing.T) {
+	t.Setenv("PORTIER_HOME", t.TempDir())
+	config, err := DefaultPortierConfig()
+	require.NoError(t, err)
+
+	require.Equal(t, api.DefaultEndpoints, config.Endpoints())
+}
+
+func TestEndpointsDerivedFromRelayURL(t *testing.T) {
+	// GIVEN a self-hosted deployment configured by the relay URL only
+	home := t.TempDir()
+	t.Setenv("PORTIER_HOME", home)
+	t.Setenv("PORTIER_URL", "wss://portier.example.com/spider")
+
+	// WHEN
+	endpoints, err := LoadEndpoints(filepath.Join(home, "config.yaml"), nil)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, api.Endpoints{
+		APIURL:       "https://portier.example.com/api",
+		RelayURL:     "wss://portier.example.com/spider",
+		AuthIssuer:   "https://portier.example.com",
+		AuthClientID: selfHostedClientID,
+		AuthAudience: "https://portier.example.com",
+	}, endpoints)
+}
+
+func TestEndpointsExplicitAuthIssuer(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("PORTIER_HOME", home)
+	t.Setenv("PORTIER_API_URL", "https://api.staging.example.com/api")
+	t.Setenv("PORTIER_AUTH_ISSUER", "https://login.example.com")
+	t.Setenv("PORTIER_AUTH_CLIENT_ID", "staging")
+
+	endpoints, err := LoadEndpoints(filepath.Join(home, "config.yaml"), nil)
+
+	require.NoError(t, err)
+	require.Equal(t, "https://api.staging.example.com/api", endpoints.APIURL)
+	require.Equal(t, api.DefaultEndpoints.RelayURL, endpoints.RelayURL)
+	require.Equal(t, "https://login.example.com", endpoints.AuthIssuer)
+	require.Equal(t, "staging", endpoints.AuthClientID)
+	require.Equal(t, "https://api.staging.example.com", endpoints.AuthAudience)
+}
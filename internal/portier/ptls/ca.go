@@ -0,0 +1,337 @@
+package ptls
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
+	"gopkg.in/yaml.v2"
+)
+
+// Files of a CA directory
+const (
+	CACertFile   = "ca.pem"
+	CAKeyFile    = "ca-key.pem"
+	CACRLFile    = "ca.crl"
+	CAIssuedFile = "issued.yaml"
+)
+
+// DefaultCRLValidity is how long a CRL is valid. Devices keep using an outdated CRL, but the
+// CA should publish a new one before.
+const DefaultCRLValidity = 30 * 24 * time.Hour
+
+// ErrCAExists is returned when initializing a CA in a directory that already contains one.
+var ErrCAExists = errors.New("a CA already exists")
+
+// IssuedCertificate is a device certificate issued by the CA.
+type IssuedCertificate struct {
+	// Serial is the serial number of the certificate in decimal format
+	Serial string `yaml:"serial"`
+
+	// DeviceID is the device the certificate was issued for
+	DeviceID string `yaml:"deviceId"`
+
+	// NotAfter is the expiry of the certificate
+	NotAfter time.Time `yaml:"notAfter"`
+
+	// Revoked is the time of the revocation, zero if the certificate is valid
+	Revoked time.Time `yaml:"revoked,omitempty"`
+}
+
+// CA is a private certificate authority that issues device certificates. Devices that have
+// the CA certificate configured as CAFile trust every device with a certificate issued by it.
+type CA struct {
+	// Dir is the directory of the CA files
+	Dir string
+
+	// Cert is the CA certificate
+	Cert *x509.Certificate
+
+	// Issued are the certificates issued by the CA
+	Issued []IssuedCertificate
+
+	key crypto.Signer
+}
+
+// InitCA creates a new CA in the given directory, together with an empty CRL.
+func InitCA(dir, commonName string, validity time.Duration) (*CA, error) {
+	if _, err := os.Stat(filepath.Join(dir, CACertFile)); err == nil {
+		return nil, fmt.Errorf("%w in %s", ErrCAExists, dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	cert, _, err := createCertificate(template, template, pubKey, privKey, privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := EncodePrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := secrets.WriteFileSecure(filepath.Join(dir, CAKeyFile), keyPEM); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, CACertFile), EncodeCertificate(cert), 0644); err != nil {
+		return nil, err
+	}
+
+	ca := &CA{Dir: dir, Cert: cert, key: privKey}
+	if err := ca.saveIssued(); err != nil {
+		return nil, err
+	}
+	if err := ca.WriteCRL(DefaultCRLValidity); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// LoadCA loads the CA of the given directory.
+func LoadCA(dir string) (*CA, error) {
+	chain, err := LoadCertificateChain(filepath.Join(dir, CACertFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the CA certificate: %w", err)
+	}
+	key, err := LoadPrivateKey(filepath.Join(dir, CAKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the CA key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("the CA key cannot sign")
+	}
+
+	ca := &CA{Dir: dir, Cert: chain[0], key: signer}
+	data, err := os.ReadFile(filepath.Join(dir, CAIssuedFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &ca.Issued); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// Sign issues a certificate for the device from its certificate signing request. The
+// certificate is valid as TLS server and client, and names the device ID as common name and
+// DNS name, which the TLS client verifies against the peer device ID.
+func (ca *CA) Sign(csr *x509.CertificateRequest, deviceID string, validity time.Duration) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate signing request: %w", err)
+	}
+	if csr.Subject.CommonName != deviceID {
+		return nil, fmt.Errorf("certificate signing request is for %q, not for device %s", csr.Subject.CommonName, deviceID)
+	}
+
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(ca.Cert.NotAfter) {
+		notAfter = ca.Cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: deviceID,
+		},
+		DNSNames:  []string{deviceID},
+		NotBefore: now,
+		NotAfter:  notAfter,
+		KeyUsage:  x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.Issued = append(ca.Issued, IssuedCertificate{
+		Serial:   cert.SerialNumber.String(),
+		DeviceID: deviceID,
+		NotAfter: cert.NotAfter,
+	})
+	if err := ca.saveIssued(); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Revoke revokes the certificates with the given serial number, or all certificates issued
+// for the given device ID, and writes a new CRL. Returns the number of revoked certificates.
+func (ca *CA) Revoke(serialOrDeviceID string, crlValidity time.Duration) (int, error) {
+	now := time.Now()
+	revoked := 0
+	for i := range ca.Issued {
+		issued := &ca.Issued[i]
+		if issued.Serial != serialOrDeviceID && issued.DeviceID != serialOrDeviceID {
+			continue
+		}
+		if issued.Revoked.IsZero() {
+			issued.Revoked = now
+			revoked++
+		}
+	}
+	if revoked == 0 {
+		return 0, nil
+	}
+	if err := ca.saveIssued(); err != nil {
+		return 0, err
+	}
+	return revoked, ca.WriteCRL(crlValidity)
+}
+
+// WriteCRL writes a new CRL of all revoked certificates that did not expire yet.
+func (ca *CA) WriteCRL(validity time.Duration) error {
+	now := time.Now()
+	number := big.NewInt(1)
+	if previous, err := LoadCRL(filepath.Join(ca.Dir, CACRLFile)); err == nil && previous.Number != nil {
+		number.Add(previous.Number, big.NewInt(1))
+	}
+
+	template := &x509.RevocationList{
+		Number:     number,
+		ThisUpdate: now,
+		NextUpdate: now.Add(validity),
+	}
+	for _, issued := range ca.Issued {
+		if issued.Revoked.IsZero() || issued.NotAfter.Before(now) {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(issued.Serial, 10)
+		if !ok {
+			return fmt.Errorf("invalid serial number %s", issued.Serial)
+		}
+		template.RevokedCertificates = append(template.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: issued.Revoked,
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.Cert, ca.key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(ca.Dir, CACRLFile), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+}
+
+func (ca *CA) saveIssued() error {
+	data, err := yaml.Marshal(ca.Issued)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(ca.Dir, CAIssuedFile), data, 0600)
+}
+
+// CreateCertificateRequest creates a certificate signing request in PEM format for the device.
+func CreateCertificateRequest(deviceID string, key crypto.PrivateKey) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName: deviceID,
+		},
+		DNSNames: []string{deviceID},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// ParseCertificateRequest parses a certificate signing request in PEM format.
+func ParseCertificateRequest(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no certificate signing request found")
+	}
+	return x509.ParseCertificateRequest(block.Bytes)
+}
+
+// LoadCRL reads a certificate revocation list in PEM or DER format.
+func LoadCRL(path string) (*x509.RevocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCRL(data)
+}
+
+// ParseCRL parses a certificate revocation list in PEM or DER format.
+func ParseCRL(data []byte) (*x509.RevocationList, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return x509.ParseRevocationList(data)
+}
+
+// checkRevocation returns an error if a certificate of the verified chains was revoked by the
+// CRL. The CRL must be signed by the root of the chain.
+func checkRevocation(crl *x509.RevocationList, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		root := chain[len(chain)-1]
+		if err := crl.CheckSignatureFrom(root); err != nil {
+			return fmt.Errorf("CRL is not signed by CA %s: %w", root.Subject.CommonName, err)
+		}
+		for _, cert := range chain[:len(chain)-1] {
+			for _, revoked := range crl.RevokedCertificates {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return fmt.Errorf("certificate %s of %s was revoked", cert.SerialNumber, cert.Subject.CommonName)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, serialNumberLimit)
+}
+
+// EncodeCertificate encodes a certificate in PEM format.
+func EncodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
@@ -0,0 +1,103 @@
+package ptls
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// withCA issues the certificate of the device for certID by the CA. The device uses the CA
+// certificate and CRL of the CA directory.
+func withCA(ca *CA, certID string) testDeviceOption {
+	return func(_ string, options *testDeviceOptions) {
+		options.ptls.CAFile = filepath.Join(ca.Dir, CACertFile)
+		options.ptls.CRLFile = filepath.Join(ca.Dir, CACRLFile)
+		options.certificate = func(t *testing.T, _ string) ([]byte, []byte) {
+			_, key, err := NewPTLSCertificateManager().CreateCertificate(certID)
+			require.NoError(t, err)
+			keyPEM, err := EncodePrivateKey(key)
+			require.NoError(t, err)
+			csrPEM, err := CreateCertificateRequest(certID, key)
+			require.NoError(t, err)
+			csr, err := ParseCertificateRequest(csrPEM)
+			require.NoError(t, err)
+			cert, err := ca.Sign(csr, certID, time.Hour)
+			require.NoError(t, err)
+			return EncodeCertificate(cert), keyPEM
+		}
+	}
+}
+
+func newTestCA(t *testing.T) *CA {
+	ca, err := InitCA(filepath.Join(t.TempDir(), "ca"), "test CA", 24*time.Hour)
+	require.NoError(t, err)
+	return ca
+}
+
+func TestCASignedDevicesConnect(t *testing.T) {
+	// GIVEN
+	ca := newTestCA(t)
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withCA(ca, "00000000-0000-0000-0000-000000000001"))
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withCA(ca, "00000000-0000-0000-0000-000000000002"))
+
+	// WHEN
+	err := connect(t, client, server)
+
+	// THEN
+	require.NoError(t, err)
+}
+
+func TestCARevokedCertificateIsRejected(t *testing.T) {
+	// GIVEN
+	ca := newTestCA(t)
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withCA(ca, "00000000-0000-0000-0000-000000000001"))
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withCA(ca, "00000000-0000-0000-0000-000000000002"))
+	revoked, err := ca.Revoke(server.id.String(), DefaultCRLValidity)
+	require.NoError(t, err)
+	require.Equal(t, 1, revoked)
+
+	// WHEN
+	err = connect(t, client, server)
+
+	// THEN
+	require.ErrorContains(t, err, "revoked")
+
+	loaded, err := LoadCA(ca.Dir)
+	require.NoError(t, err)
+	require.False(t, loaded.Issued[0].Revoked.IsZero())
+}
+
+func TestCACertificateOfOtherDeviceIsRejected(t *testing.T) {
+	// GIVEN
+	ca := newTestCA(t)
+	// the server presents a valid certificate, but one issued for another device
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withCA(ca, "00000000-0000-0000-0000-000000000003"))
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withCA(ca, "00000000-0000-0000-0000-000000000002"))
+
+	// WHEN
+	err := connect(t, client, server)
+
+	// THEN
+	require.Error(t, err)
+}
+
+func TestCASignRejectsRequestOfOtherDevice(t *testing.T) {
+	// GIVEN
+	ca := newTestCA(t)
+	_, key, err := NewPTLSCertificateManager().CreateCertificate("00000000-0000-0000-0000-000000000001")
+	require.NoError(t, err)
+	csrPEM, err := CreateCertificateRequest("00000000-0000-0000-0000-000000000001", key)
+	require.NoError(t, err)
+	csr, err := ParseCertificateRequest(csrPEM)
+	require.NoError(t, err)
+
+	// WHEN
+	_, err = ca.Sign(csr, "00000000-0000-0000-0000-000000000002", time.Hour)
+
+	// THEN
+	require.Error(t, err)
+	_, err = InitCA(ca.Dir, "test CA", time.Hour)
+	require.ErrorIs(t, err, ErrCAExists)
+}
@@ -2,22 +2,35 @@ package ptls
 
 import (
 	"crypto"
-	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"math/big"
+	"os"
 	"time"
 )
 
+const (
+	// DefaultCertificateValidity is the validity of certificates created with the default options.
+	DefaultCertificateValidity = 20 * 365 * 24 * time.Hour
+
+	// ExpiryWarningPeriod is how long before its expiry a certificate is reported as expiring.
+	ExpiryWarningPeriod = 30 * 24 * time.Hour
+)
+
 type PTLSCertificateManager interface {
 
 	// CreateCertificate creates a new TLS certificate
 	CreateCertificate(commonName string) (*x509.Certificate, crypto.PrivateKey, error)
 
+	// RotateCertificate creates a certificate with a new key for the common name of the
+	// previous certificate. The new certificate is signed with the previous key, so that
+	// peers still pinning the previous certificate can verify the continuity.
+	RotateCertificate(previous *x509.Certificate, previousKey crypto.PrivateKey) (*x509.Certificate, crypto.PrivateKey, error)
+
 	// ConvertCertificateToPEM converts the certificate to PEM format
 	ConvertCertificateToPEM(cert *x509.Certificate, privateKey crypto.PrivateKey) (certPEM []byte, keyPEM []byte, err error)
 
@@ -25,40 +38,98 @@ type PTLSCertificateManager interface {
 	GetFingerprint(cert *x509.Certificate) (fingerprint string, err error)
 }
 
+type CertificateManagerOptions struct {
+	// Validity is the duration for which created certificates are valid
+	Validity time.Duration
+
+	// KeyAlgorithm is the algorithm of the keys of created certificates. Defaults to
+	// DefaultKeyAlgorithm, rotated certificates keep the algorithm of the previous one.
+	KeyAlgorithm KeyAlgorithm
+}
+
+func NewDefaultCertificateManagerOptions() CertificateManagerOptions {
+	return CertificateManagerOptions{
+		Validity: DefaultCertificateValidity,
+	}
+}
+
 type ptlsCertMan struct {
+	options CertificateManagerOptions
 }
 
 func NewPTLSCertificateManager() PTLSCertificateManager {
-	return &ptlsCertMan{}
+	return NewPTLSCertificateManagerWithOptions(NewDefaultCertificateManagerOptions())
+}
+
+func NewPTLSCertificateManagerWithOptions(options CertificateManagerOptions) PTLSCertificateManager {
+	if options.Validity <= 0 {
+		options.Validity = DefaultCertificateValidity
+	}
+	return &ptlsCertMan{options: options}
 }
 
 func (p *ptlsCertMan) CreateCertificate(commonName string) (*x509.Certificate, crypto.PrivateKey, error) {
 	// from https://golang.org/src/crypto/tls/generate_cert.go
 	// from https://gist.github.com/rorycl/d300f3ab942fd79e6cc1f37db0c6260f
-	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	algorithm := p.options.KeyAlgorithm
+	if algorithm == "" {
+		algorithm = DefaultKeyAlgorithm
+	}
+	pubKey, privKey, err := GenerateKey(algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := p.template(commonName)
 	if err != nil {
 		return nil, nil, err
 	}
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	return createCertificate(template, template, pubKey, privKey, privKey)
+}
+
+func (p *ptlsCertMan) RotateCertificate(previous *x509.Certificate, previousKey crypto.PrivateKey) (*x509.Certificate, crypto.PrivateKey, error) {
+	algorithm := p.options.KeyAlgorithm
+	if algorithm == "" {
+		previousAlgorithm, err := KeyAlgorithmOf(previous.PublicKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		algorithm = previousAlgorithm
+	}
+	pubKey, privKey, err := GenerateKey(algorithm)
 	if err != nil {
 		return nil, nil, err
 	}
-	template := &x509.Certificate{
+	template, err := p.template(previous.Subject.CommonName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return createCertificate(template, previous, pubKey, previousKey, privKey)
+}
+
+func (p *ptlsCertMan) template(commonName string) (*x509.Certificate, error) {
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			CommonName: commonName,
 		},
-		NotBefore: time.Now(),
-		NotAfter:  time.Now().AddDate(20, 0, 0),
+		NotBefore: now,
+		NotAfter:  now.Add(p.options.Validity),
 		KeyUsage:  x509.KeyUsageDigitalSignature,
 		ExtKeyUsage: []x509.ExtKeyUsage{
 			x509.ExtKeyUsageServerAuth,
 		},
 		BasicConstraintsValid: true,
-	}
-	x509Cert, err := x509.CreateCertificate(rand.Reader, template, template, pubKey, privKey)
+	}, nil
+}
 
+// createCertificate signs the template with the signer key of the parent certificate.
+func createCertificate(template, parent *x509.Certificate, pubKey crypto.PublicKey, signer crypto.PrivateKey, privKey crypto.PrivateKey) (*x509.Certificate, crypto.PrivateKey, error) {
+	x509Cert, err := x509.CreateCertificate(rand.Reader, template, parent, pubKey, signer)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -96,3 +167,77 @@ func (p *ptlsCertMan) GetFingerprint(cert *x509.Certificate) (fingerprint string
 	fp := sha256.Sum256(cert.Raw)
 	return fmt.Sprintf("%x", fp), nil
 }
+
+// IsSignedBy reports whether the certificate was signed with the key of the issuer certificate.
+// Unlike x509.Certificate.CheckSignatureFrom, the issuer does not need to be a CA, which is the
+// case for certificates created by RotateCertificate.
+func IsSignedBy(cert *x509.Certificate, issuer *x509.Certificate) bool {
+	return issuer.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// LoadCertificateChain reads all certificates of a PEM file. The first certificate is the
+// device's own certificate, further ones are previous certificates during a rotation.
+func LoadCertificateChain(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCertificateChain(data)
+}
+
+// ParseCertificateChain parses all certificates of PEM encoded data.
+func ParseCertificateChain(data []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return chain, nil
+}
+
+// CertificateExpiry returns the expiry of the certificate in the given file and whether it
+// expires within the ExpiryWarningPeriod.
+func CertificateExpiry(certFile string, now time.Time) (time.Time, bool, error) {
+	chain, err := LoadCertificateChain(certFile)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	notAfter := chain[0].NotAfter
+	return notAfter, now.Add(ExpiryWarningPeriod).After(notAfter), nil
+}
+
+// LoadPrivateKey reads a PKCS #8 private key in PEM format.
+func LoadPrivateKey(path string) (crypto.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key %s", path)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// EncodePrivateKey encodes a private key in PKCS #8 PEM format.
+func EncodePrivateKey(key crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
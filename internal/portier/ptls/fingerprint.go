@@ -0,0 +1,95 @@
+package ptls
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sasWordCount is the number of words of a short authentication string, each word encodes one
+// byte of the fingerprint.
+const sasWordCount = 8
+
+// NormalizeFingerprint returns the fingerprint in the lower case hex format of known_hosts.
+// Accepts fingerprints with colons, spaces or dashes between the digits, as they are printed by
+// other tools.
+func NormalizeFingerprint(fingerprint string) (string, error) {
+	normalized := strings.ToLower(strings.NewReplacer(":", "", " ", "", "-", "").Replace(strings.TrimSpace(fingerprint)))
+	decoded, err := hex.DecodeString(normalized)
+	if err != nil {
+		return "", fmt.Errorf("invalid fingerprint %q: %w", fingerprint, err)
+	}
+	if len(decoded) != 32 {
+		return "", fmt.Errorf("invalid fingerprint %q: expected 32 bytes, got %d", fingerprint, len(decoded))
+	}
+	return normalized, nil
+}
+
+// FormatFingerprint groups the hex digits of the fingerprint in blocks of four, which are easier
+// to compare by reading them aloud.
+func FormatFingerprint(fingerprint string) string {
+	var groups []string
+	for i := 0; i < len(fingerprint); i += 4 {
+		end := i + 4
+		if end > len(fingerprint) {
+			end = len(fingerprint)
+		}
+		groups = append(groups, fingerprint[i:end])
+	}
+	return strings.Join(groups, " ")
+}
+
+// FingerprintWords returns the short authentication string of the fingerprint, a word for each
+// of its first bytes. Two devices showing the same words have the same fingerprint with high
+// probability, compare the full fingerprint if a collision must be ruled out.
+func FingerprintWords(fingerprint string) ([]string, error) {
+	decoded, err := hex.DecodeString(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) < sasWordCount {
+		return nil, errors.New("fingerprint too short")
+	}
+	words := make([]string, sasWordCount)
+	for i, b := range decoded[:sasWordCount] {
+		words[i] = sasWords[b]
+	}
+	return words, nil
+}
+
+// sasWords are the words of short authentication strings, indexed by byte value
+var sasWords = [256]string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alder",
+	"alpha", "amber", "anchor", "angle", "apple", "apron", "arrow", "aspen",
+	"atlas", "attic", "autumn", "avenue", "badge", "bagel", "baker", "bamboo",
+	"banjo", "barley", "basil", "basket", "beacon", "beaver", "bench", "berry",
+	"bison", "blade", "blanket", "blossom", "bonnet", "border", "bottle", "bramble",
+	"breeze", "brick", "bridge", "bronze", "brook", "bucket", "bugle", "butter",
+	"cabin", "cactus", "camel", "candle", "canoe", "canyon", "carbon", "cargo",
+	"carpet", "castle", "cedar", "cello", "chalk", "cherry", "chess", "cider",
+	"circus", "citrus", "clover", "cobalt", "cocoa", "comet", "copper", "coral",
+	"cotton", "cougar", "crane", "crater", "crayon", "cricket", "crystal", "cupola",
+	"daisy", "dancer", "delta", "denim", "desert", "diesel", "dolphin", "domino",
+	"donkey", "dragon", "drum", "eagle", "easel", "echo", "eclipse", "elbow",
+	"elder", "ember", "emerald", "engine", "falcon", "feather", "fennel", "ferry",
+	"fiddle", "fig", "flannel", "flute", "forest", "fossil", "fountain", "fox",
+	"galaxy", "garden", "garlic", "gazelle", "geyser", "ginger", "glacier", "globe",
+	"granite", "grape", "gravel", "guitar", "hammer", "harbor", "harvest", "hazel",
+	"helmet", "heron", "hickory", "honey", "horizon", "hornet", "husky", "igloo",
+	"indigo", "iris", "island", "ivory", "jacket", "jaguar", "jasmine", "jelly",
+	"jigsaw", "jungle", "kayak", "kernel", "kettle", "kiwi", "koala", "ladder",
+	"lagoon", "lantern", "lava", "lemon", "lentil", "lily", "linen", "lizard",
+	"lobster", "locket", "lotus", "magnet", "mango", "maple", "marble", "meadow",
+	"melon", "meteor", "mint", "mirror", "mitten", "monsoon", "mosaic", "muffin",
+	"nectar", "needle", "nickel", "nutmeg", "oasis", "oatmeal", "ocean", "olive",
+	"onion", "orbit", "orchid", "otter", "oyster", "paddle", "panda", "papaya",
+	"parrot", "pebble", "pepper", "piano", "pickle", "pigeon", "pilot", "pine",
+	"planet", "plum", "pollen", "poppy", "prairie", "pretzel", "puffin", "pumpkin",
+	"quartz", "quill", "rabbit", "radar", "radish", "raven", "reef", "ribbon",
+	"river", "robin", "rocket", "saddle", "saffron", "salmon", "sandal", "satin",
+	"scarf", "sequoia", "shadow", "sierra", "silver", "sketch", "sparrow", "spruce",
+	"squash", "summit", "sunset", "swan", "tablet", "tango", "teapot", "thistle",
+	"thunder", "tiger", "timber", "toast", "topaz", "tornado", "tulip", "tundra",
+	"turnip", "umbrella", "valley", "velvet", "violet", "violin", "walnut", "walrus",
+}
@@ -0,0 +1,48 @@
+package ptls
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testFingerprint = "00ff10a0b1c2d3e4f5061728394a5b6c7d8e9fa0b1c2d3e4f5061728394a5b6c"
+
+func TestNormalizeFingerprint(t *testing.T) {
+	// GIVEN
+	grouped := strings.ToUpper(FormatFingerprint(testFingerprint))
+	colons := strings.ReplaceAll(grouped, " ", ":")
+
+	// WHEN
+	fromGrouped, errGrouped := NormalizeFingerprint(grouped)
+	fromColons, errColons := NormalizeFingerprint(colons)
+	_, errShort := NormalizeFingerprint("00ff10")
+	_, errInvalid := NormalizeFingerprint(strings.Replace(testFingerprint, "0", "x", 1))
+
+	// THEN
+	require.NoError(t, errGrouped)
+	require.NoError(t, errColons)
+	require.Equal(t, testFingerprint, fromGrouped)
+	require.Equal(t, testFingerprint, fromColons)
+	require.Error(t, errShort)
+	require.Error(t, errInvalid)
+}
+
+func TestFingerprintWords(t *testing.T) {
+	// WHEN
+	words, err := FingerprintWords(testFingerprint)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, []string{sasWords[0x00], sasWords[0xff], sasWords[0x10], sasWords[0xa0], sasWords[0xb1], sasWords[0xc2], sasWords[0xd3], sasWords[0xe4]}, words)
+}
+
+func TestSASWordsAreDistinct(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, word := range sasWords {
+		require.NotEmpty(t, word)
+		require.False(t, seen[word], "duplicate word %s", word)
+		seen[word] = true
+	}
+}
@@ -0,0 +1,139 @@
+package ptls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// KeyAlgorithm is the algorithm of the key of a device certificate.
+type KeyAlgorithm string
+
+// Supported key algorithms
+const (
+	KeyAlgorithmEd25519   KeyAlgorithm = "ed25519"
+	KeyAlgorithmECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	KeyAlgorithmECDSAP384 KeyAlgorithm = "ecdsa-p384"
+	KeyAlgorithmRSA2048   KeyAlgorithm = "rsa-2048"
+	KeyAlgorithmRSA3072   KeyAlgorithm = "rsa-3072"
+	KeyAlgorithmRSA4096   KeyAlgorithm = "rsa-4096"
+
+	// DefaultKeyAlgorithm is the algorithm of created certificates. Noise encryption needs it.
+	DefaultKeyAlgorithm = KeyAlgorithmEd25519
+)
+
+// KeyAlgorithms are the supported key algorithms.
+var KeyAlgorithms = []KeyAlgorithm{
+	KeyAlgorithmEd25519,
+	KeyAlgorithmECDSAP256,
+	KeyAlgorithmECDSAP384,
+	KeyAlgorithmRSA2048,
+	KeyAlgorithmRSA3072,
+	KeyAlgorithmRSA4096,
+}
+
+// ParseKeyAlgorithm returns the key algorithm of the given name, case insensitive.
+func ParseKeyAlgorithm(name string) (KeyAlgorithm, error) {
+	for _, algorithm := range KeyAlgorithms {
+		if strings.EqualFold(name, string(algorithm)) {
+			return algorithm, nil
+		}
+	}
+	names := make([]string, len(KeyAlgorithms))
+	for i, algorithm := range KeyAlgorithms {
+		names[i] = string(algorithm)
+	}
+	return "", fmt.Errorf("unsupported key algorithm %q, use one of %s", name, strings.Join(names, ", "))
+}
+
+// GenerateKey generates a key pair of the given algorithm.
+func GenerateKey(algorithm KeyAlgorithm) (crypto.PublicKey, crypto.Signer, error) {
+	switch algorithm {
+	case KeyAlgorithmEd25519, "":
+		pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+		return pubKey, privKey, err
+	case KeyAlgorithmECDSAP256, KeyAlgorithmECDSAP384:
+		curve := elliptic.P256()
+		if algorithm == KeyAlgorithmECDSAP384 {
+			curve = elliptic.P384()
+		}
+		privKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &privKey.PublicKey, privKey, nil
+	case KeyAlgorithmRSA2048, KeyAlgorithmRSA3072, KeyAlgorithmRSA4096:
+		bits := map[KeyAlgorithm]int{KeyAlgorithmRSA2048: 2048, KeyAlgorithmRSA3072: 3072, KeyAlgorithmRSA4096: 4096}[algorithm]
+		privKey, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &privKey.PublicKey, privKey, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported key algorithm %q", algorithm)
+	}
+}
+
+// KeyAlgorithmOf returns the algorithm of a public key. Returns an error for keys that are not
+// supported, e.g. RSA keys shorter than 2048 bits.
+func KeyAlgorithmOf(key crypto.PublicKey) (KeyAlgorithm, error) {
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return KeyAlgorithmEd25519, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return KeyAlgorithmECDSAP256, nil
+		case elliptic.P384():
+			return KeyAlgorithmECDSAP384, nil
+		}
+		return "", fmt.Errorf("unsupported ECDSA curve %s", key.Curve.Params().Name)
+	case *rsa.PublicKey:
+		bits := key.N.BitLen()
+		switch {
+		case bits < 2048:
+			return "", fmt.Errorf("RSA keys need at least 2048 bits, got %d", bits)
+		case bits < 3072:
+			return KeyAlgorithmRSA2048, nil
+		case bits < 4096:
+			return KeyAlgorithmRSA3072, nil
+		}
+		return KeyAlgorithmRSA4096, nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// ImportCertificate validates an existing certificate and key in PEM format for the device: the
+// key must match the certificate, the common name must be the device ID, the key algorithm
+// must be supported and the certificate must be valid now. The key may be in PKCS #1, SEC 1
+// or PKCS #8 format. Returns the certificate chain and the key.
+func ImportCertificate(certPEM, keyPEM []byte, deviceID string, now time.Time) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate or key: %w", err)
+	}
+	chain, err := ParseCertificateChain(certPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert := chain[0]
+	if cert.Subject.CommonName != deviceID {
+		return nil, nil, fmt.Errorf("the common name %q of the certificate is not the device ID %s", cert.Subject.CommonName, deviceID)
+	}
+	if _, err := KeyAlgorithmOf(cert.PublicKey); err != nil {
+		return nil, nil, err
+	}
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, nil, fmt.Errorf("the certificate is only valid from %s to %s", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+	return chain, keyPair.PrivateKey, nil
+}
@@ -0,0 +1,149 @@
+package ptls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateCertificateWithEachKeyAlgorithm(t *testing.T) {
+	for _, algorithm := range KeyAlgorithms {
+		t.Run(string(algorithm), func(t *testing.T) {
+			// GIVEN
+			underTest := NewPTLSCertificateManagerWithOptions(CertificateManagerOptions{Validity: time.Hour, KeyAlgorithm: algorithm})
+
+			// WHEN
+			cert, key, err := underTest.CreateCertificate("00000000-0000-0000-0000-000000000001")
+
+			// THEN
+			require.NoError(t, err)
+			actual, err := KeyAlgorithmOf(cert.PublicKey)
+			require.NoError(t, err)
+			require.Equal(t, algorithm, actual)
+			require.NoError(t, cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature))
+			certPEM, keyPEM, err := underTest.ConvertCertificateToPEM(cert, key)
+			require.NoError(t, err)
+			_, _, err = ImportCertificate(certPEM, keyPEM, "00000000-0000-0000-0000-000000000001", time.Now())
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestParseKeyAlgorithm(t *testing.T) {
+	algorithm, err := ParseKeyAlgorithm("ECDSA-P256")
+	require.NoError(t, err)
+	require.Equal(t, KeyAlgorithmECDSAP256, algorithm)
+
+	_, err = ParseKeyAlgorithm("dsa")
+	require.ErrorContains(t, err, "unsupported key algorithm")
+}
+
+func TestKeyAlgorithmOfRejectsWeakKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	_, err = KeyAlgorithmOf(&rsaKey.PublicKey)
+	require.ErrorContains(t, err, "at least 2048 bits")
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	require.NoError(t, err)
+	_, err = KeyAlgorithmOf(&ecKey.PublicKey)
+	require.ErrorContains(t, err, "unsupported ECDSA curve")
+}
+
+func TestRotateCertificateKeepsKeyAlgorithm(t *testing.T) {
+	// GIVEN
+	certManager := NewPTLSCertificateManagerWithOptions(CertificateManagerOptions{Validity: time.Hour, KeyAlgorithm: KeyAlgorithmECDSAP384})
+	cert, key, err := certManager.CreateCertificate("00000000-0000-0000-0000-000000000001")
+	require.NoError(t, err)
+
+	// WHEN
+	rotated, _, err := NewPTLSCertificateManager().RotateCertificate(cert, key)
+
+	// THEN
+	require.NoError(t, err)
+	algorithm, err := KeyAlgorithmOf(rotated.PublicKey)
+	require.NoError(t, err)
+	require.Equal(t, KeyAlgorithmECDSAP384, algorithm)
+}
+
+// signTestCertificate returns a certificate and a PKCS #1 key in PEM format, like a corporate PKI
+// would issue them.
+func signTestCertificate(t *testing.T, commonName string, notBefore, notAfter time.Time) ([]byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	template.Subject.CommonName = commonName
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM
+}
+
+func TestImportCertificate(t *testing.T) {
+	// GIVEN
+	deviceID := "00000000-0000-0000-0000-000000000001"
+	now := time.Now()
+	certPEM, keyPEM := signTestCertificate(t, deviceID, now.Add(-time.Hour), now.Add(time.Hour))
+
+	// WHEN
+	chain, key, err := ImportCertificate(certPEM, keyPEM, deviceID, now)
+
+	// THEN
+	require.NoError(t, err)
+	require.Len(t, chain, 1)
+	require.IsType(t, &rsa.PrivateKey{}, key)
+	// the key is stored in PKCS #8 format and loads like a created one
+	storedPEM, err := EncodePrivateKey(key)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(keyFile, storedPEM, 0600))
+	_, err = LoadPrivateKey(keyFile)
+	require.NoError(t, err)
+}
+
+func TestImportCertificateRejectsInvalidCertificates(t *testing.T) {
+	deviceID := "00000000-0000-0000-0000-000000000001"
+	now := time.Now()
+	certPEM, _ := signTestCertificate(t, deviceID, now.Add(-time.Hour), now.Add(time.Hour))
+	_, otherKeyPEM := signTestCertificate(t, deviceID, now.Add(-time.Hour), now.Add(time.Hour))
+	otherCertPEM, otherCertKeyPEM := signTestCertificate(t, "00000000-0000-0000-0000-000000000002", now.Add(-time.Hour), now.Add(time.Hour))
+	expiredCertPEM, expiredKeyPEM := signTestCertificate(t, deviceID, now.Add(-2*time.Hour), now.Add(-time.Hour))
+
+	_, _, err := ImportCertificate(certPEM, otherKeyPEM, deviceID, now)
+	require.ErrorContains(t, err, "invalid certificate or key")
+
+	_, _, err = ImportCertificate(otherCertPEM, otherCertKeyPEM, deviceID, now)
+	require.ErrorContains(t, err, "is not the device ID")
+
+	_, _, err = ImportCertificate(expiredCertPEM, expiredKeyPEM, deviceID, now)
+	require.ErrorContains(t, err, "is only valid from")
+}
+
+func TestConnectionBetweenECDSAAndRSADevices(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withKeyAlgorithm(KeyAlgorithmECDSAP256))
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withKeyAlgorithm(KeyAlgorithmRSA2048))
+	server.trust(t, client)
+	client.trust(t, server)
+
+	// WHEN
+	_, err := exchange(t, client, server)
+
+	// THEN
+	require.NoError(t, err)
+}
@@ -0,0 +1,378 @@
+package ptls
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// KnownHostsVersion is the version of the known_hosts format written by this version.
+	KnownHostsVersion = 2
+
+	// DefaultGracePeriod is how long a replaced fingerprint stays trusted after a device
+	// rotated its certificate.
+	DefaultGracePeriod = 7 * 24 * time.Hour
+)
+
+// Sources of known fingerprints
+const (
+	// SourceAPI marks fingerprints downloaded from the portier API
+	SourceAPI = "api"
+
+	// SourceManual marks fingerprints added by the user
+	SourceManual = "manual"
+
+	// SourceTOFU marks fingerprints trusted on first use
+	SourceTOFU = "tofu"
+
+	// SourceRotation marks fingerprints of rotated certificates, signed by a known certificate
+	SourceRotation = "rotation"
+)
+
+// KnownFingerprint is a trusted certificate fingerprint of a peer device.
+type KnownFingerprint struct {
+	// Fingerprint is the SHA-256 fingerprint of the certificate in hex format
+	Fingerprint string `yaml:"fingerprint"`
+
+	// Source is where the fingerprint came from, one of the Source constants
+	Source string `yaml:"source,omitempty"`
+
+	// Added is the time the fingerprint was added
+	Added time.Time `yaml:"added,omitempty"`
+
+	// Expires is the end of the grace period of a replaced fingerprint, zero for current ones
+	Expires time.Time `yaml:"expires,omitempty"`
+}
+
+// KnownDevice holds the trusted fingerprints of a peer device.
+type KnownDevice struct {
+	// Name is the device name at the time it was trusted
+	Name string `yaml:"name,omitempty"`
+
+	// Fingerprints are the trusted fingerprints, the current one first
+	Fingerprints []KnownFingerprint `yaml:"fingerprints"`
+}
+
+// RevokedFingerprint is a fingerprint that must not be trusted anymore.
+type RevokedFingerprint struct {
+	// Fingerprint is the SHA-256 fingerprint of the revoked certificate in hex format
+	Fingerprint string `yaml:"fingerprint"`
+
+	// DeviceID is the device the fingerprint belonged to
+	DeviceID string `yaml:"device,omitempty"`
+
+	// Revoked is the time of the revocation
+	Revoked time.Time `yaml:"revoked"`
+
+	// Reason is an optional description of the revocation
+	Reason string `yaml:"reason,omitempty"`
+}
+
+// KnownHosts holds the trusted fingerprints of peer devices. A device usually has one
+// fingerprint. During a certificate rotation, the previous fingerprint is kept until its
+// grace period expires. Revoked fingerprints are never trusted, even if they are added again.
+//
+// Files without a version are read as a `deviceID: fingerprint` map, which is the format of
+// earlier versions. Saving always writes the current version.
+type KnownHosts struct {
+	Version int                     `yaml:"version"`
+	Devices map[string]*KnownDevice `yaml:"devices"`
+	Revoked []RevokedFingerprint    `yaml:"revoked,omitempty"`
+
+	// Noise holds the certificate chains in PEM format of peer devices that accept Noise
+	// encrypted connections, by device ID
+	Noise map[string]string `yaml:"noise,omitempty"`
+}
+
+// NewKnownHosts creates empty known hosts.
+func NewKnownHosts() *KnownHosts {
+	return &KnownHosts{
+		Version: KnownHostsVersion,
+		Devices: make(map[string]*KnownDevice),
+	}
+}
+
+// ParseKnownHosts parses the content of a known_hosts file.
+func ParseKnownHosts(data []byte) (*KnownHosts, error) {
+	var header struct {
+		Version int `yaml:"version"`
+	}
+	if err := yaml.Unmarshal(data, &header); err != nil || header.Version == 0 {
+		return parseLegacyKnownHosts(data)
+	}
+	if header.Version > KnownHostsVersion {
+		return nil, errors.New("known_hosts was written by a newer version of portier-cli")
+	}
+
+	knownHosts := NewKnownHosts()
+	if err := yaml.Unmarshal(data, knownHosts); err != nil {
+		return nil, err
+	}
+	if knownHosts.Devices == nil {
+		knownHosts.Devices = make(map[string]*KnownDevice)
+	}
+	for deviceID, device := range knownHosts.Devices {
+		if device == nil || len(device.Fingerprints) == 0 {
+			delete(knownHosts.Devices, deviceID)
+		}
+	}
+	return knownHosts, nil
+}
+
+// parseLegacyKnownHosts reads the unversioned format, mapping a device ID to a fingerprint or
+// to a list of fingerprints.
+func parseLegacyKnownHosts(data []byte) (*KnownHosts, error) {
+	var legacy map[string]fingerprintList
+	if err := yaml.Unmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+	knownHosts := NewKnownHosts()
+	for deviceID, fingerprints := range legacy {
+		// a device without fingerprints is not trusted
+		if len(fingerprints) > 0 {
+			knownHosts.Devices[deviceID] = &KnownDevice{Fingerprints: fingerprints}
+		}
+	}
+	return knownHosts, nil
+}
+
+// LoadKnownHosts reads a known_hosts file. A missing file yields empty known hosts.
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewKnownHosts(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseKnownHosts(data)
+}
+
+// Save removes expired fingerprints and writes the known hosts to the given path.
+func (k *KnownHosts) Save(path string) error {
+	k.Prune(time.Now())
+	k.Version = KnownHostsVersion
+	data, err := yaml.Marshal(k)
+	if err != nil {
+		return err
+	}
+	return secrets.WriteFileSecure(path, data)
+}
+
+// Has reports whether the device has trusted fingerprints.
+func (k *KnownHosts) Has(deviceID string) bool {
+	device, ok := k.Devices[deviceID]
+	return ok && len(device.Fingerprints) > 0
+}
+
+// Trusts reports whether the fingerprint is trusted for the device at the given time.
+func (k *KnownHosts) Trusts(deviceID, fingerprint string, now time.Time) bool {
+	device, ok := k.Devices[deviceID]
+	if !ok || k.IsRevoked(fingerprint) {
+		return false
+	}
+	for _, known := range device.Fingerprints {
+		if known.Fingerprint == fingerprint && (known.Expires.IsZero() || now.Before(known.Expires)) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRevoked reports whether the fingerprint was revoked.
+func (k *KnownHosts) IsRevoked(fingerprint string) bool {
+	for _, revoked := range k.Revoked {
+		if revoked.Fingerprint == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// Changed reports whether the device is known with current fingerprints other than the given one.
+// Adding such a fingerprint should be confirmed by the user.
+func (k *KnownHosts) Changed(deviceID, fingerprint string) bool {
+	device, ok := k.Devices[deviceID]
+	if !ok {
+		return false
+	}
+	changed := false
+	for _, known := range device.Fingerprints {
+		if known.Fingerprint == fingerprint {
+			return false
+		}
+		changed = changed || known.Expires.IsZero()
+	}
+	return changed
+}
+
+// Add makes the fingerprint the current one of the device. Other current fingerprints of the
+// device stay trusted for the grace period. Returns whether the known hosts changed.
+func (k *KnownHosts) Add(deviceID string, fingerprint KnownFingerprint, grace time.Duration, now time.Time) bool {
+	if fingerprint.Added.IsZero() {
+		fingerprint.Added = now
+	}
+	device, ok := k.Devices[deviceID]
+	if !ok {
+		k.Devices[deviceID] = &KnownDevice{Fingerprints: []KnownFingerprint{fingerprint}}
+		return true
+	}
+
+	fingerprints := []KnownFingerprint{fingerprint}
+	changed := true
+	for _, known := range device.Fingerprints {
+		switch {
+		case known.Fingerprint == fingerprint.Fingerprint:
+			// keep the metadata of the fingerprint, it may only lose its expiry
+			changed = !known.Expires.IsZero()
+			known.Expires = time.Time{}
+			fingerprints[0] = known
+		case known.Expires.IsZero():
+			known.Expires = now.Add(grace)
+			fingerprints = append(fingerprints, known)
+		default:
+			fingerprints = append(fingerprints, known)
+		}
+	}
+	changed = changed || len(fingerprints) != len(device.Fingerprints)
+	device.Fingerprints = fingerprints
+	return changed
+}
+
+// NoisePeer returns the certificate chain of a peer device that accepts Noise, nil if unknown.
+func (k *KnownHosts) NoisePeer(deviceID string) []byte {
+	certificate, ok := k.Noise[deviceID]
+	if !ok {
+		return nil
+	}
+	return []byte(certificate)
+}
+
+// SetNoisePeer remembers the certificate chain of a peer device that accepts Noise. An empty
+// chain forgets the peer. Returns whether the known hosts changed.
+func (k *KnownHosts) SetNoisePeer(deviceID string, certificate []byte) bool {
+	current, ok := k.Noise[deviceID]
+	if len(certificate) == 0 {
+		delete(k.Noise, deviceID)
+		return ok
+	}
+	if ok && current == string(certificate) {
+		return false
+	}
+	if k.Noise == nil {
+		k.Noise = make(map[string]string)
+	}
+	k.Noise[deviceID] = string(certificate)
+	return true
+}
+
+// SetName sets the name of a known device.
+func (k *KnownHosts) SetName(deviceID, name string) {
+	if device, ok := k.Devices[deviceID]; ok {
+		device.Name = name
+	}
+}
+
+// Revoke adds the fingerprint to the revoked list and removes it from the device. Without
+// a fingerprint, all fingerprints of the device are revoked. Returns the number of revoked
+// fingerprints.
+func (k *KnownHosts) Revoke(deviceID, fingerprint, reason string, now time.Time) int {
+	var fingerprints []string
+	if fingerprint != "" {
+		fingerprints = append(fingerprints, fingerprint)
+	} else if device, ok := k.Devices[deviceID]; ok {
+		for _, known := range device.Fingerprints {
+			fingerprints = append(fingerprints, known.Fingerprint)
+		}
+	}
+
+	revoked := 0
+	for _, fingerprint := range fingerprints {
+		if k.IsRevoked(fingerprint) {
+			continue
+		}
+		k.Revoked = append(k.Revoked, RevokedFingerprint{
+			Fingerprint: fingerprint,
+			DeviceID:    deviceID,
+			Revoked:     now,
+			Reason:      reason,
+		})
+		revoked++
+	}
+
+	if device, ok := k.Devices[deviceID]; ok {
+		valid := device.Fingerprints[:0]
+		for _, known := range device.Fingerprints {
+			if !k.IsRevoked(known.Fingerprint) {
+				valid = append(valid, known)
+			}
+		}
+		device.Fingerprints = valid
+		if len(valid) == 0 {
+			delete(k.Devices, deviceID)
+		}
+	}
+	return revoked
+}
+
+// Prune removes fingerprints whose grace period expired before the given time.
+func (k *KnownHosts) Prune(now time.Time) {
+	for deviceID, device := range k.Devices {
+		valid := device.Fingerprints[:0]
+		for _, known := range device.Fingerprints {
+			if known.Expires.IsZero() || now.Before(known.Expires) {
+				valid = append(valid, known)
+			}
+		}
+		if len(valid) == 0 {
+			delete(k.Devices, deviceID)
+			continue
+		}
+		device.Fingerprints = valid
+	}
+}
+
+// DeviceIDs returns the sorted IDs of all known devices.
+func (k *KnownHosts) DeviceIDs() []string {
+	ids := make([]string, 0, len(k.Devices))
+	for id := range k.Devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// fingerprintList accepts a single fingerprint as well as a list of fingerprints.
+type fingerprintList []KnownFingerprint
+
+func (l *fingerprintList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var fingerprint string
+	if err := unmarshal(&fingerprint); err == nil {
+		*l = nil
+		if fingerprint != "" {
+			*l = fingerprintList{{Fingerprint: fingerprint}}
+		}
+		return nil
+	}
+	var fingerprints []KnownFingerprint
+	if err := unmarshal(&fingerprints); err != nil {
+		return err
+	}
+	*l = fingerprints
+	return nil
+}
+
+func (f *KnownFingerprint) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var fingerprint string
+	if err := unmarshal(&fingerprint); err == nil {
+		*f = KnownFingerprint{Fingerprint: fingerprint}
+		return nil
+	}
+	type plain KnownFingerprint
+	return unmarshal((*plain)(f))
+}
@@ -0,0 +1,80 @@
+package ptls
+
+import (
+	"crypto/sha256"
+	"os"
+	"sync"
+	"time"
+)
+
+// racyWindow is how long after its modification a file is read again on every access. A write
+// within the resolution of the modification time, 2s on some file systems, does not change it.
+const racyWindow = 2 * time.Second
+
+// knownHostsCache parses the known_hosts file once and parses it again when its content
+// changes. Each access stats the file, it is only read again if its modification time, size or
+// inode changed, or if it was modified too recently to rely on these. The content read is
+// compared by its hash, so that a touched but unchanged file is not parsed again. Files that
+// cannot be stat'ed, e.g. of a custom loader, are read on every access.
+type knownHostsCache struct {
+	path string
+	load FileLoader
+
+	mu         sync.Mutex
+	knownHosts *KnownHosts
+	hash       [sha256.Size]byte
+	info       os.FileInfo
+}
+
+func newKnownHostsCache(path string, load FileLoader) *knownHostsCache {
+	return &knownHostsCache{
+		path: path,
+		load: load,
+	}
+}
+
+// get returns the current known hosts. The result is shared and must not be modified.
+func (c *knownHostsCache) get() (*KnownHosts, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, statErr := os.Stat(c.path)
+	if statErr != nil {
+		info = nil
+	}
+	if c.knownHosts != nil && c.unchanged(info) {
+		return c.knownHosts, nil
+	}
+
+	data, err := c.load(c.path)
+	if err != nil {
+		c.info = nil
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	c.info = info
+	if c.knownHosts != nil && hash == c.hash {
+		return c.knownHosts, nil
+	}
+
+	knownHosts, err := ParseKnownHosts(data)
+	if err != nil {
+		c.info = nil
+		return nil, err
+	}
+	c.knownHosts = knownHosts
+	c.hash = hash
+	return knownHosts, nil
+}
+
+// unchanged reports whether the file described by info is the one last read and was not
+// modified since.
+func (c *knownHostsCache) unchanged(info os.FileInfo) bool {
+	if info == nil || c.info == nil {
+		return false
+	}
+	return os.SameFile(info, c.info) &&
+		info.Size() == c.info.Size() &&
+		info.ModTime().Equal(c.info.ModTime()) &&
+		time.Since(info.ModTime()) >= racyWindow
+}
@@ -0,0 +1,169 @@
+package ptls
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLegacyKnownHostsMap(t *testing.T) {
+	// GIVEN
+	data := []byte("00000000-0000-0000-0000-000000000001: aaaa\n00000000-0000-0000-0000-000000000002: bbbb\n")
+
+	// WHEN
+	knownHosts, err := ParseKnownHosts(data)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, []string{"00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002"}, knownHosts.DeviceIDs())
+	require.True(t, knownHosts.Trusts("00000000-0000-0000-0000-000000000001", "aaaa", time.Now()))
+	require.False(t, knownHosts.Trusts("00000000-0000-0000-0000-000000000001", "bbbb", time.Now()))
+}
+
+func TestParseLegacyKnownHostsList(t *testing.T) {
+	// GIVEN
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	data := []byte("device:\n- fingerprint: new\n- fingerprint: old\n  expires: " + expires + "\n")
+
+	// WHEN
+	knownHosts, err := ParseKnownHosts(data)
+
+	// THEN
+	require.NoError(t, err)
+	require.True(t, knownHosts.Trusts("device", "new", time.Now()))
+	require.True(t, knownHosts.Trusts("device", "old", time.Now()))
+	require.False(t, knownHosts.Trusts("device", "old", time.Now().Add(2*time.Hour)))
+}
+
+func TestKnownHostsRoundTrip(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	now := time.Now().Truncate(time.Second)
+	knownHosts := NewKnownHosts()
+	knownHosts.Add("device", KnownFingerprint{Fingerprint: "aaaa", Source: SourceAPI}, time.Hour, now)
+	knownHosts.SetName("device", "myHomePC")
+	knownHosts.Revoke("other", "cccc", "stolen", now)
+
+	// WHEN
+	require.NoError(t, knownHosts.Save(path))
+	loaded, err := LoadKnownHosts(path)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, KnownHostsVersion, loaded.Version)
+	require.Equal(t, "myHomePC", loaded.Devices["device"].Name)
+	require.Equal(t, SourceAPI, loaded.Devices["device"].Fingerprints[0].Source)
+	require.True(t, now.Equal(loaded.Devices["device"].Fingerprints[0].Added))
+	require.True(t, loaded.IsRevoked("cccc"))
+	require.Equal(t, "stolen", loaded.Revoked[0].Reason)
+}
+
+func TestKnownHostsKeepReplacedFingerprintDuringGracePeriod(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	now := time.Now()
+	knownHosts := NewKnownHosts()
+	knownHosts.Add("device", KnownFingerprint{Fingerprint: "old"}, time.Hour, now)
+
+	// WHEN
+	changed := knownHosts.Changed("device", "new")
+	knownHosts.Add("device", KnownFingerprint{Fingerprint: "new"}, time.Hour, now)
+	require.NoError(t, knownHosts.Save(path))
+	loaded, err := LoadKnownHosts(path)
+
+	// THEN
+	require.True(t, changed)
+	require.NoError(t, err)
+	require.False(t, loaded.Changed("device", "new"))
+	require.True(t, loaded.Trusts("device", "new", now))
+	require.True(t, loaded.Trusts("device", "old", now))
+	require.True(t, loaded.Trusts("device", "new", now.Add(2*time.Hour)))
+	require.False(t, loaded.Trusts("device", "old", now.Add(2*time.Hour)))
+	require.False(t, loaded.Add("device", KnownFingerprint{Fingerprint: "new"}, time.Hour, now))
+}
+
+func TestRevokedFingerprintIsNotTrusted(t *testing.T) {
+	// GIVEN
+	now := time.Now()
+	knownHosts := NewKnownHosts()
+	knownHosts.Add("device", KnownFingerprint{Fingerprint: "aaaa"}, time.Hour, now)
+
+	// WHEN
+	revoked := knownHosts.Revoke("device", "", "lost", now)
+	knownHosts.Add("device", KnownFingerprint{Fingerprint: "aaaa"}, time.Hour, now)
+
+	// THEN
+	require.Equal(t, 1, revoked)
+	require.False(t, knownHosts.Trusts("device", "aaaa", now))
+}
+
+func TestLoadMissingKnownHosts(t *testing.T) {
+	// WHEN
+	knownHosts, err := LoadKnownHosts(filepath.Join(t.TempDir(), "known_hosts"))
+
+	// THEN
+	require.NoError(t, err)
+	require.Empty(t, knownHosts.Devices)
+}
+
+func TestKnownHostsCacheReloadsChangedFile(t *testing.T) {
+	// GIVEN
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(path, []byte("device: aaaa\n"), 0600))
+	cache := newKnownHostsCache(path, os.ReadFile)
+	first, err := cache.get()
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	// WHEN the content changes right after it was written, but neither the size nor the modification time
+	second, err := cache.get()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("device: bbbb\n"), 0600))
+	require.NoError(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+	third, err := cache.get()
+	require.NoError(t, err)
+
+	// THEN
+	require.Same(t, first, second)
+	require.True(t, third.Trusts("device", "bbbb", time.Now()))
+}
+
+func TestKnownHostsCacheReadsOnlyChangedFile(t *testing.T) {
+	// GIVEN a file that was modified a while ago
+	dir := t.TempDir()
+	path := filepath.Join(dir, "known_hosts")
+	require.NoError(t, os.WriteFile(path, []byte("device: aaaa\n"), 0600))
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(path, past, past))
+	loads := 0
+	cache := newKnownHostsCache(path, func(path string) ([]byte, error) {
+		loads++
+		return os.ReadFile(path)
+	})
+	first, err := cache.get()
+	require.NoError(t, err)
+
+	// WHEN
+	second, err := cache.get()
+	require.NoError(t, err)
+
+	// THEN the file is not read again
+	require.Same(t, first, second)
+	require.Equal(t, 1, loads)
+
+	// WHEN the file is replaced by one of the same size and modification time
+	replacement := filepath.Join(dir, "known_hosts.tmp")
+	require.NoError(t, os.WriteFile(replacement, []byte("device: bbbb\n"), 0600))
+	require.NoError(t, os.Chtimes(replacement, past, past))
+	require.NoError(t, os.Rename(replacement, path))
+	third, err := cache.get()
+	require.NoError(t, err)
+
+	// THEN
+	require.Equal(t, 2, loads)
+	require.True(t, third.Trusts("device", "bbbb", time.Now()))
+}
@@ -0,0 +1,445 @@
+package ptls
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// noiseProtocolName names the handshake pattern and the primitives, see the Noise
+	// specification. It is hashed into the handshake state.
+	noiseProtocolName = "Noise_IK_25519_ChaChaPoly_SHA256"
+
+	// noisePrologue binds the handshake to the portier relay protocol
+	noisePrologue = "portier relay v1"
+
+	noiseKeySize = 32
+)
+
+// ErrNoiseUnavailable is returned if a connection cannot be Noise encrypted, because Noise is
+// disabled, the device key is not an Ed25519 key or the static key of the peer is unknown.
+var ErrNoiseUnavailable = errors.New("Noise encryption is not available")
+
+// NoiseHandshake is one side of a Noise IK handshake between two devices. The initiator knows
+// the static key of the responder beforehand, so the first message already carries an
+// encrypted payload. The static keys are the X25519 forms of the Ed25519 device keys, the
+// initiator sends its certificate chain along, which the responder verifies like a TLS client
+// certificate.
+//
+// The handshake takes two messages: WriteMessage on the initiator, ReadMessage on the
+// responder, then WriteMessage on the responder and ReadMessage on the initiator. The
+// associated data of each message, i.e. its header, is authenticated by the handshake.
+type NoiseHandshake struct {
+	initiator bool
+
+	// step is the number of handshake messages processed
+	step int
+
+	state *symmetricState
+
+	// s and e are the private static and ephemeral keys
+	s []byte
+	e []byte
+
+	// rs and re are the public static and ephemeral keys of the peer
+	rs []byte
+	re []byte
+
+	// certificate is the PEM certificate chain of the initiator
+	certificate []byte
+
+	// verifyPeer verifies the certificate chain of the initiator and returns its static key
+	verifyPeer func(certificate []byte) ([]byte, error)
+
+	// authenticated is called once the peer proved that it holds its static key, nil to skip
+	authenticated func() error
+
+	session *NoiseSession
+}
+
+// newNoiseInitiator creates the initiator of a handshake with the responder's static key.
+func newNoiseInitiator(key ed25519.PrivateKey, certificate []byte, peerStatic []byte, authenticated func() error) *NoiseHandshake {
+	h := &NoiseHandshake{
+		initiator:     true,
+		state:         newSymmetricState(),
+		s:             x25519PrivateKey(key),
+		rs:            peerStatic,
+		certificate:   certificate,
+		authenticated: authenticated,
+	}
+	h.state.mixHash(h.rs)
+	return h
+}
+
+// newNoiseResponder creates the responder of a handshake.
+func newNoiseResponder(key ed25519.PrivateKey, verifyPeer func(certificate []byte) ([]byte, error), authenticated func() error) *NoiseHandshake {
+	h := &NoiseHandshake{
+		state:         newSymmetricState(),
+		s:             x25519PrivateKey(key),
+		verifyPeer:    verifyPeer,
+		authenticated: authenticated,
+	}
+	h.state.mixHash(publicKey(h.s))
+	return h
+}
+
+// WriteMessage returns the next handshake message with the encrypted payload.
+func (h *NoiseHandshake) WriteMessage(ad, payload []byte) ([]byte, error) {
+	if h.step > 1 || h.initiator != (h.step == 0) {
+		return nil, errors.New("noise: unexpected handshake message")
+	}
+	h.step++
+	h.state.mixHash(ad)
+
+	e, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+	h.e = e
+	ePub := publicKey(e)
+	h.state.mixHash(ePub)
+	message := append([]byte{}, ePub...)
+
+	if h.initiator {
+		// -> e, es, s, ss
+		if err := h.mixDH(h.e, h.rs); err != nil {
+			return nil, err
+		}
+		message = append(message, h.state.encryptAndHash(publicKey(h.s))...)
+		if err := h.mixDH(h.s, h.rs); err != nil {
+			return nil, err
+		}
+		payload = appendCertificate(h.certificate, payload)
+	} else {
+		// <- e, ee, se
+		if err := h.mixDH(h.e, h.re); err != nil {
+			return nil, err
+		}
+		if err := h.mixDH(h.e, h.rs); err != nil {
+			return nil, err
+		}
+	}
+	message = append(message, h.state.encryptAndHash(payload)...)
+
+	if !h.initiator {
+		h.split()
+	}
+	return message, nil
+}
+
+// ReadMessage processes the next handshake message of the peer and returns its payload. The
+// message is processed on a copy of the handshake state, which replaces the state only once the
+// message proved authentic. A forged or corrupt message, e.g. injected by the relay, thereby
+// does not keep the handshake from processing the genuine message of the peer.
+func (h *NoiseHandshake) ReadMessage(ad, message []byte) ([]byte, error) {
+	if h.step > 1 || h.initiator != (h.step == 1) {
+		return nil, errors.New("noise: unexpected handshake message")
+	}
+
+	next := *h
+	state := *h.state
+	next.state = &state
+	payload, err := next.readMessage(ad, message)
+	if err != nil {
+		return nil, err
+	}
+	*h = next
+	return payload, nil
+}
+
+func (h *NoiseHandshake) readMessage(ad, message []byte) ([]byte, error) {
+	h.step++
+	h.state.mixHash(ad)
+
+	if len(message) < noiseKeySize {
+		return nil, errors.New("noise: handshake message too short")
+	}
+	h.re = message[:noiseKeySize]
+	message = message[noiseKeySize:]
+	h.state.mixHash(h.re)
+
+	if h.initiator {
+		// <- e, ee, se
+		if err := h.mixDH(h.e, h.re); err != nil {
+			return nil, err
+		}
+		if err := h.mixDH(h.s, h.re); err != nil {
+			return nil, err
+		}
+		payload, err := h.state.decryptAndHash(message)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.authenticate(); err != nil {
+			return nil, err
+		}
+		h.split()
+		return payload, nil
+	}
+
+	// -> e, es, s, ss
+	if err := h.mixDH(h.s, h.re); err != nil {
+		return nil, err
+	}
+	staticSize := noiseKeySize + chacha20poly1305.Overhead
+	if len(message) < staticSize {
+		return nil, errors.New("noise: handshake message too short")
+	}
+	rs, err := h.state.decryptAndHash(message[:staticSize])
+	if err != nil {
+		return nil, err
+	}
+	h.rs = rs
+	if err := h.mixDH(h.s, h.rs); err != nil {
+		return nil, err
+	}
+	payload, err := h.state.decryptAndHash(message[staticSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, payload, err := splitCertificate(payload)
+	if err != nil {
+		return nil, err
+	}
+	static, err := h.verifyPeer(certificate)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(static, h.rs) {
+		return nil, errors.New("noise: the static key of the peer does not match its certificate")
+	}
+	if err := h.authenticate(); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// authenticate reports the authenticated peer, the message of the peer was decrypted with a
+// key derived from its static key.
+func (h *NoiseHandshake) authenticate() error {
+	if h.authenticated == nil {
+		return nil
+	}
+	return h.authenticated()
+}
+
+// Session returns the transport session once the handshake is complete.
+func (h *NoiseHandshake) Session() (*NoiseSession, error) {
+	if h.session == nil {
+		return nil, errors.New("noise: handshake not complete")
+	}
+	return h.session, nil
+}
+
+func (h *NoiseHandshake) mixDH(private, public []byte) error {
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return fmt.Errorf("noise: %w", err)
+	}
+	h.state.mixKey(shared)
+	return nil
+}
+
+func (h *NoiseHandshake) split() {
+	k1, k2 := hkdf(h.state.ck[:], nil)
+	initiatorKey, _ := chacha20poly1305.New(k1)
+	responderKey, _ := chacha20poly1305.New(k2)
+	if h.initiator {
+		h.session = &NoiseSession{send: initiatorKey, receive: responderKey}
+	} else {
+		h.session = &NoiseSession{send: responderKey, receive: initiatorKey}
+	}
+}
+
+// NoiseSession encrypts the payloads of the messages of a connection after the handshake.
+//
+// Unlike the Noise transport, every message carries its nonce, since the relay may lose,
+// retransmit and reorder messages. Replayed messages are not rejected here, the connection
+// already discards duplicate data messages by their sequence numbers.
+type NoiseSession struct {
+	send    cipher.AEAD
+	receive cipher.AEAD
+	nonce   atomic.Uint64
+}
+
+// Seal encrypts the payload of a message and authenticates the associated data, i.e. the
+// message header.
+func (s *NoiseSession) Seal(ad, plaintext []byte) []byte {
+	n := s.nonce.Add(1) - 1
+	sealed := make([]byte, 8, 8+len(plaintext)+s.send.Overhead())
+	binary.BigEndian.PutUint64(sealed, n)
+	return s.send.Seal(sealed, noiseNonce(n), plaintext, ad)
+}
+
+// Open decrypts the payload of a message sealed by the peer.
+func (s *NoiseSession) Open(ad, sealed []byte) ([]byte, error) {
+	if len(sealed) < 8 {
+		return nil, errors.New("noise: message too short")
+	}
+	n := binary.BigEndian.Uint64(sealed)
+	plaintext, err := s.receive.Open(nil, noiseNonce(n), sealed[8:], ad)
+	if err != nil {
+		return nil, fmt.Errorf("noise: %w", err)
+	}
+	return plaintext, nil
+}
+
+// symmetricState is the SymmetricState of the Noise specification.
+type symmetricState struct {
+	ck [sha256.Size]byte
+	h  [sha256.Size]byte
+	k  cipher.AEAD
+	n  uint64
+}
+
+func newSymmetricState() *symmetricState {
+	s := &symmetricState{}
+	copy(s.h[:], noiseProtocolName)
+	s.ck = s.h
+	s.mixHash([]byte(noisePrologue))
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(s.h[:])
+	hash.Write(data)
+	hash.Sum(s.h[:0])
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	ck, k := hkdf(s.ck[:], ikm)
+	copy(s.ck[:], ck)
+	s.k, _ = chacha20poly1305.New(k)
+	s.n = 0
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := s.k.Seal(nil, noiseNonce(s.n), plaintext, s.h[:])
+	s.n++
+	s.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.k.Open(nil, noiseNonce(s.n), ciphertext, s.h[:])
+	if err != nil {
+		return nil, fmt.Errorf("noise: handshake message not authentic: %w", err)
+	}
+	s.n++
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// hkdf derives two keys from the chaining key, see the Noise specification.
+func hkdf(ck, ikm []byte) ([]byte, []byte) {
+	extract := hmac.New(sha256.New, ck)
+	extract.Write(ikm)
+	tempKey := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, tempKey)
+	expand.Write([]byte{1})
+	out1 := expand.Sum(nil)
+	expand.Reset()
+	expand.Write(out1)
+	expand.Write([]byte{2})
+	out2 := expand.Sum(nil)
+	return out1, out2
+}
+
+func noiseNonce(n uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+func generateKey() ([]byte, error) {
+	key := make([]byte, noiseKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func publicKey(private []byte) []byte {
+	public, _ := curve25519.X25519(private, curve25519.Basepoint)
+	return public
+}
+
+// appendCertificate prefixes the payload with the length and the certificate chain.
+func appendCertificate(certificate, payload []byte) []byte {
+	out := make([]byte, 4, 4+len(certificate)+len(payload))
+	binary.BigEndian.PutUint32(out, uint32(len(certificate)))
+	out = append(out, certificate...)
+	return append(out, payload...)
+}
+
+func splitCertificate(payload []byte) ([]byte, []byte, error) {
+	if len(payload) < 4 {
+		return nil, nil, errors.New("noise: certificate missing")
+	}
+	size := binary.BigEndian.Uint32(payload)
+	if uint64(size) > uint64(len(payload)-4) {
+		return nil, nil, errors.New("noise: certificate truncated")
+	}
+	return payload[4 : 4+size], payload[4+size:], nil
+}
+
+// x25519PrivateKey returns the X25519 private key of the key pair of an Ed25519 private key.
+func x25519PrivateKey(key ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(key.Seed())
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return h[:noiseKeySize]
+}
+
+// curve25519P is the prime 2^255 - 19
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// x25519PublicKey returns the X25519 public key of an Ed25519 public key, the Montgomery
+// u-coordinate (1 + y) / (1 - y) of the Edwards point.
+func x25519PublicKey(key ed25519.PublicKey) ([]byte, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	// the key is the little-endian y-coordinate, the top bit is the sign of x
+	be := make([]byte, len(key))
+	for i, b := range key {
+		be[len(key)-1-i] = b
+	}
+	be[0] &= 0x7f
+	y := new(big.Int).SetBytes(be)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+
+	one := big.NewInt(1)
+	numerator := new(big.Int).Add(one, y)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, curve25519P)
+	if denominator.Sign() == 0 {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	u := numerator.Mul(numerator, denominator.ModInverse(denominator, curve25519P))
+	u.Mod(u, curve25519P)
+
+	out := u.FillBytes(make([]byte, noiseKeySize))
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
@@ -0,0 +1,192 @@
+package ptls
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (p *ptls) NoiseCertificate() ([]byte, error) {
+	certificate, _, err := p.noiseIdentity()
+	return certificate, err
+}
+
+func (p *ptls) LearnNoisePeer(peerDeviceID uuid.UUID, certificate []byte, conn net.Conn) error {
+	if len(certificate) > 0 {
+		if err := authenticatedByTLS(peerDeviceID, certificate, conn); err != nil {
+			return err
+		}
+		if _, err := p.verifyNoisePeer(peerDeviceID, certificate, true); err != nil {
+			return err
+		}
+	}
+
+	// learned peers are kept in known_hosts, a restart must not fall back to TLS
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	knownHosts, err := LoadKnownHosts(p.KnownHostsFile)
+	if err != nil {
+		return err
+	}
+	if !knownHosts.SetNoisePeer(peerDeviceID.String(), certificate) {
+		return nil
+	}
+	return knownHosts.Save(p.KnownHostsFile)
+}
+
+func (p *ptls) NewNoiseHandshake(peerDeviceID uuid.UUID, initiator bool) (*NoiseHandshake, error) {
+	certificate, key, err := p.noiseIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if !initiator {
+		var peerCertificate []byte
+		verify := func(certificate []byte) ([]byte, error) {
+			peerCertificate = certificate
+			return p.verifyNoisePeer(peerDeviceID, certificate, false)
+		}
+		return newNoiseResponder(key, verify, func() error {
+			return p.pinNoisePeer(peerCertificate)
+		}), nil
+	}
+
+	knownHosts, err := p.knownHosts.get()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var peerCertificate []byte
+	if knownHosts != nil {
+		peerCertificate = knownHosts.NoisePeer(peerDeviceID.String())
+	}
+	if len(peerCertificate) == 0 {
+		return nil, fmt.Errorf("%w: the static key of peer device %s is not known yet", ErrNoiseUnavailable, peerDeviceID)
+	}
+	// verify again, the peer may have been revoked in the meantime
+	peerStatic, err := p.verifyNoisePeer(peerDeviceID, peerCertificate, true)
+	if err != nil {
+		_ = p.LearnNoisePeer(peerDeviceID, nil, nil)
+		return nil, err
+	}
+	return newNoiseInitiator(key, certificate, peerStatic, func() error {
+		return p.pinNoisePeer(peerCertificate)
+	}), nil
+}
+
+// pinNoisePeer pins the certificate of a peer device authenticated by a Noise handshake, like
+// Handshake does for TLS peers. Peers verified by the CA are not pinned.
+func (p *ptls) pinNoisePeer(certificate []byte) error {
+	if _, err := p.Repo(p.CAFile); err == nil {
+		return nil
+	}
+	chain, err := ParseCertificateChain(certificate)
+	if err != nil {
+		return err
+	}
+	return p.pinAuthenticated(chain)
+}
+
+// noiseIdentity loads the certificate chain and the Ed25519 key of this device.
+func (p *ptls) noiseIdentity() ([]byte, ed25519.PrivateKey, error) {
+	if !p.noise {
+		return nil, nil, ErrNoiseUnavailable
+	}
+	cert, err := p.Repo(p.CertFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := p.Repo(p.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsCert, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	edKey, ok := tlsCert.PrivateKey.(ed25519.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: the device key is not an Ed25519 key", ErrNoiseUnavailable)
+	}
+	return cert, edKey, nil
+}
+
+// authenticatedByTLS checks that the certificate chain of a peer device, received over the
+// relay, starts with the certificate that the completed TLS handshake of conn verified.
+func authenticatedByTLS(peerDeviceID uuid.UUID, certificate []byte, conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return fmt.Errorf("the Noise certificate of peer device %s was not received over TLS", peerDeviceID)
+	}
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete || len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("the TLS handshake with peer device %s is not complete", peerDeviceID)
+	}
+	chain, err := ParseCertificateChain(certificate)
+	if err != nil {
+		return err
+	}
+	if len(chain) == 0 || !chain[0].Equal(state.PeerCertificates[0]) {
+		return fmt.Errorf("the Noise certificate of peer device %s is not the certificate of its TLS connection", peerDeviceID)
+	}
+	return nil
+}
+
+// verifyNoisePeer verifies the certificate chain of a peer device like a TLS peer certificate,
+// by the CA or by the known hosts, and returns the static key of the peer. Unless pinned is
+// set, the known hosts also accept unknown and rotated certificates, which the handshake pins
+// once it authenticated the peer.
+func (p *ptls) verifyNoisePeer(peerDeviceID uuid.UUID, certificate []byte, pinned bool) ([]byte, error) {
+	chain, err := ParseCertificateChain(certificate)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	rawCerts := make([][]byte, len(chain))
+	for i, cert := range chain {
+		rawCerts[i] = cert.Raw
+	}
+
+	cacert, err := p.Repo(p.CAFile)
+	if err == nil {
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(cacert)
+		verifiedChains, err := chain[0].Verify(x509.VerifyOptions{
+			Roots:     caCertPool,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = p.verifyCA(peerDeviceID)(rawCerts, verifiedChains)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if err := p.verifyKnownHosts(peerDeviceID)(rawCerts, nil); err != nil {
+			return nil, err
+		}
+		knownHosts, err := p.trustedHosts()
+		if err != nil {
+			return nil, err
+		}
+		fingerprint := fmt.Sprintf("%x", sha256.Sum256(chain[0].Raw))
+		if pinned && !knownHosts.Trusts(peerDeviceID.String(), fingerprint, time.Now()) {
+			return nil, fmt.Errorf("the certificate %s of peer device %s is not pinned", fingerprint, peerDeviceID)
+		}
+	}
+
+	edKey, ok := chain[0].PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: the key of peer device %s is not an Ed25519 key", ErrNoiseUnavailable, peerDeviceID)
+	}
+	return x25519PublicKey(edKey)
+}
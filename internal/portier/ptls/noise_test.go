@@ -0,0 +1,255 @@
+package ptls
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
+)
+
+// withNoise lets the device accept Noise encrypted connections.
+func withNoise() testDeviceOption {
+	return func(_ string, options *testDeviceOptions) {
+		options.ptls.Noise = true
+	}
+}
+
+// tlsConnection returns a TLS connection of the client to the server whose handshake completed
+// on the client side.
+func tlsConnection(t *testing.T, client, server *testDevice) net.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		serverStream, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer serverStream.Close()
+		serverTLS, err := server.ptls.CreateServer(serverStream, client.id)
+		if err != nil || server.ptls.Handshake(serverTLS) != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, serverTLS)
+	}()
+	clientStream, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = clientStream.Close() })
+	clientTLS, err := client.ptls.CreateClient(clientStream, server.id)
+	require.NoError(t, err)
+	require.NoError(t, client.ptls.Handshake(clientTLS))
+	return clientTLS
+}
+
+// noiseHandshake runs a handshake of the client to the server, which the client learned
+// about before. Returns the sessions of both sides and the payload received by the server.
+func noiseHandshake(t *testing.T, client, server *testDevice) (*NoiseSession, *NoiseSession, []byte, error) {
+	certificate, err := server.ptls.NoiseCertificate()
+	require.NoError(t, err)
+	require.NoError(t, client.ptls.LearnNoisePeer(server.id, certificate, tlsConnection(t, client, server)))
+
+	initiator, err := client.ptls.NewNoiseHandshake(server.id, true)
+	require.NoError(t, err)
+	responder, err := server.ptls.NewNoiseHandshake(client.id, false)
+	require.NoError(t, err)
+
+	message1, err := initiator.WriteMessage([]byte("CO"), []byte("bridge options"))
+	require.NoError(t, err)
+	payload, err := responder.ReadMessage([]byte("CO"), message1)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	message2, err := responder.WriteMessage([]byte("CA"), nil)
+	require.NoError(t, err)
+	_, err = initiator.ReadMessage([]byte("CA"), message2)
+	require.NoError(t, err)
+
+	clientSession, err := initiator.Session()
+	require.NoError(t, err)
+	serverSession, err := responder.Session()
+	require.NoError(t, err)
+	return clientSession, serverSession, payload, nil
+}
+
+func TestNoiseHandshakeBetweenTrustedDevices(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withNoise())
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withNoise())
+	server.trust(t, client)
+	client.trust(t, server)
+
+	// WHEN
+	clientSession, serverSession, payload, err := noiseHandshake(t, client, server)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, "bridge options", string(payload))
+
+	// messages can be lost and reordered
+	first := clientSession.Seal([]byte("D"), []byte("first"))
+	second := clientSession.Seal([]byte("D"), []byte("second"))
+	opened, err := serverSession.Open([]byte("D"), second)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(opened))
+	opened, err = serverSession.Open([]byte("D"), first)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(opened))
+
+	reply, err := clientSession.Open([]byte("DA"), serverSession.Seal([]byte("DA"), []byte("ack")))
+	require.NoError(t, err)
+	require.Equal(t, "ack", string(reply))
+
+	// the header is authenticated
+	_, err = serverSession.Open([]byte("DA"), clientSession.Seal([]byte("D"), []byte("data")))
+	require.Error(t, err)
+}
+
+func TestNoiseHandshakeRejectsUnknownInitiator(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withNoise())
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withNoise())
+	other := newTestDevice(t, "00000000-0000-0000-0000-000000000003", withNoise())
+	server.trust(t, other)
+	client.trust(t, server)
+
+	// WHEN
+	_, _, _, err := noiseHandshake(t, client, server)
+
+	// THEN
+	require.ErrorContains(t, err, "unknown peer device")
+}
+
+func TestNoiseHandshakeNeedsKnownPeer(t *testing.T) {
+	// GIVEN
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withNoise())
+	disabled := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+
+	// WHEN
+	_, err := client.ptls.NewNoiseHandshake(disabled.id, true)
+	_, errDisabled := disabled.ptls.NoiseCertificate()
+
+	// THEN
+	require.ErrorIs(t, err, ErrNoiseUnavailable)
+	require.ErrorIs(t, errDisabled, ErrNoiseUnavailable)
+}
+
+func TestX25519KeysOfEd25519KeyPair(t *testing.T) {
+	// GIVEN
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	// WHEN
+	converted, err := x25519PublicKey(public)
+	require.NoError(t, err)
+	derived, err := curve25519.X25519(x25519PrivateKey(private), curve25519.Basepoint)
+	require.NoError(t, err)
+
+	// THEN
+	require.Equal(t, derived, converted)
+}
+
+func TestLearnedNoisePeerSurvivesRestart(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withNoise())
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withNoise())
+	server.trust(t, client)
+	client.trust(t, server)
+	certificate, err := server.ptls.NoiseCertificate()
+	require.NoError(t, err)
+	require.NoError(t, client.ptls.LearnNoisePeer(server.id, certificate, tlsConnection(t, client, server)))
+
+	// WHEN a new instance starts a handshake
+	_, err = NewPTLSWithOptions(PTLSOptions{
+		Enabled:        true,
+		CertFile:       filepath.Join(client.dir, "cert.pem"),
+		KeyFile:        filepath.Join(client.dir, "key.pem"),
+		CAFile:         filepath.Join(client.dir, "cacert.pem"),
+		KnownHostsFile: filepath.Join(client.dir, "known_hosts"),
+		Noise:          true,
+	}).NewNoiseHandshake(server.id, true)
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, certificate, client.knownHosts(t).NoisePeer(server.id.String()))
+}
+
+func TestNoiseCertificateInjectedByTheRelayIsNotLearned(t *testing.T) {
+	// GIVEN devices that trust each other on first use
+	changes := make(chan PeerChange, 1)
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withTOFU(changes), withNoise())
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withTOFU(changes), withNoise())
+	certificate, err := server.ptls.NoiseCertificate()
+	require.NoError(t, err)
+
+	// the relay replaces the certificate of the server with one for the same device ID
+	relay := newTestDevice(t, server.id.String(), withNoise())
+	injected, err := relay.ptls.NoiseCertificate()
+	require.NoError(t, err)
+
+	// WHEN
+	errWithoutTLS := client.ptls.LearnNoisePeer(server.id, injected, nil)
+	errOverTLS := client.ptls.LearnNoisePeer(server.id, injected, tlsConnection(t, client, server))
+
+	// THEN
+	require.ErrorContains(t, errWithoutTLS, "not received over TLS")
+	require.ErrorContains(t, errOverTLS, "not the certificate of its TLS connection")
+	require.Empty(t, client.knownHosts(t).NoisePeer(server.id.String()))
+	_, err = client.ptls.NewNoiseHandshake(server.id, true)
+	require.ErrorIs(t, err, ErrNoiseUnavailable)
+
+	// the certificate of the server is learned over its TLS connection
+	require.NoError(t, client.ptls.LearnNoisePeer(server.id, certificate, tlsConnection(t, client, server)))
+	require.Equal(t, certificate, client.knownHosts(t).NoisePeer(server.id.String()))
+}
+
+func TestNoiseHandshakeSurvivesCorruptMessages(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withNoise())
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withNoise())
+	server.trust(t, client)
+	client.trust(t, server)
+	certificate, err := server.ptls.NoiseCertificate()
+	require.NoError(t, err)
+	require.NoError(t, client.ptls.LearnNoisePeer(server.id, certificate, tlsConnection(t, client, server)))
+	initiator, err := client.ptls.NewNoiseHandshake(server.id, true)
+	require.NoError(t, err)
+	responder, err := server.ptls.NewNoiseHandshake(client.id, false)
+	require.NoError(t, err)
+	corrupt := func(message []byte) []byte {
+		corrupted := append([]byte{}, message...)
+		corrupted[len(corrupted)-1] ^= 0xff
+		return corrupted
+	}
+
+	// WHEN the relay sends a truncated and a corrupted copy before each genuine message
+	message1, err := initiator.WriteMessage([]byte("CO"), []byte("bridge options"))
+	require.NoError(t, err)
+	_, err = responder.ReadMessage([]byte("CO"), message1[:noiseKeySize+1])
+	require.Error(t, err)
+	_, err = responder.ReadMessage([]byte("CO"), corrupt(message1))
+	require.Error(t, err)
+	payload, err := responder.ReadMessage([]byte("CO"), message1)
+	require.NoError(t, err)
+
+	message2, err := responder.WriteMessage([]byte("CA"), nil)
+	require.NoError(t, err)
+	_, err = initiator.ReadMessage([]byte("CA"), corrupt(message2))
+	require.Error(t, err)
+	_, err = initiator.ReadMessage([]byte("CA"), message2)
+	require.NoError(t, err)
+
+	// THEN
+	require.Equal(t, "bridge options", string(payload))
+	clientSession, err := initiator.Session()
+	require.NoError(t, err)
+	serverSession, err := responder.Session()
+	require.NoError(t, err)
+	opened, err := serverSession.Open([]byte("D"), clientSession.Seal([]byte("D"), []byte("data")))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(opened))
+}
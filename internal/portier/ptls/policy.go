@@ -0,0 +1,72 @@
+package ptls
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrTLSRequired is returned when a peer opens an unencrypted connection to a target
+	// that requires TLS
+	ErrTLSRequired = errors.New("TLS is required")
+
+	// ErrTLSDisabled is returned when a peer opens an encrypted connection, but TLS is
+	// disabled on this device
+	ErrTLSDisabled = errors.New("TLS is disabled")
+)
+
+// endpointPattern matches the host and port of an endpoint URL, an empty value matches any.
+type endpointPattern struct {
+	host string
+	port string
+}
+
+// parseEndpointPatterns parses the targets of the RequireTLS policy. A target is "*" for all
+// endpoints, a port ("22" or ":22"), a host ("db.local") or both ("db.local:5432").
+func parseEndpointPatterns(targets []string) ([]endpointPattern, error) {
+	patterns := make([]endpointPattern, 0, len(targets))
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		var pattern endpointPattern
+		switch {
+		case target == "" || target == "*":
+		case strings.Contains(target, ":"):
+			host, port, err := net.SplitHostPort(target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TLS policy target %q: %w", target, err)
+			}
+			pattern = endpointPattern{host: host, port: port}
+		case isPort(target):
+			pattern.port = target
+		default:
+			pattern.host = target
+		}
+		if pattern.host == "*" {
+			pattern.host = ""
+		}
+		if pattern.port == "*" {
+			pattern.port = ""
+		}
+		if pattern.port != "" && !isPort(pattern.port) {
+			return nil, fmt.Errorf("invalid TLS policy target %q: invalid port", target)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func (e endpointPattern) matches(endpoint url.URL) bool {
+	if e.host != "" && !strings.EqualFold(e.host, endpoint.Hostname()) {
+		return false
+	}
+	return e.port == "" || e.port == endpoint.Port()
+}
+
+func isPort(s string) bool {
+	port, err := strconv.Atoi(s)
+	return err == nil && port > 0 && port <= 65535
+}
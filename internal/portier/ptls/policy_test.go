@@ -0,0 +1,73 @@
+package ptls
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestEndpointURLMatchesRequireTLSTargets(t *testing.T) {
+	// GIVEN
+	underTest := NewPTLSWithOptions(PTLSOptions{Enabled: true, RequireTLS: []string{"22", "db.local", "10.0.0.5:8443"}})
+
+	for endpoint, required := range map[string]bool{
+		"tcp://localhost:22":     true,
+		"tcp://DB.local:5432":    true,
+		"tcp://10.0.0.5:8443":    true,
+		"tcp://10.0.0.5:80":      false,
+		"tcp://localhost:80":     false,
+		"udp://otherhost:53":     false,
+		"tcp://db.local.evil:80": false,
+	} {
+		// WHEN
+		u, err := url.Parse(endpoint)
+		require.NoError(t, err)
+
+		// THEN
+		require.Equal(t, required, underTest.TestEndpointURL(*u), endpoint)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	enabled, disabled := true, false
+	endpoint := url.URL{Scheme: "tcp", Host: "localhost:22"}
+	other := url.URL{Scheme: "tcp", Host: "localhost:80"}
+	tlsOn := NewPTLSWithOptions(PTLSOptions{Enabled: true, RequireTLS: []string{":22"}})
+	tlsOff := NewPTLSWithOptions(PTLSOptions{Enabled: false})
+
+	// encrypted connections are accepted if TLS is enabled
+	useTLS, err := tlsOn.Negotiate(endpoint, &enabled)
+	require.NoError(t, err)
+	require.True(t, useTLS)
+
+	// unencrypted connections are refused for targets that require TLS
+	_, err = tlsOn.Negotiate(endpoint, &disabled)
+	require.ErrorIs(t, err, ErrTLSRequired)
+	useTLS, err = tlsOn.Negotiate(other, &disabled)
+	require.NoError(t, err)
+	require.False(t, useTLS)
+
+	// encrypted connections are refused if TLS is disabled
+	_, err = tlsOff.Negotiate(other, &enabled)
+	require.ErrorIs(t, err, ErrTLSDisabled)
+
+	// peers that do not announce their choice follow the global setting
+	useTLS, err = tlsOn.Negotiate(endpoint, nil)
+	require.NoError(t, err)
+	require.True(t, useTLS)
+	useTLS, err = tlsOff.Negotiate(other, nil)
+	require.NoError(t, err)
+	require.False(t, useTLS)
+}
+
+func TestInvalidRequireTLSTargetRequiresTLSEverywhere(t *testing.T) {
+	// GIVEN
+	underTest := NewPTLSWithOptions(PTLSOptions{Enabled: true, RequireTLS: []string{"host:notaport"}})
+
+	// WHEN
+	required := underTest.TestEndpointURL(url.URL{Scheme: "tcp", Host: "localhost:80"})
+
+	// THEN
+	require.True(t, required)
+}
@@ -1,25 +1,58 @@
 package ptls
 
 import (
-	"context"
+	"bytes"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
-	"io"
+	"log"
 	"net"
 	"net/url"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"gopkg.in/yaml.v2"
 )
 
 type PTLS interface {
+	// TestEndpointURL reports whether inbound connections to the endpoint must be TLS encrypted
 	TestEndpointURL(endpoint url.URL) bool
-	CreateClientAndBridge(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, func() error, error)
-	CreateServerAndBridge(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, error)
+
+	// Negotiate decides whether an inbound connection to the endpoint is TLS encrypted, given
+	// the choice of the peer. Peers that do not announce their choice (nil) encrypt if TLS is
+	// enabled globally. Returns ErrTLSRequired or ErrTLSDisabled if the connection is refused.
+	Negotiate(endpoint url.URL, requested *bool) (bool, error)
+
+	// CreateClient runs a TLS client over the relayed byte stream to the peer device. The
+	// handshake happens on the first read or write.
+	CreateClient(stream net.Conn, peerDeviceID uuid.UUID) (net.Conn, error)
+
+	// CreateServer runs a TLS server over the relayed byte stream from the peer device. The
+	// handshake happens on the first read or write.
+	CreateServer(stream net.Conn, peerDeviceID uuid.UUID) (net.Conn, error)
+
+	// Handshake completes the handshake of a connection created by CreateClient or CreateServer.
+	// Returns ErrHandshakeTimeout and closes the connection if it takes longer than the
+	// handshake timeout. The certificate of an unknown peer device, with trust on first use,
+	// or of a rotation is pinned once the handshake authenticated the peer.
+	Handshake(conn net.Conn) error
+
+	// NoiseCertificate returns the certificate chain that peers need to open Noise encrypted
+	// connections to this device. Returns ErrNoiseUnavailable if Noise is not accepted.
+	NoiseCertificate() ([]byte, error)
+
+	// LearnNoisePeer verifies the certificate chain of a peer device and remembers it in the
+	// known hosts for Noise encrypted connections to the peer. The chain is received over the
+	// relay, so it is only learned if it starts with the certificate that the completed TLS
+	// handshake of conn authenticated. An empty chain forgets the peer.
+	LearnNoisePeer(peerDeviceID uuid.UUID, certificate []byte, conn net.Conn) error
+
+	// NewNoiseHandshake starts a Noise handshake with the peer device. The initiator needs
+	// the static key of the peer, ErrNoiseUnavailable is returned if it is not known yet.
+	NewNoiseHandshake(peerDeviceID uuid.UUID, initiator bool) (*NoiseHandshake, error)
 }
 
 type ptls struct {
@@ -36,183 +69,277 @@ type ptls struct {
 	// The path to the CA file
 	CAFile string
 
+	// The path to the certificate revocation list of the CA
+	CRLFile string
+
 	// The path to the known hosts file
 	KnownHostsFile string
 
 	// Repository is the repository
 	Repo func(string) ([]byte, error)
+
+	// requireTLS are the endpoints that only accept TLS encrypted connections
+	requireTLS []endpointPattern
+
+	// knownHosts caches the parsed known hosts file
+	knownHosts *knownHostsCache
+
+	// handshakeTimeout is the time a TLS handshake may take
+	handshakeTimeout time.Duration
+
+	// sessions holds the TLS sessions for resumption
+	sessions *sessionCache
+
+	// tofu indicates whether unknown peer devices are trusted on first use
+	tofu bool
+
+	// auditFile is the path to the audit log of trust decisions, empty to disable it
+	auditFile string
+
+	// onPeerChanged is called if a known peer device presents an unknown certificate
+	onPeerChanged func(PeerChange)
+
+	// onRotationDone is called after the previous certificate of a rotation was retired
+	onRotationDone func(Rotation)
+
+	// noise indicates whether Noise encrypted connections are accepted and opened
+	noise bool
+
+	// mu guards updates of the known hosts and rotation files
+	mu sync.Mutex
+
+	// rotationMu guards the state of the rotation checks, see checkRotation
+	rotationMu      sync.Mutex
+	rotationChecked time.Time
+	rotationCert    []byte
+	rotationActive  bool
 }
 
+// rotationCheckInterval is how often connections check the rotation of the certificate, e.g.
+// whether its overlap period ended. A changed certificate file is checked right away.
+const rotationCheckInterval = time.Minute
+
 type FileLoader func(string) ([]byte, error)
 
-// NewPTLS creates a new PTLS instance
-func NewPTLS(enabled bool, certFile, keyFile, caFile, knownHostsFile string, repo FileLoader) PTLS {
+type PTLSOptions struct {
+	// Enabled indicates whether PTLS is enabled
+	Enabled bool
 
-	if repo == nil {
-		repo = loadFile
-	}
+	// CertFile is the path to the certificate file
+	CertFile string
 
-	return &ptls{
+	// KeyFile is the path to the key file
+	KeyFile string
+
+	// CAFile is the path to the CA file. If it exists, peers are verified by the CA,
+	// otherwise by the known hosts file.
+	CAFile string
+
+	// CRLFile is the path to the certificate revocation list of the CA, checked if it exists
+	CRLFile string
+
+	// KnownHostsFile is the path to the known hosts file
+	KnownHostsFile string
+
+	// Repo loads files, defaults to reading from the file system
+	Repo FileLoader
+
+	// RequireTLS are the targets that only accept TLS encrypted inbound connections: "*" for
+	// all, a port ("22"), a host ("db.local") or a host and port ("db.local:5432")
+	RequireTLS []string
+
+	// Noise enables Noise encryption of the messages of connections, if the peer accepts it
+	Noise bool
+
+	// HandshakeTimeout is the time a TLS handshake may take, defaults to DefaultHandshakeTimeout
+	HandshakeTimeout time.Duration
+
+	// SessionCacheSize is the number of TLS sessions cached per peer device for resumption,
+	// defaults to DefaultSessionCacheSize. A negative size disables resumption.
+	SessionCacheSize int
+
+	// TOFU trusts peer devices that are not in the known hosts on first use: the fingerprint
+	// of the first verified certificate is pinned, later changes are rejected
+	TOFU bool
+
+	// AuditFile is the path to the audit log of pinned and changed peer certificates
+	AuditFile string
+
+	// OnPeerChanged is called if a known peer device presents an unknown certificate, e.g. to
+	// report the rejected connection
+	OnPeerChanged func(PeerChange)
+
+	// OnRotationCompleted is called after the previous certificate of a rotation was retired,
+	// e.g. to upload the fingerprint of the new certificate
+	OnRotationCompleted func(Rotation)
+}
+
+// NewPTLS creates a new PTLS instance
+func NewPTLS(enabled bool, certFile, keyFile, caFile, knownHostsFile string, repo FileLoader) PTLS {
+	return NewPTLSWithOptions(PTLSOptions{
 		Enabled:        enabled,
 		CertFile:       certFile,
 		KeyFile:        keyFile,
 		CAFile:         caFile,
 		KnownHostsFile: knownHostsFile,
 		Repo:           repo,
-	}
+	})
 }
 
-func (p *ptls) TestEndpointURL(endpoint url.URL) bool {
-	// look at config and determine from the endpoint configs if this endpoint must be secured with TLS
-	// also determine if TLS is globally enabled
+// NewPTLSWithOptions creates a new PTLS instance
+func NewPTLSWithOptions(options PTLSOptions) PTLS {
+	repo := options.Repo
+	if repo == nil {
+		repo = loadFile
+	}
 
-	// TODO: implement this function
-	return p.Enabled
-}
+	requireTLS, err := parseEndpointPatterns(options.RequireTLS)
+	if err != nil {
+		// fail closed, an unreadable policy must not allow unencrypted connections
+		log.Printf("Warning: %v, requiring TLS for all endpoints", err)
+		requireTLS = []endpointPattern{{}}
+	}
 
-// CreateClientAndBridge creates a new TLS client and decorates the connection with it.
-// Returns a new connection and a TLS handshaker function.
-func (p *ptls) CreateClientAndBridge(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, func() error, error) {
-	return p.decorateAndBridge(conn, peerDeviceID, p.decorateTLSClient)
-}
+	handshakeTimeout := options.HandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = DefaultHandshakeTimeout
+	}
 
-// CreateServerAndBridge creates a new TLS server and decorates the connection with it.
-// Returns a new connection.
-func (p *ptls) CreateServerAndBridge(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
-	conn, _, err := p.decorateAndBridge(conn, peerDeviceID, p.decorateTLSServer)
-	return conn, err
+	return &ptls{
+		Enabled:          options.Enabled,
+		CertFile:         options.CertFile,
+		KeyFile:          options.KeyFile,
+		CAFile:           options.CAFile,
+		CRLFile:          options.CRLFile,
+		KnownHostsFile:   options.KnownHostsFile,
+		Repo:             repo,
+		knownHosts:       newKnownHostsCache(options.KnownHostsFile, repo),
+		requireTLS:       requireTLS,
+		handshakeTimeout: handshakeTimeout,
+		sessions:         newSessionCache(options.SessionCacheSize),
+		tofu:             options.TOFU,
+		auditFile:        options.AuditFile,
+		onPeerChanged:    options.OnPeerChanged,
+		onRotationDone:   options.OnRotationCompleted,
+		noise:            options.Noise,
+	}
 }
 
-func (p *ptls) decorateAndBridge(conn net.Conn, peerDeviceID uuid.UUID, decorator func(net.Conn, uuid.UUID) (net.Conn, func() error, error)) (net.Conn, func() error, error) {
-
-	conn1, conn2 := net.Pipe()
-
-	conn1, handshaker, err := decorator(conn1, peerDeviceID)
-	if err != nil {
-		return nil, nil, err
+func (p *ptls) TestEndpointURL(endpoint url.URL) bool {
+	for _, pattern := range p.requireTLS {
+		if pattern.matches(endpoint) {
+			return true
+		}
 	}
+	return false
+}
 
-	// io.Copy from conn to conn1 and vice versa
-	go func() {
-		io.Copy(conn1, conn)
-		conn1.Close()
-	}()
-	go func() {
-		io.Copy(conn, conn1)
-		conn.Close()
-	}()
+func (p *ptls) Negotiate(endpoint url.URL, requested *bool) (bool, error) {
+	useTLS := p.Enabled
+	if requested != nil {
+		useTLS = *requested
+	}
+	if useTLS && !p.Enabled {
+		return false, fmt.Errorf("%w on the target device", ErrTLSDisabled)
+	}
+	if !useTLS && p.TestEndpointURL(endpoint) {
+		return false, fmt.Errorf("%w for %s", ErrTLSRequired, endpoint.Host)
+	}
+	return useTLS, nil
+}
 
-	return conn2, handshaker, nil
+// CreateClient creates a new TLS client over the stream.
+func (p *ptls) CreateClient(stream net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
+	return p.decorateTLSClient(stream, peerDeviceID)
 }
 
-func (p *ptls) decorateTLSClient(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, func() error, error) {
+// CreateServer creates a new TLS server over the stream.
+func (p *ptls) CreateServer(stream net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
+	return p.decorateTLSServer(stream, peerDeviceID)
+}
 
-	// create a new TLS client
+func (p *ptls) decorateTLSClient(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
 
-	// load the client's certificate and private key
+	// load the client's certificate and private key, the key after the rotation check, which
+	// completes an interrupted update of the key pair
 	cert, err := p.Repo(p.CertFile)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	p.checkRotation(cert)
 	key, err := p.Repo(p.KeyFile)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	tlsCert, err := tls.X509KeyPair(cert, key)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	// create a new TLS client
+	// create a new TLS client, the server name is the key of the cached sessions
+	sessions := &confirmingSessionCache{
+		ClientSessionCache: p.sessions.client(peerDeviceID),
+		confirm:            func() { p.confirmRotation(peerDeviceID.String()) },
+	}
 	tlsConfig := &tls.Config{
-		MinVersion:   tls.VersionTLS13,
-		Certificates: []tls.Certificate{tlsCert},
+		MinVersion:         tls.VersionTLS13,
+		Certificates:       []tls.Certificate{tlsCert},
+		ServerName:         peerDeviceID.String(),
+		ClientSessionCache: sessions,
 	}
 
 	cacert, err := p.Repo(p.CAFile)
 
 	if err == nil {
 		tlsConfig.InsecureSkipVerify = false
-		tlsConfig.ServerName = peerDeviceID.String()
 
 		// add the CA certificate to the TLS client
 		caCertPool := x509.NewCertPool()
 		caCertPool.AppendCertsFromPEM(cacert)
 		tlsConfig.RootCAs = caCertPool
+		tlsConfig.VerifyPeerCertificate = p.verifyCA(peerDeviceID)
 	} else {
 		tlsConfig.InsecureSkipVerify = true
 
-		// load the known hosts file
-		knownHosts, err := p.Repo(p.KnownHostsFile)
-		if err != nil {
-			return nil, nil, err
+		// fail early if the known hosts file cannot be loaded
+		if _, err := p.trustedHosts(); err != nil {
+			return nil, err
 		}
 
 		// add the known hosts to the TLS client
-		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			peerCertRaw := rawCerts[0]
-			peerCert, err := x509.ParseCertificate(peerCertRaw)
-			if err != nil {
-				return err
-			}
-			cName := peerCert.Subject.CommonName
-			peerCertFingerprint := fmt.Sprintf("%x", sha256.Sum256(peerCert.Raw))
-			if cName != peerDeviceID.String() {
-				return fmt.Errorf("common name %s does not match expected peer device %s", cName, peerDeviceID)
-			}
-
-			knownHostsMap := make(map[string]string)
-			err = yaml.Unmarshal(knownHosts, knownHostsMap)
-			if err != nil {
-				return err
-			}
-
-			if knownHostsMap[cName] == "" {
-				return fmt.Errorf("unknown peer device: %s", peerDeviceID)
-			}
-
-			if knownHostsMap[cName] != peerCertFingerprint {
-				return fmt.Errorf("peer device %s has an unknown certificate", peerDeviceID)
-			}
-
-			return nil
-		}
+		tlsConfig.VerifyPeerCertificate = p.verifyKnownHosts(peerDeviceID)
 	}
-
-	// create a new TLS client
-	tlsConn := tls.Client(conn, tlsConfig)
-
-	// create the TLS handshaker
-	handshaker := func() error {
-		ctx, _ := context.WithTimeout(context.Background(), time.Second*3600)
-		err = tlsConn.HandshakeContext(ctx)
-		if err != nil {
+	verifyResumedPeer := verifyResumed(tlsConfig.VerifyPeerCertificate)
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if err := verifyResumedPeer(state); err != nil {
 			return err
 		}
+		sessions.fullHandshake.Store(!state.DidResume)
 		return nil
 	}
 
-	return tlsConn, handshaker, nil
+	// create a new TLS client
+	return tls.Client(conn, tlsConfig), nil
 }
 
-func (p *ptls) decorateTLSServer(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, func() error, error) {
+func (p *ptls) decorateTLSServer(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
 
-	// create a new TLS server
-
-	// load the server's certificate and private key
+	// load the server's certificate and private key, the key after the rotation check, which
+	// completes an interrupted update of the key pair
 	cert, err := p.Repo(p.CertFile)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	p.checkRotation(cert)
 	key, err := p.Repo(p.KeyFile)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	tlsCert, err := tls.X509KeyPair(cert, key)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// create a new TLS server
@@ -220,6 +347,9 @@ func (p *ptls) decorateTLSServer(conn net.Conn, peerDeviceID uuid.UUID) (net.Con
 		MinVersion:   tls.VersionTLS13,
 		Certificates: []tls.Certificate{tlsCert},
 	}
+	if err := p.sessions.configureServer(tlsConfig, time.Now()); err != nil {
+		return nil, err
+	}
 
 	cacert, err := p.Repo(p.CAFile)
 
@@ -230,51 +360,221 @@ func (p *ptls) decorateTLSServer(conn net.Conn, peerDeviceID uuid.UUID) (net.Con
 		caCertPool := x509.NewCertPool()
 		caCertPool.AppendCertsFromPEM(cacert)
 		tlsConfig.ClientCAs = caCertPool
+		tlsConfig.VerifyPeerCertificate = p.verifyCA(peerDeviceID)
 	} else {
 		tlsConfig.ClientAuth = tls.RequireAnyClientCert
 		tlsConfig.InsecureSkipVerify = true
 
-		// load the known hosts file
-		knownHosts, err := p.Repo(p.KnownHostsFile)
-		if err != nil {
-			return nil, nil, err
+		// fail early if the known hosts file cannot be loaded
+		if _, err := p.trustedHosts(); err != nil {
+			return nil, err
 		}
 
 		// add the known hosts to the TLS server
-		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-			peerCertRaw := rawCerts[0]
-			peerCert, err := x509.ParseCertificate(peerCertRaw)
-			if err != nil {
-				return err
-			}
-			cName := peerCert.Subject.CommonName
-			peerCertFingerprint := fmt.Sprintf("%x", sha256.Sum256(peerCert.Raw))
-			if cName != peerDeviceID.String() {
-				return fmt.Errorf("common name %s does not match expected peer device %s", cName, peerDeviceID)
-			}
+		tlsConfig.VerifyPeerCertificate = p.verifyKnownHosts(peerDeviceID)
+	}
+
+	// the client verifies the server's certificate before it sends its own, so a
+	// client certificate confirms that the peer accepted our certificate
+	verifyResumedPeer := verifyResumed(tlsConfig.VerifyPeerCertificate)
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if err := verifyResumedPeer(state); err != nil {
+			return err
+		}
+		if len(state.PeerCertificates) > 0 && !state.DidResume {
+			p.confirmRotation(peerDeviceID.String())
+		}
+		return nil
+	}
+
+	// create a new TLS server
+	return tls.Server(conn, tlsConfig), nil
+}
+
+// verifyCA returns a callback that checks the identity of the peer and the CRL, if present.
+// The chain was already verified against the CA at this point.
+func (p *ptls) verifyCA(peerDeviceID uuid.UUID) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 {
+			return fmt.Errorf("certificate of peer device %s is not verified by the CA", peerDeviceID)
+		}
+
+		// a client certificate is not checked against a server name
+		peerCert := verifiedChains[0][0]
+		if err := peerCert.VerifyHostname(peerDeviceID.String()); err != nil {
+			return fmt.Errorf("certificate does not belong to expected peer device %s: %w", peerDeviceID, err)
+		}
+
+		if p.CRLFile == "" {
+			return nil
+		}
+		crlData, err := p.Repo(p.CRLFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		crl, err := ParseCRL(crlData)
+		if err != nil {
+			return fmt.Errorf("invalid CRL %s: %w", p.CRLFile, err)
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			log.Printf("Warning: the CRL %s is outdated since %s", p.CRLFile, crl.NextUpdate.Format(time.RFC3339))
+		}
+		return checkRevocation(crl, verifiedChains)
+	}
+}
 
-			knownHostsMap := make(map[string]string)
-			err = yaml.Unmarshal(knownHosts, knownHostsMap)
+// verifyKnownHosts returns a callback that accepts peer certificates whose fingerprint is in
+// the known hosts. A certificate signed with the key of a known previous certificate, sent
+// along in the chain during a rotation, is accepted as well. Revoked fingerprints are
+// rejected. With trust on first use, the certificate of an unknown peer device is accepted.
+// The callback runs before the peer proved that it holds the key of the certificate, so new
+// fingerprints are pinned by Handshake, see pinAuthenticated.
+func (p *ptls) verifyKnownHosts(peerDeviceID uuid.UUID) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		knownHosts, err := p.trustedHosts()
+		if err != nil {
+			return err
+		}
+
+		chain := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			chain[i], err = x509.ParseCertificate(raw)
 			if err != nil {
 				return err
 			}
+		}
+		peerCert := chain[0]
+		cName := peerCert.Subject.CommonName
+		peerCertFingerprint := fmt.Sprintf("%x", sha256.Sum256(peerCert.Raw))
+		if cName != peerDeviceID.String() {
+			return fmt.Errorf("common name %s does not match expected peer device %s", cName, peerDeviceID)
+		}
 
-			if knownHostsMap[cName] == "" {
-				return fmt.Errorf("unknown peer device: %s", peerDeviceID)
-			}
+		if knownHosts.IsRevoked(peerCertFingerprint) {
+			return fmt.Errorf("the certificate of peer device %s was revoked", peerDeviceID)
+		}
 
-			if knownHostsMap[cName] != peerCertFingerprint {
-				return fmt.Errorf("peer device %s has an unknown certificate", peerDeviceID)
+		if !knownHosts.Has(cName) {
+			if p.tofu {
+				return nil
 			}
+			return fmt.Errorf("unknown peer device: %s", peerDeviceID)
+		}
 
+		if knownHosts.Trusts(cName, peerCertFingerprint, time.Now()) || isRotation(knownHosts, chain, time.Now()) {
 			return nil
 		}
+
+		return p.peerChanged(knownHosts, peerDeviceID, peerCertFingerprint)
+	}
+}
+
+// isRotation reports whether the certificate of a chain is signed with the key of a previous
+// certificate of the same peer device in the chain, which the known hosts trust.
+func isRotation(knownHosts *KnownHosts, chain []*x509.Certificate, now time.Time) bool {
+	cName := chain[0].Subject.CommonName
+	for _, previous := range chain[1:] {
+		previousFingerprint := fmt.Sprintf("%x", sha256.Sum256(previous.Raw))
+		if previous.Subject.CommonName == cName && knownHosts.Trusts(cName, previousFingerprint, now) && IsSignedBy(chain[0], previous) {
+			return true
+		}
 	}
+	return false
+}
 
-	// create a new TLS server
-	tlsConn := tls.Server(conn, tlsConfig)
+// pinFingerprint adds a new fingerprint of a peer device to the known hosts file.
+func (p *ptls) pinFingerprint(deviceID, fingerprint string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	knownHosts, err := LoadKnownHosts(p.KnownHostsFile)
+	if err != nil {
+		return err
+	}
+	if !knownHosts.Add(deviceID, KnownFingerprint{Fingerprint: fingerprint, Source: SourceRotation}, DefaultGracePeriod, time.Now()) {
+		return nil
+	}
+	return knownHosts.Save(p.KnownHostsFile)
+}
 
-	return tlsConn, nil, nil
+// checkRotation updates the rotation of the certificate if it was not checked for
+// rotationCheckInterval or if cert, the content of the certificate file, changed since, e.g.
+// because `tls rotate` started a rotation. Connections are set up without accessing the
+// rotation files in between.
+func (p *ptls) checkRotation(cert []byte) {
+	p.rotationMu.Lock()
+	due := time.Since(p.rotationChecked) >= rotationCheckInterval || !bytes.Equal(cert, p.rotationCert)
+	if due {
+		p.rotationChecked = time.Now()
+		p.rotationCert = cert
+	}
+	p.rotationMu.Unlock()
+
+	if due {
+		p.updateRotation("")
+	}
+}
+
+// confirmRotation records that the peer device confirmed our certificate, if a rotation is
+// in progress.
+func (p *ptls) confirmRotation(peer string) {
+	p.rotationMu.Lock()
+	active := p.rotationActive
+	p.rotationMu.Unlock()
+
+	if active {
+		p.updateRotation(peer)
+	}
+}
+
+// updateRotation records that the peer device confirmed our certificate, if not empty, and
+// retires the previous certificate once the rotation is done.
+func (p *ptls) updateRotation(confirmedPeer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	active := false
+	defer func() {
+		p.rotationMu.Lock()
+		p.rotationActive = active
+		p.rotationMu.Unlock()
+	}()
+
+	// a rotation interrupted after the new certificate was written leaves the new key behind
+	if err := CompleteKeyPairUpdate(p.CertFile, p.KeyFile); err != nil {
+		log.Printf("failed to complete the update of the certificate and key: %v", err)
+	}
+
+	rotation, err := LoadRotation(p.CertFile)
+	if err != nil {
+		log.Printf("failed to load certificate rotation: %v", err)
+		return
+	}
+	if rotation == nil {
+		return
+	}
+
+	confirmed := confirmedPeer != "" && rotation.Confirm(confirmedPeer)
+	if rotation.Done(time.Now()) {
+		if err := RetireCertificate(p.CertFile); err != nil {
+			log.Printf("failed to retire previous certificate: %v", err)
+			return
+		}
+		log.Printf("certificate rotation completed, previous certificate %s retired", rotation.PreviousFingerprint)
+		if p.onRotationDone != nil {
+			go p.onRotationDone(*rotation)
+		}
+		return
+	}
+	active = true
+	if confirmed {
+		if err := rotation.Save(p.CertFile); err != nil {
+			log.Printf("failed to save certificate rotation: %v", err)
+		}
+	}
 }
 
 func loadFile(path string) ([]byte, error) {
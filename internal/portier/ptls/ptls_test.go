@@ -14,16 +14,15 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-func TestCreateClientAndBridge(t *testing.T) {
+func TestCreateClientAndServer(t *testing.T) {
 	// GIVEN
 	// create pipe for encrypted communication
 	commonDeviceID := uuid.MustParse("00000000-1111-0000-0000-000000000000")
 
 	// Schema:
-	// clientEnd <-net.Pipe()-> clientTLS (decorated) <-bridgeConnections()-> (decorated) serverTLS <-net.Pipe()-> serverEnd
+	// clientTLS (decorated) <-net.Pipe()-> (decorated) serverTLS, the pipe mocks portier here
 
-	clientEnd, clientTLS := net.Pipe()
-	serverEnd, serverTLS := net.Pipe()
+	clientStream, serverStream := net.Pipe()
 
 	// create a self-signed certificate
 	cert, key := getSelfSignedCert()
@@ -58,20 +57,12 @@ func TestCreateClientAndBridge(t *testing.T) {
 	// create a PTLSConfig with the self-signed certificate, then create a TLS client and server
 	ptls := NewPTLS(true, "cert.pem", "key.pem", "", "known_hosts", mockFileLoader)
 
-	clientInner, handshaker, err := ptls.CreateClientAndBridge(clientTLS, commonDeviceID)
+	clientTLS, err := ptls.CreateClient(clientStream, commonDeviceID)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	serverInner, err := ptls.CreateServerAndBridge(serverTLS, commonDeviceID)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-
-	// bridge the connections and perform the handshake
-	bridgeConnections(clientInner, serverInner) // this mocks portier here actually
-
-	err = handshaker()
+	serverTLS, err := ptls.CreateServer(serverStream, commonDeviceID)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -80,11 +71,16 @@ func TestCreateClientAndBridge(t *testing.T) {
 	// write 1kbyte message to client connection
 	expectedMessage := make([]byte, 1024)
 	rand.Read(expectedMessage)
-	clientEnd.Write(expectedMessage)
-	clientEnd.Close()
+	// the client reads the session tickets of the server, the pipe does not buffer them
+	go io.Copy(io.Discard, clientTLS)
+	go func() {
+		// the handshake happens on the first write
+		clientTLS.Write(expectedMessage)
+		clientTLS.Close()
+	}()
 
 	// THEN
-	buf := readFromConn(serverEnd)
+	buf := readFromConn(serverTLS)
 	// assert that server connection received the message
 	if len(buf) != len(expectedMessage) {
 		t.Errorf("expected %d bytes, got %d", len(expectedMessage), len(buf))
@@ -96,29 +92,10 @@ func TestCreateClientAndBridge(t *testing.T) {
 	}
 }
 
-func bridgeConnections(client, server net.Conn) {
-	go func() {
-		io.Copy(server, client)
-		server.Close()
-	}()
-	go func() {
-		io.Copy(client, server)
-		client.Close()
-	}()
-}
-
 func readFromConn(conn net.Conn) []byte {
-	buf := make([]byte, 1024)
-	total := 0
-	for {
-		n, err := conn.Read(buf[total:])
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil
-		}
-		total += n
+	buf, err := io.ReadAll(conn)
+	if err != nil {
+		return nil
 	}
 	return buf
 }
@@ -0,0 +1,197 @@
+package ptls
+
+import (
+	"encoding/pem"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/secrets"
+	"gopkg.in/yaml.v2"
+)
+
+// Rotation is the state of a certificate rotation. While a rotation is in progress, the
+// certificate file holds the new certificate followed by the previous one. Peers that only
+// trust the previous certificate accept the new one, because it is signed with the previous
+// key, and add its fingerprint to their known_hosts.
+//
+// The previous certificate is retired, once all pending peers completed a handshake with
+// the new certificate or the grace period expired.
+type Rotation struct {
+	// PreviousFingerprint is the fingerprint of the replaced certificate
+	PreviousFingerprint string `yaml:"previousFingerprint"`
+
+	// Fingerprint is the fingerprint of the new certificate
+	Fingerprint string `yaml:"fingerprint"`
+
+	// Started is the time of the rotation
+	Started time.Time `yaml:"started"`
+
+	// Expires is the end of the grace period, after which the previous certificate is retired
+	Expires time.Time `yaml:"expires"`
+
+	// Pending are the IDs of peer devices that did not confirm the new certificate yet
+	Pending []string `yaml:"pending"`
+
+	// Confirmed are the IDs of peer devices that completed a handshake with the new certificate
+	Confirmed []string `yaml:"confirmed,omitempty"`
+
+	// UploadFingerprint is set if the fingerprint of the new certificate is uploaded, once the
+	// previous certificate is retired. The server keeps a single fingerprint per device, the
+	// previous one verifies the new certificate until then.
+	UploadFingerprint bool `yaml:"uploadFingerprint,omitempty"`
+}
+
+// newFileSuffix is the suffix of the files written by WriteKeyPair before they replace the
+// current ones.
+const newFileSuffix = ".new"
+
+// RotationFile returns the path of the rotation state of a certificate file.
+func RotationFile(certFile string) string {
+	return certFile + ".rotation"
+}
+
+// LoadRotation loads the state of the rotation of the given certificate file. Returns nil if
+// no rotation is in progress.
+func LoadRotation(certFile string) (*Rotation, error) {
+	data, err := os.ReadFile(RotationFile(certFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rotation := &Rotation{}
+	if err := yaml.Unmarshal(data, rotation); err != nil {
+		return nil, err
+	}
+	return rotation, nil
+}
+
+// Save writes the rotation state next to the given certificate file.
+func (r *Rotation) Save(certFile string) error {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return secrets.WriteFileSecure(RotationFile(certFile), data)
+}
+
+// Confirm marks the peer device as confirmed. Returns whether the peer was pending.
+func (r *Rotation) Confirm(deviceID string) bool {
+	for i, pending := range r.Pending {
+		if pending == deviceID {
+			r.Pending = append(r.Pending[:i], r.Pending[i+1:]...)
+			r.Confirmed = append(r.Confirmed, deviceID)
+			return true
+		}
+	}
+	return false
+}
+
+// Done reports whether the previous certificate can be retired.
+func (r *Rotation) Done(now time.Time) bool {
+	return len(r.Pending) == 0 || !now.Before(r.Expires)
+}
+
+// RetireCertificate removes the previous certificates from the certificate file and ends the
+// rotation.
+func RetireCertificate(certFile string) error {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("no certificate found")
+	}
+	tmpFile := certFile + ".tmp"
+	if err := secrets.WriteFileSecure(tmpFile, pem.EncodeToMemory(block)); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, certFile); err != nil {
+		return err
+	}
+	return removeIfExists(RotationFile(certFile))
+}
+
+// WriteKeyPair replaces the certificate and key files and the rotation state, if not nil. The
+// files are written next to the current ones first. Renaming the certificate commits the
+// update, the key and rotation state follow. An update interrupted before the commit is
+// discarded by RecoverKeyPairUpdate, one interrupted after it is completed by
+// CompleteKeyPairUpdate.
+func WriteKeyPair(certFile, keyFile string, certPEM, keyPEM []byte, rotation *Rotation) error {
+	if err := RecoverKeyPairUpdate(certFile, keyFile); err != nil {
+		return err
+	}
+
+	// the certificate is written first, a key without it belongs to a committed update
+	if err := secrets.WriteFileSecure(certFile+newFileSuffix, certPEM); err != nil {
+		return err
+	}
+	if err := secrets.WriteFileSecure(keyFile+newFileSuffix, keyPEM); err != nil {
+		return err
+	}
+	if rotation != nil {
+		data, err := yaml.Marshal(rotation)
+		if err != nil {
+			return err
+		}
+		if err := secrets.WriteFileSecure(RotationFile(certFile)+newFileSuffix, data); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(certFile+newFileSuffix, certFile); err != nil {
+		return err
+	}
+	return CompleteKeyPairUpdate(certFile, keyFile)
+}
+
+// CompleteKeyPairUpdate moves the key and rotation state of a committed update of WriteKeyPair
+// into place. An update that is not committed yet is left alone, so it is safe to call while
+// another process writes the key pair.
+func CompleteKeyPairUpdate(certFile, keyFile string) error {
+	// the new key is checked before the certificate, it is only written after the certificate
+	if _, err := os.Stat(keyFile + newFileSuffix); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if _, err := os.Stat(certFile + newFileSuffix); err == nil {
+		return nil
+	}
+	if err := renameIfExists(RotationFile(certFile)+newFileSuffix, RotationFile(certFile)); err != nil {
+		return err
+	}
+	return renameIfExists(keyFile+newFileSuffix, keyFile)
+}
+
+// RecoverKeyPairUpdate discards an update of WriteKeyPair that was interrupted before it was
+// committed, and completes one that was interrupted after.
+func RecoverKeyPairUpdate(certFile, keyFile string) error {
+	if _, err := os.Stat(certFile + newFileSuffix); err == nil {
+		// the certificate is removed last, it marks the update as not committed
+		for _, file := range []string{keyFile + newFileSuffix, RotationFile(certFile) + newFileSuffix, certFile + newFileSuffix} {
+			if err := removeIfExists(file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return CompleteKeyPairUpdate(certFile, keyFile)
+}
+
+func renameIfExists(from, to string) error {
+	err := os.Rename(from, to)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func removeIfExists(file string) error {
+	err := os.Remove(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
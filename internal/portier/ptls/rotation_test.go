@@ -0,0 +1,435 @@
+package ptls
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type testDevice struct {
+	id   uuid.UUID
+	dir  string
+	ptls PTLS
+}
+
+// testDeviceOptions configures the device created by newTestDevice.
+type testDeviceOptions struct {
+	// algorithm is the key algorithm of the certificate
+	algorithm KeyAlgorithm
+
+	// certificate creates the PEM encoded certificate and key of the device, if set
+	certificate func(t *testing.T, id string) ([]byte, []byte)
+
+	// ptls are the options of the device's PTLS, the paths point into the device directory
+	ptls PTLSOptions
+}
+
+type testDeviceOption func(dir string, options *testDeviceOptions)
+
+// withKeyAlgorithm creates the certificate of the device with a key of the given algorithm.
+func withKeyAlgorithm(algorithm KeyAlgorithm) testDeviceOption {
+	return func(_ string, options *testDeviceOptions) {
+		options.algorithm = algorithm
+	}
+}
+
+func newTestDevice(t *testing.T, id string, opts ...testDeviceOption) *testDevice {
+	dir := t.TempDir()
+	options := testDeviceOptions{
+		ptls: PTLSOptions{
+			Enabled:        true,
+			CertFile:       filepath.Join(dir, "cert.pem"),
+			KeyFile:        filepath.Join(dir, "key.pem"),
+			CAFile:         filepath.Join(dir, "cacert.pem"),
+			KnownHostsFile: filepath.Join(dir, "known_hosts"),
+		},
+	}
+	for _, opt := range opts {
+		opt(dir, &options)
+	}
+
+	if options.certificate == nil {
+		options.certificate = func(t *testing.T, id string) ([]byte, []byte) {
+			certManager := NewPTLSCertificateManagerWithOptions(CertificateManagerOptions{KeyAlgorithm: options.algorithm})
+			cert, key, err := certManager.CreateCertificate(id)
+			require.NoError(t, err)
+			certPEM, keyPEM, err := certManager.ConvertCertificateToPEM(cert, key)
+			require.NoError(t, err)
+			return certPEM, keyPEM
+		}
+	}
+	certPEM, keyPEM := options.certificate(t, id)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600))
+
+	return &testDevice{
+		id:   uuid.MustParse(id),
+		dir:  dir,
+		ptls: NewPTLSWithOptions(options.ptls),
+	}
+}
+
+func (d *testDevice) fingerprint(t *testing.T) string {
+	chain, err := LoadCertificateChain(filepath.Join(d.dir, "cert.pem"))
+	require.NoError(t, err)
+	fingerprint, err := NewPTLSCertificateManager().GetFingerprint(chain[0])
+	require.NoError(t, err)
+	return fingerprint
+}
+
+func (d *testDevice) trust(t *testing.T, peer *testDevice) {
+	knownHosts, err := LoadKnownHosts(filepath.Join(d.dir, "known_hosts"))
+	require.NoError(t, err)
+	knownHosts.Add(peer.id.String(), KnownFingerprint{Fingerprint: peer.fingerprint(t), Source: SourceManual}, DefaultGracePeriod, time.Now())
+	require.NoError(t, knownHosts.Save(filepath.Join(d.dir, "known_hosts")))
+}
+
+func (d *testDevice) knownHosts(t *testing.T) *KnownHosts {
+	knownHosts, err := LoadKnownHosts(filepath.Join(d.dir, "known_hosts"))
+	require.NoError(t, err)
+	return knownHosts
+}
+
+// rotate replaces the certificate of the device, the new one signed by the given key.
+func (d *testDevice) rotate(t *testing.T, signer *testDevice, pending ...string) {
+	certFile := filepath.Join(d.dir, "cert.pem")
+	chain, err := LoadCertificateChain(certFile)
+	require.NoError(t, err)
+	signerChain, err := LoadCertificateChain(filepath.Join(signer.dir, "cert.pem"))
+	require.NoError(t, err)
+	signerKey, err := LoadPrivateKey(filepath.Join(signer.dir, "key.pem"))
+	require.NoError(t, err)
+
+	certManager := NewPTLSCertificateManager()
+	template := *signerChain[0]
+	template.Subject.CommonName = chain[0].Subject.CommonName
+	cert, key, err := certManager.RotateCertificate(&template, signerKey)
+	require.NoError(t, err)
+	certPEM, keyPEM, err := certManager.ConvertCertificateToPEM(cert, key)
+	require.NoError(t, err)
+	certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[0].Raw})...)
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(d.dir, "key.pem"), keyPEM, 0600))
+
+	previousFingerprint, err := certManager.GetFingerprint(chain[0])
+	require.NoError(t, err)
+	rotation := &Rotation{PreviousFingerprint: previousFingerprint, Started: time.Now(), Expires: time.Now().Add(time.Hour), Pending: pending}
+	require.NoError(t, rotation.Save(certFile))
+}
+
+// connect sends a message from the client to the server device through a TLS connection.
+func connect(t *testing.T, client, server *testDevice) error {
+	// a TCP connection buffers alerts of a failed handshake, unlike net.Pipe
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	clientStream, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer clientStream.Close()
+	serverStream, err := listener.Accept()
+	require.NoError(t, err)
+	defer serverStream.Close()
+
+	clientTLS, err := client.ptls.CreateClient(clientStream, server.id)
+	require.NoError(t, err)
+	serverTLS, err := server.ptls.CreateServer(serverStream, client.id)
+	require.NoError(t, err)
+	defer serverTLS.Close()
+
+	serverHandshake := make(chan error, 1)
+	go func() { serverHandshake <- server.ptls.Handshake(serverTLS) }()
+	if err := client.ptls.Handshake(clientTLS); err != nil {
+		// the server fails as well, once the stream is closed
+		_ = clientStream.Close()
+		return err
+	}
+	if err := <-serverHandshake; err != nil {
+		return err
+	}
+
+	expectedMessage := make([]byte, 1024)
+	_, _ = rand.Read(expectedMessage)
+	go func() {
+		_, _ = clientTLS.Write(expectedMessage)
+		_ = clientTLS.Close()
+	}()
+	_ = serverStream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := readFromConn(serverTLS)
+	require.Equal(t, expectedMessage, buf)
+	return nil
+}
+
+// connectToImpersonator runs a TLS handshake of the client with an impersonator that presents
+// the certificate chain of the server, but signs the handshake with a key of its own.
+func connectToImpersonator(t *testing.T, client, server *testDevice) error {
+	chain, err := LoadCertificateChain(filepath.Join(server.dir, "cert.pem"))
+	require.NoError(t, err)
+	rawCerts := make([][]byte, len(chain))
+	for i, cert := range chain {
+		rawCerts[i] = cert.Raw
+	}
+	impersonator := newTestDevice(t, server.id.String())
+	impersonatorKey, err := LoadPrivateKey(filepath.Join(impersonator.dir, "key.pem"))
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		stream, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		_ = tls.Server(stream, &tls.Config{
+			MinVersion:   tls.VersionTLS13,
+			Certificates: []tls.Certificate{{Certificate: rawCerts, PrivateKey: impersonatorKey}},
+			ClientAuth:   tls.RequireAnyClientCert,
+		}).Handshake()
+	}()
+	stream, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer stream.Close()
+
+	clientTLS, err := client.ptls.CreateClient(stream, server.id)
+	require.NoError(t, err)
+	return client.ptls.Handshake(clientTLS)
+}
+
+func TestRotatedCertificateIsPinnedAndPreviousRetired(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002")
+	server.trust(t, client)
+	client.trust(t, server)
+	previousFingerprint := server.fingerprint(t)
+	server.rotate(t, server, client.id.String())
+
+	// WHEN
+	err := connect(t, client, server)
+
+	// THEN
+	require.NoError(t, err)
+	knownHosts := client.knownHosts(t)
+	require.True(t, knownHosts.Trusts(server.id.String(), server.fingerprint(t), time.Now()))
+	require.True(t, knownHosts.Trusts(server.id.String(), previousFingerprint, time.Now()))
+	require.Equal(t, SourceRotation, knownHosts.Devices[server.id.String()].Fingerprints[0].Source)
+
+	chain, err := LoadCertificateChain(filepath.Join(server.dir, "cert.pem"))
+	require.NoError(t, err)
+	require.Len(t, chain, 1)
+	rotation, err := LoadRotation(filepath.Join(server.dir, "cert.pem"))
+	require.NoError(t, err)
+	require.Nil(t, rotation)
+
+	// the pinned certificate works without the previous one
+	require.NoError(t, connect(t, client, server))
+}
+
+func TestRotatedCertificateNotSignedByPreviousKeyIsRejected(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002")
+	attacker := newTestDevice(t, "00000000-0000-0000-0000-000000000003")
+	server.trust(t, client)
+	client.trust(t, server)
+	server.rotate(t, attacker, client.id.String())
+
+	// WHEN
+	err := connect(t, client, server)
+
+	// THEN
+	require.Error(t, err)
+	require.Len(t, client.knownHosts(t).Devices[server.id.String()].Fingerprints, 1)
+}
+
+func TestRotatedCertificateWithoutItsKeyIsNotPinned(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002")
+	client.trust(t, server)
+	server.rotate(t, server, client.id.String())
+
+	// WHEN an impersonator presents the rotated chain of the server without holding the new key
+	err := connectToImpersonator(t, client, server)
+
+	// THEN
+	require.ErrorContains(t, err, "invalid signature")
+	require.Len(t, client.knownHosts(t).Devices[server.id.String()].Fingerprints, 1)
+}
+
+func TestRotationRetiresPreviousCertificateAfterGracePeriod(t *testing.T) {
+	// GIVEN
+	device := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+	device.rotate(t, device, "00000000-0000-0000-0000-000000000002")
+	certFile := filepath.Join(device.dir, "cert.pem")
+	rotation, err := LoadRotation(certFile)
+	require.NoError(t, err)
+	rotation.Expires = time.Now().Add(-time.Second)
+	require.NoError(t, rotation.Save(certFile))
+
+	// WHEN
+	device.ptls.(*ptls).updateRotation("")
+
+	// THEN
+	chain, err := LoadCertificateChain(certFile)
+	require.NoError(t, err)
+	require.Len(t, chain, 1)
+}
+
+func TestRotationIsCheckedOncePerInterval(t *testing.T) {
+	// GIVEN a device whose rotation was checked
+	device := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+	p := device.ptls.(*ptls)
+	certFile := filepath.Join(device.dir, "cert.pem")
+	cert, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	p.checkRotation(cert)
+
+	// WHEN a finished rotation appears while the certificate stays the same
+	rotation := &Rotation{Started: time.Now().Add(-time.Hour), Expires: time.Now().Add(-time.Second)}
+	require.NoError(t, rotation.Save(certFile))
+	p.checkRotation(cert)
+
+	// THEN it is not noticed before the interval passed
+	require.FileExists(t, RotationFile(certFile))
+	p.rotationChecked = time.Now().Add(-rotationCheckInterval)
+	p.checkRotation(cert)
+	require.NoFileExists(t, RotationFile(certFile))
+}
+
+func TestRevokedCertificateIsRejected(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002")
+	server.trust(t, client)
+	client.trust(t, server)
+	require.NoError(t, connect(t, client, server))
+
+	// WHEN
+	knownHosts := client.knownHosts(t)
+	knownHosts.Revoke(server.id.String(), server.fingerprint(t), "lost", time.Now())
+	knownHosts.Add(server.id.String(), KnownFingerprint{Fingerprint: server.fingerprint(t)}, 0, time.Now())
+	require.NoError(t, knownHosts.Save(filepath.Join(client.dir, "known_hosts")))
+	err := connect(t, client, server)
+
+	// THEN
+	require.Error(t, err)
+}
+
+func TestRotatingClientIsConfirmedAfterFullHandshake(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002")
+	server.trust(t, client)
+	client.trust(t, server)
+	client.rotate(t, client, server.id.String())
+
+	// WHEN the client receives the session ticket of the server
+	resumed, err := exchange(t, client, server)
+
+	// THEN
+	require.NoError(t, err)
+	require.False(t, resumed)
+	require.True(t, server.knownHosts(t).Trusts(client.id.String(), client.fingerprint(t), time.Now()))
+	chain, err := LoadCertificateChain(filepath.Join(client.dir, "cert.pem"))
+	require.NoError(t, err)
+	require.Len(t, chain, 1)
+	rotation, err := LoadRotation(filepath.Join(client.dir, "cert.pem"))
+	require.NoError(t, err)
+	require.Nil(t, rotation)
+}
+
+func TestRotationStateIsNotWorldReadable(t *testing.T) {
+	// GIVEN
+	device := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+
+	// WHEN
+	device.rotate(t, device, "00000000-0000-0000-0000-000000000002")
+
+	// THEN
+	info, err := os.Stat(RotationFile(filepath.Join(device.dir, "cert.pem")))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestWriteKeyPairReplacesCertificateKeyAndRotation(t *testing.T) {
+	// GIVEN
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, []byte("old cert"), 0o644))
+	require.NoError(t, os.WriteFile(keyFile, []byte("old key"), 0o600))
+
+	// WHEN
+	err := WriteKeyPair(certFile, keyFile, []byte("new cert"), []byte("new key"), &Rotation{Fingerprint: "new"})
+
+	// THEN
+	require.NoError(t, err)
+	requireFile(t, certFile, "new cert")
+	requireFile(t, keyFile, "new key")
+	rotation, err := LoadRotation(certFile)
+	require.NoError(t, err)
+	require.Equal(t, "new", rotation.Fingerprint)
+	for _, file := range []string{certFile, keyFile, RotationFile(certFile)} {
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+		require.NoFileExists(t, file+newFileSuffix)
+	}
+}
+
+func TestRecoverKeyPairUpdateDiscardsUncommittedUpdate(t *testing.T) {
+	// GIVEN an update interrupted before the certificate was renamed
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, []byte("old cert"), 0o644))
+	require.NoError(t, os.WriteFile(keyFile, []byte("old key"), 0o600))
+	require.NoError(t, os.WriteFile(certFile+newFileSuffix, []byte("new cert"), 0o600))
+	require.NoError(t, os.WriteFile(keyFile+newFileSuffix, []byte("new key"), 0o600))
+
+	// WHEN
+	require.NoError(t, CompleteKeyPairUpdate(certFile, keyFile))
+	requireFile(t, keyFile, "old key")
+	err := RecoverKeyPairUpdate(certFile, keyFile)
+
+	// THEN
+	require.NoError(t, err)
+	requireFile(t, certFile, "old cert")
+	requireFile(t, keyFile, "old key")
+	require.NoFileExists(t, certFile+newFileSuffix)
+	require.NoFileExists(t, keyFile+newFileSuffix)
+}
+
+func TestCompleteKeyPairUpdateCompletesCommittedUpdate(t *testing.T) {
+	// GIVEN an update interrupted after the certificate was renamed
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, []byte("new cert"), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, []byte("old key"), 0o600))
+	require.NoError(t, os.WriteFile(keyFile+newFileSuffix, []byte("new key"), 0o600))
+	require.NoError(t, os.WriteFile(RotationFile(certFile)+newFileSuffix, []byte("fingerprint: new\n"), 0o600))
+
+	// WHEN
+	err := CompleteKeyPairUpdate(certFile, keyFile)
+
+	// THEN
+	require.NoError(t, err)
+	requireFile(t, keyFile, "new key")
+	rotation, err := LoadRotation(certFile)
+	require.NoError(t, err)
+	require.Equal(t, "new", rotation.Fingerprint)
+}
+
+func requireFile(t *testing.T, file, expected string) {
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(data))
+}
@@ -0,0 +1,173 @@
+package ptls
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultHandshakeTimeout is the time a TLS handshake over the relay may take
+	DefaultHandshakeTimeout = 15 * time.Second
+
+	// DefaultSessionCacheSize is the number of TLS sessions cached per peer device
+	DefaultSessionCacheSize = 16
+
+	// ticketKeyLifetime is how long a session ticket key encrypts new tickets. Tickets of the
+	// previous key are accepted for another lifetime.
+	ticketKeyLifetime = 24 * time.Hour
+)
+
+// ErrHandshakeTimeout is returned if a TLS handshake did not complete in time.
+var ErrHandshakeTimeout = errors.New("TLS handshake timed out")
+
+// sessionCache holds the TLS sessions of the connections to peer devices and the keys of the
+// session tickets issued to peers, so that repeated connections resume the previous session
+// instead of a full handshake. The ticket keys only live in memory, sessions do not survive a
+// restart.
+type sessionCache struct {
+	// size is the number of sessions cached per peer, 0 disables resumption
+	size int
+
+	mu         sync.Mutex
+	clients    map[uuid.UUID]tls.ClientSessionCache
+	ticketKeys [][32]byte
+	rotated    time.Time
+}
+
+func newSessionCache(size int) *sessionCache {
+	if size == 0 {
+		size = DefaultSessionCacheSize
+	}
+	if size < 0 {
+		size = 0
+	}
+	return &sessionCache{
+		size:    size,
+		clients: make(map[uuid.UUID]tls.ClientSessionCache),
+	}
+}
+
+// client returns the session cache for connections to the peer device, nil if resumption is
+// disabled. Each peer has its own cache, so sessions of one peer never evict another's.
+func (c *sessionCache) client(peerDeviceID uuid.UUID) tls.ClientSessionCache {
+	if c.size == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cache, ok := c.clients[peerDeviceID]
+	if !ok {
+		cache = tls.NewLRUClientSessionCache(c.size)
+		c.clients[peerDeviceID] = cache
+	}
+	return cache
+}
+
+// confirmingSessionCache is the session cache of a single client connection. The server only
+// issues session tickets after it verified the client certificate, so a ticket received after
+// a full handshake confirms that the peer accepted our certificate. A resumed session proves
+// nothing, the certificate was not sent.
+type confirmingSessionCache struct {
+	// ClientSessionCache stores the sessions of the peer, nil if resumption is disabled
+	tls.ClientSessionCache
+
+	confirm       func()
+	fullHandshake atomic.Bool
+	confirmed     sync.Once
+}
+
+func (c *confirmingSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	if c.ClientSessionCache == nil {
+		return nil, false
+	}
+	return c.ClientSessionCache.Get(sessionKey)
+}
+
+func (c *confirmingSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	if c.ClientSessionCache != nil {
+		c.ClientSessionCache.Put(sessionKey, cs)
+	}
+	if cs != nil && c.fullHandshake.Load() {
+		c.confirmed.Do(c.confirm)
+	}
+}
+
+// configureServer enables session tickets with the current keys, or disables them.
+func (c *sessionCache) configureServer(config *tls.Config, now time.Time) error {
+	if c.size == 0 {
+		config.SessionTicketsDisabled = true
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.ticketKeys) == 0 || now.Sub(c.rotated) >= ticketKeyLifetime {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		c.ticketKeys = append([][32]byte{key}, c.ticketKeys...)
+		if len(c.ticketKeys) > 2 {
+			c.ticketKeys = c.ticketKeys[:2]
+		}
+		c.rotated = now
+	}
+	config.SetSessionTicketKeys(c.ticketKeys)
+	return nil
+}
+
+// verifyResumed returns a callback that verifies the peer of a resumed session again. The
+// certificate callbacks only run during full handshakes, but the peer may have been revoked
+// since the session was established.
+func verifyResumed(verify func([][]byte, [][]*x509.Certificate) error) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if !state.DidResume {
+			return nil
+		}
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("resumed session without peer certificate")
+		}
+		rawCerts := make([][]byte, len(state.PeerCertificates))
+		for i, cert := range state.PeerCertificates {
+			rawCerts[i] = cert.Raw
+		}
+		return verify(rawCerts, state.VerifiedChains)
+	}
+}
+
+func (p *ptls) Handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	// the connection is closed if the handshake does not complete in time
+	ctx, cancel := context.WithTimeout(context.Background(), p.handshakeTimeout)
+	defer cancel()
+	err := tlsConn.HandshakeContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s", ErrHandshakeTimeout, p.handshakeTimeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the certificate callbacks run before the peer proved that it holds the key of its
+	// certificate, so new certificates are pinned only now. Peers verified by the CA have chains.
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) > 0 && len(state.VerifiedChains) == 0 {
+		if err := p.pinAuthenticated(state.PeerCertificates); err != nil {
+			_ = tlsConn.Close()
+			return err
+		}
+	}
+	return nil
+}
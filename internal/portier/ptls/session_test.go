@@ -0,0 +1,147 @@
+package ptls
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// exchange runs a TLS connection from the client to the server device, which answers a ping.
+// Returns whether the session of the client was resumed. The client reads the answer, which
+// delivers the session ticket of the server.
+func exchange(t *testing.T, client, server *testDevice) (bool, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	clientStream, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer clientStream.Close()
+	serverStream, err := listener.Accept()
+	require.NoError(t, err)
+	defer serverStream.Close()
+
+	clientTLS, err := client.ptls.CreateClient(clientStream, server.id)
+	require.NoError(t, err)
+	serverTLS, err := server.ptls.CreateServer(serverStream, client.id)
+	require.NoError(t, err)
+
+	go func() {
+		if server.ptls.Handshake(serverTLS) != nil {
+			_ = serverStream.Close()
+			return
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(serverTLS, buf); err == nil {
+			_, _ = serverTLS.Write([]byte("pong"))
+		}
+	}()
+	if err := client.ptls.Handshake(clientTLS); err != nil {
+		return false, err
+	}
+	if _, err := clientTLS.Write([]byte("ping")); err != nil {
+		return false, err
+	}
+	_ = clientStream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(clientTLS, buf); err != nil {
+		return false, err
+	}
+	require.Equal(t, "pong", string(buf))
+	return clientTLS.(*tls.Conn).ConnectionState().DidResume, nil
+}
+
+func TestRepeatedConnectionsResumeTheSession(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002")
+	server.trust(t, client)
+	client.trust(t, server)
+
+	// WHEN
+	first, errFirst := exchange(t, client, server)
+	second, errSecond := exchange(t, client, server)
+
+	// THEN
+	require.NoError(t, errFirst)
+	require.NoError(t, errSecond)
+	require.False(t, first)
+	require.True(t, second)
+}
+
+func TestResumedSessionOfRevokedPeerIsRejected(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002")
+	server.trust(t, client)
+	client.trust(t, server)
+	_, err := exchange(t, client, server)
+	require.NoError(t, err)
+
+	knownHosts := client.knownHosts(t)
+	knownHosts.Revoke(server.id.String(), "", "", time.Now())
+	require.NoError(t, knownHosts.Save(filepath.Join(client.dir, "known_hosts")))
+
+	// WHEN
+	_, err = exchange(t, client, server)
+
+	// THEN
+	require.ErrorContains(t, err, "revoked")
+}
+
+func TestSessionResumptionCanBeDisabled(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002")
+	server.trust(t, client)
+	client.trust(t, server)
+	server.ptls = NewPTLSWithOptions(PTLSOptions{
+		Enabled:          true,
+		CertFile:         filepath.Join(server.dir, "cert.pem"),
+		KeyFile:          filepath.Join(server.dir, "key.pem"),
+		KnownHostsFile:   filepath.Join(server.dir, "known_hosts"),
+		SessionCacheSize: -1,
+	})
+
+	// WHEN
+	_, errFirst := exchange(t, client, server)
+	resumed, errSecond := exchange(t, client, server)
+
+	// THEN
+	require.NoError(t, errFirst)
+	require.NoError(t, errSecond)
+	require.False(t, resumed)
+}
+
+func TestStalledHandshakeTimesOut(t *testing.T) {
+	// GIVEN
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001")
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002")
+	client.trust(t, server)
+	client.ptls = NewPTLSWithOptions(PTLSOptions{
+		Enabled:          true,
+		CertFile:         filepath.Join(client.dir, "cert.pem"),
+		KeyFile:          filepath.Join(client.dir, "key.pem"),
+		KnownHostsFile:   filepath.Join(client.dir, "known_hosts"),
+		HandshakeTimeout: 100 * time.Millisecond,
+	})
+
+	// the server never answers
+	clientStream, serverStream := net.Pipe()
+	defer serverStream.Close()
+	go func() { _, _ = io.Copy(io.Discard, serverStream) }()
+	clientTLS, err := client.ptls.CreateClient(clientStream, server.id)
+	require.NoError(t, err)
+
+	// WHEN
+	start := time.Now()
+	err = client.ptls.Handshake(clientTLS)
+
+	// THEN
+	require.ErrorIs(t, err, ErrHandshakeTimeout)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
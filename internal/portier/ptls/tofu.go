@@ -0,0 +1,172 @@
+package ptls
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrPeerChanged is returned if a known peer device presents a certificate that is neither
+// trusted nor a rotation of a trusted one.
+var ErrPeerChanged = errors.New("the certificate of the peer device changed")
+
+// Events of the audit log
+const (
+	// AuditPinned marks a fingerprint pinned on first use
+	AuditPinned = "tofu-pinned"
+
+	// AuditChanged marks a rejected certificate of a known peer device
+	AuditChanged = "certificate-changed"
+)
+
+// PeerChange describes a known peer device that presented an unknown certificate.
+type PeerChange struct {
+	// DeviceID is the peer device
+	DeviceID uuid.UUID
+
+	// Fingerprint is the fingerprint of the presented certificate
+	Fingerprint string
+
+	// Known are the trusted fingerprints of the peer device
+	Known []string
+}
+
+// AuditEntry is a trust decision about a peer device, a line of the audit log.
+type AuditEntry struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	DeviceID    string    `json:"device"`
+	Fingerprint string    `json:"fingerprint"`
+	Known       []string  `json:"known,omitempty"`
+}
+
+// AppendAuditEntry appends the entry as JSON line to the audit log at the given path.
+func AppendAuditEntry(path string, entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// trustedHosts returns the current known hosts. With trust on first use, a missing known
+// hosts file is not an error, it is created by the first pinned peer.
+func (p *ptls) trustedHosts() (*KnownHosts, error) {
+	knownHosts, err := p.knownHosts.get()
+	if p.tofu && errors.Is(err, os.ErrNotExist) {
+		return NewKnownHosts(), nil
+	}
+	return knownHosts, err
+}
+
+// pinAuthenticated pins the certificate of an authenticated peer device: with trust on first
+// use if the peer device is not known yet, or if it is a rotation of a trusted certificate.
+func (p *ptls) pinAuthenticated(chain []*x509.Certificate) error {
+	peerCert := chain[0]
+	deviceID, err := uuid.Parse(peerCert.Subject.CommonName)
+	if err != nil {
+		return err
+	}
+	knownHosts, err := p.trustedHosts()
+	if err != nil {
+		return err
+	}
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(peerCert.Raw))
+	now := time.Now()
+	switch {
+	case !knownHosts.Has(deviceID.String()):
+		if !p.tofu {
+			return nil
+		}
+		return p.pinFirstUse(deviceID, fingerprint)
+	case knownHosts.Trusts(deviceID.String(), fingerprint, now) || !isRotation(knownHosts, chain, now):
+		return nil
+	}
+	log.Printf("peer device %s rotated its certificate, trusting new fingerprint %s", deviceID, fingerprint)
+	if err := p.pinFingerprint(deviceID.String(), fingerprint); err != nil {
+		log.Printf("failed to update known hosts: %v", err)
+	}
+	return nil
+}
+
+// pinFirstUse pins the fingerprint of a peer device that is not known yet. Returns
+// ErrPeerChanged if another connection pinned a different fingerprint in the meantime.
+func (p *ptls) pinFirstUse(deviceID uuid.UUID, fingerprint string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	knownHosts, err := LoadKnownHosts(p.KnownHostsFile)
+	if err != nil {
+		return err
+	}
+	if knownHosts.Has(deviceID.String()) {
+		if knownHosts.Trusts(deviceID.String(), fingerprint, time.Now()) {
+			return nil
+		}
+		return p.peerChanged(knownHosts, deviceID, fingerprint)
+	}
+
+	knownHosts.Add(deviceID.String(), KnownFingerprint{Fingerprint: fingerprint, Source: SourceTOFU}, DefaultGracePeriod, time.Now())
+	if err := knownHosts.Save(p.KnownHostsFile); err != nil {
+		return err
+	}
+	log.Printf("peer device %s trusted on first use, pinned fingerprint %s", deviceID, fingerprint)
+	p.audit(AuditEntry{Event: AuditPinned, DeviceID: deviceID.String(), Fingerprint: fingerprint})
+	return nil
+}
+
+// peerChanged alerts about a known peer device with an unknown certificate and returns the
+// error that fails the handshake.
+func (p *ptls) peerChanged(knownHosts *KnownHosts, deviceID uuid.UUID, fingerprint string) error {
+	change := PeerChange{DeviceID: deviceID, Fingerprint: fingerprint}
+	now := time.Now()
+	for _, known := range knownHosts.Devices[deviceID.String()].Fingerprints {
+		if known.Expires.IsZero() || now.Before(known.Expires) {
+			change.Known = append(change.Known, known.Fingerprint)
+		}
+	}
+
+	banner := strings.Repeat("@", 72)
+	log.Println(banner)
+	log.Printf("WARNING: THE CERTIFICATE OF PEER DEVICE %s CHANGED", deviceID)
+	log.Printf("  presented: %s", fingerprint)
+	log.Printf("  trusted:   %s", strings.Join(change.Known, ", "))
+	log.Println("Someone may be impersonating the device. Verify the fingerprint out of band with")
+	log.Println("'portier-cli tls fingerprint show' and pin it with 'portier-cli tls trust --fingerprint'.")
+	log.Println(banner)
+
+	p.audit(AuditEntry{Event: AuditChanged, DeviceID: deviceID.String(), Fingerprint: fingerprint, Known: change.Known})
+	if p.onPeerChanged != nil {
+		go p.onPeerChanged(change)
+	}
+	return fmt.Errorf("%w: peer device %s presented %s", ErrPeerChanged, deviceID, fingerprint)
+}
+
+// audit appends an entry to the audit log, if configured.
+func (p *ptls) audit(entry AuditEntry) {
+	if p.auditFile == "" {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	if err := AppendAuditEntry(p.auditFile, entry); err != nil {
+		log.Printf("failed to write audit log: %v", err)
+	}
+}
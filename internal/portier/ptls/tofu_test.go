@@ -0,0 +1,98 @@
+package ptls
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// withTOFU lets the device trust peers on first use and report changed peers to the channel.
+func withTOFU(changes chan PeerChange) testDeviceOption {
+	return func(dir string, options *testDeviceOptions) {
+		options.ptls.TOFU = true
+		options.ptls.AuditFile = filepath.Join(dir, "tls_audit.log")
+		options.ptls.OnPeerChanged = func(change PeerChange) { changes <- change }
+	}
+}
+
+func (d *testDevice) auditLog(t *testing.T) string {
+	data, err := os.ReadFile(filepath.Join(d.dir, "tls_audit.log"))
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestUnknownPeerIsTrustedOnFirstUse(t *testing.T) {
+	// GIVEN
+	changes := make(chan PeerChange, 1)
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withTOFU(changes))
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withTOFU(changes))
+
+	// WHEN
+	err := connect(t, client, server)
+
+	// THEN
+	require.NoError(t, err)
+	knownHosts := client.knownHosts(t)
+	require.True(t, knownHosts.Trusts(server.id.String(), server.fingerprint(t), time.Now()))
+	require.Equal(t, SourceTOFU, knownHosts.Devices[server.id.String()].Fingerprints[0].Source)
+	require.True(t, server.knownHosts(t).Trusts(client.id.String(), client.fingerprint(t), time.Now()))
+	require.Contains(t, client.auditLog(t), `"event":"tofu-pinned"`)
+
+	// the pinned certificate is trusted from now on
+	require.NoError(t, connect(t, client, server))
+	require.Equal(t, 1, strings.Count(client.auditLog(t), "\n"))
+}
+
+func TestChangedCertificateOfPinnedPeerIsRejected(t *testing.T) {
+	// GIVEN
+	changes := make(chan PeerChange, 1)
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withTOFU(changes))
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withTOFU(changes))
+	require.NoError(t, connect(t, client, server))
+	pinned := server.fingerprint(t)
+
+	// an impersonator with a new certificate for the device ID of the server
+	impersonator := newTestDevice(t, server.id.String())
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		data, err := os.ReadFile(filepath.Join(impersonator.dir, name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(server.dir, name), data, 0600))
+	}
+
+	// WHEN
+	err := connect(t, client, server)
+
+	// THEN
+	require.ErrorContains(t, err, ErrPeerChanged.Error())
+	select {
+	case change := <-changes:
+		require.Equal(t, server.id, change.DeviceID)
+		require.Equal(t, server.fingerprint(t), change.Fingerprint)
+		require.Equal(t, []string{pinned}, change.Known)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change was not reported")
+	}
+	require.Contains(t, client.auditLog(t), `"event":"certificate-changed"`)
+	require.False(t, client.knownHosts(t).Trusts(server.id.String(), server.fingerprint(t), time.Now()))
+}
+
+func TestPeerWithoutTheKeyOfItsCertificateIsNotPinned(t *testing.T) {
+	// GIVEN
+	changes := make(chan PeerChange, 1)
+	client := newTestDevice(t, "00000000-0000-0000-0000-000000000002", withTOFU(changes))
+	server := newTestDevice(t, "00000000-0000-0000-0000-000000000001", withTOFU(changes))
+
+	// WHEN an impersonator presents the certificate of the server without holding its key
+	err := connectToImpersonator(t, client, server)
+
+	// THEN
+	require.ErrorContains(t, err, "invalid signature")
+	_, err = os.Stat(filepath.Join(client.dir, "known_hosts"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, connect(t, client, server))
+	require.True(t, client.knownHosts(t).Trusts(server.id.String(), server.fingerprint(t), time.Now()))
+}
@@ -7,6 +7,8 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/clock"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/compression"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
@@ -71,6 +73,57 @@ type ConnectionAdapterOptions struct {
 
 	// ReadBufferSize is the size of the read buffer in bytes
 	ReadBufferSize int
+
+	// Clock drives the tickers and retransmission timers, defaults to the wall clock
+	Clock clock.Clock
+
+	// WrapStream wraps the relayed byte stream of an outbound connection, e.g. with a TLS
+	// client, see ForwarderOptions. Inbound connections negotiate it with the peer.
+	WrapStream func(stream net.Conn) (net.Conn, error) `json:"-"`
+
+	// Noise is the handshake of a Noise encrypted connection. Outbound connections send its
+	// first message along with the connection open message, inbound connections received it.
+	Noise *ptls.NoiseHandshake `json:"-"`
+
+	// Capabilities are announced to the peer, defaults to NewDefaultCapabilities
+	Capabilities messages.Capabilities
+
+	// Negotiated are the capabilities supported by both devices. Inbound connections know them
+	// from the connection open message, outbound connections once the peer accepted.
+	Negotiated messages.Capabilities
+}
+
+// NewDefaultCapabilities returns the capabilities of this device: the current protocol version,
+// the implemented features, the maximum window of the forwarder and the supported compression
+// algorithms.
+func NewDefaultCapabilities() messages.Capabilities {
+	return messages.Capabilities{
+		Version:     messages.ProtocolVersion,
+		Features:    []messages.Capability{messages.CapabilityTLSRequired, messages.CapabilityCompression},
+		Window:      int(NewDefaultWindowOptions().MaxCap),
+		Compression: compression.Algorithms,
+	}
+}
+
+// NewServiceCapabilities returns the capabilities announced for the connections of a service,
+// which only compress with the algorithm chosen for the service, if any.
+func NewServiceCapabilities(algorithm messages.Compression) messages.Capabilities {
+	capabilities := NewDefaultCapabilities()
+	if algorithm == messages.CompressionNone {
+		capabilities.Features = []messages.Capability{messages.CapabilityTLSRequired}
+		capabilities.Compression = nil
+		return capabilities
+	}
+	capabilities.Compression = []messages.Compression{algorithm}
+	return capabilities
+}
+
+// localCapabilities returns the capabilities announced to the peer.
+func (o ConnectionAdapterOptions) localCapabilities() messages.Capabilities {
+	if o.Capabilities.Version == 0 {
+		return NewDefaultCapabilities()
+	}
+	return o.Capabilities
 }
 
 type connectionAdapter struct {
@@ -103,12 +156,12 @@ const (
 )
 
 // NewConnectionAdapter creates a new connection adapter for an outbound connection.
-func NewOutboundConnectionAdapter(options ConnectionAdapterOptions, connection net.Conn, uplink uplink.Uplink, eventChannel chan<- AdapterEvent) ConnectionAdapter {
+func NewOutboundConnectionAdapter(options ConnectionAdapterOptions, connection net.Conn, uplink uplink.Uplink, eventChannel chan<- AdapterEvent, ptls ptls.PTLS) ConnectionAdapter {
 	return &connectionAdapter{
 		options:        options,
 		encoderDecoder: encoder.NewEncoderDecoder(),
 		uplink:         uplink,
-		state:          NewConnectingOutboundState(options, eventChannel, uplink, connection),
+		state:          NewConnectingOutboundState(options, eventChannel, uplink, connection, ptls),
 		mode:           Outbound,
 		eventChannel:   eventChannel,
 	}
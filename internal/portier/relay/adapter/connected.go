@@ -6,6 +6,8 @@ import (
 	"log"
 	"time"
 
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/clock"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
@@ -32,6 +34,9 @@ type connectedState struct {
 
 	// stop is the context's cancel function
 	stop context.CancelFunc
+
+	// session decrypts the data and ack messages of a Noise encrypted connection, optional
+	session *ptls.NoiseSession
 }
 
 func (c *connectedState) Start() error {
@@ -51,9 +56,10 @@ func (c *connectedState) Start() error {
 		Message: []byte{},
 	}
 
-	ticker := time.NewTicker(1000 * time.Millisecond)
+	ticker := clock.OrReal(c.options.Clock).NewTicker(1000 * time.Millisecond)
 
 	go func() {
+		defer ticker.Stop()
 		for {
 			err := c.uplink.Send(msg)
 			if err != nil {
@@ -68,7 +74,7 @@ func (c *connectedState) Start() error {
 			case <-c.context.Done():
 				log.Printf("CR ticker %s closed\n", c.options.ConnectionId)
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 				continue
 			}
 		}
@@ -100,6 +106,10 @@ func (c *connectedState) Close() error {
 
 func (c *connectedState) HandleMessage(msg messages.Message) (ConnectionAdapterState, error) {
 	// decrypt the data
+	msg, err := openMessage(c.session, msg)
+	if err != nil {
+		return nil, err
+	}
 	if msg.Header.Type == messages.D {
 		c.stop()
 		err := c.forwarder.SendAsync(msg)
@@ -147,7 +157,7 @@ func (c *connectedState) HandleMessage(msg messages.Message) (ConnectionAdapterS
 	return nil, fmt.Errorf("expected message type [%s|%s|%s|%s|%s], but got %s", messages.D, messages.DA, messages.CC, messages.CR, messages.NF, msg.Header.Type)
 }
 
-func NewConnectedState(options ConnectionAdapterOptions, eventChannel chan<- AdapterEvent, uplink uplink.Uplink, forwarder Forwarder) ConnectionAdapterState {
+func NewConnectedState(options ConnectionAdapterOptions, eventChannel chan<- AdapterEvent, uplink uplink.Uplink, forwarder Forwarder, session *ptls.NoiseSession) ConnectionAdapterState {
 	ctx, stop := context.WithCancel(context.Background())
 	return &connectedState{
 		options:        options,
@@ -157,5 +167,6 @@ func NewConnectedState(options ConnectionAdapterOptions, eventChannel chan<- Ada
 		forwarder:      forwarder,
 		context:        ctx,
 		stop:           stop,
+		session:        session,
 	}
 }
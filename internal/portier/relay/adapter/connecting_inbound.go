@@ -2,12 +2,13 @@ package adapter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"time"
 
 	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/clock"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
@@ -37,11 +38,29 @@ type connectingInboundState struct {
 
 	// ptls is the ptls instance
 	ptls ptls.PTLS
+
+	// session encrypts the messages of a Noise encrypted connection, nil otherwise
+	session *ptls.NoiseSession
 }
 
 func (c *connectingInboundState) Start() error {
-	// the connection open message has already been received, so try to dial the service and send the connection accept/failed message
+	// the connection open message has already been received, so negotiate TLS, try to dial the service and send the connection accept/failed message
 	url := c.options.BridgeOptions.URLRemote
+
+	// a Noise encrypted connection is encrypted end-to-end already, also for targets that require TLS
+	useTLS := false
+	if c.options.Noise == nil {
+		var err error
+		useTLS, err = c.ptls.Negotiate(url, c.options.BridgeOptions.RequestedTLS(c.options.Negotiated))
+		if err != nil {
+			code := messages.TLSRequired
+			if errors.Is(err, ptls.ErrTLSDisabled) {
+				code = messages.TLSUnavailable
+			}
+			return c.fail(code, err)
+		}
+	}
+
 	var network string
 	if url.Scheme == "udp" {
 		network = "udp"
@@ -50,45 +69,31 @@ func (c *connectingInboundState) Start() error {
 	}
 	conn, err := net.Dial(network, url.Hostname()+":"+url.Port())
 	if err != nil {
-		mainError := fmt.Errorf("error dialing service: %s", err)
-		// send connection failed message
-
-		connectionFailedMessagePayload, _ := c.encoderDecoder.EncodeConnectionFailedMessage(messages.ConnectionFailedMessage{
-			Reason: "error dialing service: " + err.Error(),
-		})
-
-		msg := messages.Message{
-			Header: messages.MessageHeader{
-				From: c.options.LocalDeviceId,
-				To:   c.options.PeerDeviceId,
-				Type: messages.CF,
-				CID:  c.options.ConnectionId,
-			},
-			Message: connectionFailedMessagePayload,
-		}
-		// send the message to the uplink once, since we do not expect a response
-		err = c.uplink.Send(msg)
-		if err != nil {
-			return fmt.Errorf("%s\nerror sending connection failed message: %s", mainError, err)
-		}
-		return mainError
+		return c.fail(messages.DialFailed, fmt.Errorf("error dialing service: %s", err))
 	}
 
-	connectionAcceptMessagePayload, _ := c.encoderDecoder.EncodeConnectionAcceptMessage(messages.ConnectionAcceptMessage{})
+	header := messages.MessageHeader{
+		From: c.options.LocalDeviceId,
+		To:   c.options.PeerDeviceId,
+		Type: messages.CA,
+		CID:  c.options.ConnectionId,
+	}
+	connectionAcceptMessage, err := c.acceptNoise(header)
+	if err != nil {
+		_ = conn.Close()
+		return c.fail(messages.NoiseFailed, err)
+	}
+	connectionAcceptMessagePayload, _ := c.encoderDecoder.EncodeConnectionAcceptMessage(connectionAcceptMessage)
 
 	msg := messages.Message{
-		Header: messages.MessageHeader{
-			From: c.options.LocalDeviceId,
-			To:   c.options.PeerDeviceId,
-			Type: messages.CA,
-			CID:  c.options.ConnectionId,
-		},
+		Header:  header,
 		Message: connectionAcceptMessagePayload,
 	}
 
 	// send the message to the uplink using the ticker
-	ticker := time.NewTicker(c.options.ResponseInterval)
+	ticker := clock.OrReal(c.options.Clock).NewTicker(c.options.ResponseInterval)
 	go func() {
+		defer ticker.Stop()
 		for {
 			err := c.uplink.Send(msg)
 			if err != nil {
@@ -98,7 +103,7 @@ func (c *connectingInboundState) Start() error {
 			case <-c.context.Done():
 				log.Printf("inbound connection ticker %s closed\n", c.options.ConnectionId)
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 				continue
 			}
 		}
@@ -111,20 +116,79 @@ func (c *connectingInboundState) Start() error {
 		ConnectionID:   c.options.ConnectionId,
 		ReadTimeout:    c.options.ConnectionReadTimeout,
 		ReadBufferSize: c.options.ReadBufferSize,
+		Clock:          c.options.Clock,
+		Capabilities:   c.options.Negotiated,
 	}
 
-	if c.ptls.TestEndpointURL(url) {
-		conn, err = c.ptls.CreateServerAndBridge(conn, c.options.PeerDeviceId)
-		if err != nil {
-			return fmt.Errorf("error creating TLS server and bridge: %s", err)
+	if useTLS {
+		forwarderOptions.WrapStream = func(stream net.Conn) (net.Conn, error) {
+			tlsConn, err := c.ptls.CreateServer(stream, c.options.PeerDeviceId)
+			if err != nil {
+				return nil, fmt.Errorf("error creating TLS server: %s", err)
+			}
+			return tlsConn, nil
 		}
+		forwarderOptions.Handshake = c.ptls.Handshake
 	}
 
-	c.forwarder = NewForwarder(forwarderOptions, conn, c.uplink, c.eventChannel)
+	c.forwarder = NewForwarder(forwarderOptions, conn, sealUplink(c.uplink, c.session), c.eventChannel)
 
 	return nil
 }
 
+// acceptNoise returns the connection accept message with the capabilities of this device. For a
+// Noise encrypted connection, it carries the second handshake message, otherwise the
+// certificate of this device if it accepts Noise, so that the peer can encrypt its next
+// connections.
+func (c *connectingInboundState) acceptNoise(header messages.MessageHeader) (messages.ConnectionAcceptMessage, error) {
+	capabilities := c.options.localCapabilities()
+	if c.options.Noise == nil {
+		certificate, err := c.ptls.NoiseCertificate()
+		if err != nil {
+			return messages.ConnectionAcceptMessage{Capabilities: capabilities}, nil
+		}
+		return messages.ConnectionAcceptMessage{Certificate: certificate, Capabilities: capabilities}, nil
+	}
+
+	payload, err := c.encoderDecoder.EncodeConnectionAcceptMessage(messages.ConnectionAcceptMessage{Capabilities: capabilities})
+	if err != nil {
+		return messages.ConnectionAcceptMessage{}, err
+	}
+	handshake, err := c.options.Noise.WriteMessage(header.AssociatedData(), payload)
+	if err != nil {
+		return messages.ConnectionAcceptMessage{}, err
+	}
+	c.session, err = c.options.Noise.Session()
+	if err != nil {
+		return messages.ConnectionAcceptMessage{}, err
+	}
+	return messages.ConnectionAcceptMessage{Noise: handshake}, nil
+}
+
+// fail sends a connection failed message with the error as reason and returns the error.
+func (c *connectingInboundState) fail(code messages.FailureCode, mainError error) error {
+	connectionFailedMessagePayload, _ := c.encoderDecoder.EncodeConnectionFailedMessage(messages.ConnectionFailedMessage{
+		Reason: mainError.Error(),
+		Code:   code,
+	})
+
+	msg := messages.Message{
+		Header: messages.MessageHeader{
+			From: c.options.LocalDeviceId,
+			To:   c.options.PeerDeviceId,
+			Type: messages.CF,
+			CID:  c.options.ConnectionId,
+		},
+		Message: connectionFailedMessagePayload,
+	}
+	// send the message to the uplink once, since we do not expect a response
+	err := c.uplink.Send(msg)
+	if err != nil {
+		return fmt.Errorf("%s\nerror sending connection failed message: %s", mainError, err)
+	}
+	return mainError
+}
+
 func (c *connectingInboundState) Stop() error {
 	c.stop()
 	return nil
@@ -151,7 +215,7 @@ func (c *connectingInboundState) HandleMessage(msg messages.Message) (Connection
 
 	if msg.Header.Type == messages.D || msg.Header.Type == messages.CR {
 		// TODO check signature
-		return NewConnectedState(c.options, c.eventChannel, c.uplink, c.forwarder), nil
+		return NewConnectedState(c.options, c.eventChannel, c.uplink, c.forwarder, c.session), nil
 	}
 	if msg.Header.Type == messages.CO {
 		return nil, nil
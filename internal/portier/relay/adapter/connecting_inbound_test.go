@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	ptlspkg "github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -50,8 +52,8 @@ func TestInboundConnection(testing *testing.T) {
 	})).Return(nil)
 
 	ptls := MockPTLS{}
-	ptls.On("TestEndpointURL", mock.Anything).Return(false)
-	ptls.On("CreateServerAndBridge", mock.Anything, mock.Anything).Return(listener, nil)
+	ptls.On("Negotiate", mock.Anything, mock.Anything).Return(false, nil)
+	ptls.On("CreateServer", mock.Anything, mock.Anything).Return(listener, nil)
 
 	underTest := NewConnectingInboundState(options, eventChannel, &uplink, &ptls)
 
@@ -98,6 +100,7 @@ func TestInboundConnectionWithError(testing *testing.T) {
 	// mocks
 	uplink := MockUplink{}
 	ptls := MockPTLS{}
+	ptls.On("Negotiate", mock.Anything, mock.Anything).Return(false, nil)
 
 	uplink.On("Send", mock.MatchedBy(func(msg messages.Message) bool {
 		if msg.Header.Type == messages.CF {
@@ -124,6 +127,53 @@ func TestInboundConnectionWithError(testing *testing.T) {
 	uplink.AssertExpectations(testing)
 }
 
+func TestInboundConnectionRefusedByTLSPolicy(testing *testing.T) {
+	// GIVEN
+	failedChannel := make(chan messages.ConnectionFailedMessage, 1)
+	eventChannel := make(chan AdapterEvent, 10)
+
+	urlRemote, _ := url.Parse("tcp://localhost:22")
+	useTLS := false
+	options := ConnectionAdapterOptions{
+		ConnectionId:     "test-connection-id7",
+		LocalDeviceId:    uuid.New(),
+		PeerDeviceId:     uuid.New(),
+		ResponseInterval: 1000 * time.Millisecond,
+		BridgeOptions: messages.BridgeOptions{
+			URLRemote: *urlRemote,
+			TLS:       useTLS,
+		},
+		Negotiated: messages.Capabilities{Features: []messages.Capability{messages.CapabilityTLSRequired}},
+	}
+
+	// mocks
+	uplink := MockUplink{}
+	ptls := MockPTLS{}
+	ptls.On("Negotiate", *urlRemote, &useTLS).Return(false, fmt.Errorf("%w for localhost:22", ptlspkg.ErrTLSRequired))
+
+	uplink.On("Send", mock.MatchedBy(func(msg messages.Message) bool {
+		if msg.Header.Type == messages.CF {
+			failed, err := encoder.NewEncoderDecoder().DecodeConnectionFailedMessage(msg.Message)
+			assert.Nil(testing, err)
+			failedChannel <- failed
+		}
+		return true
+	})).Return(nil)
+
+	underTest := NewConnectingInboundState(options, eventChannel, &uplink, &ptls)
+
+	// WHEN
+	err := underTest.Start()
+
+	// THEN
+	assert.ErrorIs(testing, err, ptlspkg.ErrTLSRequired)
+	failed := <-failedChannel
+	assert.Equal(testing, messages.TLSRequired, failed.Code)
+	assert.Contains(testing, failed.Reason, "TLS is required")
+	uplink.AssertExpectations(testing)
+	ptls.AssertExpectations(testing)
+}
+
 func TestInboundConnectionStop(testing *testing.T) {
 	// GIVEN
 	listener, _ := net.Listen("tcp", "127.0.0.1:0")
@@ -155,8 +205,8 @@ func TestInboundConnectionStop(testing *testing.T) {
 	})).Return(nil)
 
 	ptls := MockPTLS{}
-	ptls.On("TestEndpointURL", mock.Anything).Return(false)
-	ptls.On("CreateServerAndBridge", mock.Anything, mock.Anything).Return(listener, nil)
+	ptls.On("Negotiate", mock.Anything, mock.Anything).Return(false, nil)
+	ptls.On("CreateServer", mock.Anything, mock.Anything).Return(listener, nil)
 
 	underTest := NewConnectingInboundState(options, eventChannel, &uplink, &ptls)
 	err := underTest.Start()
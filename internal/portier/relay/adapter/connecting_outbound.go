@@ -5,8 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"time"
 
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/clock"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
@@ -33,28 +34,46 @@ type connectingOutboundState struct {
 
 	// stop is the context's cancel function
 	stop context.CancelFunc
+
+	// ptls is the ptls instance
+	ptls ptls.PTLS
 }
 
 func (c *connectingOutboundState) Start() error {
 	// send connection open message
+	header := messages.MessageHeader{
+		From: c.options.LocalDeviceId,
+		To:   c.options.PeerDeviceId,
+		Type: messages.CO,
+		CID:  c.options.ConnectionId,
+	}
 	connectionOpenMessagePayload, err := c.encoderDecoder.EncodeConnectionOpenMessage(messages.ConnectionOpenMessage{
 		BridgeOptions: c.options.BridgeOptions,
+		Capabilities:  c.options.localCapabilities(),
 	})
 	if err != nil {
 		return err
 	}
+	if c.options.Noise != nil {
+		// the bridge options and capabilities are sent encrypted, as payload of the first handshake message
+		handshake, err := c.options.Noise.WriteMessage(header.AssociatedData(), connectionOpenMessagePayload)
+		if err != nil {
+			return err
+		}
+		connectionOpenMessagePayload, err = c.encoderDecoder.EncodeConnectionOpenMessage(messages.ConnectionOpenMessage{
+			Noise: handshake,
+		})
+		if err != nil {
+			return err
+		}
+	}
 	msg := messages.Message{
-		Header: messages.MessageHeader{
-			From: c.options.LocalDeviceId,
-			To:   c.options.PeerDeviceId,
-			Type: messages.CO,
-			CID:  c.options.ConnectionId,
-		},
+		Header:  header,
 		Message: connectionOpenMessagePayload,
 	}
 
 	// send the message to the uplink using the ticker
-	ticker := time.NewTicker(c.options.ResponseInterval)
+	ticker := clock.OrReal(c.options.Clock).NewTicker(c.options.ResponseInterval)
 
 	go func() {
 		defer ticker.Stop()
@@ -72,7 +91,7 @@ func (c *connectingOutboundState) Start() error {
 			case <-c.context.Done():
 				log.Printf("outbound connection ticker %s closed\n", c.options.ConnectionId)
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 				continue
 			}
 		}
@@ -111,6 +130,18 @@ func (c *connectingOutboundState) HandleMessage(msg messages.Message) (Connectio
 		}
 		log.Printf("connection accept message received: %v\n", connectionAcceptMessage)
 
+		session, peerCapabilities, err := c.acceptNoise(msg.Header, connectionAcceptMessage)
+		if err != nil {
+			c.eventChannel <- AdapterEvent{
+				ConnectionId: c.options.ConnectionId,
+				Type:         Error,
+				Message:      err.Error(),
+			}
+			return nil, nil
+		}
+		c.options.Negotiated = c.options.localCapabilities().Negotiate(peerCapabilities)
+		log.Printf("negotiated protocol version %d with features %v for connection %s\n", c.options.Negotiated.Version, c.options.Negotiated.Features, c.options.ConnectionId)
+
 		forwarderOptions := ForwarderOptions{
 			Throughput:     c.options.ThroughputLimit,
 			LocalDeviceID:  c.options.LocalDeviceId,
@@ -118,21 +149,43 @@ func (c *connectingOutboundState) HandleMessage(msg messages.Message) (Connectio
 			ConnectionID:   c.options.ConnectionId,
 			ReadTimeout:    c.options.ConnectionReadTimeout,
 			ReadBufferSize: c.options.ReadBufferSize,
+			Clock:          c.options.Clock,
+			WrapStream:     c.options.WrapStream,
+			Capabilities:   c.options.Negotiated,
 		}
-		forwarder := NewForwarder(forwarderOptions, c.conn, c.uplink, c.eventChannel)
+		if c.options.WrapStream != nil && c.ptls != nil {
+			certificate := connectionAcceptMessage.Certificate
+			forwarderOptions.Handshake = func(secure net.Conn) error {
+				if err := c.ptls.Handshake(secure); err != nil {
+					return err
+				}
+				c.learnNoisePeer(certificate, secure)
+				return nil
+			}
+		}
+		forwarder := NewForwarder(forwarderOptions, c.conn, sealUplink(c.uplink, session), c.eventChannel)
 
-		return NewConnectedState(c.options, c.eventChannel, c.uplink, forwarder), nil
+		return NewConnectedState(c.options, c.eventChannel, c.uplink, forwarder, session), nil
 	}
 	if msg.Header.Type == messages.CF {
 		connectionFailedMessage, err := c.encoderDecoder.DecodeConnectionFailedMessage(msg.Message)
 		if err != nil {
 			return nil, err
 		}
+		reason := connectionFailedMessage.Reason
+		if connectionFailedMessage.Code != "" {
+			reason = fmt.Sprintf("connection refused by peer (%s): %s", connectionFailedMessage.Code, reason)
+		}
+		if connectionFailedMessage.Code == messages.NoiseUnavailable {
+			// the message is not authenticated, the relay could forge it to downgrade the
+			// connections to the peer, so the peer is only forgotten by the user
+			reason = fmt.Sprintf("%s. If peer device %s disabled Noise, forget its key with: portier-cli tls trust --id %s --forget-noise", reason, c.options.PeerDeviceId, c.options.PeerDeviceId)
+		}
 		// send connection failed event
 		c.eventChannel <- AdapterEvent{
 			ConnectionId: c.options.ConnectionId,
 			Type:         Error,
-			Message:      connectionFailedMessage.Reason,
+			Message:      reason,
 		}
 		return nil, nil
 	}
@@ -147,7 +200,41 @@ func (c *connectingOutboundState) HandleMessage(msg messages.Message) (Connectio
 	return nil, fmt.Errorf("expected message type [%s|%s|%s], but got %s", messages.CA, messages.CF, messages.CC, msg.Header.Type)
 }
 
-func NewConnectingOutboundState(options ConnectionAdapterOptions, eventChannel chan<- AdapterEvent, uplink uplink.Uplink, conn net.Conn) ConnectionAdapterState {
+// learnNoisePeer remembers the peer if it accepts Noise, once the TLS handshake of the
+// connection authenticated it. The certificate of the connection accept message is not
+// authenticated, the relay could replace it, so it must be the one of the TLS connection.
+func (c *connectingOutboundState) learnNoisePeer(certificate []byte, secure net.Conn) {
+	if len(certificate) == 0 {
+		return
+	}
+	if err := c.ptls.LearnNoisePeer(c.options.PeerDeviceId, certificate, secure); err != nil {
+		log.Printf("peer device %s accepts Noise, but its certificate is not trusted: %s\n", c.options.PeerDeviceId, err)
+	}
+}
+
+// acceptNoise completes the Noise handshake with the connection accept message and returns the
+// session, nil for an unencrypted connection, and the capabilities of the peer.
+func (c *connectingOutboundState) acceptNoise(header messages.MessageHeader, accept messages.ConnectionAcceptMessage) (*ptls.NoiseSession, messages.Capabilities, error) {
+	if c.options.Noise == nil {
+		return nil, accept.Capabilities, nil
+	}
+	if len(accept.Noise) == 0 {
+		return nil, messages.Capabilities{}, fmt.Errorf("peer device %s accepted the connection without Noise encryption", c.options.PeerDeviceId)
+	}
+	payload, err := c.options.Noise.ReadMessage(header.AssociatedData(), accept.Noise)
+	if err != nil {
+		return nil, messages.Capabilities{}, fmt.Errorf("noise handshake with peer device %s failed: %w", c.options.PeerDeviceId, err)
+	}
+	// the capabilities are part of the encrypted payload
+	encrypted, err := c.encoderDecoder.DecodeConnectionAcceptMessage(payload)
+	if err != nil {
+		return nil, messages.Capabilities{}, err
+	}
+	session, err := c.options.Noise.Session()
+	return session, encrypted.Capabilities, err
+}
+
+func NewConnectingOutboundState(options ConnectionAdapterOptions, eventChannel chan<- AdapterEvent, uplink uplink.Uplink, conn net.Conn, ptls ptls.PTLS) ConnectionAdapterState {
 	ctx, stop := context.WithCancel(context.Background())
 	return &connectingOutboundState{
 		options:        options,
@@ -157,5 +244,6 @@ func NewConnectingOutboundState(options ConnectionAdapterOptions, eventChannel c
 		conn:           conn,
 		context:        ctx,
 		stop:           stop,
+		ptls:           ptls,
 	}
 }
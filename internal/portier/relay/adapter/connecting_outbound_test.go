@@ -51,7 +51,7 @@ func TestOutboundConnection(testing *testing.T) {
 
 	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
 	assert.Nil(testing, err)
-	underTest := NewConnectingOutboundState(options, eventChannel, &uplink, conn)
+	underTest := NewConnectingOutboundState(options, eventChannel, &uplink, conn, &MockPTLS{})
 
 	// WHEN
 	_ = underTest.Start()
@@ -91,7 +91,7 @@ func TestOutboundConnectionWithError(testing *testing.T) {
 	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
 	assert.Nil(testing, err)
 
-	underTest := NewConnectingOutboundState(options, eventChannel, &uplink, conn)
+	underTest := NewConnectingOutboundState(options, eventChannel, &uplink, conn, &MockPTLS{})
 	err = underTest.Start()
 	assert.Nil(testing, err)
 
@@ -115,6 +115,83 @@ func TestOutboundConnectionWithError(testing *testing.T) {
 	assert.Contains(testing, event.Message, "connection refused")
 }
 
+func TestOutboundConnectionKeepsNoisePeerOnUnauthenticatedRefusal(testing *testing.T) {
+	// GIVEN
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(testing, err)
+	defer conn.Close()
+
+	eventChannel := make(chan AdapterEvent, 10)
+	urlRemote, _ := url.Parse("tcp://localhost:22")
+	options := ConnectionAdapterOptions{
+		ConnectionId:     "test-connection-id",
+		LocalDeviceId:    uuid.New(),
+		PeerDeviceId:     uuid.New(),
+		ResponseInterval: time.Second,
+		BridgeOptions:    messages.BridgeOptions{URLRemote: *urlRemote},
+	}
+	uplink := MockUplink{}
+	uplink.On("Send", mock.Anything).Return(nil)
+	ptls := &MockPTLS{}
+	underTest := NewConnectingOutboundState(options, eventChannel, &uplink, conn, ptls)
+	assert.Nil(testing, underTest.Start())
+	payload, _ := encoder.NewEncoderDecoder().EncodeConnectionFailedMessage(messages.ConnectionFailedMessage{
+		Code:   messages.NoiseUnavailable,
+		Reason: "Noise is disabled",
+	})
+
+	// WHEN the relay forges a refusal of Noise
+	_, _ = underTest.HandleMessage(messages.Message{
+		Header:  messages.MessageHeader{Type: messages.CF},
+		Message: payload,
+	})
+	event := <-eventChannel
+
+	// THEN
+	assert.Equal(testing, 0, ptls.forgotten)
+	assert.Contains(testing, event.Message, "--forget-noise")
+}
+
+func TestOutboundConnectionDoesNotLearnNoisePeerWithoutTLS(testing *testing.T) {
+	// GIVEN
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(testing, err)
+	defer conn.Close()
+
+	eventChannel := make(chan AdapterEvent, 10)
+	urlRemote, _ := url.Parse("tcp://localhost:22")
+	options := ConnectionAdapterOptions{
+		ConnectionId:     "test-connection-id",
+		LocalDeviceId:    uuid.New(),
+		PeerDeviceId:     uuid.New(),
+		ResponseInterval: time.Second,
+		BridgeOptions:    messages.BridgeOptions{URLRemote: *urlRemote},
+	}
+	uplink := MockUplink{}
+	uplink.On("Send", mock.Anything).Return(nil)
+	ptls := &MockPTLS{}
+	underTest := NewConnectingOutboundState(options, eventChannel, &uplink, conn, ptls)
+	assert.Nil(testing, underTest.Start())
+	payload, _ := encoder.NewEncoderDecoder().EncodeConnectionAcceptMessage(messages.ConnectionAcceptMessage{
+		Certificate: []byte("certificate injected by the relay"),
+	})
+
+	// WHEN the unencrypted connection is accepted with a certificate
+	connected, err := underTest.HandleMessage(messages.Message{
+		Header:  messages.MessageHeader{Type: messages.CA},
+		Message: payload,
+	})
+
+	// THEN
+	assert.Nil(testing, err)
+	assert.Equal(testing, 0, ptls.learned)
+	_ = connected.Close()
+}
+
 func TestOutboundConnectionStop(testing *testing.T) {
 	// GIVEN
 	listener, _ := net.Listen("tcp", "127.0.0.1:0")
@@ -139,7 +216,7 @@ func TestOutboundConnectionStop(testing *testing.T) {
 	// mocks
 	uplink := MockUplink{}
 	ptls := MockPTLS{}
-	ptls.On("TestEndpointURL", mock.Anything).Return(false)
+	ptls.On("Negotiate", mock.Anything, mock.Anything).Return(false, nil)
 
 	uplink.On("Send", mock.MatchedBy(func(msg messages.Message) bool {
 		if msg.Header.Type == messages.CC {
@@ -159,3 +236,72 @@ func TestOutboundConnectionStop(testing *testing.T) {
 	<-closeChannel // connection closed message sent
 	assert.Nil(testing, err)
 }
+
+func TestOutboundConnectionNegotiatesCapabilities(testing *testing.T) {
+	// GIVEN
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	eventChannel := make(chan AdapterEvent, 10)
+	openChannel := make(chan messages.Message, 10)
+
+	urlRemote, _ := url.Parse("tcp://localhost:" + fmt.Sprint(port))
+	options := ConnectionAdapterOptions{
+		ConnectionId:     "test-connection-id7",
+		LocalDeviceId:    uuid.New(),
+		PeerDeviceId:     uuid.New(),
+		ResponseInterval: 1000 * time.Millisecond,
+		BridgeOptions: messages.BridgeOptions{
+			URLRemote: *urlRemote,
+		},
+	}
+
+	uplink := MockUplink{}
+	uplink.On("Send", mock.MatchedBy(func(msg messages.Message) bool {
+		if msg.Header.Type == messages.CO {
+			openChannel <- msg
+		}
+		return true
+	})).Return(nil)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	assert.Nil(testing, err)
+	underTest := NewConnectingOutboundState(options, eventChannel, &uplink, conn, &MockPTLS{})
+	assert.Nil(testing, underTest.Start())
+	defer underTest.Stop()
+
+	// a peer of a later protocol version with an unknown feature and a smaller window
+	encoderDecoder := encoder.NewEncoderDecoder()
+	connectionAcceptMessagePayload, _ := encoderDecoder.EncodeConnectionAcceptMessage(messages.ConnectionAcceptMessage{
+		Capabilities: messages.Capabilities{
+			Version:  messages.ProtocolVersion + 1,
+			Features: []messages.Capability{messages.CapabilityTLSRequired, "teleport"},
+			Window:   65536,
+		},
+	})
+
+	// WHEN
+	newState, err := underTest.HandleMessage(messages.Message{
+		Header:  messages.MessageHeader{Type: messages.CA},
+		Message: connectionAcceptMessagePayload,
+	})
+
+	// THEN
+	assert.Nil(testing, err)
+	connectionOpenMessage, err := encoderDecoder.DecodeConnectionOpenMessage((<-openChannel).Message)
+	assert.Nil(testing, err)
+	assert.Equal(testing, NewDefaultCapabilities(), connectionOpenMessage.Capabilities)
+
+	connected := newState.(*connectedState)
+	expected := messages.Capabilities{
+		Version:  messages.ProtocolVersion,
+		Features: []messages.Capability{messages.CapabilityTLSRequired},
+		Window:   65536,
+	}
+	assert.Equal(testing, expected, connected.options.Negotiated)
+	forwarder := connected.forwarder.(*forwarder)
+	assert.Equal(testing, expected, forwarder.options.Capabilities)
+	assert.Equal(testing, 65536.0, forwarder.window.(*window).options.MaxCap)
+	_ = forwarder.Close()
+}
@@ -2,11 +2,18 @@ package adapter
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/bufferpool"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/clock"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/compression"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
@@ -30,6 +37,23 @@ type ForwarderOptions struct {
 
 	// ReadBufferSize is the size of the read buffer in bytes
 	ReadBufferSize int
+
+	// Clock drives the retransmission timers and the read deadlines of the connection, defaults
+	// to the wall clock. With a virtual clock, the connection has to interpret its deadlines in
+	// virtual time.
+	Clock clock.Clock
+
+	// WrapStream wraps the relayed byte stream in a security layer, e.g. TLS. The connection
+	// is bridged to the returned net.Conn instead of the plain stream. Optional.
+	WrapStream func(stream net.Conn) (net.Conn, error)
+
+	// Handshake completes the handshake of the security layer before the data of the peer is
+	// forwarded, e.g. within a timeout. A failed handshake closes the connection. Optional.
+	Handshake func(secure net.Conn) error
+
+	// Capabilities are the capabilities negotiated with the peer. The window does not grow
+	// beyond the negotiated one, data is compressed with the first negotiated compression.
+	Capabilities messages.Capabilities
 }
 
 // Forwarder controls the flow of messages from and to spider.
@@ -51,17 +75,26 @@ type Forwarder interface {
 // NewForwarder creates a new forwarder.
 func NewForwarder(options ForwarderOptions, conn net.Conn, uplink uplink.Uplink, eventChannel chan<- AdapterEvent) Forwarder {
 	forwarderContext, cancel := context.WithCancel(context.Background())
+	options.Clock = clock.OrReal(options.Clock)
+	windowOptions := NewDefaultWindowOptions()
+	windowOptions.Clock = options.Clock
+	if window := float64(options.Capabilities.Window); window > 0 && window < windowOptions.MaxCap {
+		windowOptions.MaxCap = window
+		windowOptions.InitialCap = math.Min(windowOptions.InitialCap, window)
+	}
 	return &forwarder{
-		options:        options,
-		encoderDecoder: encoder.NewEncoderDecoder(),
-		conn:           conn,
-		uplink:         uplink,
-		sendChannel:    make(chan messages.Message, 500),
-		eventChannel:   eventChannel,
-		window:         NewWindow(forwarderContext, NewDefaultWindowOptions(), uplink, encoder.NewEncoderDecoder()),
-		messageHeap:    NewMessageHeap(NewDefaultMessageHeapOptions()),
-		cancel:         cancel,
-		context:        forwarderContext,
+		options:          options,
+		compressor:       newCompressor(options),
+		encoderDecoder:   encoder.NewEncoderDecoder(),
+		conn:             conn,
+		uplink:           uplink,
+		sendChannel:      make(chan messages.Message, 500),
+		eventChannel:     eventChannel,
+		window:           NewWindow(forwarderContext, windowOptions, uplink, encoder.NewEncoderDecoder()),
+		messageHeap:      NewMessageHeap(NewDefaultMessageHeapOptions()),
+		streamBufferSize: int(windowOptions.MaxCap),
+		cancel:           cancel,
+		context:          forwarderContext,
 	}
 }
 
@@ -69,6 +102,9 @@ type forwarder struct {
 	// options are the forwarder options
 	options ForwarderOptions
 
+	// compressor compresses the data sent to the peer, nil if compression is not negotiated
+	compressor *compression.Compressor
+
 	// encoderDecoder is the encoder/decoder for msgpack
 	encoderDecoder encoder.EncoderDecoder
 
@@ -95,10 +131,36 @@ type forwarder struct {
 
 	// context is the context for the forwarder
 	context context.Context
+
+	// stream is the relayed byte stream, only set if the stream is wrapped
+	stream *streamConn
+
+	// streamBufferSize is the maximum number of bytes of the peer buffered by the stream, the
+	// bound of the window, which the peer does not exceed
+	streamBufferSize int
+
+	// secure is the security layer over the stream, only set if the stream is wrapped
+	secure net.Conn
+
+	// seq is the sequence number of the next data message
+	seq uint64
+
+	// seqMutex keeps data messages in sequence when the security layer writes concurrently
+	seqMutex sync.Mutex
 }
 
 // Start starts the forwarder, returns a channel to which messages can be sent.
 func (f *forwarder) Start() error {
+	if f.options.WrapStream != nil {
+		f.stream = newStreamConn(f.options.ConnectionID, f.options.ReadBufferSize, f.streamBufferSize, f.sendData)
+		secure, err := f.options.WrapStream(f.stream)
+		if err != nil {
+			return err
+		}
+		f.secure = secure
+		go f.readSecure()
+	}
+
 	go func() {
 		defer close(f.sendChannel)
 		for {
@@ -114,6 +176,10 @@ func (f *forwarder) Start() error {
 				messages, err := f.messageHeap.Test(dm)
 				if err != nil {
 					if err.Error() == "old_message" || err.Error() == "duplicate_message" {
+						if f.stream != nil && f.stream.unread(dm.Seq) {
+							// acknowledged once it is read, the peer keeps it in its window
+							continue
+						}
 						err := f.ackMessage(dm.Seq, dm.Re)
 						if err != nil {
 							f.eventChannel <- createEvent(Error, f.options.ConnectionID, "error sending ack to uplink. Exiting", err)
@@ -130,12 +196,12 @@ func (f *forwarder) Start() error {
 				}
 
 				for _, msg := range messages {
-					_, err = f.conn.Write(msg.Data)
+					data, err := compression.Decompress(msg.Compression, msg.Data)
 					if err != nil {
-						f.eventChannel <- createEvent(Error, f.options.ConnectionID, "error processing message: ", err)
-						break
+						f.eventChannel <- createEvent(Error, f.options.ConnectionID, "error decompressing message. Exiting", err)
+						return
 					}
-					err := f.ackMessage(msg.Seq, msg.Re)
+					err = f.deliver(data, msg.Seq, msg.Re)
 					if err != nil {
 						f.eventChannel <- createEvent(Error, f.options.ConnectionID, "error processing message: ", err)
 						break
@@ -150,8 +216,6 @@ func (f *forwarder) Start() error {
 	}()
 
 	go func() {
-		var seq uint64
-
 		for {
 			// exit if the context is done
 			select {
@@ -161,10 +225,22 @@ func (f *forwarder) Start() error {
 			default:
 			}
 
-			// read from the connection
-			buf := make([]byte, f.options.ReadBufferSize)
-			_ = f.conn.SetReadDeadline(time.Now().Add(f.options.ReadTimeout))
-			n, err := f.conn.Read(buf)
+			// read from the connection into a pooled buffer, the data is copied before it is
+			// returned: encoded into a data message, compressed or encrypted
+			buf := bufferpool.Get(f.options.ReadBufferSize)
+			_ = f.conn.SetReadDeadline(f.options.Clock.Now().Add(f.options.ReadTimeout))
+			n, err := f.conn.Read(*buf)
+			if err == nil && n > 0 {
+				err = f.forward((*buf)[:n])
+				bufferpool.Put(buf)
+				if err != nil {
+					log.Printf("error sending message to uplink: %s\n", err)
+					f.eventChannel <- createEvent(Error, f.options.ConnectionID, "error sending message to uplink. Exiting", err)
+					return
+				}
+				continue
+			}
+			bufferpool.Put(buf)
 			if err != nil {
 				// if connection is closed, exit
 				if err.Error() == "EOF" {
@@ -179,45 +255,121 @@ func (f *forwarder) Start() error {
 				f.eventChannel <- createEvent(Error, f.options.ConnectionID, "error reading from connection. Exiting", err)
 				return
 			}
-			if n == 0 {
-				continue
-			}
-			// decrypt the data
-			header := messages.MessageHeader{
-				From: f.options.LocalDeviceID,
-				To:   f.options.PeerDeviceID,
-				Type: messages.D,
-				CID:  f.options.ConnectionID,
-			}
-			dm := messages.DataMessage{
-				Seq:  seq,
-				Data: buf[:n],
-			}
-			seq++
-			dmBytes, err := f.encoderDecoder.EncodeDataMessage(dm)
-			if err != nil {
-				log.Printf("error encoding data message: %s\n", err)
-				f.eventChannel <- createEvent(Error, f.options.ConnectionID, "error encoding data message. Exiting", err)
-				return
-			}
-			// wrap the data in a message
-			msg := messages.Message{
-				Header:  header,
-				Message: dmBytes,
-			}
-			// send the data to the window
-			err = f.window.add(msg, dm.Seq)
-			if err != nil {
-				log.Printf("error sending message to uplink: %s\n", err)
-				f.eventChannel <- createEvent(Error, f.options.ConnectionID, "error sending message to uplink. Exiting", err)
-				return
-			}
 		}
 	}()
 
 	return nil
 }
 
+// forward sends data read from the connection to the peer, through the security layer if the
+// stream is wrapped.
+func (f *forwarder) forward(data []byte) error {
+	if f.secure != nil && f.compressor != nil {
+		// data is compressed before it is encrypted by the security layer
+		return f.compressor.WriteFrame(f.secure, data)
+	}
+	if f.secure != nil {
+		_, err := f.secure.Write(data)
+		return err
+	}
+	return f.sendData(data)
+}
+
+// sendData sends data to the peer as the next data message of the stream.
+func (f *forwarder) sendData(data []byte) error {
+	f.seqMutex.Lock()
+	defer f.seqMutex.Unlock()
+
+	header := messages.MessageHeader{
+		From: f.options.LocalDeviceID,
+		To:   f.options.PeerDeviceID,
+		Type: messages.D,
+		CID:  f.options.ConnectionID,
+	}
+	dm := messages.DataMessage{
+		Seq:  f.seq,
+		Data: data,
+	}
+	if f.compressor != nil && f.secure == nil {
+		// the window accounts for the compressed size, the size of the encoded message
+		dm.Data, dm.Compression = f.compressor.Compress(data)
+	}
+	dmBytes, err := f.encoderDecoder.EncodeDataMessage(dm)
+	if err != nil {
+		return fmt.Errorf("error encoding data message: %w", err)
+	}
+	f.seq++
+	// wrap the data in a message and send it to the window
+	msg := messages.Message{
+		Header:  header,
+		Message: dmBytes,
+	}
+	return f.window.add(msg, dm.Seq)
+}
+
+// deliver passes data received from the peer to the connection and acknowledges it. Data for
+// the security layer is buffered by the stream and acknowledged once it is read, so that a slow
+// reader throttles the peer through its window instead of blocking the downward loop.
+func (f *forwarder) deliver(data []byte, seq uint64, re bool) error {
+	if f.stream != nil {
+		return f.stream.deliver(data, seq, func() { _ = f.ackMessage(seq, re) })
+	}
+	if _, err := f.conn.Write(data); err != nil {
+		return err
+	}
+	return f.ackMessage(seq, re)
+}
+
+// readSecure copies the data of the security layer to the connection, after the handshake.
+func (f *forwarder) readSecure() {
+	if f.options.Handshake != nil {
+		if err := f.options.Handshake(f.secure); err != nil {
+			select {
+			case <-f.context.Done():
+				return
+			default:
+			}
+			log.Printf("handshake of secure stream %s failed: %s\n", f.options.ConnectionID, err)
+			f.eventChannel <- createEvent(Error, f.options.ConnectionID, "handshake of secure stream failed. Exiting", err)
+			return
+		}
+	}
+
+	var err error
+	if f.compressor != nil {
+		err = compression.CopyFrames(f.conn, f.secure)
+	} else {
+		_, err = io.Copy(f.conn, f.secure)
+	}
+	select {
+	case <-f.context.Done():
+		return
+	default:
+	}
+	if err != nil {
+		log.Printf("error reading from secure stream: %s\n", err)
+		f.eventChannel <- createEvent(Error, f.options.ConnectionID, "error reading from secure stream. Exiting", err)
+		return
+	}
+	f.eventChannel <- createEvent(Closed, f.options.ConnectionID, "secure stream closed by peer. Exiting", nil)
+}
+
+// newCompressor returns the compressor of the negotiated compression, nil if none was negotiated.
+// The payloads of data messages are compressed, or, if the stream is wrapped in a security
+// layer, the data within it.
+func newCompressor(options ForwarderOptions) *compression.Compressor {
+	capabilities := options.Capabilities
+	if !capabilities.Has(messages.CapabilityCompression) || len(capabilities.Compression) == 0 {
+		return nil
+	}
+	compressor, err := compression.NewCompressor(capabilities.Compression[0])
+	if err != nil {
+		log.Printf("not compressing connection %s: %s\n", options.ConnectionID, err)
+		return nil
+	}
+	return compressor
+}
+
 func createEvent(eventType EventType, cid messages.ConnectionID, msg string, err error) AdapterEvent {
 	return AdapterEvent{
 		ConnectionId: cid,
@@ -252,6 +404,14 @@ func (f *forwarder) Close() error {
 	}
 
 	f.cancel()
+	if f.compressor != nil {
+		stats := f.compressor.Stats()
+		log.Printf("connection %s: compressed %d of %d chunks with %s, %d bytes to %d bytes, %d bytes saved\n",
+			f.options.ConnectionID, stats.Compressed, stats.Chunks, f.compressor.Algorithm(), stats.BytesIn, stats.BytesOut, stats.Saved())
+	}
+	if f.stream != nil {
+		_ = f.stream.Close()
+	}
 	return f.conn.Close()
 }
 
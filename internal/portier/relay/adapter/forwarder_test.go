@@ -1,12 +1,16 @@
 package adapter
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/compression"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/stretchr/testify/assert"
@@ -143,3 +147,179 @@ func TestForwardingToUplink(testing *testing.T) {
 	underTest.Close()
 	uplink.AssertExpectations(testing)
 }
+
+func TestForwardingToUplinkCompressesData(testing *testing.T) {
+	// GIVEN
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	assert.Nil(testing, err)
+	s_conn, _ := listener.Accept()
+	defer s_conn.Close()
+
+	msgChannel := make(chan messages.Message, 100)
+	eventChannel := make(chan AdapterEvent, 10)
+
+	options := ForwarderOptions{
+		LocalDeviceID:  uuid.New(),
+		PeerDeviceID:   uuid.New(),
+		ConnectionID:   "test-connection-id",
+		ReadTimeout:    100 * time.Millisecond,
+		ReadBufferSize: 65536,
+		Capabilities: messages.Capabilities{
+			Features:    []messages.Capability{messages.CapabilityCompression},
+			Compression: []messages.Compression{messages.CompressionZstd},
+		},
+	}
+
+	uplink := MockUplink{}
+	uplink.On("Send", mock.MatchedBy(func(msg messages.Message) bool {
+		if msg.Header.Type == messages.D {
+			if data, err := encoder.NewEncoderDecoder().DecodeDataMessage(msg.Message); err == nil && !data.Re {
+				msgChannel <- msg
+			}
+		}
+		return true
+	})).Return(nil)
+
+	underTest := NewForwarder(options, conn, &uplink, eventChannel)
+	assert.Nil(testing, underTest.Start())
+	defer underTest.Close()
+
+	text := []byte(strings.Repeat("GET /index.html HTTP/1.1\r\nHost: localhost\r\n\r\n", 300))
+
+	// WHEN
+	_, err = s_conn.Write(text)
+	assert.Nil(testing, err)
+
+	// THEN
+	received := []byte{}
+	sent := 0
+	for len(received) < len(text) {
+		msg := <-msgChannel
+		sent += len(msg.Message)
+		dm, err := encoder.NewEncoderDecoder().DecodeDataMessage(msg.Message)
+		assert.Nil(testing, err)
+		assert.Equal(testing, messages.CompressionZstd, dm.Compression)
+		data, err := compression.Decompress(dm.Compression, dm.Data)
+		assert.Nil(testing, err)
+		received = append(received, data...)
+	}
+	assert.Equal(testing, text, received)
+
+	// the window accounts for the compressed messages
+	window := underTest.(*forwarder).window.(*window)
+	window.mutex.Lock()
+	inFlight := window.currentSize
+	window.mutex.Unlock()
+	assert.Equal(testing, sent, inFlight)
+	assert.Less(testing, inFlight, len(text)/10)
+}
+
+func TestForwardingDecompressesToConnection(testing *testing.T) {
+	// GIVEN
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	assert.Nil(testing, err)
+	s_conn, _ := listener.Accept()
+	defer s_conn.Close()
+
+	eventChannel := make(chan AdapterEvent, 10)
+	options := ForwarderOptions{
+		LocalDeviceID: uuid.New(),
+		PeerDeviceID:  uuid.New(),
+		ConnectionID:  "test-connection-id",
+	}
+
+	uplink := MockUplink{}
+	uplink.On("Send", mock.Anything).Return(nil)
+
+	underTest := NewForwarder(options, conn, &uplink, eventChannel)
+	assert.Nil(testing, underTest.Start())
+	defer underTest.Close()
+
+	text := bytes.Repeat([]byte("SELECT * FROM users WHERE id = 1;\n"), 100)
+	compressor, err := compression.NewCompressor(messages.CompressionSnappy)
+	assert.Nil(testing, err)
+	compressed, algorithm := compressor.Compress(text)
+	assert.Equal(testing, messages.CompressionSnappy, algorithm)
+	dmEncoded, _ := encoder.NewEncoderDecoder().EncodeDataMessage(messages.DataMessage{
+		Seq:         0,
+		Data:        compressed,
+		Compression: algorithm,
+	})
+
+	// WHEN
+	_ = underTest.SendAsync(messages.Message{
+		Header:  messages.MessageHeader{Type: messages.D, CID: "test-connection-id"},
+		Message: dmEncoded,
+	})
+
+	// THEN
+	received := make([]byte, len(text))
+	_ = s_conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(s_conn, received)
+	assert.Nil(testing, err)
+	assert.Equal(testing, text, received)
+}
+
+// BenchmarkForwardingToUplink measures the upward path of a forwarder: reading a chunk of 32 KB
+// from the connection, encoding it and sending it to the uplink, which the peer acknowledges.
+func BenchmarkForwardingToUplink(b *testing.B) {
+	conn, app := net.Pipe()
+	defer app.Close()
+	uplink := &ackingUplink{acks: make(chan uint64, 16)}
+	options := ForwarderOptions{
+		LocalDeviceID:  uuid.New(),
+		PeerDeviceID:   uuid.New(),
+		ConnectionID:   "benchmark",
+		ReadTimeout:    time.Second,
+		ReadBufferSize: 64 * 1024,
+	}
+	underTest := NewForwarder(options, conn, uplink, make(chan AdapterEvent, 10))
+	defer underTest.Close()
+	if err := underTest.Start(); err != nil {
+		b.Fatal(err)
+	}
+	chunk := make([]byte, 32*1024)
+
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := app.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+		if err := underTest.Ack(<-uplink.acks, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// ackingUplink passes the sequence numbers of the data messages it is sent to acks, as if they
+// were acknowledged by the peer.
+type ackingUplink struct {
+	MockUplink
+	encoder encoder.EncoderDecoder
+	acks    chan uint64
+}
+
+func (u *ackingUplink) Send(msg messages.Message) error {
+	if msg.Header.Type != messages.D {
+		return nil
+	}
+	if u.encoder == nil {
+		u.encoder = encoder.NewEncoderDecoder()
+	}
+	dm, err := u.encoder.DecodeDataMessage(msg.Message)
+	if err != nil || dm.Re {
+		return err
+	}
+	u.acks <- dm.Seq
+	return nil
+}
@@ -0,0 +1,50 @@
+package adapter
+
+import (
+	"fmt"
+
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
+)
+
+// sealingUplink encrypts the payloads of the data and ack messages of a Noise encrypted
+// connection. Retransmissions are sealed again, with a new nonce.
+type sealingUplink struct {
+	uplink.Uplink
+
+	session *ptls.NoiseSession
+}
+
+// sealUplink returns the uplink for the messages of the connection, which seals them if the
+// connection is Noise encrypted.
+func sealUplink(u uplink.Uplink, session *ptls.NoiseSession) uplink.Uplink {
+	if session == nil {
+		return u
+	}
+	return &sealingUplink{Uplink: u, session: session}
+}
+
+func (u *sealingUplink) Send(msg messages.Message) error {
+	if isSealed(msg.Header.Type) {
+		msg.Message = u.session.Seal(msg.Header.AssociatedData(), msg.Message)
+	}
+	return u.Uplink.Send(msg)
+}
+
+// openMessage decrypts the payload of a data or ack message of a Noise encrypted connection.
+func openMessage(session *ptls.NoiseSession, msg messages.Message) (messages.Message, error) {
+	if session == nil || !isSealed(msg.Header.Type) {
+		return msg, nil
+	}
+	payload, err := session.Open(msg.Header.AssociatedData(), msg.Message)
+	if err != nil {
+		return msg, fmt.Errorf("dropping %s message: %w", msg.Header.Type, err)
+	}
+	msg.Message = payload
+	return msg, nil
+}
+
+func isSealed(messageType messages.MessageType) bool {
+	return messageType == messages.D || messageType == messages.DA
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/mh-dx/portier-cli/internal/portier/relay/clock"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
@@ -17,6 +18,9 @@ import (
 type RtoHeapOptions struct {
 	// MaxQueueSize is the maximum number of items that can be queued
 	MaxQueueSize int
+
+	// Clock drives the retransmission timers, defaults to the wall clock
+	Clock clock.Clock
 }
 
 type RtoHeap interface {
@@ -36,7 +40,8 @@ type rtoHeap struct {
 	encoder       encoder.EncoderDecoder
 	options       RtoHeapOptions
 	queue         priorityQueue
-	ticker        *time.Ticker
+	clock         clock.Clock
+	ticker        clock.Ticker
 	updateChannel chan bool
 	ctx           context.Context
 	lock          sync.Mutex
@@ -51,13 +56,15 @@ func NewDefaultRtoHeapOptions() RtoHeapOptions {
 func NewRtoHeap(ctx context.Context, options RtoHeapOptions, uplink uplink.Uplink, encoder encoder.EncoderDecoder) RtoHeap {
 	pq := make(priorityQueue, 0)
 	heap.Init(&pq)
+	clk := clock.OrReal(options.Clock)
 
 	rtoHeap := &rtoHeap{
 		uplink:        uplink,
 		encoder:       encoder,
 		options:       options,
 		queue:         pq,
-		ticker:        time.NewTicker(time.Millisecond * 20),
+		clock:         clk,
+		ticker:        clk.NewTicker(time.Millisecond * 20),
 		updateChannel: make(chan bool, 1),
 		ctx:           ctx,
 		lock:          sync.Mutex{},
@@ -69,6 +76,8 @@ func NewRtoHeap(ctx context.Context, options RtoHeapOptions, uplink uplink.Uplin
 }
 
 func (r *rtoHeap) Add(newItem *windowitem.WindowItem) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if len(r.queue) >= r.options.MaxQueueSize {
 		return errors.New("queue is full")
 	}
@@ -76,9 +85,7 @@ func (r *rtoHeap) Add(newItem *windowitem.WindowItem) error {
 	wrapper := &item{
 		value: newItem,
 	}
-	r.lock.Lock()
 	heap.Push(&r.queue, wrapper)
-	r.lock.Unlock()
 	return nil
 }
 
@@ -86,15 +93,11 @@ func (r *rtoHeap) process() {
 	for {
 
 		select {
-		case <-r.ticker.C:
+		case <-r.ticker.C():
 			// Ticker expired, check the items and resend if necessary
 
 			// iterate over every item in the queue and remove it when it is acked
 			// or resend it when it is not acked
-			if len(r.queue) == 0 {
-				continue
-			}
-
 			r.lock.Lock()
 			for i := 0; i < len(r.queue); i++ {
 				item := r.queue[i].value
@@ -103,40 +106,35 @@ func (r *rtoHeap) process() {
 					i--
 					continue
 				}
-				if item.Rto.Before(time.Now()) {
+				if item.Rto.Before(r.clock.Now()) {
 					// resend the message
 					//log.Printf("Resending message: %d", item.Seq)
-					// decode the datamessage and update the retransmitted flag
-					dataMsg, err := r.encoder.DecodeDataMessage(item.Msg.Message)
-					if err != nil {
-						log.Println("Error decoding data message")
-						continue
-					}
-					dataMsg.Re = true
-					// encode the datamessage
-					dmBytes, err := r.encoder.EncodeDataMessage(dataMsg)
-					if err != nil {
-						log.Println("Error encoding data message")
-						continue
-					}
-					// wrap the data in a message
-					msg := messages.Message{
-						Header:  item.Msg.Header,
-						Message: dmBytes,
+					if item.Retransmission.Message == nil {
+						// encode the datamessage with the retransmitted flag once
+						dmBytes, err := r.encoder.MarkRetransmitted(item.Msg.Message)
+						if err != nil {
+							log.Println("Error encoding data message")
+							continue
+						}
+						item.Retransmission = messages.Message{
+							Header:  item.Msg.Header,
+							Message: dmBytes,
+						}
 					}
 
-					err = r.uplink.Send(msg)
+					err := r.uplink.Send(item.Retransmission)
 					if err != nil {
 						log.Printf("Error sending message: %s\n", err)
 					}
 
-					item.Rto = time.Now().Add(item.RtoDuration)
+					item.Rto = r.clock.Now().Add(item.RtoDuration)
 				}
 			}
 			r.lock.Unlock()
 
 		case <-r.ctx.Done():
 			log.Printf("RTO heap shutting down")
+			r.ticker.Stop()
 			return
 		}
 	}
@@ -9,7 +9,9 @@ import (
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
 	windowitem "github.com/mh-dx/portier-cli/internal/portier/relay/window_item"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestInsertAndAck(testing *testing.T) {
@@ -22,8 +24,7 @@ func TestInsertAndAck(testing *testing.T) {
 		Message: data,
 	}
 	encoderDecoder := new(encoder.MockEncoderDecoder)
-	encoderDecoder.On("EncodeDataMessage", mock.Anything).Return([]byte("dataMsg"), nil)
-	encoderDecoder.On("DecodeDataMessage", mock.Anything).Return(messages.DataMessage{}, nil)
+	encoderDecoder.On("MarkRetransmitted", mock.Anything).Return([]byte("dataMsg"), nil)
 	options := RtoHeapOptions{
 		MaxQueueSize: 1,
 	}
@@ -80,11 +81,49 @@ func TestInsertAndAck(testing *testing.T) {
 
 	mockUplink.AssertNumberOfCalls(testing, "Send", 1)
 	mockUplink.AssertExpectations(testing)
-	encoderDecoder.AssertNumberOfCalls(testing, "EncodeDataMessage", 1)
-	encoderDecoder.AssertNumberOfCalls(testing, "DecodeDataMessage", 1)
+	encoderDecoder.AssertNumberOfCalls(testing, "MarkRetransmitted", 1)
 	encoderDecoder.AssertExpectations(testing)
 }
 
+func TestRetransmissionIsEncodedOnce(t *testing.T) {
+	// GIVEN
+	encoderDecoder := encoder.NewEncoderDecoder()
+	dmBytes, err := encoderDecoder.EncodeDataMessage(messages.DataMessage{Seq: 7, Data: []byte("data")})
+	require.NoError(t, err)
+	sent := make(chan messages.Message, 10)
+	mockUplink := new(MockUplink)
+	mockUplink.On("Send", mock.Anything).Run(func(args mock.Arguments) {
+		sent <- args.Get(0).(messages.Message)
+	}).Return(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	underTest := NewRtoHeap(ctx, NewDefaultRtoHeapOptions(), mockUplink, encoderDecoder)
+	rtoDuration := 10 * time.Millisecond
+	item := &windowitem.WindowItem{
+		Msg:         messages.Message{Message: dmBytes},
+		Seq:         7,
+		RtoDuration: rtoDuration,
+		Rto:         time.Now().Add(rtoDuration),
+	}
+
+	// WHEN
+	require.NoError(t, underTest.Add(item))
+
+	// THEN both retransmissions send the same frame, with the retransmitted flag set
+	first := <-sent
+	second := <-sent
+	assert.Same(t, &first.Message[0], &second.Message[0])
+	assert.Equal(t, messages.DataMessage{Seq: 7, Re: true, Data: []byte("data")}, mustDecode(t, encoderDecoder, first.Message))
+	assert.Equal(t, messages.DataMessage{Seq: 7, Data: []byte("data")}, mustDecode(t, encoderDecoder, item.Msg.Message))
+}
+
+func mustDecode(t *testing.T, encoderDecoder encoder.EncoderDecoder, dmBytes []byte) messages.DataMessage {
+	t.Helper()
+	dm, err := encoderDecoder.DecodeDataMessage(dmBytes)
+	require.NoError(t, err)
+	return dm
+}
+
 type MockUplink struct {
 	mock.Mock
 }
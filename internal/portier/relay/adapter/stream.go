@@ -0,0 +1,207 @@
+package adapter
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+)
+
+// errStreamBufferFull is returned when the peer sends more data than its window allows.
+var errStreamBufferFull = errors.New("stream buffer full, the peer exceeded its window")
+
+// streamConn is a net.Conn view of the relayed byte stream of a connection. Writes are sent to
+// the peer as data messages, reads return the data of received messages in sequence order. A
+// security layer like TLS runs directly on top of it, without copying the stream through an
+// intermediate pipe.
+//
+// Received data is buffered without blocking the forwarder and acknowledged once it is read, so
+// a slow reader throttles the peer through its window. The buffer is bounded by the window.
+//
+// Deadlines are not supported, the stream ends when the forwarder closes it.
+type streamConn struct {
+	// send sends data to the peer, in order and reliably
+	send func([]byte) error
+
+	// maxMessageSize is the maximum size of the data of a message
+	maxMessageSize int
+
+	// maxBuffered is the maximum number of received bytes that are not read yet
+	maxBuffered int
+
+	// mutex guards incoming, buffered and current
+	mutex sync.Mutex
+
+	// incoming holds the received chunks that are not read yet, in sequence order
+	incoming []streamChunk
+
+	// buffered is the number of bytes of incoming and current
+	buffered int
+
+	// current is the chunk being read, its data is the unread rest
+	current *streamChunk
+
+	// received is signalled when a chunk is added to incoming
+	received chan struct{}
+
+	// readMutex serializes reads
+	readMutex sync.Mutex
+
+	// closed is closed when the stream is closed
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	addr streamAddr
+}
+
+// streamChunk is the data of a received message, acknowledged once it is read.
+type streamChunk struct {
+	data []byte
+	size int
+	seq  uint64
+	ack  func()
+}
+
+func newStreamConn(connectionID messages.ConnectionID, maxMessageSize int, maxBuffered int, send func([]byte) error) *streamConn {
+	if maxMessageSize <= 0 {
+		maxMessageSize = 4096
+	}
+	return &streamConn{
+		send:           send,
+		maxMessageSize: maxMessageSize,
+		maxBuffered:    maxBuffered,
+		received:       make(chan struct{}, 1),
+		closed:         make(chan struct{}),
+		addr:           streamAddr(connectionID),
+	}
+}
+
+// deliver queues the data of the message seq for reading, ack is called once it is read. Does not
+// block, fails if the data exceeds the buffer.
+func (s *streamConn) deliver(data []byte, seq uint64, ack func()) error {
+	select {
+	case <-s.closed:
+		return net.ErrClosed
+	default:
+	}
+	if len(data) == 0 {
+		if ack != nil {
+			ack()
+		}
+		return nil
+	}
+
+	s.mutex.Lock()
+	if s.buffered+len(data) > s.maxBuffered {
+		s.mutex.Unlock()
+		return errStreamBufferFull
+	}
+	s.incoming = append(s.incoming, streamChunk{data: data, size: len(data), seq: seq, ack: ack})
+	s.buffered += len(data)
+	s.mutex.Unlock()
+
+	select {
+	case s.received <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// unread returns true if the data of the message seq is buffered and not read yet.
+func (s *streamConn) unread(seq uint64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.current != nil {
+		return seq >= s.current.seq
+	}
+	return len(s.incoming) > 0 && seq >= s.incoming[0].seq
+}
+
+func (s *streamConn) Read(b []byte) (int, error) {
+	s.readMutex.Lock()
+	defer s.readMutex.Unlock()
+
+	chunk, err := s.next()
+	if err != nil {
+		return 0, err
+	}
+	n := copy(b, chunk.data)
+
+	s.mutex.Lock()
+	chunk.data = chunk.data[n:]
+	read := len(chunk.data) == 0
+	if read {
+		s.current = nil
+		s.buffered -= chunk.size
+	}
+	s.mutex.Unlock()
+
+	if read && chunk.ack != nil {
+		chunk.ack()
+	}
+	return n, nil
+}
+
+// next returns the chunk with unread data, waits for one if nothing is buffered.
+func (s *streamConn) next() (*streamChunk, error) {
+	for {
+		s.mutex.Lock()
+		if s.current == nil && len(s.incoming) > 0 {
+			chunk := s.incoming[0]
+			s.current = &chunk
+			s.incoming = s.incoming[1:]
+		}
+		current := s.current
+		s.mutex.Unlock()
+		if current != nil {
+			return current, nil
+		}
+
+		select {
+		case <-s.received:
+		case <-s.closed:
+			return nil, io.EOF
+		}
+	}
+}
+
+func (s *streamConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		select {
+		case <-s.closed:
+			return written, net.ErrClosed
+		default:
+		}
+		end := written + s.maxMessageSize
+		if end > len(b) {
+			end = len(b)
+		}
+		// the data is encoded into a message before send returns, so b is not retained
+		if err := s.send(b[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (s *streamConn) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *streamConn) LocalAddr() net.Addr                { return s.addr }
+func (s *streamConn) RemoteAddr() net.Addr               { return s.addr }
+func (s *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (s *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (s *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// streamAddr is the address of a relayed stream, the connection ID.
+type streamAddr messages.ConnectionID
+
+func (a streamAddr) Network() string { return "portier" }
+func (a streamAddr) String() string  { return string(a) }
@@ -0,0 +1,356 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamConnSplitsWritesIntoMessages(t *testing.T) {
+	// GIVEN
+	var sent [][]byte
+	underTest := newStreamConn("test-connection-id", 4, 1024, func(data []byte) error {
+		sent = append(sent, append([]byte{}, data...))
+		return nil
+	})
+
+	// WHEN
+	n, err := underTest.Write([]byte("0123456789"))
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	require.Equal(t, [][]byte{[]byte("0123"), []byte("4567"), []byte("89")}, sent)
+}
+
+func TestStreamConnReadsDeliveredDataUntilClosed(t *testing.T) {
+	// GIVEN
+	underTest := newStreamConn("test-connection-id", 4, 1024, func(data []byte) error { return nil })
+	require.NoError(t, underTest.deliver([]byte("hello "), 0, nil))
+	require.NoError(t, underTest.deliver([]byte("world"), 1, nil))
+
+	// WHEN
+	buf := make([]byte, 11)
+	_, err := io.ReadFull(underTest, buf)
+	require.NoError(t, err)
+	_ = underTest.Close()
+	_, errAfterClose := underTest.Read(buf)
+
+	// THEN
+	require.Equal(t, "hello world", string(buf))
+	require.ErrorIs(t, errAfterClose, io.EOF)
+	require.ErrorIs(t, underTest.deliver([]byte("late"), 2, nil), net.ErrClosed)
+}
+
+func TestStreamConnAcknowledgesDataOnceRead(t *testing.T) {
+	// GIVEN
+	underTest := newStreamConn("test-connection-id", 4, 10, func(data []byte) error { return nil })
+	var acked []uint64
+	ack := func(seq uint64) func() { return func() { acked = append(acked, seq) } }
+
+	// WHEN the buffer is filled without a reader
+	require.NoError(t, underTest.deliver([]byte("hello"), 0, ack(0)))
+	require.NoError(t, underTest.deliver([]byte("world"), 1, ack(1)))
+	errFull := underTest.deliver([]byte("!"), 2, ack(2))
+
+	// THEN nothing is acknowledged before it is read
+	require.ErrorIs(t, errFull, errStreamBufferFull)
+	require.Empty(t, acked)
+	require.True(t, underTest.unread(0))
+
+	buf := make([]byte, 3)
+	_, err := io.ReadFull(underTest, buf)
+	require.NoError(t, err)
+	require.Empty(t, acked)
+	require.True(t, underTest.unread(0))
+
+	_, err = io.ReadFull(underTest, buf)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, acked)
+	require.False(t, underTest.unread(0))
+	require.True(t, underTest.unread(1))
+	require.NoError(t, underTest.deliver([]byte("!"), 2, ack(2)))
+}
+
+func TestForwarderRunsTLSOverTheRelayedStream(t *testing.T) {
+	// GIVEN
+	client, server := newForwarderPair(t, wrapStream)
+	message := make([]byte, 256*1024)
+	_, _ = rand.Read(message)
+
+	// WHEN
+	go func() { _, _ = client.Write(message) }()
+	received := make([]byte, len(message))
+	_ = server.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err := io.ReadFull(server, received)
+
+	// THEN
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(message, received))
+}
+
+func TestForwarderClosesConnectionOnFailedHandshake(t *testing.T) {
+	// GIVEN
+	client := &forwarderSide{id: uuid.New(), client: true}
+	server := &forwarderSide{id: uuid.New()}
+	newTLSDevices(t, client, server)
+	_, clientConn := tcpPair(t)
+	_, serverConn := tcpPair(t)
+	options := pairOptions(client.id, server.id)
+	options.WrapStream = func(stream net.Conn) (net.Conn, error) { return client.decorate(stream, server) }
+	options.Handshake = func(secure net.Conn) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		return secure.(*tls.Conn).HandshakeContext(ctx)
+	}
+
+	// the peer never answers
+	events := make(chan AdapterEvent, 100)
+	peer := NewForwarder(pairOptions(server.id, client.id), serverConn, &loopbackUplink{}, events)
+	forwarder := NewForwarder(options, clientConn, &loopbackUplink{peer: peer}, events)
+	t.Cleanup(func() { _ = forwarder.Close() })
+
+	// WHEN
+	require.NoError(t, forwarder.Start())
+
+	// THEN
+	select {
+	case event := <-events:
+		require.Equal(t, Error, event.Type)
+		require.ErrorIs(t, event.Error, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed handshake was not reported")
+	}
+}
+
+// BenchmarkTLSThroughput measures the throughput of a TLS connection between two forwarders,
+// with TLS running over the relayed stream, and over a net.Pipe bridge in front of the
+// forwarder as before.
+func BenchmarkTLSThroughput(b *testing.B) {
+	for _, mode := range benchmarkModes {
+		b.Run(mode.name, func(b *testing.B) {
+			client, server := newForwarderPair(b, mode.wrap)
+			chunk := make([]byte, 32*1024)
+			_, _ = rand.Read(chunk)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := client.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			buf := make([]byte, len(chunk))
+			for i := 0; i < b.N; i++ {
+				if _, err := io.ReadFull(server, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkTLSLatency measures the round trip time of a small message echoed by the server.
+func BenchmarkTLSLatency(b *testing.B) {
+	for _, mode := range benchmarkModes {
+		b.Run(mode.name, func(b *testing.B) {
+			client, server := newForwarderPair(b, mode.wrap)
+			go func() { _, _ = io.Copy(server, server) }()
+			ping := make([]byte, 64)
+			pong := make([]byte, len(ping))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(ping); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(client, pong); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+var benchmarkModes = []struct {
+	name string
+	wrap func(testing.TB, *forwarderSide, *forwarderSide)
+}{
+	{"plain", nil},
+	{"stream", wrapStream},
+	{"pipe", wrapPipe},
+}
+
+// forwarderSide is one side of a forwarder pair: the forwarder options, and the connection
+// that the forwarder bridges.
+type forwarderSide struct {
+	id      uuid.UUID
+	ptls    ptls.PTLS
+	options ForwarderOptions
+	conn    net.Conn
+	client  bool
+}
+
+func (s *forwarderSide) decorate(stream net.Conn, peer *forwarderSide) (net.Conn, error) {
+	if s.client {
+		return s.ptls.CreateClient(stream, peer.id)
+	}
+	return s.ptls.CreateServer(stream, peer.id)
+}
+
+// wrapStream runs TLS directly over the relayed stream of the forwarders.
+func wrapStream(tb testing.TB, client, server *forwarderSide) {
+	newTLSDevices(tb, client, server)
+	client.options.WrapStream = func(stream net.Conn) (net.Conn, error) { return client.decorate(stream, server) }
+	server.options.WrapStream = func(stream net.Conn) (net.Conn, error) { return server.decorate(stream, client) }
+}
+
+// wrapPipe puts TLS in front of the forwarders through a net.Pipe and two copying goroutines,
+// the way connections were bridged before the forwarder exposed its stream.
+func wrapPipe(tb testing.TB, client, server *forwarderSide) {
+	newTLSDevices(tb, client, server)
+	for _, side := range []*forwarderSide{client, server} {
+		peer := server
+		if side == server {
+			peer = client
+		}
+		conn1, conn2 := net.Pipe()
+		tlsConn, err := side.decorate(conn1, peer)
+		require.NoError(tb, err)
+		local := side.conn
+		go func() {
+			_, _ = io.Copy(tlsConn, local)
+			_ = tlsConn.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(local, tlsConn)
+			_ = local.Close()
+		}()
+		side.conn = conn2
+	}
+}
+
+// newTLSDevices creates certificates for both sides, each trusting the other one.
+func newTLSDevices(tb testing.TB, sides ...*forwarderSide) {
+	certManager := ptls.NewPTLSCertificateManager()
+	dirs := make([]string, len(sides))
+	fingerprints := make([]string, len(sides))
+	for i, side := range sides {
+		dirs[i] = tb.TempDir()
+		cert, key, err := certManager.CreateCertificate(side.id.String())
+		require.NoError(tb, err)
+		certPEM, keyPEM, err := certManager.ConvertCertificateToPEM(cert, key)
+		require.NoError(tb, err)
+		require.NoError(tb, writeFile(filepath.Join(dirs[i], "cert.pem"), certPEM))
+		require.NoError(tb, writeFile(filepath.Join(dirs[i], "key.pem"), keyPEM))
+		fingerprints[i], err = certManager.GetFingerprint(cert)
+		require.NoError(tb, err)
+	}
+	for i, side := range sides {
+		knownHosts := ptls.NewKnownHosts()
+		for j, peer := range sides {
+			if i != j {
+				knownHosts.Add(peer.id.String(), ptls.KnownFingerprint{Fingerprint: fingerprints[j], Source: ptls.SourceManual}, 0, time.Now())
+			}
+		}
+		require.NoError(tb, knownHosts.Save(filepath.Join(dirs[i], "known_hosts")))
+		side.ptls = ptls.NewPTLS(true, filepath.Join(dirs[i], "cert.pem"), filepath.Join(dirs[i], "key.pem"), filepath.Join(dirs[i], "cacert.pem"), filepath.Join(dirs[i], "known_hosts"), nil)
+	}
+}
+
+// newForwarderPair connects two forwarders through a loopback uplink. Returns the application
+// ends of the bridged connections: data written to one is read from the other.
+func newForwarderPair(tb testing.TB, wrap func(testing.TB, *forwarderSide, *forwarderSide)) (net.Conn, net.Conn) {
+	clientID, serverID := uuid.New(), uuid.New()
+	clientApp, clientConn := tcpPair(tb)
+	serverApp, serverConn := tcpPair(tb)
+	client := &forwarderSide{id: clientID, conn: clientConn, client: true, options: pairOptions(clientID, serverID)}
+	server := &forwarderSide{id: serverID, conn: serverConn, options: pairOptions(serverID, clientID)}
+	if wrap != nil {
+		wrap(tb, client, server)
+	}
+
+	events := make(chan AdapterEvent, 100)
+	clientUplink, serverUplink := &loopbackUplink{}, &loopbackUplink{}
+	clientForwarder := NewForwarder(client.options, client.conn, clientUplink, events)
+	serverForwarder := NewForwarder(server.options, server.conn, serverUplink, events)
+	clientUplink.peer, serverUplink.peer = serverForwarder, clientForwarder
+	require.NoError(tb, clientForwarder.Start())
+	require.NoError(tb, serverForwarder.Start())
+	tb.Cleanup(func() {
+		_ = clientForwarder.Close()
+		_ = serverForwarder.Close()
+	})
+	return clientApp, serverApp
+}
+
+func pairOptions(local, peer uuid.UUID) ForwarderOptions {
+	return ForwarderOptions{
+		LocalDeviceID:  local,
+		PeerDeviceID:   peer,
+		ConnectionID:   "test-connection-id",
+		ReadTimeout:    100 * time.Millisecond,
+		ReadBufferSize: 32 * 1024,
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(tb, err)
+	accepted, err := listener.Accept()
+	require.NoError(tb, err)
+	tb.Cleanup(func() {
+		_ = dialed.Close()
+		_ = accepted.Close()
+	})
+	return dialed, accepted
+}
+
+// loopbackUplink delivers data messages and acks directly to the peer forwarder.
+type loopbackUplink struct {
+	peer Forwarder
+}
+
+func (u *loopbackUplink) Connect() (<-chan messages.Message, error) { return nil, nil }
+
+func (u *loopbackUplink) Send(msg messages.Message) error {
+	switch msg.Header.Type {
+	case messages.D:
+		return u.peer.SendAsync(msg)
+	case messages.DA:
+		ack, err := encoder.NewEncoderDecoder().DecodeDataAckMessage(msg.Message)
+		if err != nil {
+			return err
+		}
+		return u.peer.Ack(ack.Seq, ack.Re)
+	}
+	return nil
+}
+
+func (u *loopbackUplink) Close() error { return nil }
+
+func (u *loopbackUplink) Events() <-chan uplink.Event { return nil }
+
+func writeFile(path string, data []byte) error {
+	return os.WriteFile(path, data, 0600)
+}
@@ -5,6 +5,7 @@ import (
 	"net/url"
 
 	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
 	"github.com/stretchr/testify/mock"
@@ -36,6 +37,9 @@ func (m *MockUplink) Events() <-chan uplink.Event {
 
 type MockPTLS struct {
 	mock.Mock
+
+	// learned and forgotten count the Noise peers learned and forgotten with LearnNoisePeer
+	learned, forgotten int
 }
 
 func (m *MockPTLS) TestEndpointURL(endpoint url.URL) bool {
@@ -43,12 +47,39 @@ func (m *MockPTLS) TestEndpointURL(endpoint url.URL) bool {
 	return args.Bool(0)
 }
 
-func (m *MockPTLS) CreateClientAndBridge(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, func() error, error) {
-	args := m.Called(conn, peerDeviceID)
-	return args.Get(0).(net.Conn), args.Get(1).(func() error), args.Error(2)
+func (m *MockPTLS) Negotiate(endpoint url.URL, requested *bool) (bool, error) {
+	args := m.Called(endpoint, requested)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockPTLS) CreateClient(stream net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
+	args := m.Called(stream, peerDeviceID)
+	return args.Get(0).(net.Conn), args.Error(1)
 }
 
-func (m *MockPTLS) CreateServerAndBridge(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
-	args := m.Called(conn, peerDeviceID)
+func (m *MockPTLS) CreateServer(stream net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
+	args := m.Called(stream, peerDeviceID)
 	return args.Get(0).(net.Conn), args.Error(1)
 }
+
+func (m *MockPTLS) Handshake(conn net.Conn) error {
+	return nil
+}
+
+// the mock devices do not accept Noise
+func (m *MockPTLS) NoiseCertificate() ([]byte, error) {
+	return nil, ptls.ErrNoiseUnavailable
+}
+
+func (m *MockPTLS) LearnNoisePeer(peerDeviceID uuid.UUID, certificate []byte, conn net.Conn) error {
+	if len(certificate) == 0 {
+		m.forgotten++
+	} else {
+		m.learned++
+	}
+	return nil
+}
+
+func (m *MockPTLS) NewNoiseHandshake(peerDeviceID uuid.UUID, initiator bool) (*ptls.NoiseHandshake, error) {
+	return nil, ptls.ErrNoiseUnavailable
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/mh-dx/portier-cli/internal/portier/relay/adapter/rto_heap"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/adapter/rtt"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/clock"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
@@ -53,6 +54,9 @@ type WindowOptions struct {
 
 	// HistSize is the size of the sliding window histogram
 	RTTHistSize int
+
+	// Clock measures RTTs and drives the retransmission timers, defaults to the wall clock
+	Clock clock.Clock
 }
 
 type Window interface {
@@ -79,7 +83,8 @@ type window struct {
 	uplink         uplink.Uplink
 	stats          *rtt.TCPStats
 	rtoHeap        rto_heap.RtoHeap
-	baseRTTTicker  *time.Ticker
+	baseRTTTicker  clock.Ticker
+	clock          clock.Clock
 }
 
 func NewDefaultWindowOptions() WindowOptions {
@@ -100,7 +105,9 @@ func NewDefaultWindowOptions() WindowOptions {
 }
 
 func NewWindow(ctx context.Context, options WindowOptions, uplink uplink.Uplink, encoderDecoder encoder.EncoderDecoder) Window {
-	rtoHeap := rto_heap.NewRtoHeap(ctx, rto_heap.NewDefaultRtoHeapOptions(), uplink, encoderDecoder)
+	rtoHeapOptions := rto_heap.NewDefaultRtoHeapOptions()
+	rtoHeapOptions.Clock = options.Clock
+	rtoHeap := rto_heap.NewRtoHeap(ctx, rtoHeapOptions, uplink, encoderDecoder)
 	return newWindow(ctx, options, uplink, rtoHeap)
 }
 
@@ -109,7 +116,8 @@ func newWindow(ctx context.Context, options WindowOptions, uplink uplink.Uplink,
 
 	stats := rtt.NewTCPStats(options.InitialRTO, options.MinRTTVAR, options.EWMAAlpha, options.EWMABeta, options.MinRTO, options.MaxRTO, options.RTTFactor, options.RTTHistSize)
 
-	baseRTTTicker := time.NewTicker(1 * time.Minute)
+	clk := clock.OrReal(options.Clock)
+	baseRTTTicker := clk.NewTicker(1 * time.Minute)
 	window := &window{
 		options:        options,
 		currentSize:    0,
@@ -122,18 +130,23 @@ func newWindow(ctx context.Context, options WindowOptions, uplink uplink.Uplink,
 		stats:          &stats,
 		rtoHeap:        rtoHeap,
 		baseRTTTicker:  baseRTTTicker,
+		clock:          clk,
 	}
 
 	go func() {
 		for {
 			// update the base rtt
-			stats.UpdateHistory()
-			window.currentBaseRTT = stats.GetBaseRTT()
-			log.Printf("updated base rtt: %fms\n", window.currentBaseRTT/1_000_000.0)
+			mutex.Lock()
+			window.stats.UpdateHistory()
+			window.currentBaseRTT = window.stats.GetBaseRTT()
+			baseRTT := window.currentBaseRTT
+			mutex.Unlock()
+			log.Printf("updated base rtt: %fms\n", baseRTT/1_000_000.0)
 			select {
-			case <-baseRTTTicker.C:
+			case <-baseRTTTicker.C():
 				continue
 			case <-ctx.Done():
+				baseRTTTicker.Stop()
 				return
 			}
 		}
@@ -151,7 +164,7 @@ func (w *window) add(msg messages.Message, seq uint64) error {
 		w.cond.Wait()
 	}
 	w.currentSize += len(msg.Message)
-	now := time.Now()
+	now := w.clock.Now()
 	rtoDuration := time.Duration(w.stats.RTO) * time.Nanosecond
 	item := &windowitem.WindowItem{
 		Msg:           msg,
@@ -195,7 +208,7 @@ func (w *window) ack(seq uint64, retransmitted bool) error {
 	defer func() { w.cond.Signal() }()
 	item.Retransmitted = retransmitted
 	if !retransmitted {
-		rtt := float64(time.Since(item.Time))
+		rtt := float64(w.clock.Since(item.Time))
 		w.stats.UpdateRTT(rtt)
 		if w.currentBaseRTT < w.stats.SRTT-w.stats.RTTVAR {
 			newCap := math.Max(w.currentCap*w.options.WindowDownscaleFactor, w.options.InitialCap)
@@ -0,0 +1,107 @@
+package batch
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Subprotocol is the websocket subprotocol negotiating batching with the relay. A device requests
+// it when dialing, a relay supporting batches selects it. Once selected, every binary frame in
+// both directions is a batch, possibly of a single message.
+const Subprotocol = "portier.batch.v1"
+
+// ErrMalformed is returned for frames that are not a sequence of length prefixed messages.
+var ErrMalformed = errors.New("malformed batch")
+
+// Options define when a batch is flushed.
+type Options struct {
+	// MaxMessages is the number of messages at which a batch is flushed
+	MaxMessages int
+
+	// MaxSize is the size in bytes at which a batch is flushed
+	MaxSize int
+
+	// Delay is the time the first message of a batch waits for further messages
+	Delay time.Duration
+}
+
+// DefaultOptions returns the options of the uplink, a short delay keeps the latency of
+// interactive sessions unnoticeable.
+func DefaultOptions() Options {
+	return Options{
+		MaxMessages: 64,
+		MaxSize:     64 * 1024,
+		Delay:       2 * time.Millisecond,
+	}
+}
+
+// Batcher packs encoded messages into one frame. Each message is prefixed with its size as uvarint.
+type Batcher struct {
+	options Options
+	frame   []byte
+	count   int
+}
+
+// NewBatcher returns a batcher flushing according to options, zero values are taken from
+// DefaultOptions.
+func NewBatcher(options Options) *Batcher {
+	defaults := DefaultOptions()
+	if options.MaxMessages <= 0 {
+		options.MaxMessages = defaults.MaxMessages
+	}
+	if options.MaxSize <= 0 {
+		options.MaxSize = defaults.MaxSize
+	}
+	if options.Delay <= 0 {
+		options.Delay = defaults.Delay
+	}
+	return &Batcher{options: options}
+}
+
+// Options returns the options of the batcher.
+func (b *Batcher) Options() Options {
+	return b.options
+}
+
+// Add appends a message to the batch and returns true if the batch is full and has to be flushed.
+func (b *Batcher) Add(message []byte) bool {
+	b.frame = Append(b.frame, message)
+	b.count++
+	return b.count >= b.options.MaxMessages || len(b.frame) >= b.options.MaxSize
+}
+
+// Len returns the number of messages in the batch.
+func (b *Batcher) Len() int {
+	return b.count
+}
+
+// Flush returns the frame of the batch and starts a new one. The frame is valid until the next
+// call to Add, which reuses its memory.
+func (b *Batcher) Flush() []byte {
+	frame := b.frame
+	b.frame = frame[:0]
+	b.count = 0
+	return frame
+}
+
+// Append appends a message to a frame.
+func Append(frame []byte, message []byte) []byte {
+	frame = binary.AppendUvarint(frame, uint64(len(message)))
+	return append(frame, message...)
+}
+
+// Split returns the messages of a frame. The messages share the memory of the frame.
+func Split(frame []byte) ([][]byte, error) {
+	var messages [][]byte
+	for len(frame) > 0 {
+		size, n := binary.Uvarint(frame)
+		if n <= 0 || size > uint64(len(frame)-n) {
+			return messages, ErrMalformed
+		}
+		frame = frame[n:]
+		messages = append(messages, frame[:size:size])
+		frame = frame[size:]
+	}
+	return messages, nil
+}
@@ -0,0 +1,70 @@
+package batch
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitReturnsAppendedMessages(t *testing.T) {
+	// GIVEN
+	messages := [][]byte{[]byte("DA"), {}, bytes.Repeat([]byte{'x'}, 300)}
+	var frame []byte
+	for _, message := range messages {
+		frame = Append(frame, message)
+	}
+
+	// WHEN
+	actual, err := Split(frame)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, messages, actual)
+}
+
+func TestSplitRejectsTruncatedFrame(t *testing.T) {
+	// GIVEN
+	frame := Append(Append(nil, []byte("first")), []byte("second"))
+
+	// WHEN
+	actual, err := Split(frame[:len(frame)-1])
+
+	// THEN the complete messages are returned
+	assert.ErrorIs(t, err, ErrMalformed)
+	assert.Equal(t, [][]byte{[]byte("first")}, actual)
+}
+
+func TestBatcherIsFullAtMaxMessages(t *testing.T) {
+	// GIVEN
+	underTest := NewBatcher(Options{MaxMessages: 3})
+
+	// WHEN / THEN
+	assert.False(t, underTest.Add([]byte("1")))
+	assert.False(t, underTest.Add([]byte("2")))
+	assert.True(t, underTest.Add([]byte("3")))
+	assert.Equal(t, 3, underTest.Len())
+
+	messages, err := Split(underTest.Flush())
+	require.NoError(t, err)
+	assert.Len(t, messages, 3)
+	assert.Zero(t, underTest.Len())
+}
+
+func TestBatcherIsFullAtMaxSize(t *testing.T) {
+	// GIVEN
+	underTest := NewBatcher(Options{MaxSize: 100})
+
+	// WHEN / THEN
+	assert.False(t, underTest.Add(make([]byte, 50)))
+	assert.True(t, underTest.Add(make([]byte, 50)))
+}
+
+func TestNewBatcherDefaultsOptions(t *testing.T) {
+	// WHEN
+	underTest := NewBatcher(Options{})
+
+	// THEN
+	assert.Equal(t, DefaultOptions(), underTest.Options())
+}
@@ -0,0 +1,34 @@
+package bufferpool
+
+import "sync"
+
+// MaxPooledSize is the capacity above which buffers are not returned to the pool, so that a
+// single large message does not pin its memory.
+const MaxPooledSize = 1 << 20
+
+// pool holds pointers to slices, putting a slice into the pool would allocate its header.
+var pool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0)
+		return &buf
+	},
+}
+
+// Get returns a buffer of length size, with the content of a previous user. Return it with Put
+// once its content is no longer referenced.
+func Get(size int) *[]byte {
+	buf := pool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+// Put returns a buffer to the pool.
+func Put(buf *[]byte) {
+	if cap(*buf) > MaxPooledSize {
+		return
+	}
+	pool.Put(buf)
+}
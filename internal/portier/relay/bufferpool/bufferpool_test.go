@@ -0,0 +1,29 @@
+package bufferpool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetReturnsBufferOfSize(t *testing.T) {
+	// GIVEN
+	Put(Get(16))
+
+	// WHEN
+	buf := Get(1024)
+
+	// THEN
+	assert.Len(t, *buf, 1024)
+}
+
+func TestPutDropsLargeBuffers(t *testing.T) {
+	// GIVEN
+	buf := Get(MaxPooledSize + 1)
+
+	// WHEN
+	Put(buf)
+
+	// THEN
+	assert.LessOrEqual(t, cap(*Get(0)), MaxPooledSize)
+}
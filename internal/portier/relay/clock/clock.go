@@ -0,0 +1,63 @@
+package clock
+
+import "time"
+
+// Clock is the source of time of the reliability layer. Production code uses Real, simulations
+// use a VirtualClock to run retransmission and congestion control in virtual time.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// Since returns the time elapsed since t
+	Since(t time.Time) time.Duration
+
+	// NewTicker returns a ticker that ticks every d
+	NewTicker(d time.Duration) Ticker
+
+	// AfterFunc calls f after d
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Ticker delivers ticks at intervals, like time.Ticker.
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered
+	C() <-chan time.Time
+
+	// Stop turns off the ticker
+	Stop()
+}
+
+// Timer is a pending call of AfterFunc, like time.Timer.
+type Timer interface {
+	// Stop prevents the call, it returns false if the call already happened or was stopped
+	Stop() bool
+}
+
+// Real is the wall clock.
+var Real Clock = realClock{}
+
+// OrReal returns c, or Real if c is nil.
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.ticker.C }
+
+func (t realTicker) Stop() { t.ticker.Stop() }
@@ -0,0 +1,203 @@
+package clock
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// VirtualClock is a Clock whose time only moves when it is advanced. Tickers and AfterFunc
+// calls fire in the order of their deadlines while the clock is advanced, so that timing
+// dependent behaviour can be simulated deterministically and faster than in real time.
+type VirtualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	seq     uint64
+	waiters waiterHeap
+}
+
+// NewVirtualClock creates a virtual clock set to start.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *VirtualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	w := &waiter{
+		clock:  c,
+		period: d,
+		ch:     make(chan time.Time, 1),
+	}
+	c.schedule(w, d)
+	return w
+}
+
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	w := &waiter{
+		clock: c,
+		f:     f,
+	}
+	c.schedule(w, d)
+	return timer{w}
+}
+
+// Advance moves the clock forward by d, firing all tickers and timers due until then.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for c.fireNext(end) {
+	}
+
+	c.mu.Lock()
+	if end.After(c.now) {
+		c.now = end
+	}
+	c.mu.Unlock()
+}
+
+// AdvanceToNext moves the clock to the next deadline and fires all tickers and timers due
+// at that time. It returns false if nothing is scheduled.
+func (c *VirtualClock) AdvanceToNext() bool {
+	next, ok := c.Next()
+	if !ok {
+		return false
+	}
+	for c.fireNext(next) {
+	}
+	return true
+}
+
+// Next returns the next deadline of a ticker or timer.
+func (c *VirtualClock) Next() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.waiters) == 0 {
+		return time.Time{}, false
+	}
+	return c.waiters[0].at, true
+}
+
+// fireNext fires the first waiter due until end and returns false if there is none.
+func (c *VirtualClock) fireNext(end time.Time) bool {
+	c.mu.Lock()
+	if len(c.waiters) == 0 || c.waiters[0].at.After(end) {
+		c.mu.Unlock()
+		return false
+	}
+	w := heap.Pop(&c.waiters).(*waiter)
+	if w.at.After(c.now) {
+		c.now = w.at
+	}
+	now := c.now
+	if w.period > 0 {
+		w.at = w.at.Add(w.period)
+		c.seq++
+		w.seq = c.seq
+		heap.Push(&c.waiters, w)
+	}
+	c.mu.Unlock()
+
+	if w.f != nil {
+		w.f()
+		return true
+	}
+	// like time.Ticker, ticks are dropped for slow receivers
+	select {
+	case w.ch <- now:
+	default:
+	}
+	return true
+}
+
+func (c *VirtualClock) schedule(w *waiter, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.at = c.now.Add(d)
+	c.seq++
+	w.seq = c.seq
+	heap.Push(&c.waiters, w)
+}
+
+// waiter is a ticker, if period is set, or an AfterFunc timer.
+type waiter struct {
+	clock  *VirtualClock
+	at     time.Time
+	seq    uint64
+	period time.Duration
+	ch     chan time.Time
+	f      func()
+	index  int
+}
+
+func (w *waiter) C() <-chan time.Time { return w.ch }
+
+func (w *waiter) Stop() {
+	w.stop()
+}
+
+// stop removes the waiter and returns false if it already fired or was stopped.
+func (w *waiter) stop() bool {
+	c := w.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if w.index < 0 {
+		return false
+	}
+	heap.Remove(&c.waiters, w.index)
+	return true
+}
+
+// timer adapts a waiter to the Timer interface, whose Stop reports success.
+type timer struct {
+	*waiter
+}
+
+func (t timer) Stop() bool { return t.waiter.stop() }
+
+// waiterHeap orders waiters by deadline, waiters with the same deadline in creation order.
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	w.index = -1
+	*h = old[:n-1]
+	return w
+}
@@ -0,0 +1,53 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualClockFiresInDeadlineOrder(t *testing.T) {
+	// GIVEN
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewVirtualClock(start)
+	calls := []string{}
+	c.AfterFunc(30*time.Millisecond, func() { calls = append(calls, "30ms") })
+	c.AfterFunc(10*time.Millisecond, func() { calls = append(calls, "10ms") })
+	stopped := c.AfterFunc(20*time.Millisecond, func() { calls = append(calls, "20ms") })
+	require.True(t, stopped.Stop())
+
+	// WHEN
+	c.Advance(25 * time.Millisecond)
+
+	// THEN
+	require.Equal(t, []string{"10ms"}, calls)
+	require.Equal(t, start.Add(25*time.Millisecond), c.Now())
+	require.True(t, c.AdvanceToNext())
+	require.Equal(t, []string{"10ms", "30ms"}, calls)
+	require.Equal(t, 30*time.Millisecond, c.Since(start))
+	require.False(t, c.AdvanceToNext())
+}
+
+func TestVirtualTicker(t *testing.T) {
+	// GIVEN
+	c := NewVirtualClock(time.Unix(0, 0))
+	ticker := c.NewTicker(10 * time.Millisecond)
+
+	// WHEN advancing by several periods without receiving
+	c.Advance(35 * time.Millisecond)
+
+	// THEN one tick is buffered, like for time.Ticker
+	require.Equal(t, time.Unix(0, 0).Add(10*time.Millisecond), <-ticker.C())
+	select {
+	case <-ticker.C():
+		t.Fatal("unexpected second tick")
+	default:
+	}
+
+	// AND the ticker continues until stopped
+	c.Advance(5 * time.Millisecond)
+	require.Equal(t, time.Unix(0, 0).Add(40*time.Millisecond), <-ticker.C())
+	ticker.Stop()
+	require.False(t, c.AdvanceToNext())
+}
@@ -0,0 +1,212 @@
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+)
+
+const (
+	// MinSize is the size below which data is sent uncompressed, the savings do not pay off
+	MinSize = 64
+
+	// MaxEntropy is the Shannon entropy in bits per byte above which data is considered
+	// compressed or encrypted already and sent uncompressed
+	MaxEntropy = 7.5
+
+	// entropySample is the number of bytes the entropy is estimated from
+	entropySample = 4096
+
+	// MaxDecompressedSize bounds the size of decompressed data, so that a malicious peer
+	// cannot exhaust the memory of this device with a small message
+	MaxDecompressedSize = 16 << 20
+)
+
+// Algorithms are the supported compression algorithms, in order of preference.
+var Algorithms = []messages.Compression{messages.CompressionZstd, messages.CompressionSnappy}
+
+// ErrTooLarge is returned for data that decompresses to more than MaxDecompressedSize.
+var ErrTooLarge = errors.New("decompressed data too large")
+
+// ParseAlgorithm returns the compression algorithm of the given name. An empty name or "none"
+// disables compression.
+func ParseAlgorithm(name string) (messages.Compression, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return messages.CompressionNone, nil
+	case string(messages.CompressionZstd):
+		return messages.CompressionZstd, nil
+	case string(messages.CompressionSnappy):
+		return messages.CompressionSnappy, nil
+	}
+	return messages.CompressionNone, fmt.Errorf("unsupported compression %q, use zstd, snappy or none", name)
+}
+
+// Stats count the data that passed a compressor.
+type Stats struct {
+	// Chunks is the number of chunks of data passed to the compressor
+	Chunks uint64
+
+	// Compressed is the number of chunks sent compressed
+	Compressed uint64
+
+	// Skipped is the number of chunks sent uncompressed, e.g. because of their entropy
+	Skipped uint64
+
+	// BytesIn is the size of the data before compression
+	BytesIn uint64
+
+	// BytesOut is the size of the data after compression, uncompressed chunks included
+	BytesOut uint64
+}
+
+// Saved returns the number of bytes saved by compression.
+func (s Stats) Saved() uint64 {
+	if s.BytesOut > s.BytesIn {
+		return 0
+	}
+	return s.BytesIn - s.BytesOut
+}
+
+// Ratio returns the size after compression relative to the size before, 1 if nothing passed.
+func (s Stats) Ratio() float64 {
+	if s.BytesIn == 0 {
+		return 1
+	}
+	return float64(s.BytesOut) / float64(s.BytesIn)
+}
+
+// counters are the atomically updated Stats.
+type counters struct {
+	chunks, compressed, skipped, bytesIn, bytesOut atomic.Uint64
+}
+
+func (c *counters) add(in, out int, compressed bool) {
+	c.chunks.Add(1)
+	if compressed {
+		c.compressed.Add(1)
+	} else {
+		c.skipped.Add(1)
+	}
+	c.bytesIn.Add(uint64(in))
+	c.bytesOut.Add(uint64(out))
+}
+
+func (c *counters) stats() Stats {
+	return Stats{
+		Chunks:     c.chunks.Load(),
+		Compressed: c.compressed.Load(),
+		Skipped:    c.skipped.Load(),
+		BytesIn:    c.bytesIn.Load(),
+		BytesOut:   c.bytesOut.Load(),
+	}
+}
+
+// totals are the stats of all compressors of this process.
+var totals counters
+
+// Totals returns the stats of all connections of this process.
+func Totals() Stats {
+	return totals.stats()
+}
+
+// shared zstd coders, both are safe for concurrent use with EncodeAll and DecodeAll
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxDecompressedSize), zstd.WithDecoderConcurrency(0))
+)
+
+// Compressor compresses the chunks of data of a connection. Each chunk is compressed on its own,
+// so that chunks can be retransmitted and reordered without state shared with the decompressor.
+type Compressor struct {
+	algorithm messages.Compression
+	counters  counters
+}
+
+// NewCompressor returns a compressor for the algorithm.
+func NewCompressor(algorithm messages.Compression) (*Compressor, error) {
+	switch algorithm {
+	case messages.CompressionZstd, messages.CompressionSnappy:
+		return &Compressor{algorithm: algorithm}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", algorithm)
+}
+
+// Algorithm returns the algorithm of the compressor.
+func (c *Compressor) Algorithm() messages.Compression {
+	return c.algorithm
+}
+
+// Compress returns the compressed data and the algorithm. Returns the data itself and
+// CompressionNone for small chunks, chunks with a high entropy and chunks that do not shrink.
+func (c *Compressor) Compress(data []byte) ([]byte, messages.Compression) {
+	if len(data) < MinSize || Entropy(data) > MaxEntropy {
+		c.record(len(data), len(data), false)
+		return data, messages.CompressionNone
+	}
+	var compressed []byte
+	switch c.algorithm {
+	case messages.CompressionZstd:
+		compressed = zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)))
+	case messages.CompressionSnappy:
+		compressed = snappy.Encode(nil, data)
+	}
+	if len(compressed) >= len(data) {
+		c.record(len(data), len(data), false)
+		return data, messages.CompressionNone
+	}
+	c.record(len(data), len(compressed), true)
+	return compressed, c.algorithm
+}
+
+func (c *Compressor) record(in, out int, compressed bool) {
+	c.counters.add(in, out, compressed)
+	totals.add(in, out, compressed)
+}
+
+// Stats returns the stats of the compressor.
+func (c *Compressor) Stats() Stats {
+	return c.counters.stats()
+}
+
+// Decompress returns the data of a chunk compressed with the algorithm.
+func Decompress(algorithm messages.Compression, data []byte) ([]byte, error) {
+	switch algorithm {
+	case messages.CompressionNone:
+		return data, nil
+	case messages.CompressionZstd:
+		decompressed, err := zstdDecoder.DecodeAll(data, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, ErrTooLarge
+		}
+		return decompressed, err
+	case messages.CompressionSnappy:
+		size, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > MaxDecompressedSize {
+			return nil, ErrTooLarge
+		}
+		return snappy.Decode(nil, data)
+	}
+	return nil, fmt.Errorf("unsupported compression %q", algorithm)
+}
+
+// Entropy returns the Shannon entropy of the data in bits per byte, estimated from its
+// beginning. Compressed and encrypted data is close to 8.
+func Entropy(data []byte) float64 {
+	if len(data) > entropySample {
+		data = data[:entropySample]
+	}
+	if len(data) == 0 {
+		return 0
+	}
+	return float64(compress.ShannonEntropyBits(data)) / float64(len(data))
+}
@@ -0,0 +1,106 @@
+package compression
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var text = []byte(strings.Repeat(`{"level":"info","msg":"request served","path":"/api/v1/devices","status":200}`+"\n", 100))
+
+func TestCompressAndDecompress(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		t.Run(string(algorithm), func(t *testing.T) {
+			// GIVEN
+			underTest, err := NewCompressor(algorithm)
+			require.NoError(t, err)
+
+			// WHEN
+			compressed, actual := underTest.Compress(text)
+
+			// THEN
+			assert.Equal(t, algorithm, actual)
+			assert.Less(t, len(compressed), len(text)/4)
+			decompressed, err := Decompress(actual, compressed)
+			require.NoError(t, err)
+			assert.Equal(t, text, decompressed)
+
+			stats := underTest.Stats()
+			assert.Equal(t, uint64(1), stats.Compressed)
+			assert.Equal(t, uint64(len(text)-len(compressed)), stats.Saved())
+			assert.GreaterOrEqual(t, Totals().Saved(), stats.Saved())
+		})
+	}
+}
+
+func TestCompressSkipsIncompressibleData(t *testing.T) {
+	// GIVEN
+	underTest, err := NewCompressor(messages.CompressionZstd)
+	require.NoError(t, err)
+	random := make([]byte, 8192)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+
+	// WHEN
+	randomResult, randomAlgorithm := underTest.Compress(random)
+	smallResult, smallAlgorithm := underTest.Compress([]byte("ping"))
+
+	// THEN
+	assert.Greater(t, Entropy(random), MaxEntropy)
+	assert.Equal(t, messages.CompressionNone, randomAlgorithm)
+	assert.Equal(t, random, randomResult)
+	assert.Equal(t, messages.CompressionNone, smallAlgorithm)
+	assert.Equal(t, []byte("ping"), smallResult)
+	stats := underTest.Stats()
+	assert.Equal(t, uint64(2), stats.Skipped)
+	assert.Equal(t, uint64(0), stats.Saved())
+}
+
+func TestDecompressRejectsTooLargeData(t *testing.T) {
+	// GIVEN
+	bomb := snappy.Encode(nil, make([]byte, MaxDecompressedSize+1))
+
+	// WHEN
+	_, err := Decompress(messages.CompressionSnappy, bomb)
+
+	// THEN
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	algorithm, err := ParseAlgorithm("ZSTD")
+	require.NoError(t, err)
+	assert.Equal(t, messages.CompressionZstd, algorithm)
+
+	algorithm, err = ParseAlgorithm("none")
+	require.NoError(t, err)
+	assert.Equal(t, messages.CompressionNone, algorithm)
+
+	_, err = ParseAlgorithm("gzip")
+	assert.ErrorContains(t, err, "unsupported compression")
+}
+
+func TestFrames(t *testing.T) {
+	// GIVEN
+	underTest, err := NewCompressor(messages.CompressionSnappy)
+	require.NoError(t, err)
+	stream := &bytes.Buffer{}
+	require.NoError(t, underTest.WriteFrame(stream, text))
+	require.NoError(t, underTest.WriteFrame(stream, []byte("ping")))
+	written := stream.Len()
+
+	// WHEN
+	out := &bytes.Buffer{}
+	err = CopyFrames(out, stream)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, append(append([]byte{}, text...), "ping"...), out.Bytes())
+	assert.Less(t, written, len(text)/4)
+}
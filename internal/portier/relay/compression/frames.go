@@ -0,0 +1,65 @@
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+)
+
+// frameHeaderSize is the size of the header of a frame: the code of the algorithm and the size of
+// the payload.
+const frameHeaderSize = 5
+
+// frameAlgorithms are the algorithms of frames, the index is the code in the header.
+var frameAlgorithms = []messages.Compression{messages.CompressionNone, messages.CompressionZstd, messages.CompressionSnappy}
+
+// WriteFrame compresses the data and writes it as one frame to a stream, e.g. a TLS connection
+// whose records do not compress once encrypted.
+func (c *Compressor) WriteFrame(w io.Writer, data []byte) error {
+	compressed, algorithm := c.Compress(data)
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(compressed))
+	for code, frameAlgorithm := range frameAlgorithms {
+		if frameAlgorithm == algorithm {
+			frame[0] = byte(code)
+		}
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(compressed)))
+	_, err := w.Write(append(frame, compressed...))
+	return err
+}
+
+// CopyFrames decompresses the frames read from src and writes their data to dst, until src
+// returns io.EOF.
+func CopyFrames(dst io.Writer, src io.Reader) error {
+	header := make([]byte, frameHeaderSize)
+	for {
+		if _, err := io.ReadFull(src, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		code := int(header[0])
+		if code >= len(frameAlgorithms) {
+			return fmt.Errorf("unsupported compression of frame: %d", code)
+		}
+		size := binary.BigEndian.Uint32(header[1:])
+		if size > MaxDecompressedSize {
+			return ErrTooLarge
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(src, payload); err != nil {
+			return err
+		}
+		data, err := Decompress(frameAlgorithms[code], payload)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(data); err != nil {
+			return err
+		}
+	}
+}
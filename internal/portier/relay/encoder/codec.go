@@ -0,0 +1,440 @@
+package encoder
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+)
+
+// The messages of the data path, Message, DataMessage and DataAckMessage, are encoded by hand in
+// exactly the layout msgpack produces for their structs: a map of the field names, uint64 in
+// 9 bytes, byte slices as bin and nil slices as nil. Peers decoding with msgpack cannot tell the
+// difference. Decoding takes the same fast path for messages in this layout and falls back to
+// msgpack for anything else, e.g. fields added by newer peers.
+
+// msgpack format codes
+const (
+	codeNil    = 0xc0
+	codeFalse  = 0xc2
+	codeTrue   = 0xc3
+	codeBin8   = 0xc4
+	codeBin16  = 0xc5
+	codeBin32  = 0xc6
+	codeUint8  = 0xcc
+	codeUint16 = 0xcd
+	codeUint32 = 0xce
+	codeUint64 = 0xcf
+	codeStr8   = 0xd9
+	codeStr16  = 0xda
+	codeStr32  = 0xdb
+	codeMap16  = 0xde
+
+	fixMap    = 0x80
+	fixMapMax = 0x0f
+	fixStr    = 0xa0
+	fixStrMax = 0x1f
+)
+
+// retransmittedOffset is the offset of the Re flag in an encoded DataMessage: the map header,
+// "Seq" with its uint64 and the key "Re".
+const retransmittedOffset = 1 + 4 + 9 + 3
+
+// sizes of the field names, with their fixstr header
+const (
+	keysMessage        = 1 + len("Header") + 1 + len("Message")
+	keysHeader         = 1 + len("From") + 1 + len("To") + 1 + len("Type") + 1 + len("CID")
+	keysDataMessage    = 1 + len("Seq") + 1 + len("Re") + 1 + len("Data")
+	keysDataAckMessage = 1 + len("Seq") + 1 + len("Re")
+)
+
+// messageSize returns the size of an encoded Message.
+func messageSize(msg messages.Message) int {
+	return 1 + keysMessage + 1 + keysHeader + 2*(2+len(uuid.UUID{})) +
+		strSize(len(msg.Header.Type)) + strSize(len(msg.Header.CID)) + binSize(msg.Message)
+}
+
+// dataMessageSize returns the size of an encoded DataMessage.
+func dataMessageSize(msg messages.DataMessage) int {
+	size := 1 + keysDataMessage + 9 + 1 + binSize(msg.Data)
+	if msg.Compression != messages.CompressionNone {
+		size += 1 + len("Compression") + strSize(len(msg.Compression))
+	}
+	return size
+}
+
+// dataAckMessageSize is the size of an encoded DataAckMessage.
+const dataAckMessageSize = 1 + keysDataAckMessage + 9 + 1
+
+// appendMessage appends the encoded message to dst.
+func appendMessage(dst []byte, msg messages.Message) []byte {
+	dst = append(dst, fixMap|2)
+	dst = appendStr(dst, "Header")
+	dst = append(dst, fixMap|4)
+	dst = appendStr(dst, "From")
+	dst = appendBin(dst, msg.Header.From[:])
+	dst = appendStr(dst, "To")
+	dst = appendBin(dst, msg.Header.To[:])
+	dst = appendStr(dst, "Type")
+	dst = appendStr(dst, string(msg.Header.Type))
+	dst = appendStr(dst, "CID")
+	dst = appendStr(dst, string(msg.Header.CID))
+	dst = appendStr(dst, "Message")
+	return appendBin(dst, msg.Message)
+}
+
+// appendDataMessage appends the encoded data message to dst. Compression is omitted if empty.
+func appendDataMessage(dst []byte, msg messages.DataMessage) []byte {
+	if msg.Compression == messages.CompressionNone {
+		dst = append(dst, fixMap|3)
+	} else {
+		dst = append(dst, fixMap|4)
+	}
+	dst = appendStr(dst, "Seq")
+	dst = appendUint64(dst, msg.Seq)
+	dst = appendStr(dst, "Re")
+	dst = appendBool(dst, msg.Re)
+	dst = appendStr(dst, "Data")
+	dst = appendBin(dst, msg.Data)
+	if msg.Compression != messages.CompressionNone {
+		dst = appendStr(dst, "Compression")
+		dst = appendStr(dst, string(msg.Compression))
+	}
+	return dst
+}
+
+// appendDataAckMessage appends the encoded ack message to dst.
+func appendDataAckMessage(dst []byte, msg messages.DataAckMessage) []byte {
+	dst = append(dst, fixMap|2)
+	dst = appendStr(dst, "Seq")
+	dst = appendUint64(dst, msg.Seq)
+	dst = appendStr(dst, "Re")
+	return appendBool(dst, msg.Re)
+}
+
+func strSize(n int) int {
+	switch {
+	case n <= fixStrMax:
+		return 1 + n
+	case n <= math.MaxUint8:
+		return 2 + n
+	case n <= math.MaxUint16:
+		return 3 + n
+	}
+	return 5 + n
+}
+
+func binSize(b []byte) int {
+	switch {
+	case b == nil:
+		return 1
+	case len(b) <= math.MaxUint8:
+		return 2 + len(b)
+	case len(b) <= math.MaxUint16:
+		return 3 + len(b)
+	}
+	return 5 + len(b)
+}
+
+func appendStr(dst []byte, s string) []byte {
+	switch n := len(s); {
+	case n <= fixStrMax:
+		dst = append(dst, fixStr|byte(n))
+	case n <= math.MaxUint8:
+		dst = append(dst, codeStr8, byte(n))
+	case n <= math.MaxUint16:
+		dst = append(dst, codeStr16)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(n))
+	default:
+		dst = append(dst, codeStr32)
+		dst = binary.BigEndian.AppendUint32(dst, uint32(n))
+	}
+	return append(dst, s...)
+}
+
+func appendBin(dst []byte, b []byte) []byte {
+	switch n := len(b); {
+	case b == nil:
+		return append(dst, codeNil)
+	case n <= math.MaxUint8:
+		dst = append(dst, codeBin8, byte(n))
+	case n <= math.MaxUint16:
+		dst = append(dst, codeBin16)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(n))
+	default:
+		dst = append(dst, codeBin32)
+		dst = binary.BigEndian.AppendUint32(dst, uint32(n))
+	}
+	return append(dst, b...)
+}
+
+func appendUint64(dst []byte, v uint64) []byte {
+	dst = append(dst, codeUint64)
+	return binary.BigEndian.AppendUint64(dst, v)
+}
+
+func appendBool(dst []byte, v bool) []byte {
+	if v {
+		return append(dst, codeTrue)
+	}
+	return append(dst, codeFalse)
+}
+
+// reader decodes the msgpack values of the fast path. Once a value does not match the expected
+// format, ok is false and all further reads return zero values.
+type reader struct {
+	b  []byte
+	ok bool
+}
+
+func newReader(b []byte) *reader {
+	return &reader{b: b, ok: true}
+}
+
+// done returns true if all values were read as expected.
+func (r *reader) done() bool {
+	return r.ok && len(r.b) == 0
+}
+
+func (r *reader) fail() {
+	r.ok = false
+	r.b = nil
+}
+
+func (r *reader) next(n int) []byte {
+	if !r.ok || len(r.b) < n {
+		r.fail()
+		return nil
+	}
+	b := r.b[:n:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) code() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// length reads a length of 1, 2 or 4 bytes.
+func (r *reader) length(size int) int {
+	b := r.next(size)
+	switch {
+	case b == nil:
+		return 0
+	case size == 1:
+		return int(b[0])
+	case size == 2:
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return int(binary.BigEndian.Uint32(b))
+}
+
+func (r *reader) mapLen() int {
+	code := r.code()
+	switch {
+	case code&^fixMapMax == fixMap:
+		return int(code & fixMapMax)
+	case code == codeMap16:
+		return r.length(2)
+	}
+	r.fail()
+	return 0
+}
+
+// str returns the bytes of a string, without copying them.
+func (r *reader) str() []byte {
+	code := r.code()
+	switch {
+	case code&^fixStrMax == fixStr:
+		return r.next(int(code & fixStrMax))
+	case code == codeStr8:
+		return r.next(r.length(1))
+	case code == codeStr16:
+		return r.next(r.length(2))
+	case code == codeStr32:
+		return r.next(r.length(4))
+	}
+	r.fail()
+	return nil
+}
+
+// bin returns the bytes of a bin or nil value, sharing the memory of the encoded message.
+func (r *reader) bin() []byte {
+	switch r.code() {
+	case codeNil:
+		return nil
+	case codeBin8:
+		return r.next(r.length(1))
+	case codeBin16:
+		return r.next(r.length(2))
+	case codeBin32:
+		return r.next(r.length(4))
+	}
+	r.fail()
+	return nil
+}
+
+func (r *reader) uuid() uuid.UUID {
+	var id uuid.UUID
+	if b := r.bin(); len(b) == len(id) {
+		copy(id[:], b)
+	} else {
+		r.fail()
+	}
+	return id
+}
+
+func (r *reader) uint64() uint64 {
+	code := r.code()
+	switch {
+	case code <= 0x7f && r.ok:
+		return uint64(code)
+	case code == codeUint8:
+		return uint64(r.length(1))
+	case code == codeUint16:
+		return uint64(r.length(2))
+	case code == codeUint32:
+		return uint64(r.length(4))
+	case code == codeUint64:
+		if b := r.next(8); b != nil {
+			return binary.BigEndian.Uint64(b)
+		}
+		return 0
+	}
+	r.fail()
+	return 0
+}
+
+func (r *reader) bool() bool {
+	switch r.code() {
+	case codeFalse:
+		return false
+	case codeTrue:
+		return true
+	}
+	r.fail()
+	return false
+}
+
+// messageType returns the type of a message, known types without allocating a string.
+func messageType(b []byte) messages.MessageType {
+	switch messages.MessageType(b) {
+	case messages.D:
+		return messages.D
+	case messages.DA:
+		return messages.DA
+	case messages.CO:
+		return messages.CO
+	case messages.CA:
+		return messages.CA
+	case messages.CR:
+		return messages.CR
+	case messages.CC:
+		return messages.CC
+	case messages.CF:
+		return messages.CF
+	case messages.NF:
+		return messages.NF
+	case messages.DG:
+		return messages.DG
+	}
+	return messages.MessageType(b)
+}
+
+// compressionOf returns the compression of a data message, known algorithms without allocating a string.
+func compressionOf(b []byte) messages.Compression {
+	switch messages.Compression(b) {
+	case messages.CompressionZstd:
+		return messages.CompressionZstd
+	case messages.CompressionSnappy:
+		return messages.CompressionSnappy
+	}
+	return messages.Compression(b)
+}
+
+// decodeMessage decodes a message in the layout of appendMessage, in any order of the fields.
+// Returns false for any other layout.
+func decodeMessage(b []byte) (messages.Message, bool) {
+	var msg messages.Message
+	r := newReader(b)
+	for n := r.mapLen(); n > 0 && r.ok; n-- {
+		switch string(r.str()) {
+		case "Header":
+			for m := r.mapLen(); m > 0 && r.ok; m-- {
+				switch string(r.str()) {
+				case "From":
+					msg.Header.From = r.uuid()
+				case "To":
+					msg.Header.To = r.uuid()
+				case "Type":
+					msg.Header.Type = messageType(r.str())
+				case "CID":
+					msg.Header.CID = messages.ConnectionID(r.str())
+				default:
+					r.fail()
+				}
+			}
+		case "Message":
+			msg.Message = r.bin()
+		default:
+			r.fail()
+		}
+	}
+	return msg, r.done()
+}
+
+// decodeDataMessage decodes a data message in the layout of appendDataMessage, in any order of
+// the fields. Returns false for any other layout.
+func decodeDataMessage(b []byte) (messages.DataMessage, bool) {
+	var msg messages.DataMessage
+	r := newReader(b)
+	for n := r.mapLen(); n > 0 && r.ok; n-- {
+		switch string(r.str()) {
+		case "Seq":
+			msg.Seq = r.uint64()
+		case "Re":
+			msg.Re = r.bool()
+		case "Data":
+			msg.Data = r.bin()
+		case "Compression":
+			msg.Compression = compressionOf(r.str())
+		default:
+			r.fail()
+		}
+	}
+	return msg, r.done()
+}
+
+// decodeDataAckMessage decodes an ack message in the layout of appendDataAckMessage, in any
+// order of the fields. Returns false for any other layout.
+func decodeDataAckMessage(b []byte) (messages.DataAckMessage, bool) {
+	var msg messages.DataAckMessage
+	r := newReader(b)
+	for n := r.mapLen(); n > 0 && r.ok; n-- {
+		switch string(r.str()) {
+		case "Seq":
+			msg.Seq = r.uint64()
+		case "Re":
+			msg.Re = r.bool()
+		default:
+			r.fail()
+		}
+	}
+	return msg, r.done()
+}
+
+// isDataMessage returns true if b starts like a data message encoded by appendDataMessage, i.e.
+// its Re flag is at retransmittedOffset.
+func isDataMessage(b []byte) bool {
+	const prefix = "\xa3Seq\xcf"
+	return len(b) > retransmittedOffset &&
+		(b[0] == fixMap|3 || b[0] == fixMap|4) &&
+		string(b[1:1+len(prefix)]) == prefix &&
+		string(b[retransmittedOffset-3:retransmittedOffset]) == "\xa2Re" &&
+		(b[retransmittedOffset] == codeFalse || b[retransmittedOffset] == codeTrue)
+}
@@ -0,0 +1,232 @@
+package encoder
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack"
+)
+
+// payloads cover each size class of the msgpack bin and str formats.
+var payloads = [][]byte{nil, {}, bytes.Repeat([]byte{1}, 31), bytes.Repeat([]byte{2}, 32), bytes.Repeat([]byte{3}, 255), bytes.Repeat([]byte{4}, 256), bytes.Repeat([]byte{5}, 70000)}
+
+func TestCodecEncodesLikeMsgpack(t *testing.T) {
+	underTest := NewEncoderDecoder()
+	for _, payload := range payloads {
+		cid := messages.ConnectionID(strings.Repeat("c", len(payload)))
+		msg := messages.Message{
+			Header:  messages.MessageHeader{From: uuid.New(), To: uuid.New(), Type: messages.D, CID: cid},
+			Message: payload,
+		}
+		dataMessages := []messages.DataMessage{
+			{Seq: uint64(len(payload)), Data: payload},
+			{Seq: 1 << 40, Re: true, Data: payload, Compression: messages.CompressionZstd},
+		}
+		ack := messages.DataAckMessage{Seq: uint64(len(payload)) << 20, Re: len(payload)%2 == 0}
+
+		// WHEN
+		encoded, err := underTest.Encode(msg)
+		require.NoError(t, err)
+
+		// THEN
+		expected, err := msgpack.Marshal(msg)
+		require.NoError(t, err)
+		assert.Equal(t, expected, encoded)
+		assert.Equal(t, len(expected), cap(encoded))
+		for _, dm := range dataMessages {
+			encoded, err := underTest.EncodeDataMessage(dm)
+			require.NoError(t, err)
+			expected, err := msgpack.Marshal(dm)
+			require.NoError(t, err)
+			assert.Equal(t, expected, encoded)
+			assert.Equal(t, len(expected), cap(encoded))
+		}
+		encoded, err = underTest.EncodeDataAckMessage(ack)
+		require.NoError(t, err)
+		expected, err = msgpack.Marshal(ack)
+		require.NoError(t, err)
+		assert.Equal(t, expected, encoded)
+	}
+}
+
+func TestCodecDecodesLikeMsgpack(t *testing.T) {
+	for _, payload := range payloads {
+		// GIVEN
+		msg := messages.Message{
+			Header:  messages.MessageHeader{From: uuid.New(), To: uuid.New(), Type: messages.DA, CID: "cid"},
+			Message: payload,
+		}
+		dm := messages.DataMessage{Seq: 42, Re: true, Data: payload, Compression: messages.CompressionSnappy}
+		encodedMsg, err := msgpack.Marshal(msg)
+		require.NoError(t, err)
+		encodedDM, err := msgpack.Marshal(dm)
+		require.NoError(t, err)
+
+		// WHEN
+		decodedMsg, ok := decodeMessage(encodedMsg)
+		require.True(t, ok)
+		decodedDM, ok := decodeDataMessage(encodedDM)
+		require.True(t, ok)
+
+		// THEN
+		var expectedMsg messages.Message
+		require.NoError(t, msgpack.Unmarshal(encodedMsg, &expectedMsg))
+		assert.Equal(t, expectedMsg, decodedMsg)
+		var expectedDM messages.DataMessage
+		require.NoError(t, msgpack.Unmarshal(encodedDM, &expectedDM))
+		assert.Equal(t, expectedDM, decodedDM)
+	}
+}
+
+func TestDecodeFallsBackToMsgpackForOtherLayouts(t *testing.T) {
+	// GIVEN
+	// a data message of a newer peer with an additional field and a compact sequence number
+	payload, err := msgpack.Marshal(map[string]interface{}{
+		"Data":     []byte("data"),
+		"Seq":      uint8(7),
+		"Priority": 3,
+	})
+	require.NoError(t, err)
+	_, ok := decodeDataMessage(payload)
+	require.False(t, ok)
+
+	// WHEN
+	dm, err := NewEncoderDecoder().DecodeDataMessage(payload)
+
+	// THEN
+	require.NoError(t, err)
+	assert.Equal(t, messages.DataMessage{Seq: 7, Data: []byte("data")}, dm)
+}
+
+func TestDecodeRejectsTruncatedMessages(t *testing.T) {
+	// GIVEN
+	encoded, err := NewEncoderDecoder().EncodeDataMessage(messages.DataMessage{Seq: 1, Data: []byte("data")})
+	require.NoError(t, err)
+
+	// WHEN
+	_, err = NewEncoderDecoder().DecodeDataMessage(encoded[:len(encoded)-1])
+
+	// THEN
+	assert.Error(t, err)
+}
+
+func TestMarkRetransmitted(t *testing.T) {
+	underTest := NewEncoderDecoder()
+	compact, err := msgpack.Marshal(map[string]interface{}{"Seq": uint8(3), "Data": []byte("data")})
+	require.NoError(t, err)
+	encoded, err := underTest.EncodeDataMessage(messages.DataMessage{Seq: 3, Data: []byte("data")})
+	require.NoError(t, err)
+	original := append([]byte(nil), encoded...)
+
+	for name, dm := range map[string][]byte{"codec": encoded, "other layout": compact} {
+		t.Run(name, func(t *testing.T) {
+			// WHEN
+			retransmitted, err := underTest.MarkRetransmitted(dm)
+
+			// THEN
+			require.NoError(t, err)
+			decoded, err := underTest.DecodeDataMessage(retransmitted)
+			require.NoError(t, err)
+			assert.Equal(t, messages.DataMessage{Seq: 3, Re: true, Data: []byte("data")}, decoded)
+		})
+	}
+	assert.Equal(t, original, encoded)
+}
+
+func TestDataPathAllocations(t *testing.T) {
+	underTest := NewEncoderDecoder()
+	dm := messages.DataMessage{Seq: 1, Data: make([]byte, 32*1024)}
+	encodedDM, _ := underTest.EncodeDataMessage(dm)
+	msg := messages.Message{
+		Header:  messages.MessageHeader{From: uuid.New(), To: uuid.New(), Type: messages.D, CID: "cid"},
+		Message: encodedDM,
+	}
+	encodedMsg, _ := underTest.Encode(msg)
+	buf := make([]byte, 0, 64*1024)
+
+	// the encoded data message is kept for retransmissions, the message is encoded into a pooled buffer
+	assert.Equal(t, 1.0, testing.AllocsPerRun(100, func() { _, _ = underTest.EncodeDataMessage(dm) }))
+	assert.Zero(t, testing.AllocsPerRun(100, func() { _, _ = underTest.AppendMessage(buf[:0], msg) }))
+	// decoded payloads share the memory of the frame, only the connection ID is copied
+	assert.Equal(t, 1.0, testing.AllocsPerRun(100, func() { _, _ = underTest.Decode(encodedMsg) }))
+	assert.Zero(t, testing.AllocsPerRun(100, func() { _, _ = underTest.DecodeDataMessage(encodedDM) }))
+}
+
+// BenchmarkEncodeDataPath encodes a data message of 32 KB wrapped in a message, as the forwarder
+// and the uplink do, by hand and with msgpack.
+func BenchmarkEncodeDataPath(b *testing.B) {
+	dm := messages.DataMessage{Seq: 1, Data: make([]byte, 32*1024)}
+	header := messages.MessageHeader{From: uuid.New(), To: uuid.New(), Type: messages.D, CID: "cid"}
+
+	b.Run("codec", func(b *testing.B) {
+		underTest := NewEncoderDecoder()
+		buf := make([]byte, 0, 64*1024)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			encodedDM, _ := underTest.EncodeDataMessage(dm)
+			buf, _ = underTest.AppendMessage(buf[:0], messages.Message{Header: header, Message: encodedDM})
+		}
+	})
+	b.Run("msgpack", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			encodedDM, _ := msgpack.Marshal(dm)
+			_, _ = msgpack.Marshal(messages.Message{Header: header, Message: encodedDM})
+		}
+	})
+}
+
+// BenchmarkDecodeDataPath decodes a message with a data message of 32 KB, by hand and with msgpack.
+func BenchmarkDecodeDataPath(b *testing.B) {
+	underTest := NewEncoderDecoder()
+	encodedDM, _ := underTest.EncodeDataMessage(messages.DataMessage{Seq: 1, Data: make([]byte, 32*1024)})
+	frame, _ := underTest.Encode(messages.Message{
+		Header:  messages.MessageHeader{From: uuid.New(), To: uuid.New(), Type: messages.D, CID: "cid"},
+		Message: encodedDM,
+	})
+
+	b.Run("codec", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			msg, _ := underTest.Decode(frame)
+			_, _ = underTest.DecodeDataMessage(msg.Message)
+		}
+	})
+	b.Run("msgpack", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var msg messages.Message
+			_ = msgpack.Unmarshal(frame, &msg)
+			var dm messages.DataMessage
+			_ = msgpack.Unmarshal(msg.Message, &dm)
+		}
+	})
+}
+
+// BenchmarkRetransmission sets the retransmitted flag of an encoded data message of 32 KB, by
+// flipping it and by decoding and encoding the message with msgpack as before.
+func BenchmarkRetransmission(b *testing.B) {
+	underTest := NewEncoderDecoder()
+	encodedDM, _ := underTest.EncodeDataMessage(messages.DataMessage{Seq: 1, Data: make([]byte, 32*1024)})
+
+	b.Run("codec", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = underTest.MarkRetransmitted(encodedDM)
+		}
+	})
+	b.Run("msgpack", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var dm messages.DataMessage
+			_ = msgpack.Unmarshal(encodedDM, &dm)
+			dm.Re = true
+			_, _ = msgpack.Marshal(dm)
+		}
+	})
+}
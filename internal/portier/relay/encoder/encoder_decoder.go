@@ -10,7 +10,10 @@ type EncoderDecoder interface {
 	// Encode encodes a message
 	Encode(messages.Message) ([]byte, error)
 
-	// Decode decodes a message
+	// AppendMessage appends the encoded message to a buffer, e.g. one taken from a pool
+	AppendMessage([]byte, messages.Message) ([]byte, error)
+
+	// Decode decodes a message, the payload shares the memory of the encoded message
 	Decode([]byte) (messages.Message, error)
 
 	// DecodeConnectionOpenMessage decodes a connection open message
@@ -31,12 +34,15 @@ type EncoderDecoder interface {
 	// EncodeConnectionFailedMessage encodes a connection failed message
 	EncodeConnectionFailedMessage(messages.ConnectionFailedMessage) ([]byte, error)
 
-	// Decode DataMessage decodes a data message
+	// Decode DataMessage decodes a data message, the data shares the memory of the encoded message
 	DecodeDataMessage([]byte) (messages.DataMessage, error)
 
 	// EncodeDataMessage encodes a data message
 	EncodeDataMessage(messages.DataMessage) ([]byte, error)
 
+	// MarkRetransmitted returns a copy of an encoded data message with the retransmitted flag set
+	MarkRetransmitted([]byte) ([]byte, error)
+
 	// EncodeDatagramMessage encodes a datagram message
 	EncodeDatagramMessage(messages.DatagramMessage) ([]byte, error)
 
@@ -56,17 +62,20 @@ func NewEncoderDecoder() EncoderDecoder {
 
 // Encode encodes a message.
 func (e *encoderDecoder) Encode(msg messages.Message) ([]byte, error) {
-	// use msgpack to encode the message
-	msgpack, err := msgpack.Marshal(msg)
-	if err != nil {
-		return nil, err
-	}
-	return msgpack, nil
+	return appendMessage(make([]byte, 0, messageSize(msg)), msg), nil
+}
+
+// AppendMessage appends the encoded message to dst.
+func (e *encoderDecoder) AppendMessage(dst []byte, msg messages.Message) ([]byte, error) {
+	return appendMessage(dst, msg), nil
 }
 
 // Decode decodes a message.
 func (e *encoderDecoder) Decode(msg []byte) (messages.Message, error) {
-	// use msgpack to decode the message
+	if message, ok := decodeMessage(msg); ok {
+		return message, nil
+	}
+	// use msgpack to decode messages of other layouts
 	var message messages.Message
 	err := msgpack.Unmarshal(msg, &message)
 	if err != nil {
@@ -140,7 +149,10 @@ func (e *encoderDecoder) EncodeConnectionFailedMessage(msg messages.ConnectionFa
 
 // Decode DataMessage decodes a data message.
 func (e *encoderDecoder) DecodeDataMessage(msg []byte) (messages.DataMessage, error) {
-	// use msgpack to decode the message
+	if message, ok := decodeDataMessage(msg); ok {
+		return message, nil
+	}
+	// use msgpack to decode messages of other layouts
 	var message messages.DataMessage
 	err := msgpack.Unmarshal(msg, &message)
 	if err != nil {
@@ -151,12 +163,23 @@ func (e *encoderDecoder) DecodeDataMessage(msg []byte) (messages.DataMessage, er
 
 // EncodeDataMessage encodes a data message.
 func (e *encoderDecoder) EncodeDataMessage(msg messages.DataMessage) ([]byte, error) {
-	// use msgpack to encode the message
-	msgpack, err := msgpack.Marshal(msg)
+	return appendDataMessage(make([]byte, 0, dataMessageSize(msg)), msg), nil
+}
+
+// MarkRetransmitted returns a copy of an encoded data message with the retransmitted flag set.
+// Messages encoded by this device only have their flag flipped.
+func (e *encoderDecoder) MarkRetransmitted(msg []byte) ([]byte, error) {
+	if isDataMessage(msg) {
+		retransmitted := append([]byte(nil), msg...)
+		retransmitted[retransmittedOffset] = codeTrue
+		return retransmitted, nil
+	}
+	message, err := e.DecodeDataMessage(msg)
 	if err != nil {
 		return nil, err
 	}
-	return msgpack, nil
+	message.Re = true
+	return e.EncodeDataMessage(message)
 }
 
 // EncodeDatagramMessage encodes a datagram message.
@@ -171,7 +194,10 @@ func (e *encoderDecoder) EncodeDatagramMessage(msg messages.DatagramMessage) ([]
 
 // Decode DataAckMessage decodes a ack message.
 func (e *encoderDecoder) DecodeDataAckMessage(msg []byte) (messages.DataAckMessage, error) {
-	// use msgpack to decode the message
+	if message, ok := decodeDataAckMessage(msg); ok {
+		return message, nil
+	}
+	// use msgpack to decode messages of other layouts
 	var message messages.DataAckMessage
 	err := msgpack.Unmarshal(msg, &message)
 	if err != nil {
@@ -182,10 +208,5 @@ func (e *encoderDecoder) DecodeDataAckMessage(msg []byte) (messages.DataAckMessa
 
 // EncodeDataAckMessage encodes a ack message.
 func (e *encoderDecoder) EncodeDataAckMessage(msg messages.DataAckMessage) ([]byte, error) {
-	// use msgpack to encode the message
-	msgpack, err := msgpack.Marshal(msg)
-	if err != nil {
-		return nil, err
-	}
-	return msgpack, nil
+	return appendDataAckMessage(make([]byte, 0, dataAckMessageSize), msg), nil
 }
@@ -0,0 +1,53 @@
+package encoder
+
+import (
+	"testing"
+
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestDecodeConnectionOpenMessageOfOlderPeer(t *testing.T) {
+	// GIVEN
+	// a connection open message without capabilities, as sent before they were introduced
+	payload, err := msgpack.Marshal(struct {
+		BridgeOptions messages.BridgeOptions
+	}{})
+	assert.Nil(t, err)
+
+	// WHEN
+	message, err := NewEncoderDecoder().DecodeConnectionOpenMessage(payload)
+
+	// THEN
+	assert.Nil(t, err)
+	assert.Equal(t, 1, message.Capabilities.ProtocolVersion())
+}
+
+func TestDecodeConnectionAcceptMessageIgnoresUnknownFields(t *testing.T) {
+	// GIVEN
+	// a connection accept message of a newer peer with a field and a feature unknown to this device
+	type futureCapabilities struct {
+		Version    int
+		Features   []string
+		Window     int
+		Congestion string
+	}
+	payload, err := msgpack.Marshal(struct {
+		Capabilities futureCapabilities
+		Resume       []byte
+	}{
+		Capabilities: futureCapabilities{Version: 3, Features: []string{"tls-required", "multipath"}, Window: 4096, Congestion: "bbr"},
+		Resume:       []byte{1, 2, 3},
+	})
+	assert.Nil(t, err)
+
+	// WHEN
+	message, err := NewEncoderDecoder().DecodeConnectionAcceptMessage(payload)
+
+	// THEN
+	assert.Nil(t, err)
+	assert.Equal(t, 3, message.Capabilities.Version)
+	assert.True(t, message.Capabilities.Has(messages.CapabilityTLSRequired))
+	assert.Equal(t, 4096, message.Capabilities.Window)
+}
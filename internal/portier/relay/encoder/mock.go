@@ -14,6 +14,11 @@ func (m *MockEncoderDecoder) EncodeDataMessage(dm messages.DataMessage) ([]byte,
 	return args.Get(0).([]byte), args.Error(1)
 }
 
+func (m *MockEncoderDecoder) MarkRetransmitted(data []byte) ([]byte, error) {
+	args := m.Called(data)
+	return args.Get(0).([]byte), args.Error(1)
+}
+
 func (m *MockEncoderDecoder) DecodeDataMessage(data []byte) (messages.DataMessage, error) {
 	args := m.Called(data)
 	return args.Get(0).(messages.DataMessage), args.Error(1)
@@ -78,3 +83,8 @@ func (m *MockEncoderDecoder) Decode(msg []byte) (messages.Message, error) {
 	args := m.Called(msg)
 	return args.Get(0).(messages.Message), args.Error(1)
 }
+
+func (m *MockEncoderDecoder) AppendMessage(dst []byte, msg messages.Message) ([]byte, error) {
+	args := m.Called(dst, msg)
+	return args.Get(0).([]byte), args.Error(1)
+}
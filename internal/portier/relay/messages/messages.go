@@ -48,6 +48,127 @@ type BridgeOptions struct {
 
 	// The remote URL
 	URLRemote url.URL
+
+	// TLS indicates whether the bridged stream is TLS encrypted end-to-end. It is only sent by
+	// peers that announce CapabilityTLSRequired, see RequestedTLS.
+	TLS bool
+}
+
+// RequestedTLS returns whether the peer with the given capabilities requested a TLS encrypted
+// stream, or nil if the peer does not negotiate TLS per connection and encrypts if TLS is
+// enabled globally.
+func (o BridgeOptions) RequestedTLS(peer Capabilities) *bool {
+	if !peer.Has(CapabilityTLSRequired) {
+		return nil
+	}
+	requested := o.TLS
+	return &requested
+}
+
+// ProtocolVersion is the version of the connection protocol of this device. Peers that do not
+// announce a version speak version 1, the protocol before capabilities were negotiated.
+const ProtocolVersion = 2
+
+// Capability is an optional feature of the connection protocol.
+type Capability string
+
+const (
+	// CapabilityCompression means the device decompresses the payloads of data messages
+	CapabilityCompression Capability = "compression"
+
+	// CapabilityTLSRequired means the device negotiates TLS per connection, see
+	// BridgeOptions.TLS, and refuses connections that violate its TLS policy with a failure code
+	CapabilityTLSRequired Capability = "tls-required"
+
+	// CapabilitySACK means the device acknowledges ranges of received data messages. Reserved,
+	// this device does not announce it yet.
+	CapabilitySACK Capability = "sack"
+
+	// CapabilityDatagram means the device forwards datagram messages. Reserved, this device
+	// does not announce it yet.
+	CapabilityDatagram Capability = "datagram"
+)
+
+// Compression is an algorithm the payloads of data messages are compressed with.
+type Compression string
+
+const (
+	// CompressionNone means the data is not compressed
+	CompressionNone Compression = ""
+
+	// CompressionZstd compresses with Zstandard
+	CompressionZstd Compression = "zstd"
+
+	// CompressionSnappy compresses with Snappy, faster but with less savings than zstd
+	CompressionSnappy Compression = "snappy"
+)
+
+// Capabilities are announced by both devices of a connection, in the connection open and
+// accept messages. Features and fields unknown to a device are ignored, so new ones can be
+// added without breaking older peers.
+type Capabilities struct {
+	// Version is the protocol version of the device, 0 for peers that do not announce it
+	Version int
+
+	// Features are the optional features supported by the device
+	Features []Capability
+
+	// Window is the maximum number of bytes in flight the device accepts, 0 if unlimited
+	Window int
+
+	// Compression are the compression algorithms the device supports, in order of preference.
+	// Only announced along with CapabilityCompression.
+	Compression []Compression
+}
+
+// ProtocolVersion returns the protocol version of the capabilities, 1 if none was announced.
+func (c Capabilities) ProtocolVersion() int {
+	if c.Version == 0 {
+		return 1
+	}
+	return c.Version
+}
+
+// Has returns whether the feature is supported.
+func (c Capabilities) Has(feature Capability) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the capabilities supported by both devices: the lower protocol version, the
+// common features, the smaller window and the common compression algorithms, in the order of
+// preference of this device.
+func (c Capabilities) Negotiate(peer Capabilities) Capabilities {
+	negotiated := Capabilities{
+		Version: c.ProtocolVersion(),
+		Window:  c.Window,
+	}
+	if peer.ProtocolVersion() < negotiated.Version {
+		negotiated.Version = peer.ProtocolVersion()
+	}
+	for _, feature := range c.Features {
+		if peer.Has(feature) {
+			negotiated.Features = append(negotiated.Features, feature)
+		}
+	}
+	if peer.Window > 0 && (negotiated.Window == 0 || peer.Window < negotiated.Window) {
+		negotiated.Window = peer.Window
+	}
+	if negotiated.Has(CapabilityCompression) {
+		for _, compression := range c.Compression {
+			for _, peerCompression := range peer.Compression {
+				if compression == peerCompression {
+					negotiated.Compression = append(negotiated.Compression, compression)
+					break
+				}
+			}
+		}
+	}
+	return negotiated
 }
 
 type MessageHeader struct {
@@ -64,28 +185,84 @@ type MessageHeader struct {
 	CID ConnectionID
 }
 
+// AssociatedData returns the header in the form that is authenticated along with the encrypted
+// payload of a Noise encrypted connection.
+func (h MessageHeader) AssociatedData() []byte {
+	ad := make([]byte, 0, 2*len(h.From)+len(h.Type)+1+len(h.CID))
+	ad = append(ad, h.From[:]...)
+	ad = append(ad, h.To[:]...)
+	ad = append(ad, h.Type...)
+	ad = append(ad, 0)
+	return append(ad, h.CID...)
+}
+
 // Message is a message that is sent to the portier server.
 type Message struct {
-	// Header is the plaintext, but authenticated header of the message
+	// Header is the plaintext, but authenticated header of the message. Only Noise encrypted
+	// connections authenticate it.
 	Header MessageHeader
 
-	// Message is the serialized and encrypted message, i.e. a DataMessage
+	// Message is the serialized message, i.e. a DataMessage. The payloads of CO, CA, D and DA
+	// messages of Noise encrypted connections are encrypted.
 	Message []byte
 }
 
 // ConnectionOpenMessage is a message that is sent when a connection is opened.
 type ConnectionOpenMessage struct {
-	// BridgeOptions defines the options for the bridge, which are shared
+	// BridgeOptions defines the options for the bridge, which are shared. Empty if the
+	// connection is Noise encrypted.
 	BridgeOptions BridgeOptions
+
+	// Noise is the first message of the Noise handshake, its payload is the encoded
+	// ConnectionOpenMessage with the bridge options. Empty for unencrypted connections.
+	Noise []byte
+
+	// Capabilities are the capabilities of the connecting device. Part of the encrypted
+	// payload if the connection is Noise encrypted.
+	Capabilities Capabilities
 }
 
 type ConnectionAcceptMessage struct {
+	// Noise is the second message of the Noise handshake, its payload is the encoded
+	// ConnectionAcceptMessage. Empty for unencrypted connections.
+	Noise []byte
+
+	// Certificate is the certificate chain of the accepting device, sent on unencrypted
+	// connections if the device accepts Noise. The peer uses Noise for its next connections.
+	Certificate []byte
+
+	// Capabilities are the capabilities of the accepting device. Part of the encrypted
+	// payload if the connection is Noise encrypted.
+	Capabilities Capabilities
 }
 
+// FailureCode identifies the cause of a failed connection open attempt.
+type FailureCode string
+
+const (
+	// DialFailed means the target service could not be reached
+	DialFailed FailureCode = "dial-failed"
+
+	// TLSRequired means the target only accepts TLS encrypted connections
+	TLSRequired FailureCode = "tls-required"
+
+	// TLSUnavailable means TLS is disabled on the target device
+	TLSUnavailable FailureCode = "tls-unavailable"
+
+	// NoiseUnavailable means the target device does not accept Noise encrypted connections
+	NoiseUnavailable FailureCode = "noise-unavailable"
+
+	// NoiseFailed means the Noise handshake failed, e.g. the peer is not trusted
+	NoiseFailed FailureCode = "noise-failed"
+)
+
 // ConnectionFailedMessage is a message that is sent when a connection open attempt failed.
 type ConnectionFailedMessage struct {
 	// Reason is the reason why the connection failed
 	Reason string
+
+	// Code identifies the cause of the failure, empty for peers that do not send it
+	Code FailureCode
 }
 
 // DataMessage is a message that contains data.
@@ -98,6 +275,10 @@ type DataMessage struct {
 
 	// Data is the actual payload from the bridged connection
 	Data []byte
+
+	// Compression is the algorithm the data is compressed with, empty for uncompressed data.
+	// Only sent if compression was negotiated, omitted otherwise.
+	Compression Compression `msgpack:",omitempty"`
 }
 
 // DataGramMessage is a message that contains data.
@@ -0,0 +1,60 @@
+package messages
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateWithPeerOfSameVersion(t *testing.T) {
+	// GIVEN
+	local := Capabilities{Version: ProtocolVersion, Features: []Capability{CapabilityCompression, CapabilityTLSRequired}, Window: 1 << 20}
+	peer := Capabilities{Version: ProtocolVersion, Features: []Capability{CapabilityTLSRequired, CapabilityDatagram}, Window: 1 << 16}
+
+	// WHEN
+	negotiated := local.Negotiate(peer)
+
+	// THEN
+	assert.Equal(t, Capabilities{Version: ProtocolVersion, Features: []Capability{CapabilityTLSRequired}, Window: 1 << 16}, negotiated)
+	assert.Equal(t, negotiated, peer.Negotiate(local))
+}
+
+func TestNegotiateWithPeerWithoutCapabilities(t *testing.T) {
+	// GIVEN
+	local := Capabilities{Version: ProtocolVersion, Features: []Capability{CapabilityTLSRequired}, Window: 1 << 20}
+
+	// WHEN
+	negotiated := local.Negotiate(Capabilities{})
+
+	// THEN
+	assert.Equal(t, 1, negotiated.Version)
+	assert.False(t, negotiated.Has(CapabilityTLSRequired))
+	assert.Equal(t, 1<<20, negotiated.Window)
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	// GIVEN
+	service := Capabilities{Version: ProtocolVersion, Features: []Capability{CapabilityCompression}, Compression: []Compression{CompressionSnappy}}
+	device := Capabilities{Version: ProtocolVersion, Features: []Capability{CapabilityCompression}, Compression: []Compression{CompressionZstd, CompressionSnappy}}
+	withoutCompression := Capabilities{Version: ProtocolVersion, Compression: []Compression{CompressionZstd}}
+
+	// WHEN / THEN
+	assert.Equal(t, []Compression{CompressionSnappy}, service.Negotiate(device).Compression)
+	assert.Equal(t, []Compression{CompressionSnappy}, device.Negotiate(service).Compression)
+	assert.Empty(t, device.Negotiate(withoutCompression).Compression)
+}
+
+func TestRequestedTLSOnlyOfPeersNegotiatingTLS(t *testing.T) {
+	// GIVEN
+	options := BridgeOptions{TLS: false}
+	negotiating := Capabilities{Version: ProtocolVersion, Features: []Capability{CapabilityTLSRequired}}
+
+	// WHEN
+	requested := options.RequestedTLS(negotiating)
+	legacy := options.RequestedTLS(Capabilities{})
+
+	// THEN
+	assert.NotNil(t, requested)
+	assert.False(t, *requested)
+	assert.Nil(t, legacy)
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/adapter"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/router"
@@ -260,8 +261,8 @@ func createRelay(deviceId uuid.UUID, url string, events chan adapter.AdapterEven
 	uplink := createUplink(deviceId.String(), url)
 	messageChannel, _ := uplink.Connect()
 	pTLS := &MockPTLS{}
-	pTLS.On("TestEndpointURL", mock.Anything).Return(false)
-	router := router.NewRouter(uplink, messageChannel, events, pTLS, nil)
+	pTLS.On("Negotiate", mock.Anything, mock.Anything).Return(false, nil)
+	router := router.NewRouter(uplink, messageChannel, events, pTLS, nil, nil)
 
 	return router, uplink
 }
@@ -271,7 +272,7 @@ func createOutboundAdapter(uplink uplink.Uplink, opts adapter.ConnectionAdapterO
 	cConn, _ := net.Dial(ln.Addr().Network(), ln.Addr().String())
 	sConn, _ := ln.Accept()
 
-	adapter := adapter.NewOutboundConnectionAdapter(opts, sConn, uplink, events)
+	adapter := adapter.NewOutboundConnectionAdapter(opts, sConn, uplink, events, &MockPTLS{})
 	return adapter, cConn
 }
 
@@ -308,12 +309,34 @@ func (m *MockPTLS) TestEndpointURL(endpoint url.URL) bool {
 	return args.Bool(0)
 }
 
-func (m *MockPTLS) CreateClientAndBridge(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, func() error, error) {
-	args := m.Called(conn, peerDeviceID)
-	return args.Get(0).(net.Conn), args.Get(1).(func() error), args.Error(2)
+func (m *MockPTLS) Negotiate(endpoint url.URL, requested *bool) (bool, error) {
+	args := m.Called(endpoint, requested)
+	return args.Bool(0), args.Error(1)
 }
 
-func (m *MockPTLS) CreateServerAndBridge(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
-	args := m.Called(conn, peerDeviceID)
+func (m *MockPTLS) CreateClient(stream net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
+	args := m.Called(stream, peerDeviceID)
 	return args.Get(0).(net.Conn), args.Error(1)
 }
+
+func (m *MockPTLS) CreateServer(stream net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
+	args := m.Called(stream, peerDeviceID)
+	return args.Get(0).(net.Conn), args.Error(1)
+}
+
+func (m *MockPTLS) Handshake(conn net.Conn) error {
+	return nil
+}
+
+// the mock devices do not accept Noise
+func (m *MockPTLS) NoiseCertificate() ([]byte, error) {
+	return nil, ptls.ErrNoiseUnavailable
+}
+
+func (m *MockPTLS) LearnNoisePeer(peerDeviceID uuid.UUID, certificate []byte, conn net.Conn) error {
+	return nil
+}
+
+func (m *MockPTLS) NewNoiseHandshake(peerDeviceID uuid.UUID, initiator bool) (*ptls.NoiseHandshake, error) {
+	return nil, ptls.ErrNoiseUnavailable
+}
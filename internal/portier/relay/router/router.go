@@ -1,7 +1,9 @@
 package router
 
 import (
+	"errors"
 	"log"
+	"net/url"
 	"sync"
 	"time"
 
@@ -23,6 +25,9 @@ type InitiationFailureReport struct {
 
 type InitiationFailureReporter func(report InitiationFailureReport)
 
+// TargetCapabilities returns the capabilities announced for inbound connections to a target.
+type TargetCapabilities func(target url.URL) messages.Capabilities
+
 type Router interface {
 	// Start starts the router
 	Start() error
@@ -65,10 +70,13 @@ type router struct {
 
 	// reportInitiationFailure reports inbound initiation failures without affecting packet handling.
 	reportInitiationFailure InitiationFailureReporter
+
+	// targetCapabilities returns the capabilities of inbound connections, nil for the defaults
+	targetCapabilities TargetCapabilities
 }
 
 // NewRouter creates a new router.
-func NewRouter(uplink uplink.Uplink, msg <-chan messages.Message, events chan adapter.AdapterEvent, ptls ptls.PTLS, reportInitiationFailure InitiationFailureReporter) Router {
+func NewRouter(uplink uplink.Uplink, msg <-chan messages.Message, events chan adapter.AdapterEvent, ptls ptls.PTLS, reportInitiationFailure InitiationFailureReporter, targetCapabilities TargetCapabilities) Router {
 	return &router{
 		connections:             make(map[messages.ConnectionID]adapter.ConnectionAdapter),
 		encoderDecoder:          encoder.NewEncoderDecoder(),
@@ -78,6 +86,7 @@ func NewRouter(uplink uplink.Uplink, msg <-chan messages.Message, events chan ad
 		mutex:                   sync.Mutex{},
 		ptls:                    ptls,
 		reportInitiationFailure: reportInitiationFailure,
+		targetCapabilities:      targetCapabilities,
 	}
 }
 
@@ -147,7 +156,20 @@ func (r *router) HandleMessage(msg messages.Message) {
 			log.Printf("message: %v\n", msg)
 			return
 		}
-		r.CreateInboundConnection(msg.Header, connectionOpenMessage.BridgeOptions)
+		var handshake *ptls.NoiseHandshake
+		if len(connectionOpenMessage.Noise) > 0 {
+			handshake, connectionOpenMessage, err = r.acceptNoise(msg.Header, connectionOpenMessage.Noise)
+			if err != nil {
+				log.Printf("refusing Noise encrypted connection %s: %v\n", msg.Header.CID, err)
+				code := messages.NoiseFailed
+				if errors.Is(err, ptls.ErrNoiseUnavailable) {
+					code = messages.NoiseUnavailable
+				}
+				r.refuse(msg.Header, code, err)
+				return
+			}
+		}
+		r.CreateInboundConnection(msg.Header, connectionOpenMessage.BridgeOptions, connectionOpenMessage.Capabilities, handshake)
 		return
 	}
 
@@ -184,14 +206,61 @@ func (r *router) RemoveConnection(connectionId messages.ConnectionID) {
 	log.Printf("removed connection %s\n", connectionId)
 }
 
-// CreateInboundConnection creates an inbound connection.
-func (r *router) CreateInboundConnection(header messages.MessageHeader, bridgeOptions messages.BridgeOptions) {
+// acceptNoise processes the first message of the Noise handshake of a connection and returns the
+// handshake and the connection open message of its payload, with the bridge options and the
+// capabilities of the peer.
+func (r *router) acceptNoise(header messages.MessageHeader, message []byte) (*ptls.NoiseHandshake, messages.ConnectionOpenMessage, error) {
+	handshake, err := r.ptls.NewNoiseHandshake(header.From, false)
+	if err != nil {
+		return nil, messages.ConnectionOpenMessage{}, err
+	}
+	payload, err := handshake.ReadMessage(header.AssociatedData(), message)
+	if err != nil {
+		return nil, messages.ConnectionOpenMessage{}, err
+	}
+	connectionOpenMessage, err := r.encoderDecoder.DecodeConnectionOpenMessage(payload)
+	if err != nil {
+		return nil, messages.ConnectionOpenMessage{}, err
+	}
+	return handshake, connectionOpenMessage, nil
+}
+
+// refuse sends a connection failed message for a connection open message.
+func (r *router) refuse(header messages.MessageHeader, code messages.FailureCode, reason error) {
+	payload, _ := r.encoderDecoder.EncodeConnectionFailedMessage(messages.ConnectionFailedMessage{
+		Reason: reason.Error(),
+		Code:   code,
+	})
+	_ = r.uplink.Send(messages.Message{
+		Header: messages.MessageHeader{
+			From: header.To,
+			To:   header.From,
+			Type: messages.CF,
+			CID:  header.CID,
+		},
+		Message: payload,
+	})
+}
+
+// CreateInboundConnection creates an inbound connection with the capabilities of the target
+// negotiated with those of the peer. The handshake is set for Noise encrypted connections.
+func (r *router) CreateInboundConnection(header messages.MessageHeader, bridgeOptions messages.BridgeOptions, peerCapabilities messages.Capabilities, handshake *ptls.NoiseHandshake) {
+	capabilities := adapter.NewDefaultCapabilities()
+	if r.targetCapabilities != nil {
+		capabilities = r.targetCapabilities(bridgeOptions.URLRemote)
+	}
+	negotiated := capabilities.Negotiate(peerCapabilities)
+	log.Printf("negotiated protocol version %d with features %v for connection %s\n", negotiated.Version, negotiated.Features, header.CID)
+
 	// create a new inbound connection adapter
 	connectionAdapter := adapter.NewInboundConnectionAdapter(adapter.ConnectionAdapterOptions{
 		ConnectionId:          header.CID,
 		LocalDeviceId:         header.To,
 		PeerDeviceId:          header.From,
 		BridgeOptions:         bridgeOptions,
+		Noise:                 handshake,
+		Capabilities:          capabilities,
+		Negotiated:            negotiated,
 		ResponseInterval:      1000 * time.Millisecond,
 		ConnectionReadTimeout: 1000 * time.Millisecond,
 		ReadBufferSize:        1024,
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/adapter"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
@@ -23,7 +24,7 @@ func TestRouting(testing *testing.T) {
 	events := make(chan adapter.AdapterEvent, 10)
 	uplinkMock := &MockUplink{}
 	ptls := &MockPTLS{}
-	underTest := NewRouter(uplinkMock, msg, events, ptls, nil)
+	underTest := NewRouter(uplinkMock, msg, events, ptls, nil, nil)
 	underTest.AddConnection(connectionId, connectionAdapterMock)
 	connectionAdapterMock.On("Send", mock.MatchedBy(func(msg messages.Message) bool {
 		return msg.Header.CID == connectionId
@@ -58,9 +59,9 @@ func TestConnectionOpen(testing *testing.T) {
 		return true
 	})).Return(nil)
 	ptls := &MockPTLS{}
-	ptls.On("TestEndpointURL", mock.Anything).Return(false)
+	ptls.On("Negotiate", mock.Anything, mock.Anything).Return(false, nil)
 
-	underTest := NewRouter(uplinkMock, msg, events, ptls, nil)
+	underTest := NewRouter(uplinkMock, msg, events, ptls, nil, nil)
 
 	remoteUrl, _ := url.Parse("tcp://" + forwarded.Addr().String())
 	bridgeOptions := messages.BridgeOptions{
@@ -100,7 +101,7 @@ func TestConnectionNotFound(testing *testing.T) {
 		return msg.Header.Type == messages.NF
 	})).Return(nil)
 	ptls := &MockPTLS{}
-	underTest := NewRouter(uplinkMock, msg, events, ptls, nil)
+	underTest := NewRouter(uplinkMock, msg, events, ptls, nil, nil)
 
 	// WHEN
 	underTest.HandleMessage(messages.Message{
@@ -123,12 +124,12 @@ func TestConnectionOpenReportsInitiationFailure(testing *testing.T) {
 	uplinkMock := &MockUplink{}
 	uplinkMock.On("Send", mock.Anything).Return(nil)
 	ptls := &MockPTLS{}
-	ptls.On("TestEndpointURL", mock.Anything).Return(false)
+	ptls.On("Negotiate", mock.Anything, mock.Anything).Return(false, nil)
 
 	reportCh := make(chan InitiationFailureReport, 1)
 	underTest := NewRouter(uplinkMock, msg, events, ptls, func(report InitiationFailureReport) {
 		reportCh <- report
-	})
+	}, nil)
 
 	remoteURL, _ := url.Parse("tcp://127.0.0.1:1")
 	connectionOpenMessage := messages.ConnectionOpenMessage{
@@ -157,6 +158,61 @@ func TestConnectionOpenReportsInitiationFailure(testing *testing.T) {
 	}
 }
 
+func TestConnectionOpenAnnouncesTargetCapabilities(testing *testing.T) {
+	// GIVEN
+	forwarded, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer forwarded.Close()
+	msg := make(chan messages.Message, 10)
+	events := make(chan adapter.AdapterEvent, 10)
+	encoderDecoder := encoder.NewEncoderDecoder()
+	accepted := make(chan messages.ConnectionAcceptMessage, 1)
+	uplinkMock := &MockUplink{}
+	uplinkMock.On("Send", mock.MatchedBy(func(msg messages.Message) bool {
+		if msg.Header.Type == messages.CA {
+			connectionAcceptMessage, _ := encoderDecoder.DecodeConnectionAcceptMessage(msg.Message)
+			select {
+			case accepted <- connectionAcceptMessage:
+			default:
+			}
+		}
+		return true
+	})).Return(nil)
+	ptls := &MockPTLS{}
+	ptls.On("Negotiate", mock.Anything, mock.Anything).Return(false, nil)
+
+	remoteUrl, _ := url.Parse("tcp://" + forwarded.Addr().String())
+	var target url.URL
+	underTest := NewRouter(uplinkMock, msg, events, ptls, nil, func(url url.URL) messages.Capabilities {
+		target = url
+		return adapter.NewServiceCapabilities(messages.CompressionSnappy)
+	})
+	connectionOpenMessagePayload, _ := encoderDecoder.EncodeConnectionOpenMessage(messages.ConnectionOpenMessage{
+		BridgeOptions: messages.BridgeOptions{URLRemote: *remoteUrl},
+		Capabilities:  adapter.NewDefaultCapabilities(),
+	})
+
+	// WHEN
+	underTest.HandleMessage(messages.Message{
+		Header: messages.MessageHeader{
+			From: uuid.New(),
+			To:   uuid.New(),
+			Type: messages.CO,
+			CID:  messages.ConnectionID("test-connection-id"),
+		},
+		Message: connectionOpenMessagePayload,
+	})
+
+	// THEN
+	assert.Equal(testing, *remoteUrl, target)
+	select {
+	case connectionAcceptMessage := <-accepted:
+		assert.Equal(testing, []messages.Compression{messages.CompressionSnappy}, connectionAcceptMessage.Capabilities.Compression)
+	case <-time.After(2 * time.Second):
+		testing.Fatal("expected connection accept message to be sent")
+	}
+	_ = underTest.(*router).connections[messages.ConnectionID("test-connection-id")].Close()
+}
+
 type ConnectionAdapterMock struct {
 	mock.Mock
 }
@@ -208,12 +264,34 @@ func (m *MockPTLS) TestEndpointURL(endpoint url.URL) bool {
 	return args.Bool(0)
 }
 
-func (m *MockPTLS) CreateClientAndBridge(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, func() error, error) {
-	args := m.Called(conn, peerDeviceID)
-	return args.Get(0).(net.Conn), args.Get(1).(func() error), args.Error(2)
+func (m *MockPTLS) Negotiate(endpoint url.URL, requested *bool) (bool, error) {
+	args := m.Called(endpoint, requested)
+	return args.Bool(0), args.Error(1)
 }
 
-func (m *MockPTLS) CreateServerAndBridge(conn net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
-	args := m.Called(conn, peerDeviceID)
+func (m *MockPTLS) CreateClient(stream net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
+	args := m.Called(stream, peerDeviceID)
 	return args.Get(0).(net.Conn), args.Error(1)
 }
+
+func (m *MockPTLS) CreateServer(stream net.Conn, peerDeviceID uuid.UUID) (net.Conn, error) {
+	args := m.Called(stream, peerDeviceID)
+	return args.Get(0).(net.Conn), args.Error(1)
+}
+
+func (m *MockPTLS) Handshake(conn net.Conn) error {
+	return nil
+}
+
+// the mock devices do not accept Noise
+func (m *MockPTLS) NoiseCertificate() ([]byte, error) {
+	return nil, ptls.ErrNoiseUnavailable
+}
+
+func (m *MockPTLS) LearnNoisePeer(peerDeviceID uuid.UUID, certificate []byte, conn net.Conn) error {
+	return nil
+}
+
+func (m *MockPTLS) NewNoiseHandshake(peerDeviceID uuid.UUID, initiator bool) (*ptls.NoiseHandshake, error) {
+	return nil, ptls.ErrNoiseUnavailable
+}
@@ -0,0 +1,329 @@
+// Package simulation runs two forwarders connected by a virtual network in virtual time.
+// Retransmission and congestion control see the latency and loss of the virtual network,
+// but a simulated second takes only a few milliseconds, so loss and RTO edge cases can be
+// reproduced quickly and without flaky wall clock timing.
+package simulation
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/adapter"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/clock"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/uplink"
+)
+
+type Options struct {
+	// Latency is the one-way delay of the virtual network
+	Latency time.Duration
+
+	// Jitter adds a random delay in [0, Jitter) to every packet
+	Jitter time.Duration
+
+	// Loss is the probability in [0, 1] that a packet is dropped
+	Loss float64
+
+	// Drop decides about the loss of single packets in addition to Loss, e.g. to drop the
+	// first transmission of a specific sequence number
+	Drop func(packet Packet) bool
+
+	// Seed makes random loss and jitter reproducible
+	Seed int64
+
+	// Start is the virtual time the simulation starts at
+	Start time.Time
+
+	// ReadBufferSize is the read buffer size of the forwarders
+	ReadBufferSize int
+
+	// Settle is the real time the forwarders get to react before virtual time advances
+	Settle time.Duration
+}
+
+func NewDefaultOptions() Options {
+	return Options{
+		Latency:        20 * time.Millisecond,
+		Seed:           1,
+		Start:          time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		ReadBufferSize: 4096,
+		Settle:         200 * time.Microsecond,
+	}
+}
+
+// Packet is a message sent over the virtual network.
+type Packet struct {
+	// From is the sending side, 0 for Local and 1 for Remote
+	From int
+
+	// Type is the message type, D for data and DA for acks
+	Type messages.MessageType
+
+	// Seq is the sequence number of the data or ack message
+	Seq uint64
+
+	// Retransmission is true for data messages sent again after their RTO expired
+	Retransmission bool
+}
+
+// Stats count the packets of the virtual network.
+type Stats struct {
+	// Sent is the number of packets sent by both forwarders
+	Sent int
+
+	// Dropped is the number of packets lost
+	Dropped int
+
+	// Retransmissions is the number of data packets sent again after their RTO expired
+	Retransmissions int
+}
+
+// Simulation bridges Local and Remote through two forwarders and the virtual network.
+type Simulation struct {
+	// Clock is the virtual time of the simulation
+	Clock *clock.VirtualClock
+
+	// Local is the application end of the first forwarder
+	Local net.Conn
+
+	// Remote is the application end of the second forwarder
+	Remote net.Conn
+
+	options    Options
+	encoder    encoder.EncoderDecoder
+	forwarders [2]adapter.Forwarder
+	events     chan adapter.AdapterEvent
+
+	mu     sync.Mutex
+	random *rand.Rand
+	stats  Stats
+	errors []error
+}
+
+// New creates a simulation and starts its forwarders.
+func New(options Options) (*Simulation, error) {
+	s := &Simulation{
+		Clock:   clock.NewVirtualClock(options.Start),
+		options: options,
+		encoder: encoder.NewEncoderDecoder(),
+		events:  make(chan adapter.AdapterEvent, 100),
+		random:  rand.New(rand.NewSource(options.Seed)),
+	}
+
+	deviceIDs := [2]uuid.UUID{uuid.New(), uuid.New()}
+	cid := messages.ConnectionID(uuid.NewString())
+	for side := 0; side < 2; side++ {
+		app, forwarded := net.Pipe()
+		if side == 0 {
+			s.Local = app
+		} else {
+			s.Remote = app
+		}
+
+		forwarderOptions := adapter.ForwarderOptions{
+			LocalDeviceID:  deviceIDs[side],
+			PeerDeviceID:   deviceIDs[1-side],
+			ConnectionID:   cid,
+			ReadTimeout:    100 * time.Millisecond,
+			ReadBufferSize: options.ReadBufferSize,
+			Clock:          s.Clock,
+		}
+		link := &virtualUplink{simulation: s, side: side}
+		s.forwarders[side] = adapter.NewForwarder(forwarderOptions, &virtualDeadlineConn{Conn: forwarded, clock: s.Clock}, link, s.events)
+	}
+
+	go func() {
+		for event := range s.events {
+			if event.Type == adapter.Error {
+				s.mu.Lock()
+				s.errors = append(s.errors, fmt.Errorf("%s: %v", event.Message, event.Error))
+				s.mu.Unlock()
+			}
+		}
+	}()
+
+	for _, forwarder := range s.forwarders {
+		if err := forwarder.Start(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Run advances virtual time from event to event until done returns true. It fails if done
+// is not reached within limit of virtual time, or if a forwarder reports an error. It returns
+// the virtual time elapsed.
+func (s *Simulation) Run(done func() bool, limit time.Duration) (time.Duration, error) {
+	start := s.Clock.Now()
+	for {
+		s.settle()
+		if err := s.err(); err != nil {
+			return s.Clock.Since(start), err
+		}
+		if done() {
+			return s.Clock.Since(start), nil
+		}
+		if s.Clock.Since(start) >= limit {
+			return s.Clock.Since(start), fmt.Errorf("simulation did not finish within %s of virtual time", limit)
+		}
+		if !s.Clock.AdvanceToNext() {
+			return s.Clock.Since(start), fmt.Errorf("simulation stalled, nothing is scheduled")
+		}
+	}
+}
+
+// Stats returns the packet counters.
+func (s *Simulation) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Close stops the forwarders.
+func (s *Simulation) Close() {
+	for _, forwarder := range s.forwarders {
+		_ = forwarder.Close()
+	}
+	_ = s.Local.Close()
+	_ = s.Remote.Close()
+}
+
+// settle gives the forwarder goroutines real time to process what happened at the current virtual time.
+func (s *Simulation) settle() {
+	runtime.Gosched()
+	time.Sleep(s.options.Settle)
+}
+
+func (s *Simulation) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.errors) > 0 {
+		return s.errors[0]
+	}
+	return nil
+}
+
+// transmit sends msg from side over the virtual network.
+func (s *Simulation) transmit(side int, msg messages.Message) {
+	packet := Packet{From: side, Type: msg.Header.Type}
+	ackRe := false
+	switch msg.Header.Type {
+	case messages.D:
+		dm, err := s.encoder.DecodeDataMessage(msg.Message)
+		if err != nil {
+			return
+		}
+		packet.Seq = dm.Seq
+		packet.Retransmission = dm.Re
+	case messages.DA:
+		ack, err := s.encoder.DecodeDataAckMessage(msg.Message)
+		if err != nil {
+			return
+		}
+		packet.Seq = ack.Seq
+		ackRe = ack.Re
+	default:
+		// connection control messages are not part of the simulation
+		return
+	}
+
+	s.mu.Lock()
+	s.stats.Sent++
+	if packet.Retransmission {
+		s.stats.Retransmissions++
+	}
+	dropped := s.random.Float64() < s.options.Loss || (s.options.Drop != nil && s.options.Drop(packet))
+	if dropped {
+		s.stats.Dropped++
+		s.mu.Unlock()
+		return
+	}
+	delay := s.options.Latency
+	if s.options.Jitter > 0 {
+		delay += time.Duration(s.random.Int63n(int64(s.options.Jitter)))
+	}
+	s.mu.Unlock()
+
+	peer := s.forwarders[1-side]
+	s.Clock.AfterFunc(delay, func() {
+		if packet.Type == messages.D {
+			_ = peer.SendAsync(msg)
+			return
+		}
+		_ = peer.Ack(packet.Seq, ackRe)
+	})
+}
+
+// virtualUplink sends the messages of one forwarder over the virtual network.
+type virtualUplink struct {
+	simulation *Simulation
+	side       int
+}
+
+func (u *virtualUplink) Connect() (<-chan messages.Message, error) {
+	return nil, nil
+}
+
+func (u *virtualUplink) Send(msg messages.Message) error {
+	u.simulation.transmit(u.side, msg)
+	return nil
+}
+
+func (u *virtualUplink) Close() error {
+	return nil
+}
+
+func (u *virtualUplink) Events() <-chan uplink.Event {
+	return nil
+}
+
+// virtualDeadlineConn interprets read deadlines in the virtual time of clock. The deadline of
+// the wrapped connection is cleared and expired by a virtual timer.
+type virtualDeadlineConn struct {
+	net.Conn
+	clock *clock.VirtualClock
+
+	mu    sync.Mutex
+	timer clock.Timer
+	gen   uint64
+}
+
+// expired is a deadline in the past, reads time out immediately.
+var expired = time.Unix(1, 0)
+
+func (c *virtualDeadlineConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	// a timer of a previous deadline that already fired must not expire the new one
+	c.gen++
+	gen := c.gen
+
+	if t.IsZero() {
+		return c.Conn.SetReadDeadline(time.Time{})
+	}
+	d := t.Sub(c.clock.Now())
+	if d <= 0 {
+		return c.Conn.SetReadDeadline(expired)
+	}
+	if err := c.Conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	c.timer = c.clock.AfterFunc(d, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.gen == gen {
+			_ = c.Conn.SetReadDeadline(expired)
+		}
+	})
+	return nil
+}
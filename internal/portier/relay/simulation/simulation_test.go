@@ -0,0 +1,112 @@
+package simulation
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/relay/clock"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+	"github.com/stretchr/testify/require"
+)
+
+// transfer writes payload to from and reads it from to in the background. The returned
+// flag is set once all bytes arrived.
+func transfer(t *testing.T, from net.Conn, to net.Conn, payload []byte) (*int32, chan []byte) {
+	t.Helper()
+	done := new(int32)
+	received := make(chan []byte, 1)
+	go func() {
+		_, _ = from.Write(payload)
+	}()
+	go func() {
+		buf := make([]byte, len(payload))
+		_, err := io.ReadFull(to, buf)
+		if err == nil {
+			atomic.StoreInt32(done, 1)
+		}
+		received <- buf
+	}()
+	return done, received
+}
+
+func TestTransferWithLoss(t *testing.T) {
+	// GIVEN a network with 50ms latency and 5% loss
+	options := NewDefaultOptions()
+	options.Latency = 50 * time.Millisecond
+	options.Loss = 0.05
+	sim, err := New(options)
+	require.NoError(t, err)
+	defer sim.Close()
+
+	payload := make([]byte, 256*1024)
+	_, _ = rand.Read(payload)
+
+	// WHEN
+	started := time.Now()
+	done, received := transfer(t, sim.Local, sim.Remote, payload)
+	elapsed, err := sim.Run(func() bool { return atomic.LoadInt32(done) == 1 }, time.Minute)
+
+	// THEN all bytes arrive in order, lost packets were retransmitted
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(payload, <-received))
+	stats := sim.Stats()
+	require.Positive(t, stats.Dropped)
+	require.Positive(t, stats.Retransmissions)
+	require.GreaterOrEqual(t, elapsed, 2*options.Latency)
+	t.Logf("virtual time %s, real time %s, stats %+v", elapsed, time.Since(started), stats)
+}
+
+func TestRetransmissionAfterRTO(t *testing.T) {
+	// GIVEN a network that drops the first transmission of the first data packet
+	options := NewDefaultOptions()
+	options.Drop = func(packet Packet) bool {
+		return packet.Type == messages.D && packet.Seq == 0 && !packet.Retransmission
+	}
+	sim, err := New(options)
+	require.NoError(t, err)
+	defer sim.Close()
+
+	// WHEN
+	done, received := transfer(t, sim.Local, sim.Remote, []byte("hello"))
+	elapsed, err := sim.Run(func() bool { return atomic.LoadInt32(done) == 1 }, 10*time.Second)
+
+	// THEN the packet arrives after the initial RTO of 100ms
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), <-received)
+	require.Equal(t, 1, sim.Stats().Dropped)
+	require.Equal(t, 1, sim.Stats().Retransmissions)
+	require.GreaterOrEqual(t, elapsed, 100*time.Millisecond+options.Latency)
+}
+
+func TestReadDeadlineInVirtualTime(t *testing.T) {
+	// GIVEN a connection with a read deadline in 100ms of virtual time
+	virtualClock := clock.NewVirtualClock(NewDefaultOptions().Start)
+	app, forwarded := net.Pipe()
+	defer app.Close()
+	conn := &virtualDeadlineConn{Conn: forwarded, clock: virtualClock}
+	require.NoError(t, conn.SetReadDeadline(virtualClock.Now().Add(100*time.Millisecond)))
+	result := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		result <- err
+	}()
+
+	// WHEN real time passes THEN the read does not time out
+	select {
+	case err := <-result:
+		t.Fatalf("read returned before the virtual deadline: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// WHEN virtual time reaches the deadline THEN the read times out
+	virtualClock.Advance(100 * time.Millisecond)
+	err := <-result
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+}
@@ -7,9 +7,13 @@ import (
 	"math"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/batch"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/bufferpool"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/clock"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
 )
@@ -67,6 +71,24 @@ type Options struct {
 
 	// ReconnectRetries is the number of retries to reconnect to the portier server
 	ReconnectRetries int64
+
+	// Batching defines when messages coalesced into one frame are sent, see batch.DefaultOptions
+	Batching batch.Options
+
+	// DisableBatching sends each message as a frame of its own, even if the relay supports batches
+	DisableBatching bool
+
+	// Clock drives the batch delay and the write and read deadlines, defaults to the wall clock
+	Clock clock.Clock
+}
+
+// Stats count the messages and frames sent to the portier server.
+type Stats struct {
+	// Messages is the number of messages sent
+	Messages uint64
+
+	// Frames is the number of websocket frames sent, fewer than Messages if batching was negotiated
+	Frames uint64
 }
 
 type WebsocketUplink struct {
@@ -82,8 +104,9 @@ type WebsocketUplink struct {
 	// recv is the channel to receive messages from the portier server
 	recv chan messages.Message
 
-	// send is the channel to send messages to the portier server
-	send chan []byte
+	// send is the channel to send messages to the portier server, the encoded messages are
+	// returned to the buffer pool once written
+	send chan *[]byte
 
 	// events is the channel to receive events from the uplink
 	events chan Event
@@ -96,6 +119,12 @@ type WebsocketUplink struct {
 
 	// cancel is the cancel function to close the uplink
 	cancel context.CancelFunc
+
+	// messages and frames count the messages and frames sent
+	messages, frames atomic.Uint64
+
+	// clock drives the batch delay and the deadlines
+	clock clock.Clock
 }
 
 func defaultOptions() Options {
@@ -130,9 +159,10 @@ func NewWebsocketUplink(options Options, encoderDecoder encoder.EncoderDecoder)
 	return &WebsocketUplink{
 		Options:        options,
 		recv:           make(chan messages.Message, 1000),
-		send:           make(chan []byte),
+		send:           make(chan *[]byte),
 		events:         make(chan Event, 100),
 		encoderDecoder: encoderDecoder,
+		clock:          clock.OrReal(options.Clock),
 	}
 }
 
@@ -149,11 +179,14 @@ func (u *WebsocketUplink) Connect() (<-chan messages.Message, error) {
 
 // Send enqueues a message to the portier server.
 func (u *WebsocketUplink) Send(message messages.Message) error {
-	payload, err := u.encoderDecoder.Encode(message)
+	buf := bufferpool.Get(0)
+	payload, err := u.encoderDecoder.AppendMessage(*buf, message)
 	if err != nil {
+		bufferpool.Put(buf)
 		return err
 	}
-	u.send <- payload
+	*buf = payload
+	u.send <- buf
 	return nil
 }
 
@@ -170,6 +203,14 @@ func (u *WebsocketUplink) Events() <-chan Event {
 	return u.events
 }
 
+// Stats returns the number of messages and frames sent.
+func (u *WebsocketUplink) Stats() Stats {
+	return Stats{
+		Messages: u.messages.Load(),
+		Frames:   u.frames.Load(),
+	}
+}
+
 func (u *WebsocketUplink) connectWebsocket() error {
 	// Create a header with the API token
 	header := make(http.Header)
@@ -179,6 +220,12 @@ func (u *WebsocketUplink) connectWebsocket() error {
 		Event: "connecting to portier server: " + u.Options.PortierURL,
 	}
 
+	// Request batching, the relay selects the subprotocol if it supports batches
+	dialer := dialer
+	if !u.Options.DisableBatching {
+		dialer.Subprotocols = []string{batch.Subprotocol}
+	}
+
 	// Establish a websocket connection to the portier server
 	connection, _, err := dialer.Dial(u.Options.PortierURL, header)
 	if err != nil {
@@ -198,9 +245,14 @@ func (u *WebsocketUplink) connectWebsocket() error {
 		time.Sleep(u.calculateBackoff())
 		return u.connectWebsocket()
 	}
+	batching := connection.Subprotocol() == batch.Subprotocol
+	connected := fmt.Sprintf("Connected to portier server: %s", u.Options.PortierURL)
+	if batching {
+		connected += " (batching)"
+	}
 	u.events <- Event{
 		State: Connected,
-		Event: fmt.Sprintf("Connected to portier server: %s", u.Options.PortierURL),
+		Event: connected,
 	}
 
 	u.retries = 0
@@ -231,55 +283,65 @@ func (u *WebsocketUplink) connectWebsocket() error {
 				}
 				return
 			}
-			message, err := u.encoderDecoder.Decode(frame)
-			if err != nil {
-				u.events <- Event{
-					State: Connected,
-					Event: fmt.Sprintf("error decoding message: %v", err),
+			payloads := [][]byte{frame}
+			if batching {
+				payloads, err = batch.Split(frame)
+				if err != nil {
+					u.events <- Event{
+						State: Connected,
+						Event: fmt.Sprintf("error splitting batch: %v", err),
+					}
 				}
-				continue
 			}
-			select {
-			case u.recv <- message:
-			default:
-				u.events <- Event{
-					State: Connected,
-					Event: "recv channel full, dropping message",
-				}
+			for _, payload := range payloads {
+				u.receive(payload)
 			}
 		}
 	}()
 
 	mutex := &sync.Mutex{}
+	write := func(frame []byte, messages int) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		connection.SetWriteDeadline(u.clock.Now().Add(10 * time.Second))
+		err := connection.WriteMessage(websocket.BinaryMessage, frame)
+		if err != nil {
+			u.events <- Event{
+				State: Disconnected,
+				Event: fmt.Sprintf("send - websocket error: %v", err),
+			}
+			return err
+		}
+		u.frames.Add(1)
+		u.messages.Add(uint64(messages))
+		return nil
+	}
 
 	// send messages to the portier server
-	go func() {
-		for {
-			select {
-			case payload := <-u.send:
-				mutex.Lock()
-				connection.SetWriteDeadline(time.Now().Add(10 * time.Second))
-				err = connection.WriteMessage(websocket.BinaryMessage, payload)
-				if err != nil {
-					u.events <- Event{
-						State: Disconnected,
-						Event: fmt.Sprintf("send - websocket error: %v", err),
+	if batching {
+		go u.sendBatches(u.context, write)
+	} else {
+		go func() {
+			for {
+				select {
+				case buf := <-u.send:
+					err := write(*buf, 1)
+					bufferpool.Put(buf)
+					if err != nil {
+						return
 					}
-					mutex.Unlock()
+				case <-u.context.Done():
 					return
 				}
-				mutex.Unlock()
-			case <-u.context.Done():
-				return
 			}
-		}
-	}()
+		}()
+	}
 
 	// setup ping
 	connection.SetPingHandler(func(appData string) error {
 		mutex.Lock()
 		defer mutex.Unlock()
-		err := connection.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(10*time.Second))
+		err := connection.WriteControl(websocket.PongMessage, []byte(appData), u.clock.Now().Add(10*time.Second))
 		if err != nil {
 			u.events <- Event{
 				State: Disconnected,
@@ -287,7 +349,7 @@ func (u *WebsocketUplink) connectWebsocket() error {
 			}
 			return err
 		}
-		connection.SetReadDeadline(time.Now().Add(10 * time.Second))
+		connection.SetReadDeadline(u.clock.Now().Add(10 * time.Second))
 		return nil
 	})
 
@@ -295,6 +357,81 @@ func (u *WebsocketUplink) connectWebsocket() error {
 	return nil
 }
 
+// receive decodes a message from the portier server and forwards it to the recv channel.
+func (u *WebsocketUplink) receive(payload []byte) {
+	message, err := u.encoderDecoder.Decode(payload)
+	if err != nil {
+		u.events <- Event{
+			State: Connected,
+			Event: fmt.Sprintf("error decoding message: %v", err),
+		}
+		return
+	}
+	select {
+	case u.recv <- message:
+	default:
+		u.events <- Event{
+			State: Connected,
+			Event: "recv channel full, dropping message",
+		}
+	}
+}
+
+// sendBatches coalesces the messages to the portier server into frames. A batch is written once
+// it is full or its first message waited for the delay of the batching options.
+func (u *WebsocketUplink) sendBatches(ctx context.Context, write func(frame []byte, messages int) error) {
+	batcher := batch.NewBatcher(u.Options.Batching)
+
+	// expired receives the number of the batch whose delay expired. The delay of a batch that
+	// was flushed because it was full may expire anyway, its number is outdated then.
+	expired := make(chan uint64, 1)
+	var batches uint64
+	var timer clock.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	flush := func() error {
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		batches++
+		messages := batcher.Len()
+		return write(batcher.Flush(), messages)
+	}
+
+	for {
+		select {
+		case buf := <-u.send:
+			first := batcher.Len() == 0
+			full := batcher.Add(*buf)
+			bufferpool.Put(buf)
+			if full {
+				if flush() != nil {
+					return
+				}
+			} else if first {
+				current := batches
+				timer = u.clock.AfterFunc(batcher.Options().Delay, func() {
+					select {
+					case expired <- current:
+					case <-ctx.Done():
+					}
+				})
+			}
+		case current := <-expired:
+			if current == batches && batcher.Len() > 0 && flush() != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func (u *WebsocketUplink) calculateBackoff() time.Duration {
 	if u.retries == 0 {
 		return 50 * time.Millisecond
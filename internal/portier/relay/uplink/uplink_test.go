@@ -4,11 +4,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/batch"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/clock"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
 	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var upgrader = websocket.Upgrader{
@@ -143,3 +148,150 @@ func TestReconnect(testing *testing.T) {
 		testing.Errorf("expected %v, got %v", okayMsg, response)
 	}
 }
+
+func TestBatchesMessagesIfRelaySupportsBatching(t *testing.T) {
+	// GIVEN a relay selecting the batching subprotocol and echoing frames
+	frames := make(chan int, 100)
+	batchingUpgrader := websocket.Upgrader{Subprotocols: []string{batch.Subprotocol}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := batchingUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, frame, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			payloads, err := batch.Split(frame)
+			require.NoError(t, err)
+			frames <- len(payloads)
+			_ = c.WriteMessage(mt, frame)
+		}
+	}))
+	defer server.Close()
+	options := defaultOptions()
+	options.PortierURL = "ws" + server.URL[4:]
+	options.APIToken = "80451937-0625-4ffe-b97c-b2ec9e75a0a5"
+	options.Batching = batch.Options{MaxMessages: 4, Delay: 50 * time.Millisecond}
+	uplink := NewWebsocketUplink(options, nil)
+	channel, err := uplink.Connect()
+	require.NoError(t, err)
+
+	// WHEN
+	sent := make([]messages.Message, 10)
+	for i := range sent {
+		sent[i] = messages.Message{
+			Header: messages.MessageHeader{
+				From: uuid.New(),
+				To:   uuid.New(),
+				Type: messages.DA,
+			},
+			Message: []byte{byte(i)},
+		}
+		require.NoError(t, uplink.Send(sent[i]))
+	}
+
+	// THEN full batches are flushed at once, the rest after the delay
+	assert.Equal(t, 4, <-frames)
+	assert.Equal(t, 4, <-frames)
+	assert.Equal(t, 2, <-frames)
+	for _, expected := range sent {
+		assert.Equal(t, expected, <-channel)
+	}
+	assert.Eventually(t, func() bool { return uplink.Stats() == Stats{Messages: 10, Frames: 3} }, time.Second, time.Millisecond)
+}
+
+func TestBatchDelayIsDrivenByTheClock(t *testing.T) {
+	// GIVEN a relay selecting the batching subprotocol and an uplink with a virtual clock
+	frames := make(chan int, 100)
+	batchingUpgrader := websocket.Upgrader{Subprotocols: []string{batch.Subprotocol}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := batchingUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			_, frame, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			payloads, err := batch.Split(frame)
+			require.NoError(t, err)
+			frames <- len(payloads)
+		}
+	}))
+	defer server.Close()
+	virtualClock := clock.NewVirtualClock(time.Now())
+	options := defaultOptions()
+	options.PortierURL = "ws" + server.URL[4:]
+	options.APIToken = "80451937-0625-4ffe-b97c-b2ec9e75a0a5"
+	options.Batching = batch.Options{MaxMessages: 4, Delay: 50 * time.Millisecond}
+	options.Clock = virtualClock
+	uplink := NewWebsocketUplink(options, nil)
+	_, err := uplink.Connect()
+	require.NoError(t, err)
+	message := messages.Message{
+		Header:  messages.MessageHeader{From: uuid.New(), To: uuid.New(), Type: messages.DA},
+		Message: []byte("Hello, world!"),
+	}
+
+	// WHEN a full batch is flushed and a message waits for the delay
+	for i := 0; i < 5; i++ {
+		require.NoError(t, uplink.Send(message))
+	}
+	assert.Equal(t, 4, <-frames)
+	require.Eventually(t, func() bool { _, ok := virtualClock.Next(); return ok }, time.Second, time.Millisecond)
+
+	// THEN the message is sent once the clock passed the delay
+	select {
+	case n := <-frames:
+		t.Fatalf("batch of %d messages sent before the delay", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	virtualClock.Advance(50 * time.Millisecond)
+	assert.Equal(t, 1, <-frames)
+}
+
+func TestSendsFramePerMessageIfBatchingIsDisabled(t *testing.T) {
+	// GIVEN a relay supporting batching
+	batchingUpgrader := websocket.Upgrader{Subprotocols: []string{batch.Subprotocol}}
+	subprotocols := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := batchingUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		subprotocols <- c.Subprotocol()
+		for {
+			mt, frame, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			_ = c.WriteMessage(mt, frame)
+		}
+	}))
+	defer server.Close()
+	options := defaultOptions()
+	options.PortierURL = "ws" + server.URL[4:]
+	options.APIToken = "80451937-0625-4ffe-b97c-b2ec9e75a0a5"
+	options.DisableBatching = true
+	uplink := NewWebsocketUplink(options, nil)
+	channel, err := uplink.Connect()
+	require.NoError(t, err)
+	msg := messages.Message{
+		Header:  messages.MessageHeader{From: uuid.New(), To: uuid.New(), Type: messages.D},
+		Message: []byte("Hello, world!"),
+	}
+
+	// WHEN
+	require.NoError(t, uplink.Send(msg))
+
+	// THEN
+	assert.Empty(t, <-subprotocols)
+	assert.Equal(t, msg, <-channel)
+	assert.Eventually(t, func() bool { return uplink.Stats() == Stats{Messages: 1, Frames: 1} }, time.Second, time.Millisecond)
+}
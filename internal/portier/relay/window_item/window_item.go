@@ -15,4 +15,8 @@ type WindowItem struct {
 	Acked         bool
 	Retransmitted bool
 	RtoDuration   time.Duration
+
+	// Retransmission is Msg with the retransmitted flag set, encoded on the first retransmission
+	// and sent as is on further ones
+	Retransmission messages.Message
 }
@@ -0,0 +1,271 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	fileFormatVersion = 1
+
+	keySourcePassphrase = "passphrase"
+	keySourceUser       = "user"
+
+	// userKeyFile is the random key of the user, the secret part of the user key source
+	userKeyFile = "secrets.key"
+
+	// scrypt parameters as recommended for interactive logins
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// machineIDFiles are read, in order, to bind the key to the machine. The machine id is readable
+// by every local user, the secret part of the key is a random key file readable by the user only.
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// encryptedFile is the on-disk format of the file backend.
+type encryptedFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	KeySource  string `json:"keySource"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// FileStore keeps all secrets in a single AES-256-GCM encrypted file. The key is derived with
+// scrypt either from a passphrase or, if no passphrase is given, from the machine id and a random
+// key file in the home directory with mode 0600. Without a passphrase, the store protects against
+// copies of the store to other machines and against other local users, but not against anyone who
+// can read the user's home directory.
+type FileStore struct {
+	path       string
+	passphrase string
+	home       string
+	mu         sync.Mutex
+}
+
+// NewFileStore creates a file backed store at path. If passphrase is empty, the key is
+// derived from the machine id and a random key file in home.
+func NewFileStore(path string, passphrase string, home string) *FileStore {
+	return &FileStore{
+		path:       path,
+		passphrase: passphrase,
+		home:       home,
+	}
+}
+
+func (s *FileStore) Backend() string {
+	return BackendFile
+}
+
+func (s *FileStore) Get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	value, ok := entries[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *FileStore) Set(name string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.load()
+	if err != nil {
+		return err
+	}
+	entries[name] = value
+	return s.save(entries)
+}
+
+func (s *FileStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[name]; !ok {
+		return nil
+	}
+	delete(entries, name)
+	return s.save(entries)
+}
+
+func (s *FileStore) load() (map[string][]byte, error) {
+	entries := make(map[string][]byte)
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+
+	file := encryptedFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse secret store %s: %w", s.path, err)
+	}
+	if file.Version != fileFormatVersion || file.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported secret store format %s version %d", file.KDF, file.Version)
+	}
+	if file.KeySource == keySourcePassphrase && s.passphrase == "" {
+		return nil, fmt.Errorf("secret store %s is protected by a passphrase, set %s", s.path, PassphraseEnv)
+	}
+
+	aead, err := s.aead(file.KeySource, file.Salt, file.N, file.R, file.P)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, additionalData(file.Version, file.KeySource))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret store %s, wrong passphrase or key file", s.path)
+	}
+
+	if err := json.Unmarshal(plaintext, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *FileStore) save(entries map[string][]byte) error {
+	plaintext, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	file := encryptedFile{
+		Version:   fileFormatVersion,
+		KDF:       "scrypt",
+		KeySource: s.keySource(),
+		N:         scryptN,
+		R:         scryptR,
+		P:         scryptP,
+		Salt:      make([]byte, 16),
+	}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+
+	aead, err := s.aead(file.KeySource, file.Salt, file.N, file.R, file.P)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, plaintext, additionalData(file.Version, file.KeySource))
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := WriteFileSecure(tmp, data); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *FileStore) keySource() string {
+	if s.passphrase != "" {
+		return keySourcePassphrase
+	}
+	return keySourceUser
+}
+
+func (s *FileStore) aead(keySource string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	var secret []byte
+	switch keySource {
+	case keySourcePassphrase:
+		secret = []byte(s.passphrase)
+	case keySourceUser:
+		userKey, err := s.userKey()
+		if err != nil {
+			return nil, err
+		}
+		secret = append(machineID(), userKey...)
+	default:
+		return nil, fmt.Errorf("unknown key source %s", keySource)
+	}
+
+	key, err := scrypt.Key(secret, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds the ciphertext to the format and the key source of the store, but not to
+// its path, so that the home directory can be moved.
+func additionalData(version int, keySource string) []byte {
+	return []byte(fmt.Sprintf("portier-secrets/v%d/%s", version, keySource))
+}
+
+// machineID returns the machine id, or nil on systems that do not provide one.
+func machineID() []byte {
+	for _, file := range machineIDFiles {
+		data, err := os.ReadFile(file)
+		if err == nil && strings.TrimSpace(string(data)) != "" {
+			return []byte(strings.TrimSpace(string(data)))
+		}
+	}
+	return nil
+}
+
+// userKey returns the random key persisted in the home directory, creating it on first use.
+func (s *FileStore) userKey() ([]byte, error) {
+	keyFile := filepath.Join(s.home, userKeyFile)
+	key, err := os.ReadFile(keyFile)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.home, 0o700); err != nil {
+		return nil, err
+	}
+	if err := WriteFileSecure(keyFile, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
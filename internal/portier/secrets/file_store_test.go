@@ -0,0 +1,100 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	path := filepath.Join(home, "secrets.enc")
+	store := NewFileStore(path, "correct horse", home)
+
+	// WHEN
+	require.NoError(t, store.Set("credentials/credentials_device.yaml", []byte("api-key")))
+
+	// THEN
+	value, err := NewFileStore(path, "correct horse", home).Get("credentials/credentials_device.yaml")
+	require.NoError(t, err)
+	require.Equal(t, []byte("api-key"), value)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "api-key")
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	require.NoError(t, store.Delete("credentials/credentials_device.yaml"))
+	_, err = store.Get("credentials/credentials_device.yaml")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestFileStoreRejectsWrongPassphrase(t *testing.T) {
+	home := t.TempDir()
+	path := filepath.Join(home, "secrets.enc")
+	require.NoError(t, NewFileStore(path, "correct horse", home).Set("name", []byte("value")))
+
+	_, err := NewFileStore(path, "battery staple", home).Get("name")
+	require.Error(t, err)
+
+	_, err = NewFileStore(path, "", home).Get("name")
+	require.ErrorContains(t, err, PassphraseEnv)
+}
+
+func TestFileStoreUserKeyWithoutMachineID(t *testing.T) {
+	// GIVEN a machine without a machine id
+	home := t.TempDir()
+	original := machineIDFiles
+	machineIDFiles = []string{filepath.Join(home, "does-not-exist")}
+	defer func() { machineIDFiles = original }()
+	path := filepath.Join(home, "secrets.enc")
+
+	// WHEN
+	require.NoError(t, NewFileStore(path, "", home).Set("name", []byte("value")))
+
+	// THEN a random user key is persisted with restricted permissions
+	info, err := os.Stat(filepath.Join(home, userKeyFile))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	value, err := NewFileStore(path, "", home).Get("name")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+}
+
+func TestFileStoreRequiresUserKey(t *testing.T) {
+	// GIVEN a store of one user
+	home := t.TempDir()
+	path := filepath.Join(home, "secrets.enc")
+	require.NoError(t, NewFileStore(path, "", home).Set("name", []byte("value")))
+
+	// WHEN another local user with access to the store, but not to the key file, opens it
+	_, err := NewFileStore(path, "", t.TempDir()).Get("name")
+
+	// THEN the machine id alone does not decrypt it
+	require.Error(t, err)
+	info, err := os.Stat(filepath.Join(home, userKeyFile))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestFileStoreSurvivesMove(t *testing.T) {
+	// GIVEN
+	home := t.TempDir()
+	require.NoError(t, NewFileStore(filepath.Join(home, "secrets.enc"), "", home).Set("name", []byte("value")))
+
+	// WHEN the home directory is moved
+	moved := filepath.Join(t.TempDir(), "moved")
+	require.NoError(t, os.Rename(home, moved))
+	value, err := NewFileStore(filepath.Join(moved, "secrets.enc"), "", moved).Get("name")
+
+	// THEN
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+}
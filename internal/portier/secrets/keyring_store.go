@@ -0,0 +1,53 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"github.com/zalando/go-keyring"
+)
+
+const keyringService = "portier-cli"
+
+// KeyringStore keeps secrets in the operating system's keyring (macOS Keychain,
+// Windows Credential Manager or the Secret Service on Linux).
+type KeyringStore struct {
+	home string
+}
+
+// NewKeyringStore creates a keyring backed store. Entries are scoped to the portier home
+// directory, so several homes on the same machine do not share secrets.
+func NewKeyringStore(home string) *KeyringStore {
+	return &KeyringStore{home: home}
+}
+
+func (s *KeyringStore) Backend() string {
+	return BackendKeyring
+}
+
+func (s *KeyringStore) Get(name string) ([]byte, error) {
+	encoded, err := keyring.Get(keyringService, s.user(name))
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+func (s *KeyringStore) Set(name string, value []byte) error {
+	return keyring.Set(keyringService, s.user(name), base64.StdEncoding.EncodeToString(value))
+}
+
+func (s *KeyringStore) Delete(name string) error {
+	err := keyring.Delete(keyringService, s.user(name))
+	if errors.Is(err, keyring.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *KeyringStore) user(name string) string {
+	return name + "@" + s.home
+}
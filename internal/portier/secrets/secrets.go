@@ -0,0 +1,74 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrNotFound is returned when a secret does not exist in the store.
+var ErrNotFound = errors.New("secret not found")
+
+const (
+	// BackendFile stores secrets in an encrypted file inside the portier home directory.
+	BackendFile = "file"
+
+	// BackendKeyring stores secrets in the operating system's keyring.
+	BackendKeyring = "keyring"
+
+	// BackendEnv selects the backend used for new secrets.
+	BackendEnv = "PORTIER_SECRET_STORE"
+
+	// PassphraseEnv holds the passphrase for the encrypted file backend. If not set,
+	// the key is derived from the machine id and the random secrets.key file in home.
+	PassphraseEnv = "PORTIER_SECRETS_PASSPHRASE"
+)
+
+// Store persists secrets such as API keys and OAuth tokens by name.
+type Store interface {
+	// Get returns the secret stored under name, or ErrNotFound
+	Get(name string) ([]byte, error)
+
+	// Set stores value under name, replacing any existing value
+	Set(name string, value []byte) error
+
+	// Delete removes the secret stored under name. Deleting a missing secret is not an error.
+	Delete(name string) error
+
+	// Backend returns the backend identifier, i.e. BackendFile or BackendKeyring
+	Backend() string
+}
+
+// DefaultBackend returns the backend configured via PORTIER_SECRET_STORE, defaulting to BackendFile.
+func DefaultBackend() string {
+	if backend := os.Getenv(BackendEnv); backend != "" {
+		return backend
+	}
+	return BackendFile
+}
+
+// Open opens the secret store of the given backend for the portier home directory.
+// An empty backend selects DefaultBackend.
+func Open(home string, backend string) (Store, error) {
+	if backend == "" {
+		backend = DefaultBackend()
+	}
+
+	switch backend {
+	case BackendFile:
+		return NewFileStore(filepath.Join(home, "secrets.enc"), os.Getenv(PassphraseEnv), home), nil
+	case BackendKeyring:
+		return NewKeyringStore(home), nil
+	default:
+		return nil, fmt.Errorf("unknown secret store backend: %s", backend)
+	}
+}
+
+// WriteFileSecure writes data to path with mode 0600, tightening the permissions of an existing file.
+func WriteFileSecure(path string, data []byte) error {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0o600)
+}
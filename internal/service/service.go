@@ -8,6 +8,7 @@ import (
 	"github.com/kardianos/service"
 	"github.com/mh-dx/portier-cli/internal/portier/application"
 	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/utils"
 )
 
 // Config holds the shared service configuration
@@ -15,6 +16,10 @@ type Config struct {
 	ConfigFile   string
 	ApiTokenFile string
 	LogFile      string
+
+	// FlagValues are the config override flags, see config.FlagValues. They are passed on to
+	// the installed service.
+	FlagValues map[string]string
 }
 
 // ServiceManager provides a unified interface for service management
@@ -42,6 +47,10 @@ func NewServiceManager(cfg *Config) (*ServiceManager, error) {
 	if cfg.LogFile != "" {
 		args = append(args, "-l", cfg.LogFile)
 	}
+	if profile, err := utils.ActiveProfile(); err == nil && profile != utils.DefaultProfile {
+		args = append(args, "--profile", profile)
+	}
+	args = append(args, config.FlagArgs(cfg.FlagValues)...)
 
 	svcConfig := &service.Config{
 		Name:        "portier-cli",
@@ -136,13 +145,14 @@ func (p *portierServiceProgram) Stop(s service.Service) error {
 
 func (p *portierServiceProgram) run() {
 	// Load configuration
-	portierConfig, err := config.LoadConfig(p.config.ConfigFile)
+	effectiveConfig, err := config.LoadEffectiveConfig(p.config.ConfigFile, p.config.FlagValues)
 	if err != nil {
 		return
 	}
+	portierConfig := effectiveConfig.Config
 
 	// Load API credentials
-	apiBaseURL := config.APIBaseURLFromPortierURL(portierConfig.PortierURL.String())
+	apiBaseURL := portierConfig.Endpoints().APIBaseURL()
 	deviceCreds, err := config.LoadApiTokenWithBaseURL(p.config.ApiTokenFile, apiBaseURL)
 	if err != nil {
 		return
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultProfile is the profile whose files live directly in the base home directory.
+	DefaultProfile = "default"
+
+	// ProfileEnv selects the active profile, unless overridden by the --profile flag.
+	ProfileEnv = "PORTIER_PROFILE"
+
+	// profilesDir is the directory in the base home that holds one directory per named profile.
+	profilesDir = "profiles"
+
+	// currentProfileFile in the base home holds the profile selected with "profile use".
+	currentProfileFile = "current_profile"
+)
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// profileOverride is the profile selected by the --profile flag.
+var profileOverride string
+
+// SetProfile selects the active profile for this process, taking precedence over
+// PORTIER_PROFILE and the profile selected with "profile use".
+func SetProfile(profile string) {
+	profileOverride = profile
+}
+
+// ActiveProfile returns the profile selected by the --profile flag, PORTIER_PROFILE or
+// "profile use", in that order. It defaults to DefaultProfile.
+func ActiveProfile() (string, error) {
+	profile := profileOverride
+	if profile == "" {
+		profile = os.Getenv(ProfileEnv)
+	}
+	if profile == "" {
+		current, err := CurrentProfile()
+		if err != nil {
+			return "", err
+		}
+		profile = current
+	}
+	if err := ValidateProfileName(profile); err != nil {
+		return "", err
+	}
+	return profile, nil
+}
+
+// CurrentProfile returns the profile selected with "profile use", or DefaultProfile.
+func CurrentProfile() (string, error) {
+	home, err := BaseHome()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(home, currentProfileFile))
+	if os.IsNotExist(err) {
+		return DefaultProfile, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if profile := strings.TrimSpace(string(data)); profile != "" {
+		return profile, nil
+	}
+	return DefaultProfile, nil
+}
+
+// UseProfile persists profile as the profile used when neither --profile nor PORTIER_PROFILE are set.
+func UseProfile(profile string) error {
+	home, err := BaseHome()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(home, currentProfileFile), []byte(profile+"\n"), 0o600)
+}
+
+// ProfileHome returns the home directory of a profile within the base home directory.
+func ProfileHome(baseHome string, profile string) string {
+	if profile == DefaultProfile {
+		return baseHome
+	}
+	return filepath.Join(baseHome, profilesDir, profile)
+}
+
+// Profiles returns the default profile followed by all named profiles.
+func Profiles() ([]string, error) {
+	home, err := BaseHome()
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := []string{DefaultProfile}
+	entries, err := os.ReadDir(filepath.Join(home, profilesDir))
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != DefaultProfile && ValidateProfileName(entry.Name()) == nil {
+			profiles = append(profiles, entry.Name())
+		}
+	}
+	return profiles, nil
+}
+
+// ValidateProfileName checks that a profile name can safely be used as a directory name.
+func ValidateProfileName(profile string) error {
+	if !profileNamePattern.MatchString(profile) {
+		return fmt.Errorf("invalid profile name %q, use letters, digits, '.', '_' and '-'", profile)
+	}
+	return nil
+}
+
+// ProfileFromArgs returns the value of a --profile flag in args, or an empty string. Command
+// defaults such as config and credentials paths are derived from Home when the commands are
+// built, so the flag has to be known before cobra parses the command line.
+func ProfileFromArgs(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			return ""
+		}
+		if arg == "--profile" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "--profile=") {
+			return strings.TrimPrefix(arg, "--profile=")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHomeFollowsActiveProfile(t *testing.T) {
+	// GIVEN
+	base := t.TempDir()
+	t.Setenv("PORTIER_HOME", base)
+	t.Setenv(ProfileEnv, "")
+	defer SetProfile("")
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "profiles", "work"), 0o700))
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "profiles", "personal"), 0o700))
+
+	// WHEN no profile is selected THEN the base home is used
+	home, err := Home()
+	require.NoError(t, err)
+	require.Equal(t, base, home)
+
+	// WHEN a profile is selected with "profile use"
+	require.NoError(t, UseProfile("work"))
+	home, err = Home()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(base, "profiles", "work"), home)
+
+	// WHEN PORTIER_PROFILE is set THEN it takes precedence
+	t.Setenv(ProfileEnv, "personal")
+	home, err = Home()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(base, "profiles", "personal"), home)
+
+	// WHEN the --profile flag is set THEN it takes precedence over the environment
+	SetProfile(DefaultProfile)
+	home, err = Home()
+	require.NoError(t, err)
+	require.Equal(t, base, home)
+
+	profiles, err := Profiles()
+	require.NoError(t, err)
+	require.Equal(t, []string{DefaultProfile, "personal", "work"}, profiles)
+}
+
+func TestHomeRejectsUnknownProfile(t *testing.T) {
+	// GIVEN
+	base := t.TempDir()
+	t.Setenv("PORTIER_HOME", base)
+	t.Setenv(ProfileEnv, "wrok")
+	defer SetProfile("")
+
+	// WHEN
+	_, err := Home()
+
+	// THEN no profile directory is created
+	require.ErrorIs(t, err, ErrUnknownProfile)
+	_, err = os.Stat(filepath.Join(base, "profiles", "wrok"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestValidateProfileName(t *testing.T) {
+	require.NoError(t, ValidateProfileName("work-2.0"))
+	require.Error(t, ValidateProfileName("../etc"))
+	require.Error(t, ValidateProfileName(""))
+}
+
+func TestProfileFromArgs(t *testing.T) {
+	require.Equal(t, "work", ProfileFromArgs([]string{"run", "--profile", "work"}))
+	require.Equal(t, "work", ProfileFromArgs([]string{"--profile=work", "run"}))
+	require.Equal(t, "", ProfileFromArgs([]string{"run", "--", "--profile", "work"}))
+}
@@ -2,13 +2,46 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/url"
 	"os"
 	"path/filepath"
 )
 
-// Home returns the home directory of the current user withouth a trailing slash.
+// Home returns the home directory of the active profile withouth a trailing slash. For the
+// default profile, this is the base home directory, see BaseHome and ActiveProfile. Named profiles
+// are only created by "profile create", Home returns ErrUnknownProfile if the directory is missing.
 func Home() (string, error) {
+	home, err := BaseHome()
+	if err != nil {
+		return "", err
+	}
+
+	profile, err := ActiveProfile()
+	if err != nil {
+		return "", err
+	}
+	if profile == DefaultProfile {
+		return home, nil
+	}
+
+	home = ProfileHome(home, profile)
+	if _, err := os.Stat(home); err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%w %s, create it with: portier-cli profile create %s", ErrUnknownProfile, profile, profile)
+		}
+		return "", err
+	}
+	return home, nil
+}
+
+// ErrUnknownProfile is returned by Home if the active profile does not exist.
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// BaseHome returns the portier directory of the current user, ~/.portier or PORTIER_HOME,
+// withouth a trailing slash.
+func BaseHome() (string, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
@@ -20,19 +53,22 @@ func Home() (string, error) {
 		home = customHome
 	}
 
+	if err := ensureDir(home); err != nil {
+		return "", err
+	}
+
+	return home, nil
+}
+
+func ensureDir(home string) error {
 	if _, err := os.Stat(home); err != nil {
 		if os.IsNotExist(err) {
 			perm := os.FileMode(0o700)
-			err := os.Mkdir(home, perm)
-			if err != nil {
-				return "", err
-			}
-		} else {
-			return "", err
+			return os.MkdirAll(home, perm)
 		}
+		return err
 	}
-
-	return home, nil
+	return nil
 }
 
 type YAMLURL struct {
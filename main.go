@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"io"
 	"log"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/mh-dx/portier-cli/cmd"
 	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/spf13/pflag"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -19,9 +21,24 @@ var memprofile = flag.String("memprofile", "", "write memory profile to this fil
 var logfile = flag.String("logfile", "", "path to log file")
 
 func main() {
-	flag.Parse()
+	// the flags of the commands, e.g. --profile and the config overrides, are declared and
+	// evaluated by the root command, they are skipped here
+	flags := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	flags.AddGoFlagSet(flag.CommandLine)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.Usage = func() {}
+	_ = flags.Parse(os.Args[1:])
+
+	// the profile selects the home directory, including the log file's default location
+	utils.SetProfile(utils.ProfileFromArgs(os.Args[1:]))
 
 	home, err := utils.Home()
+	if errors.Is(err, utils.ErrUnknownProfile) && flags.Arg(0) == "profile" {
+		// the profile commands create and select profiles, they work without the active one and
+		// the other commands are built for the default profile
+		utils.SetProfile(utils.DefaultProfile)
+		home, err = utils.Home()
+	}
 	if err != nil {
 		log.Fatalf("Failed to get portier home directory: %v", err)
 	}
@@ -0,0 +1,89 @@
+package e2e
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// defaultReorderDelay holds back reordered frames if Faults.ReorderDelay is not set.
+const defaultReorderDelay = 20 * time.Millisecond
+
+// Faults describe the network conditions the relay simulates for frames between two devices.
+// The zero value forwards all frames immediately.
+type Faults struct {
+	// Latency delays every frame
+	Latency time.Duration
+
+	// Jitter adds a uniformly distributed random delay in [0, Jitter) to every frame, which
+	// reorders frames sent in quick succession
+	Jitter time.Duration
+
+	// Loss is the probability in [0, 1] that a frame is dropped
+	Loss float64
+
+	// Duplication is the probability in [0, 1] that a frame is delivered twice
+	Duplication float64
+
+	// Reorder is the probability in [0, 1] that a frame is held back by ReorderDelay,
+	// so that the following frames overtake it
+	Reorder float64
+
+	// ReorderDelay is the extra delay of reordered frames, 20ms if not set
+	ReorderDelay time.Duration
+
+	// Bandwidth caps the bytes per second delivered to the receiving device, unlimited if 0
+	Bandwidth int
+}
+
+// random is a source of randomness that can be shared between goroutines. A fixed seed
+// makes the decisions about which frames are dropped, duplicated or delayed reproducible.
+type random struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newRandom(seed int64) *random {
+	return &random{rnd: rand.New(rand.NewSource(seed))}
+}
+
+// chance returns true with probability p.
+func (r *random) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Float64() < p
+}
+
+// duration returns a random duration in [0, max).
+func (r *random) duration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Duration(r.rnd.Int63n(int64(max)))
+}
+
+// delay returns when a frame sent at now should be delivered, excluding bandwidth limits.
+func (f Faults) delay(r *random) (time.Duration, bool) {
+	delay := f.Latency + r.duration(f.Jitter)
+	if r.chance(f.Reorder) {
+		reorderDelay := f.ReorderDelay
+		if reorderDelay == 0 {
+			reorderDelay = defaultReorderDelay
+		}
+		return delay + reorderDelay, true
+	}
+	return delay, false
+}
+
+// transmissionTime returns how long sending size bytes takes at the configured bandwidth.
+func (f Faults) transmissionTime(size int) time.Duration {
+	if f.Bandwidth <= 0 {
+		return 0
+	}
+	return time.Duration(int64(size) * int64(time.Second) / int64(f.Bandwidth))
+}
@@ -0,0 +1,336 @@
+// Package e2e runs portier applications in-process against a relay that simulates
+// unreliable networks, to test tunnels end-to-end. A test creates a Harness with the
+// desired number of devices and network faults, forwards a service from one device
+// to another and asserts byte-exact delivery:
+//
+//	h := e2e.New(t, options)
+//	tunnel := h.Forward(h.Devices[0], h.Devices[1])
+//	h.RequireDelivery(tunnel, 1<<20)
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mh-dx/portier-cli/internal/portier/application"
+	"github.com/mh-dx/portier-cli/internal/portier/config"
+	"github.com/mh-dx/portier-cli/internal/portier/ptls"
+	"github.com/mh-dx/portier-cli/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+type Options struct {
+	// Devices is the number of applications started
+	Devices int
+
+	// Faults are applied to all links of the relay, see FaultyRelay.SetLinkFaults for single links
+	Faults Faults
+
+	// Seed makes the simulated faults reproducible
+	Seed int64
+
+	// TLS secures the tunnels with PTLS, using certificates created for each device
+	TLS bool
+
+	// Noise encrypts the messages of the tunnels with Noise, once the devices learned about
+	// each other from a connection accept message
+	Noise bool
+
+	// Compression is the compression of the tunnels, see config.ServiceOptions
+	Compression string
+
+	// Batching lets the relay accept batched frames from the devices, see FaultyRelay.Batching
+	Batching bool
+
+	// Timeout bounds connecting to the relay and each assertion
+	Timeout time.Duration
+}
+
+func NewDefaultOptions() Options {
+	return Options{
+		Devices: 2,
+		Seed:    1,
+		Timeout: 30 * time.Second,
+	}
+}
+
+// Device is an application started by the harness.
+type Device struct {
+	ID          uuid.UUID
+	App         *application.PortierApplication
+	Config      *config.PortierConfig
+	Credentials *config.DeviceCredentials
+}
+
+// Tunnel is a service forwarded from one device to another.
+type Tunnel struct {
+	// LocalAddr is the address the service is exposed at on the forwarding device
+	LocalAddr string
+
+	// listener accepts the connections bridged to the remote device
+	listener net.Listener
+}
+
+// Harness runs a set of applications connected to a FaultyRelay. Everything is shut
+// down when the test ends.
+type Harness struct {
+	t       testing.TB
+	options Options
+	server  *httptest.Server
+
+	// Relay is the relay all devices are connected to, its faults can be changed at any time
+	Relay *FaultyRelay
+
+	// Devices are the running applications
+	Devices []*Device
+}
+
+// New starts options.Devices applications connected to a new relay and waits until all are connected.
+func New(t testing.TB, options Options) *Harness {
+	t.Helper()
+	if options.Timeout == 0 {
+		options.Timeout = NewDefaultOptions().Timeout
+	}
+
+	h := &Harness{
+		t:       t,
+		options: options,
+		Relay:   NewFaultyRelay(options.Faults, options.Seed),
+	}
+	h.Relay.Batching = options.Batching
+	h.server = httptest.NewServer(h.Relay)
+	t.Cleanup(h.close)
+	relayURL, err := url.Parse("ws" + h.server.URL[len("http"):])
+	require.NoError(t, err)
+
+	for i := 0; i < options.Devices; i++ {
+		h.Devices = append(h.Devices, h.newDevice(i+1, relayURL))
+	}
+	if options.TLS || options.Noise {
+		h.trustEachOther()
+	}
+
+	for _, device := range h.Devices {
+		require.NoError(t, device.App.StartServices(device.Config, device.Credentials))
+	}
+	require.Eventually(t, func() bool {
+		for _, device := range h.Devices {
+			if !h.Relay.Connected(device.ID) {
+				return false
+			}
+		}
+		return true
+	}, options.Timeout, 10*time.Millisecond, "devices did not connect to the relay")
+
+	return h
+}
+
+func (h *Harness) newDevice(n int, relayURL *url.URL) *Device {
+	id := uuid.MustParse(fmt.Sprintf("00000000-0000-0000-0000-%012d", n))
+	home := h.t.TempDir()
+
+	portierConfig := config.DefaultPortierConfigForHome(home)
+	portierConfig.PortierURL.URL = relayURL
+	portierConfig.TLSEnabled = h.options.TLS
+	portierConfig.PTLSConfig = config.PTLSConfig{
+		CertFile:       filepath.Join(home, "cert.pem"),
+		KeyFile:        filepath.Join(home, "key.pem"),
+		KnownHostsFile: filepath.Join(home, "known_hosts"),
+		Noise:          h.options.Noise,
+	}
+
+	return &Device{
+		ID:     id,
+		App:    application.NewPortierApplication(),
+		Config: portierConfig,
+		Credentials: &config.DeviceCredentials{
+			DeviceID: id,
+			ApiToken: id.String(),
+		},
+	}
+}
+
+// trustEachOther creates a certificate for every device and adds the fingerprints of all
+// other devices to its known_hosts file.
+func (h *Harness) trustEachOther() {
+	certManager := ptls.NewPTLSCertificateManager()
+	fingerprints := make(map[string]string)
+	for _, device := range h.Devices {
+		cert, key, err := certManager.CreateCertificate(device.ID.String())
+		require.NoError(h.t, err)
+		certPEM, keyPEM, err := certManager.ConvertCertificateToPEM(cert, key)
+		require.NoError(h.t, err)
+		require.NoError(h.t, os.WriteFile(device.Config.PTLSConfig.CertFile, certPEM, 0o600))
+		require.NoError(h.t, os.WriteFile(device.Config.PTLSConfig.KeyFile, keyPEM, 0o600))
+		fingerprints[device.ID.String()], err = certManager.GetFingerprint(cert)
+		require.NoError(h.t, err)
+	}
+
+	for _, device := range h.Devices {
+		knownHosts := ptls.NewKnownHosts()
+		for id, fingerprint := range fingerprints {
+			if id != device.ID.String() {
+				knownHosts.Add(id, ptls.KnownFingerprint{Fingerprint: fingerprint, Source: ptls.SourceManual}, 0, time.Now())
+			}
+		}
+		require.NoError(h.t, knownHosts.Save(device.Config.PTLSConfig.KnownHostsFile))
+	}
+}
+
+// Forward exposes a new service of the remote device on the local device.
+func (h *Harness) Forward(local *Device, remote *Device) *Tunnel {
+	h.t.Helper()
+
+	// the remote device bridges connections to this listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(h.t, err)
+	h.t.Cleanup(func() { _ = listener.Close() })
+
+	localAddr := fmt.Sprintf("127.0.0.1:%d", freePort(h.t))
+	urlLocal, err := url.Parse("tcp://" + localAddr)
+	require.NoError(h.t, err)
+	urlRemote, err := url.Parse("tcp://" + listener.Addr().String())
+	require.NoError(h.t, err)
+
+	service := config.Service{
+		Name: fmt.Sprintf("e2e-%s", urlLocal.Port()),
+		Options: config.ServiceOptions{
+			URLLocal:     utils.YAMLURL{URL: urlLocal},
+			URLRemote:    utils.YAMLURL{URL: urlRemote},
+			PeerDeviceID: remote.ID,
+			TLSEnabled:   h.options.TLS,
+			Compression:  h.options.Compression,
+		},
+	}
+	require.NoError(h.t, local.App.AddService(service))
+
+	return &Tunnel{
+		LocalAddr: localAddr,
+		listener:  listener,
+	}
+}
+
+// Open connects to the tunnel and returns both ends of the bridged connection.
+func (h *Harness) Open(tunnel *Tunnel) (local net.Conn, remote net.Conn) {
+	h.t.Helper()
+
+	local, err := net.DialTimeout("tcp", tunnel.LocalAddr, h.options.Timeout)
+	require.NoError(h.t, err)
+	h.t.Cleanup(func() { _ = local.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := tunnel.listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case remote = <-accepted:
+	case <-time.After(h.options.Timeout):
+		h.t.Fatalf("connection through %s was not bridged to the remote device within %s", tunnel.LocalAddr, h.options.Timeout)
+	}
+	h.t.Cleanup(func() { _ = remote.Close() })
+
+	return local, remote
+}
+
+// RequireDelivery opens a connection through the tunnel, sends size random bytes in both
+// directions at the same time and requires that they arrive byte-exact.
+func (h *Harness) RequireDelivery(tunnel *Tunnel, size int) {
+	h.t.Helper()
+	h.RequireDeliveryOf(tunnel, randomBytes(h.t, size), randomBytes(h.t, size))
+}
+
+// RequireDeliveryOf opens a connection through the tunnel and requires the given payloads to
+// arrive byte-exact in both directions.
+func (h *Harness) RequireDeliveryOf(tunnel *Tunnel, upstream, downstream []byte) {
+	h.t.Helper()
+
+	local, remote := h.Open(tunnel)
+	errs := make(chan error, 2)
+	go func() { errs <- transfer(local, remote, upstream, h.options.Timeout) }()
+	go func() { errs <- transfer(remote, local, downstream, h.options.Timeout) }()
+	for i := 0; i < 2; i++ {
+		require.NoError(h.t, <-errs)
+	}
+}
+
+// RequireBytes reads len(expected) bytes from conn and requires them to equal expected.
+func (h *Harness) RequireBytes(conn net.Conn, expected []byte) {
+	h.t.Helper()
+	require.NoError(h.t, readExpected(conn, expected, h.options.Timeout))
+}
+
+// transfer writes payload to from and requires it to arrive byte-exact at to.
+func transfer(from net.Conn, to net.Conn, payload []byte, timeout time.Duration) error {
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := from.Write(payload)
+		writeErr <- err
+	}()
+	if err := readExpected(to, payload, timeout); err != nil {
+		return err
+	}
+	return <-writeErr
+}
+
+func readExpected(conn net.Conn, expected []byte, timeout time.Duration) error {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	received := make([]byte, len(expected))
+	n, err := io.ReadFull(conn, received)
+	if err != nil {
+		return fmt.Errorf("received %d of %d bytes: %w", n, len(expected), err)
+	}
+	if !bytes.Equal(received, expected) {
+		return fmt.Errorf("received bytes differ from sent bytes at offset %d", firstDifference(received, expected))
+	}
+	return nil
+}
+
+func firstDifference(a []byte, b []byte) int {
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+func randomBytes(t testing.TB, size int) []byte {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return b
+}
+
+func freePort(t testing.TB) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func (h *Harness) close() {
+	for _, device := range h.Devices {
+		if device.App.IsRunning() {
+			_ = device.App.StopServices()
+		}
+	}
+	h.Relay.Close()
+	h.server.Close()
+}
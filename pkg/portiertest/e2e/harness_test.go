@@ -0,0 +1,173 @@
+package e2e
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mh-dx/portier-cli/internal/portier/relay/compression"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliveryOverPerfectNetwork(t *testing.T) {
+	// GIVEN
+	options := NewDefaultOptions()
+	options.TLS = true
+	h := New(t, options)
+	tunnel := h.Forward(h.Devices[0], h.Devices[1])
+
+	// WHEN / THEN
+	h.RequireDelivery(tunnel, 256*1024)
+}
+
+func TestDeliveryWithNoiseEncryption(t *testing.T) {
+	// GIVEN
+	options := NewDefaultOptions()
+	options.TLS = true
+	options.Noise = true
+	options.Faults = Faults{
+		Loss:        0.02,
+		Duplication: 0.02,
+	}
+	h := New(t, options)
+	tunnel := h.Forward(h.Devices[0], h.Devices[1])
+
+	// the first connection is TLS encrypted, the accepting device announces that it accepts Noise
+	h.RequireDelivery(tunnel, 64*1024)
+	require.Zero(t, h.Relay.Stats().NoiseHandshakes)
+
+	// WHEN / THEN
+	h.RequireDelivery(tunnel, 256*1024)
+	require.Positive(t, h.Relay.Stats().NoiseHandshakes)
+}
+
+func TestDeliveryWithCompression(t *testing.T) {
+	for _, encryption := range []string{"none", "tls", "noise"} {
+		t.Run(encryption, func(t *testing.T) {
+			// GIVEN
+			options := NewDefaultOptions()
+			options.TLS = encryption != "none"
+			options.Noise = encryption == "noise"
+			options.Compression = "zstd"
+			h := New(t, options)
+			tunnel := h.Forward(h.Devices[0], h.Devices[1])
+			if options.Noise {
+				// the devices learn about each other with a TLS encrypted connection
+				h.RequireDelivery(tunnel, 1024)
+			}
+			saved := compression.Totals().Saved()
+			before := h.Relay.Stats().Bytes
+			upstream := []byte(strings.Repeat("GET /api/v1/devices HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\n\r\n", 4000))
+			downstream := []byte(strings.Repeat(`{"name":"workplace","id":"cd9b0785-5f26-405f-beed-b2568a2d9efe","online":true}`+"\n", 4000))
+
+			// WHEN
+			h.RequireDeliveryOf(tunnel, upstream, downstream)
+
+			// THEN
+			relayed := h.Relay.Stats().Bytes - before
+			require.Less(t, relayed, (len(upstream)+len(downstream))/2)
+			require.Greater(t, compression.Totals().Saved(), saved)
+		})
+	}
+}
+
+func TestDeliveryWithBatching(t *testing.T) {
+	// GIVEN a relay accepting batches, losing and duplicating messages of a batch one by one
+	options := NewDefaultOptions()
+	options.Batching = true
+	options.Faults = Faults{
+		Loss:        0.02,
+		Duplication: 0.02,
+	}
+	h := New(t, options)
+	tunnel := h.Forward(h.Devices[0], h.Devices[1])
+
+	// WHEN
+	h.RequireDelivery(tunnel, 256*1024)
+
+	// THEN the devices sent fewer frames than messages
+	stats := h.Relay.Stats()
+	require.Positive(t, stats.Frames)
+	require.Less(t, stats.Frames, stats.Received)
+}
+
+func TestDeliveryWithLatencyJitterAndLoss(t *testing.T) {
+	// GIVEN
+	options := NewDefaultOptions()
+	options.Faults = Faults{
+		Latency: 5 * time.Millisecond,
+		Jitter:  5 * time.Millisecond,
+		Loss:    0.05,
+	}
+	h := New(t, options)
+	tunnel := h.Forward(h.Devices[0], h.Devices[1])
+
+	// WHEN / THEN
+	h.RequireDelivery(tunnel, 64*1024)
+	require.Positive(t, h.Relay.Stats().Dropped)
+}
+
+func TestDeliveryWithDuplicationAndReordering(t *testing.T) {
+	// GIVEN
+	options := NewDefaultOptions()
+	options.Faults = Faults{
+		Duplication: 0.1,
+		Reorder:     0.1,
+	}
+	h := New(t, options)
+	tunnel := h.Forward(h.Devices[0], h.Devices[1])
+
+	// WHEN / THEN
+	h.RequireDelivery(tunnel, 64*1024)
+	stats := h.Relay.Stats()
+	require.Positive(t, stats.Duplicated)
+	require.Positive(t, stats.Reordered)
+}
+
+func TestDeliveryWithBandwidthCap(t *testing.T) {
+	// GIVEN a link of 256 KB/s
+	options := NewDefaultOptions()
+	options.Faults = Faults{Bandwidth: 256 * 1024}
+	h := New(t, options)
+	tunnel := h.Forward(h.Devices[0], h.Devices[1])
+
+	// WHEN sending 128 KB in each direction
+	start := time.Now()
+	h.RequireDelivery(tunnel, 128*1024)
+
+	// THEN the transfer takes at least half a second
+	require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestDeliveryAcrossForcedDisconnect(t *testing.T) {
+	// GIVEN an open connection
+	h := New(t, NewDefaultOptions())
+	tunnel := h.Forward(h.Devices[0], h.Devices[1])
+	local, remote := h.Open(tunnel)
+	_, err := local.Write([]byte("before"))
+	require.NoError(t, err)
+	h.RequireBytes(remote, []byte("before"))
+
+	// WHEN the remote device loses its connection to the relay
+	h.Relay.Disconnect(h.Devices[1].ID)
+	require.Eventually(t, func() bool { return h.Relay.Connected(h.Devices[1].ID) }, h.options.Timeout, 10*time.Millisecond)
+
+	// THEN the connection survives
+	_, err = local.Write([]byte("after"))
+	require.NoError(t, err)
+	h.RequireBytes(remote, []byte("after"))
+}
+
+func TestMultipleDevices(t *testing.T) {
+	// GIVEN three devices forwarding in a ring
+	options := NewDefaultOptions()
+	options.Devices = 3
+	options.Faults = Faults{Latency: 2 * time.Millisecond, Jitter: 2 * time.Millisecond}
+	h := New(t, options)
+
+	// WHEN / THEN
+	for i, device := range h.Devices {
+		tunnel := h.Forward(device, h.Devices[(i+1)%len(h.Devices)])
+		h.RequireDelivery(tunnel, 32*1024)
+	}
+}
@@ -0,0 +1,405 @@
+package e2e
+
+import (
+	"container/heap"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/batch"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/encoder"
+	"github.com/mh-dx/portier-cli/internal/portier/relay/messages"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// batchingUpgrader selects the batching subprotocol if a device requests it.
+var batchingUpgrader = websocket.Upgrader{
+	CheckOrigin:  upgrader.CheckOrigin,
+	Subprotocols: []string{batch.Subprotocol},
+}
+
+// Stats count what the relay did to the frames it received. Faults apply to the messages of a
+// frame one by one, the counters other than Frames count messages.
+type Stats struct {
+	// Frames is the number of websocket frames received from devices
+	Frames int
+
+	// Received is the number of messages received from devices
+	Received int
+
+	// Bytes is the size of the messages received from devices
+	Bytes int
+
+	// Delivered is the number of messages written to the receiving devices, including duplicates
+	Delivered int
+
+	// Dropped is the number of messages lost, including messages to offline devices
+	Dropped int
+
+	// Duplicated is the number of messages delivered twice
+	Duplicated int
+
+	// Reordered is the number of messages held back by Faults.ReorderDelay
+	Reordered int
+
+	// Disconnects is the number of forced disconnects
+	Disconnects int
+
+	// NoiseHandshakes is the number of connection open messages with a Noise handshake instead of
+	// readable bridge options
+	NoiseHandshakes int
+}
+
+type link struct {
+	from uuid.UUID
+	to   uuid.UUID
+}
+
+// FaultyRelay is an in-process relay for the websocket protocol of the portier server that
+// simulates an unreliable network. Devices authenticate with their device ID as API token.
+// Messages are routed to the device in their header, applying the Faults of the link.
+type FaultyRelay struct {
+	encoder encoder.EncoderDecoder
+	random  *random
+
+	// Batching accepts devices requesting batched frames, it must be set before devices connect.
+	// Messages due for a device at the same time are then written as one frame.
+	Batching bool
+
+	mu         sync.Mutex
+	faults     Faults
+	linkFaults map[link]Faults
+	conns      map[uuid.UUID]*relayConn
+	stats      Stats
+}
+
+// NewFaultyRelay creates a relay applying faults to all links. seed makes the simulated faults reproducible.
+func NewFaultyRelay(faults Faults, seed int64) *FaultyRelay {
+	return &FaultyRelay{
+		encoder:    encoder.NewEncoderDecoder(),
+		random:     newRandom(seed),
+		faults:     faults,
+		linkFaults: make(map[link]Faults),
+		conns:      make(map[uuid.UUID]*relayConn),
+	}
+}
+
+// SetFaults changes the faults of all links without specific faults.
+func (r *FaultyRelay) SetFaults(faults Faults) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.faults = faults
+}
+
+// SetLinkFaults changes the faults of frames sent from one device to another.
+func (r *FaultyRelay) SetLinkFaults(from uuid.UUID, to uuid.UUID, faults Faults) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.linkFaults[link{from: from, to: to}] = faults
+}
+
+// Stats returns the frame counters.
+func (r *FaultyRelay) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Connected returns true if the device is connected to the relay.
+func (r *FaultyRelay) Connected(deviceID uuid.UUID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.conns[deviceID]
+	return ok
+}
+
+// Disconnect closes the websocket of a device, frames queued for it are lost. The device's
+// uplink reconnects on its own.
+func (r *FaultyRelay) Disconnect(deviceID uuid.UUID) {
+	r.mu.Lock()
+	conn, ok := r.conns[deviceID]
+	if ok {
+		delete(r.conns, deviceID)
+		r.stats.Disconnects++
+	}
+	r.mu.Unlock()
+	if ok {
+		conn.close()
+	}
+}
+
+// Close disconnects all devices.
+func (r *FaultyRelay) Close() {
+	r.mu.Lock()
+	conns := r.conns
+	r.conns = make(map[uuid.UUID]*relayConn)
+	r.mu.Unlock()
+	for _, conn := range conns {
+		conn.close()
+	}
+}
+
+func (r *FaultyRelay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	deviceID, err := uuid.Parse(req.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	wsUpgrader := &upgrader
+	if r.Batching {
+		wsUpgrader = &batchingUpgrader
+	}
+	ws, err := wsUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	conn := newRelayConn(ws)
+	go conn.writeLoop()
+
+	r.mu.Lock()
+	previous := r.conns[deviceID]
+	r.conns[deviceID] = conn
+	r.mu.Unlock()
+	if previous != nil {
+		previous.close()
+	}
+
+	defer func() {
+		r.mu.Lock()
+		if r.conns[deviceID] == conn {
+			delete(r.conns, deviceID)
+		}
+		r.mu.Unlock()
+		conn.close()
+	}()
+
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		r.receive(conn, messageType, data)
+	}
+}
+
+// receive routes the messages of a frame.
+func (r *FaultyRelay) receive(conn *relayConn, messageType int, data []byte) {
+	r.mu.Lock()
+	r.stats.Frames++
+	r.mu.Unlock()
+	if !conn.batching {
+		r.route(messageType, data)
+		return
+	}
+	payloads, _ := batch.Split(data)
+	for _, payload := range payloads {
+		r.route(messageType, payload)
+	}
+}
+
+// route schedules the delivery of a message according to the faults of its link.
+func (r *FaultyRelay) route(messageType int, data []byte) {
+	msg, err := r.encoder.Decode(data)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stats.Received++
+	r.stats.Bytes += len(data)
+	if msg.Header.Type == messages.CO {
+		if open, err := r.encoder.DecodeConnectionOpenMessage(msg.Message); err == nil && len(open.Noise) > 0 {
+			r.stats.NoiseHandshakes++
+		}
+	}
+	faults, ok := r.linkFaults[link{from: msg.Header.From, to: msg.Header.To}]
+	if !ok {
+		faults = r.faults
+	}
+	target, online := r.conns[msg.Header.To]
+	if !online || r.random.chance(faults.Loss) {
+		r.stats.Dropped++
+		return
+	}
+
+	copies := 1
+	if r.random.chance(faults.Duplication) {
+		copies = 2
+		r.stats.Duplicated++
+	}
+	for i := 0; i < copies; i++ {
+		delay, reordered := faults.delay(r.random)
+		if reordered {
+			r.stats.Reordered++
+		}
+		target.schedule(messageType, data, delay, faults.transmissionTime(len(data)))
+		r.stats.Delivered++
+	}
+}
+
+// relayConn delivers frames to a device at their scheduled time.
+type relayConn struct {
+	ws *websocket.Conn
+
+	// batching is true if the device negotiated batches, the messages due at once are then
+	// written as one frame
+	batching bool
+
+	mu        sync.Mutex
+	queue     frameHeap
+	seq       uint64
+	busyUntil time.Time
+	closed    bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+func newRelayConn(ws *websocket.Conn) *relayConn {
+	return &relayConn{
+		ws:       ws,
+		batching: ws.Subprotocol() == batch.Subprotocol,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// schedule queues a frame for delivery after delay. Frames occupy the connection for
+// transmission, which delays the frames sent after them.
+func (c *relayConn) schedule(messageType int, data []byte, delay time.Duration, transmission time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+
+	now := time.Now()
+	start := now
+	if c.busyUntil.After(start) {
+		start = c.busyUntil
+	}
+	c.busyUntil = start.Add(transmission)
+
+	c.seq++
+	heap.Push(&c.queue, frame{
+		at:          c.busyUntil.Add(delay),
+		seq:         c.seq,
+		messageType: messageType,
+		data:        data,
+	})
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *relayConn) writeLoop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		var wait time.Duration = time.Hour
+		var next *frame
+		if c.queue.Len() > 0 {
+			wait = time.Until(c.queue[0].at)
+			if wait <= 0 {
+				f := heap.Pop(&c.queue).(frame)
+				next = &f
+				if c.batching {
+					next.data = c.popDue(batch.NewBatcher(batch.DefaultOptions()), next.data)
+				}
+			}
+		}
+		c.mu.Unlock()
+
+		if next != nil {
+			if err := c.ws.WriteMessage(next.messageType, next.data); err != nil {
+				c.close()
+				return
+			}
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-c.wake:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// popDue packs the message and the further messages that are due into one batch. c.mu must be held.
+func (c *relayConn) popDue(batcher *batch.Batcher, message []byte) []byte {
+	full := batcher.Add(message)
+	for !full && c.queue.Len() > 0 && !c.queue[0].at.After(time.Now()) {
+		full = batcher.Add(heap.Pop(&c.queue).(frame).data)
+	}
+	return batcher.Flush()
+}
+
+func (c *relayConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.queue = nil
+	close(c.done)
+	_ = c.ws.Close()
+}
+
+type frame struct {
+	at          time.Time
+	seq         uint64
+	messageType int
+	data        []byte
+}
+
+// frameHeap orders frames by delivery time, frames due at the same time in the order they were sent.
+type frameHeap []frame
+
+func (h frameHeap) Len() int { return len(h) }
+
+func (h frameHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h frameHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *frameHeap) Push(x interface{}) { *h = append(*h, x.(frame)) }
+
+func (h *frameHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}